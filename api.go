@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fynelabs/vault-policies/pkg/bundle"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// apiTokenEnv is the environment variable holding the token of the HTTP API,
+// when it isn't read from a file.
+const apiTokenEnv = "VAULT_POLICIES_API_TOKEN"
+
+// apiPolicy is a policy as returned by the HTTP API, with either its drift or
+// its content in Vault.
+type apiPolicy struct {
+	Name    string   `json:"name"`
+	Drift   string   `json:"drift,omitempty"`
+	Diff    []string `json:"diff,omitempty"`
+	Content string   `json:"content,omitempty"`
+}
+
+// apiServer exposes the operations on a policies directory over HTTP. Only one
+// apply runs at a time.
+type apiServer struct {
+	client    *vaultApi.Client
+	directory string
+	token     string
+	// limit refuses the applies deleting more policies, unless nil.
+	limit *deletionLimit
+	mu    sync.Mutex
+}
+
+// readAPIToken returns the token of the HTTP API from file, or from the
+// environment if file is empty. An empty token disables the API.
+func readAPIToken(file string) (string, error) {
+	if file == "" {
+		return os.Getenv(apiTokenEnv), nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the API token: %w", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (a *apiServer) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/diff", a.authenticated(http.MethodGet, a.diff))
+	mux.HandleFunc("/api/v1/plan", a.authenticated(http.MethodGet, a.plan))
+	mux.HandleFunc("/api/v1/apply", a.authenticated(http.MethodPost, a.apply))
+	mux.HandleFunc("/api/v1/backup", a.authenticated(http.MethodGet, a.backup))
+}
+
+// authenticated wraps a handler so that it only answers the given method with
+// the API token as bearer token.
+func (a *apiServer) authenticated(method string, handler func(w http.ResponseWriter, r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tokenMatches(r, a.token) {
+			writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid token"))
+			return
+		}
+		if r.Method != method {
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s requires %s", r.URL.Path, method))
+			return
+		}
+
+		result, err := handler(w, r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadGateway, err)
+			return
+		}
+		if b, ok := result.(*bundle.Bundle); ok {
+			w.Header().Set("Content-Type", bundle.ContentType)
+			err = b.Write(w)
+			if err != nil {
+				log("Unable to write the API response:", err.Error())
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			log("Unable to write the API response:", err.Error())
+		}
+	}
+}
+
+// tokenMatches tells if the request carries token as bearer token, or as the
+// password of a basic authentication for browsers. Any other Authorization
+// header, like a token without scheme, is refused.
+func tokenMatches(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	given := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	} else {
+		scheme, credentials, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return false
+		}
+		given = credentials
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// diff returns the policies with how they drifted.
+func (a *apiServer) diff(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	states, err := loadPolicyStates(a.client, a.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := []apiPolicy{}
+	for _, s := range states {
+		p := newDashboardPolicy(s)
+		policies = append(policies, apiPolicy{Name: p.Name, Drift: p.State, Diff: p.Diff})
+	}
+	return policies, nil
+}
+
+// plan returns the changes a restore of the directory would make.
+func (a *apiServer) plan(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	changes, err := a.planRestore()
+	if err != nil {
+		return nil, err
+	}
+	return newJSONChanges(changes), nil
+}
+
+// apply restores the directory, or only plans it with ?dry_run=true, and
+// returns the changes.
+func (a *apiServer) apply(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	err := runHooks(dryRun, hookBeforePlan, hookPayload{Directory: a.directory})
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := a.planRestore()
+	if err != nil {
+		return nil, err
+	}
+	base := &baseSync{client: a.client, directory: a.directory, onConflict: conflictFail}
+	changes, err = base.resolve(changes)
+	if err != nil {
+		return nil, err
+	}
+	err = checkDeletions(a.client, changes, a.limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		err = applySyncChanges(changes, false, base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newJSONChanges(changes), nil
+}
+
+// backup returns the policies of Vault, or with ?format=vpb their bundle.
+func (a *apiServer) backup(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if r.URL.Query().Get("format") == "vpb" {
+		return liveBundle(a.client)
+	}
+
+	policies := []apiPolicy{}
+	err := walkRemotePolicies(a.client, func(policy, content string) error {
+		policies = append(policies, apiPolicy{Name: policy, Content: content})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// planRestore plans the same changes as the restore command.
+func (a *apiServer) planRestore() ([]change, error) {
+	return planRestore(a.client, a.directory)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenMatches(t *testing.T) {
+	const token = "s3cr3t"
+
+	tests := []struct {
+		name          string
+		authorization string
+		basic         string
+		token         string
+		expected      bool
+	}{
+		{name: "bearer token", authorization: "Bearer s3cr3t", token: token, expected: true},
+		{name: "scheme case", authorization: "bearer s3cr3t", token: token, expected: true},
+		{name: "basic authentication", basic: token, token: token, expected: true},
+		{name: "no scheme", authorization: "s3cr3t", token: token},
+		{name: "other scheme", authorization: "Token s3cr3t", token: token},
+		{name: "other token", authorization: "Bearer other", token: token},
+		{name: "token prefix", authorization: "Bearer s3cr", token: token},
+		{name: "extra space", authorization: "Bearer  s3cr3t", token: token},
+		{name: "other basic password", basic: "other", token: token},
+		{name: "missing", token: token},
+		{name: "empty bearer", authorization: "Bearer ", token: token},
+		{name: "API disabled", authorization: "Bearer ", token: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/diff", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			if test.basic != "" {
+				r.SetBasicAuth("ci", test.basic)
+			}
+			if got := tokenMatches(r, test.token); got != test.expected {
+				t.Errorf("got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestAuthenticated(t *testing.T) {
+	a := &apiServer{token: "s3cr3t"}
+	handler := a.authenticated(http.MethodGet, func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return map[string]bool{"ok": true}, nil
+	})
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		status        int
+	}{
+		{name: "authenticated", method: http.MethodGet, authorization: "Bearer s3cr3t", status: http.StatusOK},
+		{name: "token without scheme", method: http.MethodGet, authorization: "s3cr3t", status: http.StatusUnauthorized},
+		{name: "other method", method: http.MethodPost, authorization: "Bearer s3cr3t", status: http.StatusMethodNotAllowed},
+		{name: "other method without token", method: http.MethodPost, status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/api/v1/diff", nil)
+			r.Header.Set("Authorization", test.authorization)
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.status {
+				t.Errorf("got status %d, expected %d", w.Code, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// checkApplyWindow fails when the active profile has apply windows and now
+// isn't in any of them.
+func checkApplyWindow(now time.Time) error {
+	if activeProfile == nil || activeProfile.inApplyWindow(now) {
+		return nil
+	}
+	return fmt.Errorf("profile %s only allows changes in %s", activeProfile.name, strings.Join(activeProfile.ApplyWindows, ", "))
+}
+
+// inApplyWindow tells if Vault may be changed at t.
+func (pr *profile) inApplyWindow(t time.Time) bool {
+	return len(pr.windows) == 0 || inAnyWindow(pr.windows, t)
+}
+
+// queueOutsideApplyWindow writes the plan of the policy changes of a restore
+// to the queue directory of the active profile, and returns true, when the
+// profile has one and now is outside of its apply windows.
+func queueOutsideApplyWindow(client *vaultApi.Client, directories []string, changes []change, now time.Time) (bool, error) {
+	if activeProfile == nil || activeProfile.QueueDirectory == "" || activeProfile.inApplyWindow(now) {
+		return false, nil
+	}
+
+	p := newPlan(client, directories, changes)
+	if len(p.Changes) < len(changes) {
+		fmt.Fprintln(os.Stderr, "Warning: only the changes to policies are queued, restore again in an apply window for the others")
+	}
+	if len(p.Changes) == 0 {
+		return true, fmt.Errorf("profile %s only allows changes in %s", activeProfile.name, strings.Join(activeProfile.ApplyWindows, ", "))
+	}
+
+	err := os.MkdirAll(activeProfile.QueueDirectory, 0700)
+	if err != nil {
+		return true, err
+	}
+	file := filepath.Join(activeProfile.QueueDirectory, fmt.Sprintf("%s-%s.json", activeProfile.name, now.UTC().Format("20060102T150405Z")))
+	err = savePlan(file, p)
+	if err != nil {
+		return true, err
+	}
+
+	printPlan(changes)
+	fmt.Printf("Outside of the apply windows of profile %s, queued the plan %s, apply it in %s\n", activeProfile.name, file, strings.Join(activeProfile.ApplyWindows, ", "))
+	return true, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// assertionExtension is the extension of the files of a tests directory
+// holding assertions.
+const assertionExtension = ".test"
+
+// assertion is a line of a test file, like
+// policy app-read CAN read secret/data/app/config.
+type assertion struct {
+	file         string
+	line         int
+	policy       string
+	can          bool
+	capabilities []string
+	path         string
+}
+
+func (a assertion) String() string {
+	verb := "CANNOT"
+	if a.can {
+		verb = "CAN"
+	}
+	return fmt.Sprintf("%s:%d: policy %s %s %s %s", a.file, a.line, a.policy, verb, strings.Join(a.capabilities, ","), a.path)
+}
+
+func testCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "test",
+		Usage:     "Check the policies of a local directory against the assertions of the .test files of a tests directory",
+		ArgsUsage: "<policies directory> <tests directory>",
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 2 {
+				return fmt.Errorf("test requires a policies directory and a tests directory")
+			}
+
+			directory := c.Args().Slice()[0]
+			testsDirectory := c.Args().Slice()[1]
+
+			return testPolicies(directory, testsDirectory)
+		},
+	}
+}
+
+func testPolicies(directory, testsDirectory string) error {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+
+	byName := map[string]*parsedPolicy{}
+	for _, p := range policies {
+		byName[p.name] = p
+	}
+
+	assertions, err := loadAssertions(testsDirectory)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, a := range assertions {
+		reason := checkAssertion(byName, a)
+		if reason != "" {
+			fmt.Printf("FAIL %s: %s\n", a, reason)
+			failed++
+		}
+	}
+
+	fmt.Printf("%d assertions, %d failed\n", len(assertions), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d assertions failed", failed)
+	}
+	return nil
+}
+
+// checkAssertion returns why an assertion doesn't hold, or an empty string.
+func checkAssertion(policies map[string]*parsedPolicy, a assertion) string {
+	p, ok := policies[a.policy]
+	if !ok {
+		return "no such policy"
+	}
+
+	path := p.match(a.path)
+	for _, capability := range a.capabilities {
+		allowed := path != nil && path.allows(capability)
+		switch {
+		case allowed && !a.can:
+			return fmt.Sprintf("%s is allowed by path %q line %d", capability, path.path, path.line)
+		case !allowed && a.can && path == nil:
+			return fmt.Sprintf("%s is denied, no path matches", capability)
+		case !allowed && a.can:
+			return fmt.Sprintf("%s is denied by path %q line %d", capability, path.path, path.line)
+		}
+	}
+	return ""
+}
+
+// loadAssertions reads the assertions of the test files of a directory.
+// Empty lines and lines starting with # are ignored.
+func loadAssertions(directory string) ([]assertion, error) {
+	assertions := []assertion{}
+
+	err := filepath.Walk(directory, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(file) != assertionExtension {
+			return nil
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+
+			a, err := parseAssertion(text)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", file, line, err)
+			}
+			a.file, a.line = file, line
+			assertions = append(assertions, a)
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return assertions, nil
+}
+
+// parseAssertion parses policy <name> CAN|CANNOT <capability>[,<capability>] <path>.
+func parseAssertion(text string) (assertion, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 5 || fields[0] != "policy" {
+		return assertion{}, fmt.Errorf("expected policy <name> CAN|CANNOT <capabilities> <path>, got %q", text)
+	}
+
+	a := assertion{policy: fields[1], path: strings.TrimPrefix(fields[4], "/")}
+	switch strings.ToUpper(fields[2]) {
+	case "CAN":
+		a.can = true
+	case "CANNOT":
+	default:
+		return assertion{}, fmt.Errorf("expected CAN or CANNOT, got %s", fields[2])
+	}
+
+	for _, capability := range strings.Split(fields[3], ",") {
+		if !validCapabilities[capability] || capability == "deny" {
+			return assertion{}, fmt.Errorf("unknown capability %s", capability)
+		}
+		a.capabilities = append(a.capabilities, capability)
+	}
+	return a, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAssertion(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected assertion
+		err      string
+	}{
+		{
+			text:     "policy app-read CAN read secret/data/app/config",
+			expected: assertion{policy: "app-read", can: true, capabilities: []string{"read"}, path: "secret/data/app/config"},
+		},
+		{
+			text:     "policy app-read cannot create,update /secret/data/app/config",
+			expected: assertion{policy: "app-read", capabilities: []string{"create", "update"}, path: "secret/data/app/config"},
+		},
+		{text: "policy app-read CAN read", err: "expected policy <name>"},
+		{text: "role app-read CAN read secret/data/app", err: "expected policy <name>"},
+		{text: "policy app-read MAY read secret/data/app", err: "expected CAN or CANNOT"},
+		{text: "policy app-read CAN write secret/data/app", err: "unknown capability write"},
+		{text: "policy app-read CANNOT deny secret/data/app", err: "unknown capability deny"},
+	}
+
+	for _, test := range tests {
+		got, err := parseAssertion(test.text)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseAssertion(%q) returned error %v, expected %q", test.text, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("parseAssertion(%q) = %+v, %v, expected %+v", test.text, got, err, test.expected)
+		}
+	}
+}
+
+func TestCheckAssertion(t *testing.T) {
+	policy, err := parsePolicy("app", `
+path "secret/data/app/*" {
+  capabilities = ["read", "list"]
+}
+
+path "secret/data/app/admin" {
+  capabilities = ["deny"]
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := map[string]*parsedPolicy{"app": policy}
+
+	tests := []struct {
+		text   string
+		reason string
+	}{
+		{text: "policy app CAN read,list secret/data/app/config"},
+		{text: "policy app CANNOT update secret/data/app/config"},
+		{text: "policy app CANNOT read secret/data/app/admin"},
+		{text: "policy app CANNOT read secret/data/other"},
+		{text: "policy app CAN update secret/data/app/config", reason: `update is denied by path "secret/data/app/*" line 2`},
+		{text: "policy app CAN read secret/data/app/admin", reason: `read is denied by path "secret/data/app/admin" line 6`},
+		{text: "policy app CAN read secret/data/other", reason: "read is denied, no path matches"},
+		{text: "policy app CANNOT list secret/data/app/config", reason: `list is allowed by path "secret/data/app/*" line 2`},
+		{text: "policy other CAN read secret/data/app/config", reason: "no such policy"},
+	}
+
+	for _, test := range tests {
+		a, err := parseAssertion(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := checkAssertion(policies, a); got != test.reason {
+			t.Errorf("%q failed with %q, expected %q", test.text, got, test.reason)
+		}
+	}
+}
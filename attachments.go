@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// attachmentsFile is the name of the file, in a policies directory, that
+// declares which policies are attached to which identity groups.
+const attachmentsFile = "attachments.yaml"
+
+type attachments struct {
+	Groups map[string][]string `yaml:"groups"`
+}
+
+func attachCommand() *cli.Command {
+	group := ""
+
+	return &cli.Command{
+		Name:         "attach",
+		Usage:        "Attach a policy to an identity group",
+		ArgsUsage:    "<policy>",
+		BashComplete: completePolicies,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "group",
+				Usage:       "Name of the identity group",
+				Required:    true,
+				Destination: &group,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("attach requires a policy")
+			}
+
+			policy := c.Args().Slice()[0]
+
+			return attachPolicy(dev, dryRun, policy, group)
+		},
+	}
+}
+
+func detachCommand() *cli.Command {
+	group := ""
+
+	return &cli.Command{
+		Name:         "detach",
+		Usage:        "Detach a policy from an identity group",
+		ArgsUsage:    "<policy>",
+		BashComplete: completePolicies,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "group",
+				Usage:       "Name of the identity group",
+				Required:    true,
+				Destination: &group,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("detach requires a policy")
+			}
+
+			policy := c.Args().Slice()[0]
+
+			return detachPolicy(dev, dryRun, policy, group)
+		},
+	}
+}
+
+func attachPolicy(dev, dryRun bool, policy, group string) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	current, err := readGroupPolicies(client, group)
+	if err != nil {
+		return err
+	}
+
+	c, ok := groupPoliciesChange(client, group, current, append(current, policy))
+	if !ok {
+		fmt.Printf("Policy %s is already attached to group %s\n", policy, group)
+		return nil
+	}
+
+	return applyChanges([]change{c}, dryRun)
+}
+
+func detachPolicy(dev, dryRun bool, policy, group string) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	current, err := readGroupPolicies(client, group)
+	if err != nil {
+		return err
+	}
+
+	wanted := []string{}
+	for _, p := range current {
+		if p != policy {
+			wanted = append(wanted, p)
+		}
+	}
+
+	c, ok := groupPoliciesChange(client, group, current, wanted)
+	if !ok {
+		fmt.Printf("Policy %s is not attached to group %s\n", policy, group)
+		return nil
+	}
+
+	return applyChanges([]change{c}, dryRun)
+}
+
+// planDirectoryAttachments plans the attachments of the attachments file of a
+// policies directory, if it has one.
+func planDirectoryAttachments(client *vaultApi.Client, directory string) ([]change, error) {
+	file := filepath.Join(directory, attachmentsFile)
+	if _, err := os.Stat(file); err != nil {
+		return nil, nil
+	}
+
+	log("Reconciling the group attachments from", file)
+	return planAttachments(client, file)
+}
+
+// planAttachments returns the changes needed for the policies attached to each
+// group listed in file to match the file. Groups that aren't listed are left
+// untouched.
+func planAttachments(client *vaultApi.Client, file string) ([]change, error) {
+	a, err := loadAttachments(file)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(a.Groups))
+	for group := range a.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	changes := []change{}
+	for _, group := range groups {
+		current, err := readGroupPolicies(client, group)
+		if err != nil {
+			return nil, err
+		}
+
+		if c, ok := groupPoliciesChange(client, group, current, a.Groups[group]); ok {
+			changes = append(changes, c)
+		}
+	}
+
+	return changes, nil
+}
+
+func loadAttachments(file string) (*attachments, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var a attachments
+	err = yaml.Unmarshal(content, &a)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+	return &a, nil
+}
+
+func readGroupPolicies(client *vaultApi.Client, group string) ([]string, error) {
+	secret, err := client.Logical().Read("identity/group/name/" + group)
+	if err != nil {
+		return nil, err
+	}
+	// A group that doesn't exist yet has no policy attached. Changing its
+	// policies fails if it is still missing by then.
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	list, _ := secret.Data["policies"].([]interface{})
+	policies := make([]string, 0, len(list))
+	for _, policy := range list {
+		policies = append(policies, fmt.Sprint(policy))
+	}
+	return policies, nil
+}
+
+// groupPoliciesChange returns the change replacing the policies attached to
+// group, which reports the policies the group gained and lost. It returns
+// false if there is nothing to change.
+func groupPoliciesChange(client *vaultApi.Client, group string, current, wanted []string) (change, bool) {
+	gained := missingFrom(current, wanted)
+	lost := missingFrom(wanted, current)
+	if len(gained) == 0 && len(lost) == 0 {
+		return change{}, false
+	}
+
+	details := []string{}
+	if len(gained) > 0 {
+		details = append(details, "gained: "+strings.Join(gained, ", "))
+	}
+	if len(lost) > 0 {
+		details = append(details, "lost: "+strings.Join(lost, ", "))
+	}
+
+	return change{
+		action:  actionUpdate,
+		kind:    "group policies",
+		name:    group,
+		details: details,
+		apply: func() error {
+			secret, err := client.Logical().Read("identity/group/name/" + group)
+			if err != nil {
+				return err
+			}
+			if secret == nil {
+				return fmt.Errorf("group %s doesn't exist", group)
+			}
+
+			_, err = client.Logical().Write("identity/group/name/"+group, map[string]interface{}{
+				"policies": wanted,
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, detail := range details {
+				fmt.Printf("Group %s %s\n", group, detail)
+			}
+			return nil
+		},
+	}, true
+}
+
+// missingFrom returns the elements of b that are not in a.
+func missingFrom(a, b []string) []string {
+	present := make(map[string]bool, len(a))
+	for _, s := range a {
+		present[s] = true
+	}
+
+	missing := []string{}
+	for _, s := range b {
+		if !present[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// policyHolder is an object of the server that policies are attached to.
+type policyHolder struct {
+	name     string
+	policies []string
+	// field is the setting holding the policies, like token_policies.
+	field string
+}
+
+// policyHolders returns the groups, entities and roles of the server with the
+// policies they hold, or allow for the token roles. The roles of every mount of
+// their auth method are included.
+func policyHolders(client *vaultApi.Client) ([]policyHolder, error) {
+	sources := []struct {
+		r     *resource
+		field string
+	}{
+		{groupsResource, "policies"},
+		{entitiesResource, "policies"},
+		{tokenRolesResource, "allowed_policies"},
+		{approleRolesResource, "token_policies"},
+		{kubernetesRolesResource, "token_policies"},
+	}
+
+	holders := []policyHolder{}
+	for _, source := range sources {
+		for _, r := range resourceMounts(client, source.r) {
+			prefix := ""
+			if r.mount != source.r.mount {
+				prefix = r.mount + "/"
+			}
+
+			field := source.field
+			err := walkRemoteResources(client, r, func(name string, data map[string]interface{}) error {
+				list, _ := data[field].([]interface{})
+				if len(list) == 0 {
+					return nil
+				}
+
+				holder := policyHolder{name: fmt.Sprintf("%s %s%s", r.kind, prefix, name), field: field}
+				for _, policy := range list {
+					holder.policies = append(holder.policies, fmt.Sprint(policy))
+				}
+				holders = append(holders, holder)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return holders, nil
+}
+
+// resourceMounts returns the resource for each mount of its auth method, or
+// for its default mount if the auth methods can't be listed.
+func resourceMounts(client *vaultApi.Client, r *resource) []*resource {
+	if r.mount == "" {
+		return []*resource{r}
+	}
+	auths, err := client.Sys().ListAuth()
+	if err != nil {
+		log("Only looking at the", r.name, "of", r.mount+":", err.Error())
+		return []*resource{r}
+	}
+
+	paths := []string{}
+	for path, auth := range auths {
+		if auth.Type == r.mount {
+			paths = append(paths, strings.Trim(path, "/"))
+		}
+	}
+	sort.Strings(paths)
+
+	resources := make([]*resource, 0, len(paths))
+	for _, path := range paths {
+		selected := *r
+		selected.mount = path
+		resources = append(resources, &selected)
+	}
+	return resources
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// operationCapabilities maps the operation of a request to the capability it
+// requires.
+var operationCapabilities = map[string]string{
+	"create": "create",
+	"read":   "read",
+	"update": "update",
+	"patch":  "patch",
+	"delete": "delete",
+	"list":   "list",
+}
+
+// auditEntry is the part of a Vault audit log entry that is used here.
+type auditEntry struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Error string    `json:"error"`
+	Auth  struct {
+		Policies []string `json:"policies"`
+	} `json:"auth"`
+	Request struct {
+		Operation string `json:"operation"`
+		Path      string `json:"path"`
+	} `json:"request"`
+}
+
+// auditRequest is a request that Vault authorized, as read from an audit log.
+type auditRequest struct {
+	time       time.Time
+	capability string
+	path       string
+	policies   []string
+}
+
+// stanzaUsage is how much a path stanza of a policy was used.
+type stanzaUsage struct {
+	requests     int
+	capabilities map[string]bool
+}
+
+// policyUsage is how much a policy was used, with the usage of each of its
+// path stanzas in the same order as the stanzas.
+type policyUsage struct {
+	policy   *parsedPolicy
+	requests int
+	paths    map[string]int
+	// sole counts, by path, the requests that no other policy of the
+	// directory held by the token allowed.
+	sole    map[string]int
+	stanzas []stanzaUsage
+}
+
+// auditUsage is the usage of the policies over the requests of audit logs.
+type auditUsage struct {
+	policies map[string]*policyUsage
+	requests int
+	// first and last are the times of the first and last requests.
+	first, last time.Time
+}
+
+// readAuditLogs calls f with every authorized request of the audit log files
+// matching the patterns. Only the responses are used, so that each request is
+// counted once, and denied requests are skipped.
+func readAuditLogs(patterns []string, f func(r auditRequest)) error {
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no audit log matches %s", pattern)
+		}
+
+		for _, file := range files {
+			err = readAuditLog(file, f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readAuditLog(file string, f func(r auditRequest)) error {
+	log("Reading audit log", file)
+	input, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		var entry auditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			log(fmt.Sprintf("Skipping %s:%d: %v", file, line, err))
+			continue
+		}
+
+		capability, ok := operationCapabilities[entry.Request.Operation]
+		if entry.Type != "response" || entry.Error != "" || !ok {
+			continue
+		}
+
+		f(auditRequest{time: entry.Time, capability: capability, path: entry.Request.Path, policies: entry.Auth.Policies})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read the audit log %s: %w", file, err)
+	}
+	return nil
+}
+
+// attributeUsage reads the audit logs and attributes each request to the path
+// stanza of each of the token policies that allowed it.
+func attributeUsage(policies []*parsedPolicy, logs []string) (*auditUsage, error) {
+	usages := &auditUsage{policies: make(map[string]*policyUsage, len(policies))}
+	for _, p := range policies {
+		usage := &policyUsage{policy: p, paths: map[string]int{}, sole: map[string]int{}, stanzas: make([]stanzaUsage, len(p.paths))}
+		for i := range usage.stanzas {
+			usage.stanzas[i] = stanzaUsage{capabilities: map[string]bool{}}
+		}
+		usages.policies[p.name] = usage
+	}
+
+	err := readAuditLogs(logs, func(r auditRequest) {
+		usages.requests++
+		if !r.time.IsZero() && (usages.first.IsZero() || r.time.Before(usages.first)) {
+			usages.first = r.time
+		}
+		if r.time.After(usages.last) {
+			usages.last = r.time
+		}
+
+		var grantors []*policyUsage
+		for _, name := range r.policies {
+			if usage, ok := usages.policies[name]; ok && usage.record(r) {
+				grantors = append(grantors, usage)
+			}
+		}
+		if len(grantors) == 1 {
+			grantors[0].sole[r.path]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+// record attributes a request to the policy if the policy allows it, and
+// returns if it did.
+func (u *policyUsage) record(r auditRequest) bool {
+	path := u.policy.match(r.path)
+	if path == nil || !path.allows(r.capability) {
+		return false
+	}
+
+	u.requests++
+	u.paths[r.path]++
+	for i, p := range u.policy.paths {
+		if p == path {
+			u.stanzas[i].requests++
+			u.stanzas[i].capabilities[r.capability] = true
+		}
+	}
+	return true
+}
+
+// sortedCounts returns the keys of counts, the most counted first.
+func sortedCounts(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
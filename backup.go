@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// The layouts of the new files of a backup.
+const (
+	layoutFlat        = "flat"
+	layoutByPrefix    = "by-prefix"
+	layoutByNamespace = "by-namespace"
+)
+
+// backupOptions are how a backup writes its files.
+type backupOptions struct {
+	fileMode, dirMode os.FileMode
+	normalize         bool
+	layout            string
+	separator         string
+	// gitCommit commits the backup, and gitPush pushes it too.
+	gitCommit, gitPush bool
+}
+
+func newBackupOptions(fileMode, dirMode, layout, separator string) (backupOptions, error) {
+	f, err := parseFileMode(fileMode)
+	if err != nil {
+		return backupOptions{}, err
+	}
+	d, err := parseDirMode(dirMode)
+	if err != nil {
+		return backupOptions{}, err
+	}
+
+	switch layout {
+	case layoutFlat, layoutByPrefix, layoutByNamespace:
+	default:
+		return backupOptions{}, fmt.Errorf("unknown layout %s, expected %s, %s or %s", layout, layoutFlat, layoutByPrefix, layoutByNamespace)
+	}
+	if layout == layoutByPrefix && separator == "" {
+		return backupOptions{}, fmt.Errorf("the %s layout requires a separator", layoutByPrefix)
+	}
+
+	return backupOptions{
+		fileMode:  f,
+		dirMode:   d,
+		layout:    layout,
+		separator: separator,
+	}, nil
+}
+
+// parseDirMode parses the octal permissions of the directories created.
+func parseDirMode(dirMode string) (os.FileMode, error) {
+	d, err := strconv.ParseUint(dirMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid directory mode %s: %w", dirMode, err)
+	}
+	return os.FileMode(d).Perm(), nil
+}
+
+// parseFileMode parses the octal permissions of the policy files written.
+func parseFileMode(fileMode string) (os.FileMode, error) {
+	f, err := strconv.ParseUint(fileMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %s: %w", fileMode, err)
+	}
+	return os.FileMode(f).Perm(), nil
+}
+
+// policyLayout returns where a new policy file goes in the directory: in a
+// subdirectory named after the prefix of the policy for the by-prefix layout,
+// and at the root otherwise.
+func (o backupOptions) policyLayout(name string) string {
+	if o.layout == layoutByPrefix {
+		if i := strings.Index(name, o.separator); i > 0 {
+			return filepath.Join(name[:i], name+".hcl")
+		}
+	}
+	return name + ".hcl"
+}
+
+func backupPolicies(dev, dryRun bool, options backupOptions, directory string) error {
+	log("Backing policies to", directory)
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	if options.gitCommit {
+		// Fail before writing anything rather than after.
+		_, err = runGit(existingParent(directory), "rev-parse", "--show-toplevel")
+		if err != nil {
+			return fmt.Errorf("--git-commit requires %s to be in a git repository: %w", directory, err)
+		}
+	}
+
+	namespaces := []string{""}
+	if options.layout == layoutByNamespace {
+		namespaces, err = listNamespaces(client, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	// The policies of each namespace are in the directory named after it,
+	// which also holds the directories of its children, and so only its own
+	// files are policies.
+	for _, namespace := range namespaces {
+		err = backupNamespace(inNamespace(client, namespace), dryRun, options, filepath.Join(directory, namespace))
+		if err != nil {
+			return err
+		}
+	}
+
+	if !dryRun {
+		err = recordBase(client, directory, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.gitCommit && !dryRun {
+		err = commitBackup(directory, client.Address(), options.gitPush)
+		if err != nil {
+			return err
+		}
+	}
+
+	log("Done backing up")
+	return nil
+}
+
+// backupNamespace writes the policies of the namespace of client to
+// directory.
+func backupNamespace(client *vaultApi.Client, dryRun bool, options backupOptions, directory string) error {
+	if !dryRun {
+		err := os.MkdirAll(directory, options.dirMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	local := policyDirectory(directory)
+	local.NormalizeWrites = options.normalize
+	local.FileMode = options.fileMode
+	local.DirMode = options.dirMode
+	local.Layout = options.policyLayout
+	local.Shallow = options.layout == layoutByNamespace
+	// The files of the policies --tag doesn't select still hold them.
+	local.Filter = nil
+
+	err := walkRemotePolicies(client, func(policy, content string) error {
+		file, err := local.File(policy)
+		if dryRun && errors.Is(err, fs.ErrNotExist) {
+			file, err = filepath.Join(directory, options.policyLayout(policy)), nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// A template rendering the policy of Vault stays as it is
+		if existing, err := local.Get(policy); err == nil && existing != content {
+			if rendered, err := substituteVariables(existing); err == nil && rendered == content {
+				log("Keeping", file, "whose variables render the policy of Vault")
+				return nil
+			}
+		}
+
+		if dryRun {
+			fmt.Printf("Would have written %s with content:\n", file)
+			fmt.Println(content)
+			return nil
+		}
+
+		log("Writing", file)
+		err = local.Put(policy, content)
+		if err != nil {
+			return err
+		}
+		complete("wrote %s", file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return backupMetadata(client, dryRun, options, directory)
+}
+
+// listNamespaces returns the namespaces under parent, relative to the
+// namespace of client and ending with a slash, parent itself first.
+func listNamespaces(client *vaultApi.Client, parent string) ([]string, error) {
+	namespaces := []string{parent}
+
+	children, err := listKeys(inNamespace(client, parent), "sys/namespaces")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the namespaces of %q: %w", parent, err)
+	}
+	sort.Strings(children)
+
+	for _, child := range children {
+		descendants, err := listNamespaces(client, parent+child)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, descendants...)
+	}
+	return namespaces, nil
+}
+
+// inNamespace returns a client of the namespace at path relative to the
+// namespace of client, or client itself for an empty path.
+func inNamespace(client *vaultApi.Client, path string) *vaultApi.Client {
+	if path == "" {
+		return client
+	}
+
+	base := strings.TrimSuffix(client.Namespace(), "/")
+	if base != "" {
+		path = base + "/" + path
+	}
+	return client.WithNamespace(path)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/policysync"
+	"github.com/fynelabs/vault-policies/pkg/store"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// baseFile is the file of a policies directory holding the state of the
+// policies of each Vault server when they were last backed up or restored.
+const baseFile = ".vault-policies-base.json"
+
+// baseState is the hash of the normalized content of the policies of a Vault
+// server, by name, at some time.
+type baseState struct {
+	Time     time.Time         `json:"time"`
+	Policies map[string]string `json:"policies"`
+}
+
+// loadBase returns the state of the policies of the Vault at address when
+// directory was last synchronized with it, or nil if it never was.
+func loadBase(directory, address string) (*baseState, error) {
+	bases, err := readBases(directory)
+	if err != nil {
+		return nil, err
+	}
+	return bases[address], nil
+}
+
+func readBases(directory string) (map[string]*baseState, error) {
+	bases := map[string]*baseState{}
+	content, err := os.ReadFile(filepath.Join(directory, baseFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return bases, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &bases)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the base state of %s: %w", directory, err)
+	}
+	return bases, nil
+}
+
+// recordBase saves the current state of the policies of Vault as the base of
+// directory, keeping the previous one of the policies that synced, when not
+// nil, tells were not synchronized.
+func recordBase(client *vaultApi.Client, directory string, synced func(name string) bool) error {
+	bases, err := readBases(directory)
+	if err != nil {
+		return err
+	}
+
+	// Only the hashes of the policies are kept, not their contents.
+	previous := bases[client.Address()]
+	state := &baseState{Time: time.Now().UTC(), Policies: map[string]string{}}
+	err = policysync.Walk(store.NewVault(client), func(name, content string) error {
+		if synced == nil || synced(name) {
+			state.Policies[name] = baseHash(content)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if previous != nil && synced != nil {
+		for name, hash := range previous.Policies {
+			if !synced(name) {
+				state.Policies[name] = hash
+			}
+		}
+	}
+	bases[client.Address()] = state
+
+	content, err := json.MarshalIndent(bases, "", "  ")
+	if err != nil {
+		return err
+	}
+	log("Recording the base state of", directory)
+	return os.WriteFile(filepath.Join(directory, baseFile), append(content, '\n'), 0644)
+}
+
+// baseSync is the base of the directory whose policies changes synchronize
+// Vault with: the conflicts of the changes with it are resolved before they
+// are applied, and it is recorded once they are.
+type baseSync struct {
+	client    *vaultApi.Client
+	directory string
+	// onConflict is the strategy resolving the conflicts, interactive asking
+	// on the standard input.
+	onConflict string
+	// scope tells the policies the changes synchronize, all of them when nil.
+	scope func(name string) bool
+	// planned are the changes before their conflicts were resolved.
+	planned  []change
+	resolved bool
+}
+
+// resolve returns changes without those of the policies the strategy keeps as
+// they are in Vault.
+func (b *baseSync) resolve(changes []change) ([]change, error) {
+	resolved, err := resolveBaseConflicts(b.client, b.directory, changes, b.onConflict, os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	b.planned, b.resolved = changes, true
+	return resolved, nil
+}
+
+// record saves the base once the changes applied, keeping the previous one of
+// the policies of the scope left as they are in Vault.
+func (b *baseSync) record(applied []change) {
+	skipped := skippedPolicies(b.planned, applied)
+	err := recordBase(b.client, b.directory, func(name string) bool {
+		return (b.scope == nil || b.scope(name)) && !skipped[name]
+	})
+	if err != nil {
+		// The policies are applied, the directory may just be read-only.
+		fmt.Fprintln(os.Stderr, "Warning: unable to record the base state:", err)
+	}
+}
+
+// The strategies resolving the conflicts with the base.
+const (
+	conflictFail        = "fail"
+	conflictOurs        = "ours"
+	conflictTheirs      = "theirs"
+	conflictInteractive = "interactive"
+)
+
+func checkConflictStrategy(strategy string) error {
+	switch strategy {
+	case conflictFail, conflictOurs, conflictTheirs, conflictInteractive:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict strategy %s, expected %s, %s, %s or %s", strategy, conflictFail, conflictOurs, conflictTheirs, conflictInteractive)
+}
+
+// resolveBaseConflicts returns changes without those of the policies changed
+// both in Vault and in directory since its base that the strategy keeps as
+// they are in Vault: fail refuses all of them, ours overwrites them, theirs
+// keeps them, and interactive asks for each, reading the answers from input.
+func resolveBaseConflicts(client *vaultApi.Client, directory string, changes []change, strategy string, input io.Reader) ([]change, error) {
+	base, err := loadBase(directory, client.Address())
+	if err != nil {
+		return nil, err
+	}
+	conflicts := base.conflicts(changes)
+	if len(conflicts) == 0 {
+		return changes, nil
+	}
+
+	kept := map[string]bool{}
+	switch strategy {
+	case conflictOurs:
+		fmt.Fprintln(os.Stderr, "Warning: overwriting the policies changed in Vault since", base.Time.Format(time.RFC3339)+":", strings.Join(sortedKeys(conflicts), ", "))
+		return changes, nil
+	case conflictTheirs:
+		kept = conflicts
+	case conflictInteractive:
+		kept, err = askConflicts(changes, conflicts, input)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("policies changed both in Vault and in the directory since %s, merge them or use --on-conflict with restore or upload:\n  %s",
+			base.Time.Format(time.RFC3339), strings.Join(sortedKeys(conflicts), "\n  "))
+	}
+
+	resolved := []change{}
+	for _, c := range changes {
+		if c.kind == "policy" && kept[c.name] {
+			fmt.Printf("Keeping policy %s as it is in Vault\n", c.name)
+			continue
+		}
+		resolved = append(resolved, c)
+	}
+	return resolved, nil
+}
+
+// askConflicts shows the diff of each conflicting change and asks whether to
+// apply it, and returns the policies to keep as they are in Vault.
+func askConflicts(changes []change, conflicts map[string]bool, input io.Reader) (map[string]bool, error) {
+	kept := map[string]bool{}
+	scanner := bufio.NewScanner(input)
+	for _, c := range changes {
+		if c.kind != "policy" || !conflicts[c.name] {
+			continue
+		}
+
+		fmt.Printf("Policy %s changed both in Vault and in the directory:\n--- %s in Vault\n+++ %s in the directory\n", c.name, c.name, c.name)
+		for _, line := range policyDiff(c.previous, c.content) {
+			fmt.Println(line)
+		}
+
+		for answer := ""; answer != "o" && answer != "t"; {
+			fmt.Print("Apply the directory (o), keep Vault (t), or abort (a)? ")
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("aborted, no answer for policy %s", c.name)
+			}
+			answer = strings.ToLower(strings.TrimSpace(scanner.Text()))
+			if answer == "a" {
+				return nil, fmt.Errorf("aborted")
+			}
+			kept[c.name] = answer == "t"
+		}
+	}
+	return kept, nil
+}
+
+// conflicts returns the policies changes overwrite that changed both in Vault
+// and in the directory since the base.
+func (b *baseState) conflicts(changes []change) map[string]bool {
+	conflicts := map[string]bool{}
+	if b == nil {
+		return conflicts
+	}
+
+	for _, c := range changes {
+		if c.kind != "policy" {
+			continue
+		}
+
+		base := b.Policies[c.name]
+		remote, local := "", ""
+		if c.action != actionCreate {
+			remote = baseHash(c.previous)
+		}
+		if c.action != actionDelete {
+			local = baseHash(c.content)
+		}
+		if remote != base && local != base {
+			conflicts[c.name] = true
+		}
+	}
+	return conflicts
+}
+
+// baseHash returns the hash of the normalized content of a policy, so that
+// formatting and comments don't count as changes.
+func baseHash(content string) string {
+	sum := sha256.Sum256([]byte(policysync.Normalize(content)))
+	return hex.EncodeToString(sum[:])
+}
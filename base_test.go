@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fynelabs/vault-policies/pkg/store"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+func TestBaseConflicts(t *testing.T) {
+	const (
+		v1 = `path "secret/*" { capabilities = ["read"] }`
+		v2 = `path "secret/*" { capabilities = ["read", "list"] }`
+		v3 = `path "secret/*" { capabilities = ["update"] }`
+	)
+	base := &baseState{Policies: map[string]string{
+		"changed-in-vault": baseHash(v1),
+		"changed-locally":  baseHash(v1),
+		"changed-in-both":  baseHash(v1),
+		"same-change":      baseHash(v1),
+		"deleted-locally":  baseHash(v1),
+		"deleted-in-vault": baseHash(v1),
+		"reformatted":      baseHash(v1),
+	}}
+
+	changes := []change{
+		// Vault has v2, the directory still v1
+		{action: actionUpdate, kind: "policy", name: "changed-in-vault", previous: v2, content: v1},
+		{action: actionUpdate, kind: "policy", name: "changed-locally", previous: v1, content: v2},
+		{action: actionUpdate, kind: "policy", name: "changed-in-both", previous: v2, content: v3},
+		{action: actionDelete, kind: "policy", name: "deleted-locally", previous: v1},
+		{action: actionCreate, kind: "policy", name: "deleted-in-vault", content: v2},
+		{action: actionCreate, kind: "policy", name: "new-in-both", content: v2},
+		{action: actionUpdate, kind: "policy", name: "reformatted", previous: "# comment\n" + v1, content: v3},
+		{action: actionUpdate, kind: "attachment", name: "changed-in-both", previous: v2, content: v3},
+	}
+
+	expected := map[string]bool{
+		"changed-in-both":  true,
+		"deleted-in-vault": true,
+	}
+	if got := base.conflicts(changes); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got conflicts %v, expected %v", got, expected)
+	}
+
+	var none *baseState
+	if got := none.conflicts(changes); len(got) != 0 {
+		t.Errorf("got conflicts %v without a base", got)
+	}
+}
+
+func TestAskConflicts(t *testing.T) {
+	discardOutput(t)
+
+	changes := []change{
+		{action: actionUpdate, kind: "policy", name: "a", previous: "a1", content: "a2"},
+		{action: actionUpdate, kind: "policy", name: "b", previous: "b1", content: "b2"},
+		{action: actionUpdate, kind: "policy", name: "c", previous: "c1", content: "c2"},
+	}
+	conflicts := map[string]bool{"a": true, "c": true}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]bool
+		err      string
+	}{
+		{name: "keep one", input: "t\no\n", expected: map[string]bool{"a": true, "c": false}},
+		{name: "answers repeated", input: "x\nT\n\n o \n", expected: map[string]bool{"a": true, "c": false}},
+		{name: "abort", input: "o\na\n", err: "aborted"},
+		{name: "no more answers", input: "o\n", err: "no answer for policy c"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kept, err := askConflicts(changes, conflicts, strings.NewReader(test.input))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(kept, test.expected) {
+				t.Errorf("got %v, %v, expected %v", kept, err, test.expected)
+			}
+		})
+	}
+}
+
+func TestApplySyncChanges(t *testing.T) {
+	discardOutput(t)
+	const (
+		v1 = `path "secret/*" { capabilities = ["read"] }`
+		v2 = `path "secret/*" { capabilities = ["read", "list"] }`
+		v3 = `path "secret/*" { capabilities = ["update"] }`
+	)
+
+	tests := []struct {
+		strategy string
+		err      string
+		// app is the policy app in Vault after the apply, and appBase its
+		// base.
+		app     string
+		appBase string
+	}{
+		{strategy: conflictFail, err: "changed both in Vault and in the directory", app: v2, appBase: v1},
+		{strategy: conflictTheirs, app: v2, appBase: v1},
+		{strategy: conflictOurs, app: v3, appBase: v3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			client := newTestMemoryVault(t)
+			directory := t.TempDir()
+			writePolicyFile(t, directory, "app", v1)
+			m := activeMemoryVault
+			m.putPolicy("app", v1)
+			err := recordBase(client, directory, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// app changes on both sides, and other is new in the directory
+			m.putPolicy("app", v2)
+			writePolicyFile(t, directory, "app", v3)
+			writePolicyFile(t, directory, "other", v1)
+
+			changes, err := planPolicies(client, directory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = applySyncChanges(changes, false, &baseSync{client: client, directory: directory, onConflict: test.strategy})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if app, _ := store.NewVault(client).Get("app"); app != test.app {
+				t.Errorf("got policy app %q in Vault, expected %q", app, test.app)
+			}
+			base, err := loadBase(directory, client.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if base.Policies["app"] != baseHash(test.appBase) {
+				t.Errorf("got base %s of app, expected that of %q", base.Policies["app"], test.appBase)
+			}
+			_, created := base.Policies["other"]
+			if created != (test.err == "") {
+				t.Errorf("got policy other in the base %v, expected %v", created, test.err == "")
+			}
+		})
+	}
+}
+
+// newTestMemoryVault returns the client of a new in-memory Vault, the active
+// one of the test.
+func newTestMemoryVault(t *testing.T) *vaultApi.Client {
+	previousBackend, previous := backend, activeMemoryVault
+	t.Cleanup(func() {
+		backend, activeMemoryVault = previousBackend, previous
+	})
+	backend, activeMemoryVault = memoryBackend, nil
+
+	client, err := newMemoryVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func writePolicyFile(t *testing.T, directory, name, content string) {
+	err := os.WriteFile(filepath.Join(directory, name+".hcl"), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// discardOutput hides what the test prints to the standard output, like the
+// prompts answered by a scripted input.
+func discardOutput(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = null
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		null.Close()
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// benchPrefix starts the names of the policies of bench, the only ones it
+// changes.
+const benchPrefix = "bench-"
+
+func benchCommand() *cli.Command {
+	policies := 1000
+	paths := 5
+	concurrencies := cli.NewIntSlice(1, 4, 16)
+
+	return &cli.Command{
+		Name:  "bench",
+		Usage: "Measure how fast upload, backup and restore go with synthetic policies, at several concurrencies, against the dev server or the memory backend",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "policies",
+				Usage:       "Number of synthetic policies",
+				Value:       policies,
+				Destination: &policies,
+			},
+			&cli.IntFlag{
+				Name:        "paths",
+				Usage:       "Number of path stanzas of each synthetic policy",
+				Value:       paths,
+				Destination: &paths,
+			},
+			&cli.IntSliceFlag{
+				Name:  "concurrency",
+				Usage: "Concurrency of the uploads and restores to measure (can be repeated)",
+				Value: concurrencies,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if !dev && backend == "vault" {
+				return fmt.Errorf("bench creates and deletes policies, and so only runs against the dev server of --dev or with --backend memory")
+			}
+			if policies < 1 || paths < 1 {
+				return fmt.Errorf("bench requires at least one policy and one path")
+			}
+			for _, concurrency := range c.IntSlice("concurrency") {
+				if concurrency < 1 {
+					return fmt.Errorf("--concurrency must be at least 1, not %d", concurrency)
+				}
+			}
+
+			return bench(policies, paths, c.IntSlice("concurrency"))
+		},
+	}
+}
+
+// benchResult is how long an operation took on the synthetic policies.
+type benchResult struct {
+	concurrency int
+	operation   string
+	elapsed     time.Duration
+}
+
+// bench uploads, backs up, restores with other contents and deletes the
+// synthetic policies at each concurrency, and prints how long each took.
+func bench(policies, paths int, concurrencies []int) error {
+	root, err := os.MkdirTemp("", "vault-policies-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+
+	// The policies, as uploaded then as restored, and none to delete them.
+	created := filepath.Join(root, "created")
+	updated := filepath.Join(root, "updated")
+	deleted := filepath.Join(root, "deleted")
+	for version, directory := range []string{created, updated} {
+		err = writeBenchPolicies(directory, policies, paths, version)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Mkdir(deleted, 0700)
+	if err != nil {
+		return err
+	}
+
+	backupOptions, err := newBackupOptions("0600", "0700", layoutFlat, "-")
+	if err != nil {
+		return err
+	}
+	only := restoreOptions{only: []string{benchPrefix + "*"}, onConflict: conflictOurs}
+
+	defer func(concurrency int) {
+		applyConcurrency = concurrency
+	}(applyConcurrency)
+
+	results := []benchResult{}
+	for _, concurrency := range concurrencies {
+		applyConcurrency = concurrency
+		steps := []struct {
+			operation string
+			run       func() error
+		}{
+			{"upload", func() error { return uploadPolicies(dev, false, conflictOurs, []string{created}) }},
+			{"backup", func() error { return backupPolicies(dev, false, backupOptions, filepath.Join(root, "backup")) }},
+			{"restore", func() error { return restorePolicies(dev, false, only, []string{updated}) }},
+			{"delete", func() error { return restorePolicies(dev, false, only, []string{deleted}) }},
+		}
+
+		for _, step := range steps {
+			log("Benchmarking", step.operation, "at concurrency", fmt.Sprint(concurrency))
+			start := time.Now()
+			err = step.run()
+			if err != nil {
+				return fmt.Errorf("unable to %s the synthetic policies at concurrency %d: %w", step.operation, concurrency, err)
+			}
+			results = append(results, benchResult{concurrency: concurrency, operation: step.operation, elapsed: time.Since(start)})
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONCURRENCY\tOPERATION\tPOLICIES\tDURATION\tPOLICIES/S")
+	for _, r := range results {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%.0f\n", r.concurrency, r.operation, policies, r.elapsed.Round(time.Millisecond), float64(policies)/r.elapsed.Seconds())
+	}
+	return w.Flush()
+}
+
+// writeBenchPolicies writes the synthetic policies to directory, their
+// capabilities depending on version so that each version changes them all.
+func writeBenchPolicies(directory string, policies, paths, version int) error {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return err
+	}
+
+	capabilities := []string{`"read", "list"`, `"create", "read", "update", "list"`}[version%2]
+	for i := 0; i < policies; i++ {
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Synthetic policy of vault-policies bench\n")
+		for p := 0; p < paths; p++ {
+			fmt.Fprintf(&b, "\npath \"secret/data/bench/%06d/%d/*\" {\n  capabilities = [%s]\n}\n", i, p, capabilities)
+		}
+
+		name := fmt.Sprintf("%s%06d", benchPrefix, i)
+		err = os.WriteFile(filepath.Join(directory, name+".hcl"), []byte(b.String()), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
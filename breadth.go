@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// capabilityWeights tells how much a capability multiplies the breadth of a
+// path: reading a wide tree is bad, writing to it is worse.
+var capabilityWeights = map[string]int{
+	"read":   1,
+	"list":   1,
+	"create": 2,
+	"update": 2,
+	"patch":  2,
+	"delete": 2,
+	"sudo":   4,
+}
+
+// grantBreadth is the breadth of a path of a policy, with what makes it broad.
+type grantBreadth struct {
+	policy  string
+	path    *policyPath
+	score   int
+	reasons []string
+}
+
+func breadthCommand() *cli.Command {
+	top := 20
+
+	return &cli.Command{
+		Name:  "breadth",
+		Usage: "Rank the paths of the policies of a local directory by how broad their grants are",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "top",
+				Usage:       "Number of paths to report, 0 for all of them",
+				Value:       top,
+				Destination: &top,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("breadth requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			return reportBreadth(directory, top)
+		},
+	}
+}
+
+func reportBreadth(directory string, top int) error {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+
+	grants := rankBreadth(policies)
+	if top > 0 && len(grants) > top {
+		grants = grants[:top]
+	}
+	if len(grants) == 0 {
+		fmt.Println("No path uses a wildcard")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCORE\tPOLICY\tPATH\tCAPABILITIES\tWHY")
+	for _, g := range grants {
+		fmt.Fprintf(w, "%d\t%s:%d\t%s\t%s\t%s\n", g.score, g.policy, g.path.line, g.path.path,
+			strings.Join(g.path.Capabilities, ","), strings.Join(g.reasons, ", "))
+	}
+	return w.Flush()
+}
+
+// rankBreadth returns the paths of policies that grant something through a
+// wildcard, broadest first.
+func rankBreadth(policies []*parsedPolicy) []grantBreadth {
+	grants := []grantBreadth{}
+	for _, p := range policies {
+		for _, path := range p.paths {
+			score, reasons := pathBreadth(path)
+			if score == 0 {
+				continue
+			}
+			grants = append(grants, grantBreadth{policy: p.name, path: path, score: score, reasons: reasons})
+		}
+	}
+
+	sort.SliceStable(grants, func(i, j int) bool {
+		return grants[i].score > grants[j].score
+	})
+	return grants
+}
+
+// pathBreadth scores how broad the grant of a path is, and explains why. A
+// trailing * is worse the closer it is to the root, each + segment and each
+// parameter wildcard adds to it, and the result is multiplied by the weight of
+// the strongest capability. Denying paths score 0.
+func pathBreadth(path *policyPath) (int, []string) {
+	weight := 0
+	for _, capability := range path.Capabilities {
+		if capability == "deny" {
+			return 0, nil
+		}
+		if capabilityWeights[capability] > weight {
+			weight = capabilityWeights[capability]
+		}
+	}
+
+	score := 0
+	reasons := []string{}
+	if strings.HasSuffix(path.path, "*") {
+		depth := strings.Count(path.path, "/")
+		glob := 64 >> depth
+		if glob == 0 {
+			glob = 1
+		}
+		score += glob
+		reasons = append(reasons, fmt.Sprintf("* at depth %d", depth))
+	}
+
+	for _, segment := range strings.Split(path.path, "/") {
+		if segment == "+" {
+			score += 8
+			reasons = append(reasons, "+ segment")
+		}
+	}
+
+	parameterScore, parameterReasons := parametersBreadth(path.AllowedParameters)
+	return (score + parameterScore) * weight, append(reasons, parameterReasons...)
+}
+
+// parametersBreadth scores the wildcards of the allowed parameters of a path.
+func parametersBreadth(allowed map[string][]interface{}) (int, []string) {
+	names := make([]string, 0, len(allowed))
+	for name := range allowed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	score := 0
+	reasons := []string{}
+	for _, name := range names {
+		if name == "*" {
+			score += 4
+			reasons = append(reasons, "any parameter allowed")
+			continue
+		}
+		for _, value := range allowed[name] {
+			if strings.Contains(fmt.Sprint(value), "*") {
+				score += 2
+				reasons = append(reasons, fmt.Sprintf("parameter %s accepts a glob", name))
+				break
+			}
+		}
+	}
+	return score, reasons
+}
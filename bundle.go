@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// bundleStage is a subdirectory of a bundle and the way to plan its content.
+type bundleStage struct {
+	directory string
+	plan      func(client *vaultApi.Client, directory string) ([]change, error)
+	// synced tells that the stage synchronizes the policies of its directory,
+	// checking the conflicts with its base and recording it.
+	synced bool
+}
+
+// bundleStages returns the stages of a bundle in the order they are applied,
+// so that everything an object depends on exists before it is written: mounts
+// and auth methods first, then the auth roles, the policies and what is
+// attached to them.
+func bundleStages(allowDisable bool) []bundleStage {
+	stages := []bundleStage{}
+	for _, t := range []*mountTable{secretEngines, authMethods} {
+		t := t
+		stages = append(stages, bundleStage{
+			directory: t.name,
+			plan: func(client *vaultApi.Client, directory string) ([]change, error) {
+				return planMounts(client, t, directory, allowDisable)
+			},
+		})
+	}
+
+	resources := []*resource{
+		approleRolesResource,
+		kubernetesRolesResource,
+		tokenRolesResource,
+		databaseRolesResource,
+	}
+	stages = append(stages, resourceStages("", resources)...)
+
+	stages = append(stages, bundleStage{directory: "policies", plan: planPolicies, synced: true})
+
+	resources = []*resource{
+		egpBindingsResource,
+		entitiesResource,
+		groupsResource,
+	}
+	stages = append(stages, resourceStages("", resources)...)
+
+	stages = append(stages, bundleStage{directory: "policies", plan: planDirectoryAttachments})
+	stages = append(stages, resourceStages("oidc", oidcResources)...)
+
+	resources = []*resource{
+		rateLimitQuotasResource,
+		leaseCountQuotasResource,
+	}
+	return append(stages, resourceStages("", resources)...)
+}
+
+func resourceStages(parent string, resources []*resource) []bundleStage {
+	stages := make([]bundleStage, 0, len(resources))
+	for _, r := range resources {
+		r := r
+		stages = append(stages, bundleStage{
+			directory: filepath.Join(parent, r.name),
+			plan: func(client *vaultApi.Client, directory string) ([]change, error) {
+				return planResources(client, r, directory)
+			},
+		})
+	}
+	return stages
+}
+
+func applyBundleCommand() *cli.Command {
+	allowDisable := false
+	maxDeletions := "50%"
+	force := false
+
+	return &cli.Command{
+		Name:  "apply-bundle",
+		Usage: "Apply a directory holding a subdirectory per kind of configuration (mounts, policies, groups, roles...) in dependency order",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "allow-disable",
+				Usage:       "Disable mounts not present in the bundle and recreate mounts whose type changed",
+				Destination: &allowDisable,
+			},
+			&cli.StringFlag{
+				Name:        "max-deletions",
+				Usage:       "Most policies the bundle may delete, as a number or a percentage of the policies in Vault, above which it is refused unless forced",
+				Value:       maxDeletions,
+				Destination: &maxDeletions,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Usage:       "Apply even if the bundle deletes more policies than --max-deletions",
+				Destination: &force,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("apply-bundle requires a directory")
+			}
+
+			limit, err := newDeletionLimit(maxDeletions, force)
+			if err != nil {
+				return err
+			}
+			directory := c.Args().Slice()[0]
+
+			return applyBundle(dev, dryRun, allowDisable, directory, limit)
+		},
+	}
+}
+
+// stagePlan is the plan of a stage of a bundle, with the base of its
+// directory when it synchronizes policies.
+type stagePlan struct {
+	directory string
+	changes   []change
+	base      *baseSync
+}
+
+// applyBundle plans every stage of the bundle, shows their plans and, once
+// confirmed, applies them one after the other. The stages are all planned
+// against Vault as it is, a change needing what a stage before it writes
+// being checked when it is made.
+func applyBundle(dev, dryRun, allowDisable bool, directory string, limit *deletionLimit) error {
+	log("Applying bundle", directory)
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	err = runHooks(dryRun, hookBeforePlan, hookPayload{Directory: directory})
+	if err != nil {
+		return err
+	}
+
+	plans, err := planBundle(client, bundleStages(allowDisable), directory, limit)
+	if err != nil {
+		return err
+	}
+
+	changes := printBundlePlan(plans)
+	if len(changes) == 0 {
+		fmt.Println("Nothing to do, Vault matches the bundle")
+	}
+	if dryRun {
+		return nil
+	}
+
+	if len(changes) > 0 {
+		err = checkChanges()
+		if err != nil {
+			return err
+		}
+		err = confirmBundle(len(changes), os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range plans {
+		err = applySyncChanges(p.changes, false, p.base)
+		if err != nil {
+			return fmt.Errorf("unable to apply %s: %w", p.directory, err)
+		}
+	}
+
+	if len(changes) > 0 {
+		fmt.Printf("Applied %d changes\n", len(changes))
+	}
+	return nil
+}
+
+// planBundle plans the stages of the bundle present in directory, resolving
+// the conflicts of its policies with their base, and refuses the bundle if it
+// deletes more policies than limit, unless nil.
+func planBundle(client *vaultApi.Client, stages []bundleStage, directory string, limit *deletionLimit) ([]stagePlan, error) {
+	plans := []stagePlan{}
+	all := []change{}
+	for _, stage := range stages {
+		stageDirectory := filepath.Join(directory, stage.directory)
+		if _, err := os.Stat(stageDirectory); err != nil {
+			log("Skipping missing", stageDirectory)
+			continue
+		}
+
+		log("Planning", stageDirectory)
+		changes, err := stage.plan(client, stageDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("unable to plan %s: %w", stageDirectory, err)
+		}
+
+		p := stagePlan{directory: stageDirectory}
+		if stage.synced {
+			p.base = &baseSync{client: client, directory: stageDirectory, onConflict: conflictFail}
+			changes, err = p.base.resolve(changes)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.changes = changes
+
+		plans = append(plans, p)
+		all = append(all, changes...)
+	}
+
+	err := checkDeletions(client, all, limit)
+	if err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// printBundlePlan prints the plan of each stage changing something and the
+// summary of the whole bundle, and returns all the changes.
+func printBundlePlan(plans []stagePlan) []change {
+	all := []change{}
+	for _, p := range plans {
+		if len(p.changes) == 0 {
+			continue
+		}
+
+		fmt.Printf("Plan of %s:\n", p.directory)
+		printPlan(p.changes)
+		all = append(all, p.changes...)
+	}
+
+	if len(all) > 0 {
+		fmt.Println("Summary:", summarize(all))
+	}
+	return all
+}
+
+// confirmBundle asks whether to apply the changes of the bundle, reading the
+// answer from input, anything but yes aborting. --yes confirms them without
+// asking.
+func confirmBundle(count int, input io.Reader) error {
+	if confirmed {
+		return nil
+	}
+
+	fmt.Printf("Apply the %d changes of the bundle [y/N]? ", count)
+	answer := ""
+	scanner := bufio.NewScanner(input)
+	if scanner.Scan() {
+		answer = strings.ToLower(strings.TrimSpace(scanner.Text()))
+	}
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("aborted")
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fynelabs/vault-policies/pkg/store"
+)
+
+func TestBundleStages(t *testing.T) {
+	order := map[string]int{}
+	for i, stage := range bundleStages(false) {
+		if _, ok := order[stage.directory]; !ok {
+			order[stage.directory] = i
+		}
+	}
+
+	for _, dependency := range [][2]string{
+		{"mounts", "auth-methods"},
+		{"auth-methods", "approle-roles"},
+		{"approle-roles", "policies"},
+		{"policies", "groups"},
+		{"groups", filepath.Join("oidc", "assignments")},
+	} {
+		first, ok := order[dependency[0]]
+		if !ok {
+			t.Fatalf("no stage %s", dependency[0])
+		}
+		then, ok := order[dependency[1]]
+		if !ok {
+			t.Fatalf("no stage %s", dependency[1])
+		}
+		if first >= then {
+			t.Errorf("stage %s comes after %s", dependency[0], dependency[1])
+		}
+	}
+}
+
+func TestApplyBundle(t *testing.T) {
+	discardOutput(t)
+	previous := confirmed
+	t.Cleanup(func() {
+		confirmed = previous
+	})
+	confirmed = true
+
+	client := newTestMemoryVault(t)
+	directory := t.TempDir()
+	writeBundleFile(t, directory, "mounts/kv.json", `{"type": "kv", "options": {"version": "2"}, "config": {}}`)
+	writeBundleFile(t, directory, "auth-methods/approle.json", `{"type": "approle", "config": {}}`)
+	writeBundleFile(t, directory, "policies/app.hcl", `path "kv/data/app/*" { capabilities = ["read"] }`)
+
+	err := applyBundle(false, false, false, directory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"sys/mounts/kv", "sys/auth/approle"} {
+		secret, err := client.Logical().Read(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret == nil {
+			t.Errorf("no %s, expected it to be enabled", path)
+		}
+	}
+	if app, _ := store.NewVault(client).Get("app"); !strings.Contains(app, "kv/data/app/*") {
+		t.Errorf("got policy app %q in Vault", app)
+	}
+	if _, err := loadBase(filepath.Join(directory, "policies"), client.Address()); err != nil {
+		t.Errorf("unable to load the base of the policies: %v", err)
+	}
+}
+
+func TestPlanBundleDeletions(t *testing.T) {
+	discardOutput(t)
+	client := newTestMemoryVault(t)
+	vault := store.NewVault(client)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		err := vault.Put(name, `path "secret/*" { capabilities = ["read"] }`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	directory := t.TempDir()
+	writeBundleFile(t, directory, "mounts/kv.json", `{"type": "kv", "config": {}}`)
+	writeBundleFile(t, directory, "policies/a.hcl", `path "secret/*" { capabilities = ["read"] }`)
+
+	limit, err := newDeletionLimit("50%", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = planBundle(client, bundleStages(false), directory, limit)
+	if err == nil || !strings.Contains(err.Error(), "would delete 3 of the 4 policies") {
+		t.Fatalf("got error %v, expected the deletions to be refused", err)
+	}
+
+	writeBundleFile(t, directory, "policies/b.hcl", `path "secret/*" { capabilities = ["read"] }`)
+	plans, err := planBundle(client, bundleStages(false), directory, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 3 || plans[0].directory != filepath.Join(directory, "mounts") || len(plans[0].changes) != 1 || plans[1].base == nil || len(plans[1].changes) != 2 {
+		t.Errorf("got plans %+v, expected those of mounts, policies and their attachments", plans)
+	}
+}
+
+func TestConfirmBundle(t *testing.T) {
+	discardOutput(t)
+	previous := confirmed
+	t.Cleanup(func() {
+		confirmed = previous
+	})
+
+	tests := []struct {
+		input     string
+		confirmed bool
+		err       bool
+	}{
+		{input: "y\n"},
+		{input: " Yes \n"},
+		{input: "n\n", err: true},
+		{input: "", err: true},
+		{input: "", confirmed: true},
+	}
+
+	for _, test := range tests {
+		confirmed = test.confirmed
+		err := confirmBundle(3, strings.NewReader(test.input))
+		if (err != nil) != test.err {
+			t.Errorf("got error %v answering %q, expected one %v", err, test.input, test.err)
+		}
+	}
+}
+
+func writeBundleFile(t *testing.T, directory, file, content string) {
+	file = filepath.Join(directory, filepath.FromSlash(file))
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/policysync"
+	"github.com/fynelabs/vault-policies/pkg/store"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// canaryOptions are the policies of a plan applied first with apply --canary,
+// and how long to wait before verifying them.
+type canaryOptions struct {
+	patterns []string
+	wait     time.Duration
+}
+
+// checkCanaryPatterns refuses the scopes a plan can't be split by.
+func checkCanaryPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "ns:") {
+			return fmt.Errorf("--canary %s: a plan changes the policies of a single namespace, its canary is a pattern of policy names", pattern)
+		}
+	}
+	return nil
+}
+
+// applyPlanCanary applies the changes of the canary policies of a plan, waits,
+// and verifies them with the after_canary hooks before applying the others.
+// A canary failing its verification is reverted, and the rest isn't applied.
+func applyPlanCanary(client *vaultApi.Client, p *planFile, progress *planProgress, canary canaryOptions, dryRun bool) error {
+	changes, err := p.changes(client, progress)
+	if err != nil {
+		return err
+	}
+	canaryChanges, rest := splitCanary(changes, canary.patterns)
+	if len(canaryChanges) == 0 {
+		return fmt.Errorf("no change of the plan matches --canary %s", strings.Join(canary.patterns, ", "))
+	}
+
+	if dryRun {
+		fmt.Println("Canary:")
+		printDryRun(canaryChanges)
+		fmt.Println("Then:")
+		printDryRun(rest)
+		return nil
+	}
+
+	fmt.Println("Applying the canary:", summarize(canaryChanges))
+	err = applyChanges(canaryChanges, false)
+	if err != nil {
+		return err
+	}
+
+	if canary.wait > 0 {
+		log("Waiting", canary.wait.String(), "before verifying the canary")
+		time.Sleep(canary.wait)
+	}
+	err = verifyCanary(store.NewVault(client), canaryChanges)
+	if err != nil {
+		revertErr := revertCanary(store.NewVault(client), progress, canaryChanges)
+		if revertErr != nil {
+			return fmt.Errorf("the canary failed: %v, and reverting it failed: %w", err, revertErr)
+		}
+		return fmt.Errorf("the canary failed and was reverted, the rest of the plan wasn't applied: %w", err)
+	}
+
+	// The rest is checked against Vault again, as the lock was released.
+	changes, err = p.changes(client, progress)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Canary verified, applying the rest:", summarize(changes))
+	return applyChanges(changes, false)
+}
+
+// splitCanary returns the changes of the policies matching patterns, and the
+// others.
+func splitCanary(changes []change, patterns []string) ([]change, []change) {
+	canary, rest := []change{}, []change{}
+	for _, c := range changes {
+		if matchesAny(patterns, c.name) {
+			canary = append(canary, c)
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	return canary, rest
+}
+
+// verifyCanary checks that Vault has the content of the canary policies, and
+// runs the after_canary hooks, like smoke tests logging in with them.
+func verifyCanary(remote store.Store, canary []change) error {
+	names, err := remote.List()
+	if err != nil {
+		return err
+	}
+	current := map[string]bool{}
+	for _, name := range names {
+		current[name] = true
+	}
+
+	for _, c := range canary {
+		if c.action == actionDelete {
+			if current[c.name] {
+				return fmt.Errorf("policy %s is still in Vault", c.name)
+			}
+			continue
+		}
+
+		content, err := remote.Get(c.name)
+		if err != nil {
+			return fmt.Errorf("unable to get policy %s: %w", c.name, err)
+		}
+		if !current[c.name] || !policysync.Equal(content, c.content) {
+			return fmt.Errorf("policy %s doesn't have the content of the plan in Vault", c.name)
+		}
+	}
+
+	return runHooks(false, hookAfterCanary, hookPayload{Changes: newJSONChanges(canary)})
+}
+
+// revertCanary restores the canary policies as they were before the plan, and
+// forgets their changes in the progress so that the plan can be applied again.
+func revertCanary(remote store.Store, progress *planProgress, canary []change) error {
+	reverts := make([]change, 0, len(canary))
+	for _, c := range canary {
+		revert := change{kind: c.kind, name: c.name, content: c.previous, previous: c.content}
+		switch c.action {
+		case actionCreate:
+			revert.action = actionDelete
+		case actionDelete:
+			revert.action = actionCreate
+		default:
+			revert.action = actionUpdate
+			revert.details = policyDiff(c.content, c.previous)
+		}
+
+		sc := policysync.Change{Action: policysync.Action(revert.action), Name: revert.name, Content: revert.content, Previous: revert.previous}
+		revert.apply = func() error {
+			err := applyPolicyChange(remote, sc)
+			if err != nil {
+				return err
+			}
+			return progress.forget(sc.Name)
+		}
+		reverts = append(reverts, revert)
+	}
+
+	fmt.Println("Reverting the canary:", summarize(reverts))
+	return applyChanges(reverts, false)
+}
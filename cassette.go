@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+var (
+	recordFile = ""
+	replayFile = ""
+
+	// activeRecording is shared by the clients of a command, so that the
+	// cassette holds the requests of all of them.
+	activeRecording *recording
+)
+
+// cassette holds the requests made to Vault and their responses, without the
+// headers and so without the token.
+type cassette struct {
+	Address      string        `json:"address"`
+	Interactions []interaction `json:"interactions"`
+}
+
+type interaction struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Query       string `json:"query,omitempty"`
+	Body        string `json:"body,omitempty"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Response    string `json:"response,omitempty"`
+
+	used bool
+}
+
+func (i *interaction) matches(r *http.Request, body []byte) bool {
+	return i.Method == r.Method && i.Path == r.URL.Path && i.Query == r.URL.RawQuery && i.Body == string(body)
+}
+
+// recording is a cassette being recorded to a file.
+type recording struct {
+	file     string
+	mu       sync.Mutex
+	cassette cassette
+}
+
+// recorder sends the requests to Vault and adds them, with their responses,
+// to a recording.
+type recorder struct {
+	next      http.RoundTripper
+	recording *recording
+}
+
+func (rec *recorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rec.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(response))
+
+	return resp, rec.recording.add(interaction{
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Query:       r.URL.RawQuery,
+		Body:        string(body),
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Response:    string(response),
+	})
+}
+
+// add adds an interaction and rewrites the whole cassette, so that it is
+// complete whenever the command stops.
+func (rec *recording) add(i interaction) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.cassette.Interactions = append(rec.cassette.Interactions, i)
+	content, err := json.MarshalIndent(rec.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(rec.file, content, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write the cassette %s: %w", rec.file, err)
+	}
+	return nil
+}
+
+// player answers the requests with the responses of a cassette, without
+// reaching any server.
+type player struct {
+	mu       sync.Mutex
+	cassette *cassette
+}
+
+// RoundTrip answers with the first unused recorded interaction matching the
+// request or, once they are all used, the last one, as the requests read the
+// same data.
+func (p *player) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var found *interaction
+	for i := range p.cassette.Interactions {
+		candidate := &p.cassette.Interactions[i]
+		if !candidate.matches(r, body) {
+			continue
+		}
+		found = candidate
+		if !candidate.used {
+			break
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no recorded response for %s %s", r.Method, r.URL.RequestURI())
+	}
+	found.used = true
+
+	header := http.Header{}
+	if found.ContentType != "" {
+		header.Set("Content-Type", found.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", found.Status, http.StatusText(found.Status)),
+		StatusCode:    found.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewBufferString(found.Response)),
+		ContentLength: int64(len(found.Response)),
+		Request:       r,
+	}, nil
+}
+
+// readRequestBody returns the body of a request and puts it back for the
+// transport.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// recordingOption returns the client option recording the requests to
+// recordFile, if set.
+func recordingOption(address string) []vaultclient.Option {
+	if recordFile == "" {
+		return nil
+	}
+
+	if activeRecording == nil {
+		activeRecording = &recording{file: recordFile, cassette: cassette{Address: address}}
+
+		// Several commands can be recorded in the same cassette, one after
+		// the other.
+		content, err := os.ReadFile(recordFile)
+		if err == nil {
+			err = json.Unmarshal(content, &activeRecording.cassette)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log("Starting a new cassette:", err.Error())
+		}
+	}
+	return []vaultclient.Option{vaultclient.WithTransport(func(next http.RoundTripper) http.RoundTripper {
+		return &recorder{next: next, recording: activeRecording}
+	})}
+}
+
+// newReplayVault returns a client answered by the cassette of replayFile,
+// which needs neither network access nor credentials.
+func newReplayVault() (*vaultApi.Client, error) {
+	content, err := os.ReadFile(replayFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cassette{}
+	err = json.Unmarshal(content, c)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the cassette %s: %w", replayFile, err)
+	}
+
+	if c.Address == "" {
+		c.Address = vaultclient.DevAddress
+	}
+
+	client, err := vaultclient.New(c.Address, "", "", "", "", vaultclient.WithTransport(func(http.RoundTripper) http.RoundTripper {
+		return &player{cassette: c}
+	}))
+	if err != nil {
+		return nil, err
+	}
+	client.SetMaxRetries(0)
+	return client, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/fynelabs/vault-policies/pkg/policysync"
+	"github.com/fynelabs/vault-policies/pkg/store"
+	"github.com/urfave/cli/v2"
+)
+
+// liveState is the state argument of changelog naming the policies of Vault.
+const liveState = "@vault"
+
+func changelogCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "changelog",
+		Usage:     "Print the policies added, removed and modified between two states, each a directory, a git revision and path like v1.2:policies, or @vault for the policies of Vault, as Markdown for release notes",
+		ArgsUsage: "old new",
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 2 {
+				return fmt.Errorf("changelog requires an old and a new state")
+			}
+
+			before, err := loadState(c.Args().Get(0))
+			if err != nil {
+				return err
+			}
+			after, err := loadState(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			fmt.Print(changelog(before, after))
+			return nil
+		},
+	}
+}
+
+// loadState returns the policies of a directory, a git revision and path, or
+// Vault, by name.
+func loadState(state string) (map[string]string, error) {
+	if state == liveState {
+		client, err := selectNewVault(dev)
+		if err != nil {
+			return nil, err
+		}
+		return policysync.Load(store.NewVault(client))
+	}
+
+	if _, err := os.Stat(state); err == nil || !strings.Contains(state, ":") {
+		return policysync.Load(policyDirectory(state))
+	}
+	return loadGitState(state)
+}
+
+// loadGitState returns the policies of the .hcl files under a path at a git
+// revision, given as revision:path.
+func loadGitState(state string) (map[string]string, error) {
+	parts := strings.SplitN(state, ":", 2)
+	revision, directory := parts[0], strings.TrimSuffix(parts[1], "/")
+	if directory == "" {
+		directory = "."
+	}
+
+	output, err := exec.Command("git", "ls-tree", "-r", "--name-only", "--full-name", revision, "--", directory).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the files of %s: %w", state, commandError(err))
+	}
+
+	policies := map[string]string{}
+	files := map[string]string{}
+	for _, file := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if filepath.Ext(file) != ".hcl" {
+			continue
+		}
+
+		name := store.PolicyName(strings.TrimSuffix(filepath.Base(file), ".hcl"))
+		if previous, ok := files[name]; ok {
+			return nil, fmt.Errorf("%s and %s both hold policy %s at %s", previous, file, name, revision)
+		}
+		files[name] = file
+
+		content, err := exec.Command("git", "show", revision+":"+file).Output()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s at %s: %w", file, revision, commandError(err))
+		}
+		policies[name] = string(store.NormalizeText(content))
+	}
+	return policies, nil
+}
+
+// changelog returns the Markdown changelog going from the policies before to
+// those after.
+func changelog(before, after map[string]string) string {
+	added, removed, modified := []string{}, []string{}, []string{}
+
+	for _, name := range sortedStateNames(after) {
+		previous, ok := before[name]
+		switch {
+		case !ok:
+			added = append(added, "- `"+name+"`")
+		case !policysync.Equal(previous, after[name]):
+			modified = append(modified, "- `"+name+"`")
+			for _, line := range policyDiff(previous, after[name]) {
+				modified = append(modified, "  - `"+line+"`")
+			}
+		}
+	}
+	for _, name := range sortedStateNames(before) {
+		// Built-in policies are only missing from directories that don't
+		// manage them.
+		if _, ok := after[name]; !ok && !builtinPolicies[name] {
+			removed = append(removed, "- `"+name+"`")
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d added, %d removed, %d modified\n", len(added), len(removed), countPolicies(modified))
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{{"Added", added}, {"Removed", removed}, {"Modified", modified}} {
+		if len(section.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", section.title, strings.Join(section.lines, "\n"))
+	}
+	return b.String()
+}
+
+// countPolicies counts the policies of a list, without their details.
+func countPolicies(lines []string) int {
+	count := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "- ") {
+			count++
+		}
+	}
+	return count
+}
+
+func sortedStateNames(state map[string]string) []string {
+	names := make(map[string]bool, len(state))
+	for name := range state {
+		names[name] = true
+	}
+	return sortedKeys(names)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// changeRefComment starts the comment stamped at the top of the policies
+// written with --change-ref.
+const changeRefComment = "# change-ref: "
+
+// changeRef is the change ticket the changes are made for, as set with
+// --change-ref.
+var changeRef = ""
+
+// checkChangeRef fails when the active profile requires a change ticket and
+// none was given.
+func checkChangeRef() error {
+	if changeRef == "" && activeProfile != nil && activeProfile.RequireChangeRef {
+		return fmt.Errorf("profile %s requires the change ticket of the changes, set with --change-ref", activeProfile.name)
+	}
+	return nil
+}
+
+// stampChangeRef returns the content of a policy with the change ticket in a
+// comment at its top, replacing the one of a previous change.
+func stampChangeRef(content string) string {
+	if changeRef == "" {
+		return content
+	}
+
+	if strings.HasPrefix(content, changeRefComment) {
+		end := strings.Index(content, "\n")
+		if end < 0 {
+			end = len(content) - 1
+		}
+		content = content[end+1:]
+	}
+	return changeRefComment + changeRef + "\n" + content
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// completionTimeout bounds how long completing the policy names may wait on
+// Vault, so that a slow or unreachable server doesn't freeze the shell.
+const completionTimeout = 500 * time.Millisecond
+
+// The completion scripts ask the program itself for the candidates of the
+// words typed so far. When it has none, they fall back to completing file
+// names, which is what the directory arguments need.
+var completionScripts = map[string]string{
+	"bash": `_vault_policies() {
+  local cur="${COMP_WORDS[COMP_CWORD]}"
+  local opts
+  if [[ "$cur" == "-"* ]]; then
+    opts=$("${COMP_WORDS[@]:0:$COMP_CWORD}" "$cur" --generate-bash-completion 2>/dev/null)
+  else
+    opts=$("${COMP_WORDS[@]:0:$COMP_CWORD}" --generate-bash-completion 2>/dev/null)
+  fi
+  COMPREPLY=($(compgen -W "$opts" -- "$cur"))
+}
+
+complete -o bashdefault -o default -F _vault_policies vault-policies
+`,
+	"zsh": `#compdef vault-policies
+
+_vault_policies() {
+  local -a opts
+  local cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion 2>/dev/null)}")
+  else
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} --generate-bash-completion 2>/dev/null)}")
+  fi
+
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+
+compdef _vault_policies vault-policies
+`,
+	"fish": `function __vault_policies_complete
+  set -l words (commandline -opc)
+  set -l cur (commandline -ct)
+  if string match -q -- '-*' $cur
+    $words $cur --generate-bash-completion 2>/dev/null
+  else
+    $words --generate-bash-completion 2>/dev/null
+  end
+end
+
+complete -c vault-policies -a '(__vault_policies_complete)'
+`,
+}
+
+func completionCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "completion",
+		Usage:     "Print the completion script of bash, zsh or fish, to be sourced by the shell",
+		ArgsUsage: "<bash|zsh|fish>",
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("completion requires a shell")
+			}
+
+			shell := c.Args().Slice()[0]
+			script, ok := completionScripts[shell]
+			if !ok {
+				return fmt.Errorf("unknown shell %s, expected bash, zsh or fish", shell)
+			}
+
+			fmt.Print(script)
+			return nil
+		},
+	}
+}
+
+// completePolicies completes the policy argument of a command with the names
+// of the policy files of the current directory and of the policies of Vault,
+// when it answers quickly enough.
+func completePolicies(c *cli.Context) {
+	if c.NArg() > 0 {
+		return
+	}
+
+	for _, policy := range completionPolicyNames() {
+		fmt.Println(policy)
+	}
+}
+
+func completionPolicyNames() []string {
+	names := map[string]bool{}
+
+	files, _ := filepath.Glob("*.hcl")
+	for _, file := range files {
+		names[file[:len(file)-len(filepath.Ext(file))]] = true
+	}
+
+	client, err := selectNewVault(dev)
+	if err == nil {
+		client.SetClientTimeout(completionTimeout)
+		client.SetMaxRetries(0)
+		// Completing is best effort, the local names are enough otherwise.
+		policies, _ := client.Sys().ListPolicies()
+		for _, policy := range policies {
+			names[policy] = true
+		}
+	}
+
+	return sortedKeys(names)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// applyConcurrency is how many policies are written or deleted at once, as
+// set with --concurrency.
+var applyConcurrency = 1
+
+func concurrencyFlag() cli.Flag {
+	return &cli.IntFlag{
+		Name:        "concurrency",
+		Usage:       "Number of policies to write or delete at once, which speeds up large changes to a distant Vault",
+		Value:       applyConcurrency,
+		Destination: &applyConcurrency,
+	}
+}
+
+func checkConcurrency() error {
+	if applyConcurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1, not %d", applyConcurrency)
+	}
+	return nil
+}
+
+// applyAll makes the changes in order, and returns those made. The changes to
+// consecutive policies are made up to applyConcurrency at once, and all of
+// them are tried even when some fail. It stops at the first change, or group
+// of policy changes, that failed.
+func applyAll(changes []change) ([]change, error) {
+	applied := []change{}
+	for start := 0; start < len(changes); {
+		end := start + 1
+		for applyConcurrency > 1 && end < len(changes) && changes[start].kind == "policy" && changes[end].kind == "policy" {
+			end++
+		}
+
+		done, err := applyConcurrently(changes[start:end])
+		applied = append(applied, done...)
+		if err != nil {
+			return applied, err
+		}
+		start = end
+	}
+	return applied, nil
+}
+
+// applyConcurrently makes the changes, up to applyConcurrency at once, and
+// returns those made and the failures of the others.
+func applyConcurrently(changes []change) ([]change, error) {
+	errs := make([]error, len(changes))
+	slots := make(chan struct{}, applyConcurrency)
+	var wg sync.WaitGroup
+	for i := range changes {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = circuitOpen()
+			if errs[i] == nil {
+				errs[i] = lockLost()
+			}
+			if errs[i] == nil {
+				errs[i] = applyChange(changes[i])
+			}
+			<-slots
+		}(i)
+	}
+	wg.Wait()
+
+	applied := []change{}
+	failed := []error{}
+	failures := []string{}
+	for i, c := range changes {
+		if errs[i] == nil {
+			applied = append(applied, c)
+			continue
+		}
+		failed = append(failed, errs[i])
+		failures = append(failures, errs[i].Error())
+	}
+
+	switch len(failed) {
+	case 0:
+		return applied, nil
+	case 1:
+		return applied, failed[0]
+	}
+	if open := circuitOpen(); open != nil {
+		return applied, fmt.Errorf("%d of %d changes made: %w", len(applied), len(changes), open)
+	}
+	if lost := lockLost(); lost != nil {
+		return applied, fmt.Errorf("%d of %d changes made: %w", len(applied), len(changes), lost)
+	}
+	return applied, fmt.Errorf("%d of %d changes failed:\n  %s", len(failures), len(changes), strings.Join(failures, "\n  "))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
+)
+
+// controlGroup is the control_group block of a path, decoded like Vault
+// Enterprise does.
+type controlGroup struct {
+	TTL     interface{}                    `hcl:"ttl"`
+	Factors map[string]*controlGroupFactor `hcl:"factor"`
+}
+
+// controlGroupFactor is a factor of a control group, whose approvals are all
+// required.
+type controlGroupFactor struct {
+	Identity *identityFactor `hcl:"identity"`
+	// ControlledCapabilities limits the factor to these capabilities.
+	ControlledCapabilities []string `hcl:"controlled_capabilities"`
+}
+
+// identityFactor is who can approve a request.
+type identityFactor struct {
+	GroupIDs   []string `hcl:"group_ids"`
+	GroupNames []string `hcl:"group_names"`
+	Approvals  int      `hcl:"approvals"`
+}
+
+// lintControlGroups reports the control groups that no one could ever satisfy.
+// Vault only finds out when a request needs an approval. With --live, the
+// groups are checked to exist and have enough members to approve.
+func lintControlGroups(p *parsedPolicy, ctx *lintContext) []finding {
+	findings := []finding{}
+	for _, path := range p.paths {
+		if path.ControlGroup == nil {
+			continue
+		}
+		for _, problem := range controlGroupProblems(path, ctx) {
+			findings = append(findings, finding{
+				policy:  p.name,
+				line:    path.line,
+				rule:    "control-group",
+				message: fmt.Sprintf("path %q: %s", path.path, problem),
+			})
+		}
+	}
+	return findings
+}
+
+func controlGroupProblems(path *policyPath, ctx *lintContext) []string {
+	cg := path.ControlGroup
+	problems := []string{}
+	if cg.TTL != nil {
+		if _, err := parseutil.ParseDurationSecond(cg.TTL); err != nil {
+			problems = append(problems, fmt.Sprintf("control_group ttl %v isn't a duration", cg.TTL))
+		}
+	}
+	if len(cg.Factors) == 0 {
+		problems = append(problems, "control_group has no factor")
+	}
+
+	names := make([]string, 0, len(cg.Factors))
+	for name := range cg.Factors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		factor := cg.Factors[name]
+		if factor == nil || factor.Identity == nil {
+			problems = append(problems, fmt.Sprintf("factor %s has no identity block, no one can approve", name))
+			continue
+		}
+		for _, c := range factor.ControlledCapabilities {
+			if !path.allows(c) {
+				problems = append(problems, fmt.Sprintf("factor %s controls %s, which the path doesn't grant", name, c))
+			}
+		}
+		problems = append(problems, identityFactorProblems(name, factor.Identity, ctx)...)
+	}
+	return problems
+}
+
+func identityFactorProblems(name string, identity *identityFactor, ctx *lintContext) []string {
+	problems := []string{}
+	if len(identity.GroupIDs) == 0 && len(identity.GroupNames) == 0 {
+		problems = append(problems, fmt.Sprintf("factor %s has no group_names nor group_ids, no one can approve", name))
+	}
+	if identity.Approvals < 1 {
+		problems = append(problems, fmt.Sprintf("factor %s requires %d approvals, set approvals to at least 1", name, identity.Approvals))
+	}
+	if ctx.client == nil {
+		return problems
+	}
+
+	// approvers is -1 when a group has members that can't be counted.
+	approvers := 0
+	groups := []string{}
+	for _, group := range identity.GroupNames {
+		groups = append(groups, "identity/group/name/"+group)
+	}
+	for _, id := range identity.GroupIDs {
+		groups = append(groups, "identity/group/id/"+id)
+	}
+	for _, group := range groups {
+		members, found, err := ctx.groupMembers(group)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("factor %s: unable to read %s: %v", name, group, err))
+		case !found:
+			kind, group := path.Split(strings.TrimPrefix(group, "identity/group/"))
+			if kind == "id/" {
+				group = "id " + group
+			}
+			problems = append(problems, fmt.Sprintf("factor %s: group %s doesn't exist", name, group))
+		case members < 0 || approvers < 0:
+			approvers = -1
+		default:
+			approvers += members
+		}
+	}
+	if len(problems) == 0 && approvers >= 0 && approvers < identity.Approvals {
+		problems = append(problems, fmt.Sprintf("factor %s requires %d approvals, but its groups only have %d members",
+			name, identity.Approvals, approvers))
+	}
+	return problems
+}
+
+// groupMembers returns how many entities are members of the identity group at
+// path, and whether it exists. The members of external groups and of the
+// subgroups can't be counted, and are returned as -1.
+func (ctx *lintContext) groupMembers(path string) (int, bool, error) {
+	secret, ok := ctx.groups[path]
+	if !ok {
+		var err error
+		secret, err = ctx.client.Logical().Read(path)
+		if err != nil {
+			return 0, false, err
+		}
+		ctx.groups[path] = secret
+	}
+	if secret == nil || secret.Data == nil {
+		return 0, false, nil
+	}
+
+	subgroups, _ := secret.Data["member_group_ids"].([]interface{})
+	if secret.Data["type"] == "external" || len(subgroups) > 0 {
+		return -1, true, nil
+	}
+	members, _ := secret.Data["member_entity_ids"].([]interface{})
+	return len(members), true, nil
+}
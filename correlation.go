@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+)
+
+// logFormat is the format of the debug logs, text or json.
+var logFormat = "text"
+
+const logFormatJSON = "json"
+
+// The headers of the requests to Vault carrying the id of the run, and of the
+// request, for the Vault audit logs to record them.
+const (
+	runIDHeader     = "X-Vault-Policies-Run-Id"
+	requestIDHeader = "X-Request-Id"
+)
+
+// requestCount numbers the requests to Vault of the run.
+var requestCount uint64
+
+func checkLogFormat() error {
+	if logFormat != "text" && logFormat != logFormatJSON {
+		return fmt.Errorf("unknown log format %s, expected text or json", logFormat)
+	}
+	return nil
+}
+
+// logEntry is a line of the debug logs of --log-format json.
+type logEntry struct {
+	Time      time.Time `json:"time"`
+	RunID     string    `json:"run_id"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Duration  float64   `json:"duration_ms,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func writeLog(entry logEntry) {
+	entry.Time = time.Now().UTC()
+	entry.RunID = runID
+	content, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println(entry.Message)
+		return
+	}
+	fmt.Println(string(content))
+}
+
+// correlationOption returns the client option sending the id of the run, and
+// an id of each request made of it, with the requests to Vault, timing the
+// requests and logging them in debug mode.
+func correlationOption() vaultclient.Option {
+	return vaultclient.WithTransport(func(next http.RoundTripper) http.RoundTripper {
+		return &correlatingTransport{next: next}
+	})
+}
+
+type correlatingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *correlatingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	id := fmt.Sprintf("%s-%d", runID, atomic.AddUint64(&requestCount, 1))
+	r = r.Clone(r.Context())
+	r.Header.Set(runIDHeader, runID)
+	r.Header.Set(requestIDHeader, id)
+
+	r, trace := timings.begin(r)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	elapsed := time.Since(start)
+	timings.end(r, trace, elapsed)
+	if debug {
+		logRequest(id, r, resp, err, elapsed)
+	}
+	return resp, err
+}
+
+func logRequest(id string, r *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	status := 0
+	outcome := ""
+	if resp != nil {
+		status = resp.StatusCode
+		outcome = resp.Status
+	}
+	if err != nil {
+		outcome = err.Error()
+	}
+
+	if logFormat == logFormatJSON {
+		entry := logEntry{Message: "request", RequestID: id, Method: r.Method, Path: r.URL.RequestURI(), Status: status,
+			Duration: float64(elapsed.Microseconds()) / 1000}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		writeLog(entry)
+		return
+	}
+	log("Request", id, r.Method, r.URL.RequestURI()+":", outcome, "in", elapsed.String())
+}
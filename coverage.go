@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+func coverageCommand() *cli.Command {
+	auditLogs := cli.NewStringSlice()
+	top := 10
+
+	return &cli.Command{
+		Name:      "coverage",
+		Usage:     "Report the path stanzas of the policies of a local directory never used in Vault audit logs, and the requests only one policy allowed",
+		ArgsUsage: "[more audit logs...] <directory>",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "audit-log",
+				Usage:       "Vault audit log file, or glob pattern of files (can be repeated)",
+				Required:    true,
+				Destination: auditLogs,
+			},
+			&cli.IntFlag{
+				Name:        "top",
+				Usage:       "Number of solely granted paths to report per policy, 0 for all of them",
+				Value:       top,
+				Destination: &top,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			logs, directory, err := auditLogArgs(c, auditLogs.Value())
+			if err != nil {
+				return err
+			}
+
+			return reportCoverage(logs, directory, top)
+		},
+	}
+}
+
+func reportCoverage(auditLogs []string, directory string, top int) error {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+
+	usages, err := attributeUsage(policies, auditLogs)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range policies {
+		usage := usages.policies[p.name]
+
+		dead := []*policyPath{}
+		granting := 0
+		for i, path := range p.paths {
+			if isDeny(path) {
+				continue
+			}
+			granting++
+			if usage.stanzas[i].requests == 0 {
+				dead = append(dead, path)
+			}
+		}
+
+		fmt.Printf("%s: %d of %d paths used\n", p.name, granting-len(dead), granting)
+		for _, path := range dead {
+			fmt.Printf("    dead rule at line %d: %q\n", path.line, path.path)
+		}
+
+		printSoleGrants(usage, top)
+	}
+	return nil
+}
+
+// printSoleGrants prints the paths of the requests that only the policy
+// allowed, which would be denied without it.
+func printSoleGrants(usage *policyUsage, top int) {
+	paths := sortedCounts(usage.sole)
+	if len(paths) == 0 {
+		return
+	}
+
+	total := 0
+	for _, count := range usage.sole {
+		total += count
+	}
+	fmt.Printf("    sole grantor of %d requests:\n", total)
+
+	if top > 0 && len(paths) > top {
+		fmt.Printf("        (%d more paths)\n", len(paths)-top)
+		paths = paths[:top]
+	}
+	for _, path := range paths {
+		fmt.Printf("        %6d %s\n", usage.sole[path], path)
+	}
+}
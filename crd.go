@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// operatorGroup is the API group of the custom resources of the Vault Config
+// Operator.
+const operatorGroup = "redhatcop.redhat.io"
+
+// operatorVariablePattern matches the ${auth/<mount>/@accessor} the Vault
+// Config Operator replaces in the policies it writes, and Vault doesn't.
+var operatorVariablePattern = regexp.MustCompile(`\$\{[^}]*/@accessor\}`)
+
+// manifestPolicy is a policy found in a Kubernetes manifest or a bank-vaults
+// configuration.
+type manifestPolicy struct {
+	name    string
+	content string
+	// source is the file and document it comes from.
+	source string
+}
+
+func importCRDCommand() *cli.Command {
+	output := "."
+
+	return &cli.Command{
+		Name:      "crd",
+		Usage:     "Write the policies of bank-vaults externalConfig blocks and Vault Config Operator Policy resources found in the YAML files of a directory as .hcl files",
+		ArgsUsage: "manifests",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Directory to write the policy files to",
+				Value:       output,
+				Destination: &output,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("import crd requires a file or directory of manifests")
+			}
+
+			return importCRDs(dryRun, c.Args().First(), output)
+		},
+	}
+}
+
+func importCRDs(dryRun bool, manifests, output string) error {
+	policies, err := findManifestPolicies(manifests)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return fmt.Errorf("no policy found in %s", manifests)
+	}
+
+	if !dryRun {
+		err = os.MkdirAll(output, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	local := policyDirectory(output)
+	local.Filter = nil
+	for _, p := range policies {
+		if operatorVariablePattern.MatchString(p.content) {
+			fmt.Fprintf(os.Stderr, "Warning: policy %s of %s uses the accessors the operator replaces, like %s, which Vault takes literally\n",
+				p.name, p.source, operatorVariablePattern.FindString(p.content))
+		}
+
+		if dryRun {
+			fmt.Printf("Would have written policy %s of %s with content:\n", p.name, p.source)
+			fmt.Println(p.content)
+			continue
+		}
+
+		log("Writing policy", p.name, "of", p.source)
+		err = local.Put(p.name, p.content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findManifestPolicies returns the policies of the YAML files of manifests, a
+// file or a directory, sorted by name. A policy defined twice is an error.
+func findManifestPolicies(manifests string) ([]manifestPolicy, error) {
+	policies := []manifestPolicy{}
+	err := filepath.WalkDir(manifests, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		extension := filepath.Ext(file)
+		if entry.IsDir() || (extension != ".yaml" && extension != ".yml") {
+			return nil
+		}
+
+		found, err := readManifestPolicies(file)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, found...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(policies, func(i, j int) bool {
+		return policies[i].name < policies[j].name
+	})
+	for i := 1; i < len(policies); i++ {
+		if policies[i].name == policies[i-1].name {
+			return nil, fmt.Errorf("policy %s is defined in both %s and %s", policies[i].name, policies[i-1].source, policies[i].source)
+		}
+	}
+	return policies, nil
+}
+
+// readManifestPolicies returns the policies of the documents of a YAML file.
+// The files that aren't valid YAML, like Helm templates, are skipped with a
+// warning.
+func readManifestPolicies(file string) ([]manifestPolicy, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := []manifestPolicy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for n := 1; ; n++ {
+		document := map[string]interface{}{}
+		err = decoder.Decode(&document)
+		if errors.Is(err, io.EOF) {
+			return policies, nil
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s, which isn't valid YAML: %v\n", file, err)
+			return nil, nil
+		}
+
+		source := file
+		if n > 1 {
+			source = fmt.Sprintf("%s#%d", file, n)
+		}
+		found, err := documentPolicies(document, source)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, found...)
+	}
+}
+
+// documentPolicies returns the policies of a YAML document: a Policy resource
+// of the Vault Config Operator, a Vault resource of bank-vaults with the
+// policies of its externalConfig, or a bank-vaults configuration file.
+func documentPolicies(document map[string]interface{}, source string) ([]manifestPolicy, error) {
+	apiVersion, _ := document["apiVersion"].(string)
+	kind, _ := document["kind"].(string)
+	spec, _ := document["spec"].(map[string]interface{})
+
+	switch {
+	case strings.HasPrefix(apiVersion, operatorGroup+"/") && (kind == "Policy" || kind == "VaultPolicy"):
+		metadata, _ := document["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		content, _ := spec["policy"].(string)
+		if name == "" || content == "" {
+			return nil, fmt.Errorf("%s: %s without metadata.name or spec.policy", source, kind)
+		}
+		return []manifestPolicy{{name: name, content: content, source: source}}, nil
+
+	case kind == "Vault" && spec != nil:
+		externalConfig, _ := spec["externalConfig"].(map[string]interface{})
+		return bankVaultsPolicies(externalConfig["policies"], source)
+
+	case kind == "" && document["policies"] != nil:
+		return bankVaultsPolicies(document["policies"], source)
+	}
+	return nil, nil
+}
+
+// bankVaultsPolicies returns the policies of the policies list of a bank-vaults
+// configuration, whose items have a name and rules.
+func bankVaultsPolicies(list interface{}, source string) ([]manifestPolicy, error) {
+	items, _ := list.([]interface{})
+
+	policies := make([]manifestPolicy, 0, len(items))
+	for i, item := range items {
+		fields, _ := item.(map[string]interface{})
+		name, _ := fields["name"].(string)
+		rules, _ := fields["rules"].(string)
+		if name == "" || rules == "" {
+			return nil, fmt.Errorf("%s: policy %d of the bank-vaults configuration without name or rules", source, i+1)
+		}
+		policies = append(policies, manifestPolicy{name: name, content: rules, source: source})
+	}
+	return policies, nil
+}
+
+// kubernetesNamePattern matches the names Kubernetes accepts for most
+// resources, DNS subdomains.
+var kubernetesNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// operatorPolicy is a Policy resource of the Vault Config Operator, which
+// writes the policy of its name.
+type operatorPolicy struct {
+	APIVersion string                 `yaml:"apiVersion"`
+	Kind       string                 `yaml:"kind"`
+	Metadata   operatorPolicyMetadata `yaml:"metadata"`
+	Spec       operatorPolicySpec     `yaml:"spec"`
+}
+
+type operatorPolicyMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+type operatorPolicySpec struct {
+	Connection     *operatorConnection    `yaml:"connection,omitempty"`
+	Authentication operatorAuthentication `yaml:"authentication"`
+	Policy         string                 `yaml:"policy"`
+}
+
+// operatorConnection is the Vault the operator writes to, its own default
+// when not set.
+type operatorConnection struct {
+	Address string `yaml:"address"`
+}
+
+// operatorAuthentication is how the operator logs in to Vault, with the
+// Kubernetes auth method.
+type operatorAuthentication struct {
+	Path           string                  `yaml:"path"`
+	Role           string                  `yaml:"role"`
+	ServiceAccount *operatorServiceAccount `yaml:"serviceAccount,omitempty"`
+}
+
+type operatorServiceAccount struct {
+	Name string `yaml:"name"`
+}
+
+// crdExportOptions are the settings of the resources export crd writes.
+type crdExportOptions struct {
+	namespace      string
+	authPath       string
+	authRole       string
+	serviceAccount string
+	address        string
+}
+
+func exportCRDCommand() *cli.Command {
+	output := ""
+	options := crdExportOptions{authPath: "kubernetes"}
+
+	return &cli.Command{
+		Name:      "crd",
+		Usage:     "Export a Policy resource of the Vault Config Operator per policy of a local directory, to deploy them through the operator",
+		ArgsUsage: "directory",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Directory to write a <name>.yaml file per policy to, instead of all of them to the standard output",
+				Destination: &output,
+			},
+			&cli.StringFlag{
+				Name:        "namespace",
+				Usage:       "Kubernetes namespace of the resources",
+				Destination: &options.namespace,
+			},
+			&cli.StringFlag{
+				Name:        "auth-path",
+				Usage:       "Path of the Kubernetes auth method the operator logs in with",
+				Value:       options.authPath,
+				Destination: &options.authPath,
+			},
+			&cli.StringFlag{
+				Name:        "auth-role",
+				Usage:       "Role of the Kubernetes auth method the operator logs in with, allowed to write policies",
+				Required:    true,
+				Destination: &options.authRole,
+			},
+			&cli.StringFlag{
+				Name:        "service-account",
+				Usage:       "Service account the operator logs in as, the default one of the namespace when not set",
+				Destination: &options.serviceAccount,
+			},
+			&cli.StringFlag{
+				Name:        "vault-address",
+				Usage:       "Address of the Vault the operator writes to, its own default when not set",
+				Destination: &options.address,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("export crd requires a directory")
+			}
+
+			return exportCRDs(dryRun, c.Args().First(), output, options)
+		},
+	}
+}
+
+func exportCRDs(dryRun bool, directory, output string, options crdExportOptions) error {
+	source := substitutedStore{Store: policyDirectory(directory)}
+	names, err := source.List()
+	if err != nil {
+		return err
+	}
+
+	if output != "" && !dryRun {
+		err = os.MkdirAll(output, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	exported := 0
+	for _, name := range names {
+		if !kubernetesNamePattern.MatchString(name) || len(name) > 253 {
+			fmt.Fprintf(os.Stderr, "Warning: skipping policy %s, whose name isn't a valid Kubernetes name\n", name)
+			continue
+		}
+
+		content, err := source.Get(name)
+		if err != nil {
+			return fmt.Errorf("unable to get policy %s: %w", name, err)
+		}
+		resource, err := yaml.Marshal(newOperatorPolicy(name, content, options))
+		if err != nil {
+			return err
+		}
+
+		exported++
+
+		switch {
+		case output == "":
+			if exported > 1 {
+				fmt.Println("---")
+			}
+			fmt.Print(string(resource))
+		case dryRun:
+			fmt.Printf("Would have written %s with content:\n%s\n", filepath.Join(output, name+".yaml"), resource)
+		default:
+			file := filepath.Join(output, name+".yaml")
+			log("Writing", file)
+			err = os.WriteFile(file, resource, 0644)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newOperatorPolicy(name, content string, options crdExportOptions) operatorPolicy {
+	p := operatorPolicy{
+		APIVersion: operatorGroup + "/v1alpha1",
+		Kind:       "Policy",
+		Metadata:   operatorPolicyMetadata{Name: name, Namespace: options.namespace},
+		Spec: operatorPolicySpec{
+			Authentication: operatorAuthentication{Path: options.authPath, Role: options.authRole},
+			Policy:         content,
+		},
+	}
+	if options.serviceAccount != "" {
+		p.Spec.Authentication.ServiceAccount = &operatorServiceAccount{Name: options.serviceAccount}
+	}
+	if options.address != "" {
+		p.Spec.Connection = &operatorConnection{Address: options.address}
+	}
+	return p
+}
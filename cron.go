@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is one of the five fields of a cron expression, whose values run
+// from min to max, or are named.
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	// Sunday is both 0 and 7
+	{name: "day of week", min: 0, max: 7, names: weekdayNumbers()},
+}
+
+func weekdayNumbers() map[string]int {
+	numbers := make(map[string]int, len(weekdays))
+	for name, day := range weekdays {
+		numbers[name] = int(day)
+	}
+	return numbers
+}
+
+// cronSchedule is the minutes matched by a cron expression, like
+// "0 22 * * Sat,Sun". Each field is a set of bits, one per value.
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// As in cron, when both the day of the month and the day of the week are
+	// restricted, a day matching either matches.
+	anyDay     bool
+	anyWeekday bool
+}
+
+// parseCronWindow parses a window made of a cron expression, when the window
+// opens, "for" how long it stays open, and an optional time zone, the local
+// one if missing, like "0 22 * * Sat,Sun for 8h Europe/Paris".
+func parseCronWindow(text, expression, rest string) (*timeWindow, error) {
+	schedule, err := parseCron(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window %q: %w", text, err)
+	}
+	w := &timeWindow{text: text, cron: schedule, location: time.Local}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid window %q, expected a cron expression for a duration [time zone]", text)
+	}
+	w.duration, err = time.ParseDuration(fields[0])
+	if err != nil || w.duration < time.Minute {
+		return nil, fmt.Errorf("invalid window %q, expected a duration of at least a minute like 2h after for", text)
+	}
+	if len(fields) == 2 {
+		w.location, err = time.LoadLocation(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %w", text, err)
+		}
+	}
+	return w, nil
+}
+
+// parseCron parses a cron expression of five fields, minute, hour, day of
+// month, month and day of week, made of values, names, ranges, lists, * and
+// steps.
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("the cron expression %q has %d fields, expected minute, hour, day of month, month and day of week", expression, len(fields))
+	}
+
+	s := &cronSchedule{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	sets := []*uint64{&s.minutes, &s.hours, &s.days, &s.months, &s.weekdays}
+	for i, field := range cronFields {
+		set, err := field.parse(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		*sets[i] = set
+	}
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+	return s, nil
+}
+
+func (f cronField) parse(text string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(strings.ToLower(text), ",") {
+		values, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in the %s %s", f.name, part)
+			}
+			values, step = part[:i], n
+		}
+
+		first, last, err := f.bounds(values, step)
+		if err != nil {
+			return 0, err
+		}
+		for v := first; v <= last; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// bounds returns the first and last values of *, a value or a range. A value
+// with a step runs to the last value of the field.
+func (f cronField) bounds(text string, step int) (int, int, error) {
+	if text == "*" {
+		return f.min, f.max, nil
+	}
+
+	bounds := strings.SplitN(text, "-", 2)
+	first, err := f.value(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	last := first
+	switch {
+	case len(bounds) == 2:
+		last, err = f.value(bounds[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	case step > 1:
+		last = f.max
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("the %s range %s ends before it starts", f.name, text)
+	}
+	return first, last, nil
+}
+
+func (f cronField) value(text string) (int, error) {
+	if v, ok := f.names[text]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %s, expected a number from %d to %d", f.name, text, f.min, f.max)
+	}
+	return v, nil
+}
+
+// matches tells if the schedule matches the minute of t.
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !hasBit(s.minutes, t.Minute()) || !hasBit(s.hours, t.Hour()) || !hasBit(s.months, int(t.Month())) {
+		return false
+	}
+
+	day, weekday := hasBit(s.days, t.Day()), hasBit(s.weekdays, int(t.Weekday()))
+	if !s.anyDay && !s.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// startedWithin tells if the schedule matched a minute in the duration up to
+// t, that is if a window opening then is still open at t.
+func (s *cronSchedule) startedWithin(t time.Time, duration time.Duration) bool {
+	for start := t.Truncate(time.Minute); t.Sub(start) < duration; start = start.Add(-time.Minute) {
+		if s.matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasBit(set uint64, bit int) bool {
+	return set&(1<<bit) != 0
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// daemon checks a directory against Vault on a schedule, and reconciles them
+// on another one.
+type daemon struct {
+	client    *vaultApi.Client
+	directory string
+	checkOnly bool
+	// reconcileInterval is the least time between two reconciliations, and
+	// reconcileWindows when they may happen, at any time if empty.
+	reconcileInterval time.Duration
+	reconcileWindows  []*timeWindow
+	lastReconcile     time.Time
+	// limit refuses the reconciliations deleting more policies, unless nil.
+	limit *deletionLimit
+
+	mu            sync.Mutex
+	checks        int
+	failures      int
+	reconciles    int
+	drifted       int
+	lastCheckTime time.Time
+}
+
+func daemonCommand() *cli.Command {
+	interval := 10 * time.Minute
+	checkOnly := false
+	reconcileInterval := time.Duration(0)
+	reconcileWindows := cli.NewStringSlice()
+	metricsListen := ""
+	maxDeletions := "50%"
+	force := false
+
+	return &cli.Command{
+		Name:      "daemon",
+		Usage:     "Check on a schedule that Vault matches the policies of a local directory, calling the drift hooks when it doesn't, and restore them on another schedule",
+		ArgsUsage: "directory",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:        "interval",
+				Usage:       "Time between two checks",
+				Value:       interval,
+				Destination: &interval,
+			},
+			&cli.BoolFlag{
+				Name:        "check-only",
+				Usage:       "Never change Vault, only report the drift",
+				Destination: &checkOnly,
+			},
+			&cli.DurationFlag{
+				Name:        "reconcile-interval",
+				Usage:       "Least time between two restores of the drift, at every check if 0",
+				Destination: &reconcileInterval,
+			},
+			&cli.StringSliceFlag{
+				Name:        "reconcile-window",
+				Usage:       "Only restore the drift in this window, like \"Mon-Fri 09:00-17:00 Europe/Paris\" (can be repeated)",
+				Destination: reconcileWindows,
+			},
+			&cli.StringFlag{
+				Name:        "metrics-listen",
+				Usage:       "Address to serve Prometheus metrics of the checks on, under /metrics",
+				Destination: &metricsListen,
+			},
+			&cli.StringFlag{
+				Name:        "max-deletions",
+				Usage:       "Most policies a restore of the drift may delete, as a number or a percentage of the policies in Vault, above which it is refused unless forced",
+				Value:       maxDeletions,
+				Destination: &maxDeletions,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Usage:       "Restore the drift even if it deletes more policies than --max-deletions",
+				Destination: &force,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("daemon requires a directory")
+			}
+			if interval <= 0 {
+				return fmt.Errorf("--interval must be positive")
+			}
+
+			windows, err := parseTimeWindows(reconcileWindows.Value())
+			if err != nil {
+				return err
+			}
+			limit, err := newDeletionLimit(maxDeletions, force)
+			if err != nil {
+				return err
+			}
+
+			client, err := selectNewVault(dev)
+			if err != nil {
+				return err
+			}
+
+			d := &daemon{
+				client:            client,
+				directory:         c.Args().Slice()[0],
+				checkOnly:         checkOnly,
+				reconcileInterval: reconcileInterval,
+				reconcileWindows:  windows,
+				limit:             limit,
+			}
+			return d.run(interval, metricsListen)
+		},
+	}
+}
+
+func (d *daemon) run(interval time.Duration, metricsListen string) error {
+	if metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", d.metrics)
+		go func() {
+			fmt.Fprintln(os.Stderr, "Metrics server stopped:", http.ListenAndServe(metricsListen, mux))
+		}()
+		fmt.Printf("Serving the metrics on %s\n", metricsListen)
+	}
+
+	fmt.Printf("Checking %s every %s\n", d.directory, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := d.check(time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+		}
+		<-ticker.C
+	}
+}
+
+// check compares Vault with the directory, calls the drift hooks if they
+// differ, and restores the directory if it is time to.
+func (d *daemon) check(now time.Time) error {
+	changes, err := planRestore(d.client, d.directory)
+
+	d.mu.Lock()
+	d.checks++
+	d.lastCheckTime = now
+	if err != nil {
+		d.failures++
+	} else {
+		d.drifted = len(changes)
+	}
+	d.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("unable to check for drift: %w", err)
+	}
+	if len(changes) == 0 {
+		log("No drift")
+		return nil
+	}
+
+	fmt.Printf("%s: drift found, %s\n", now.Format(time.RFC3339), summarize(changes))
+	warnHooks(hookDrift, hookPayload{Directory: d.directory, Changes: newJSONChanges(changes)})
+
+	if !d.reconcileDue(now) {
+		return nil
+	}
+
+	// The policies changed both in Vault and in the directory since they
+	// were last synchronized are left for an operator to merge.
+	base := &baseSync{client: d.client, directory: d.directory, onConflict: conflictFail}
+	err = runHooks(dryRun, hookBeforePlan, hookPayload{Directory: d.directory})
+	if err == nil {
+		changes, err = base.resolve(changes)
+	}
+	if err == nil {
+		err = checkDeletions(d.client, changes, d.limit)
+	}
+	if err == nil {
+		err = applySyncChanges(changes, dryRun, base)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastReconcile = now
+	d.reconciles++
+	if err != nil {
+		return fmt.Errorf("unable to restore the drift: %w", err)
+	}
+	return nil
+}
+
+// reconcileDue tells if the drift may be restored now.
+func (d *daemon) reconcileDue(now time.Time) bool {
+	switch {
+	case d.checkOnly:
+		return false
+	case len(d.reconcileWindows) > 0 && !inAnyWindow(d.reconcileWindows, now):
+		log("Not restoring the drift outside of the reconcile windows")
+		return false
+	case d.reconcileInterval > 0 && !d.lastReconcile.IsZero() && now.Sub(d.lastReconcile) < d.reconcileInterval:
+		log("Not restoring the drift before", d.lastReconcile.Add(d.reconcileInterval).Format(time.RFC3339))
+		return false
+	}
+	return true
+}
+
+// metrics serves the counters of the checks in the Prometheus text format.
+func (d *daemon) metrics(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP vault_policies_checks_total Checks for drift made.\n# TYPE vault_policies_checks_total counter\nvault_policies_checks_total %d\n", d.checks)
+	fmt.Fprintf(w, "# HELP vault_policies_check_failures_total Checks for drift that failed.\n# TYPE vault_policies_check_failures_total counter\nvault_policies_check_failures_total %d\n", d.failures)
+	fmt.Fprintf(w, "# HELP vault_policies_drift_changes Changes restoring the directory would make at the last successful check.\n# TYPE vault_policies_drift_changes gauge\nvault_policies_drift_changes %d\n", d.drifted)
+	fmt.Fprintf(w, "# HELP vault_policies_reconciles_total Restores of the drift attempted.\n# TYPE vault_policies_reconciles_total counter\nvault_policies_reconciles_total %d\n", d.reconciles)
+	fmt.Fprintf(w, "# HELP vault_policies_last_check_timestamp_seconds Time of the last check.\n# TYPE vault_policies_last_check_timestamp_seconds gauge\nvault_policies_last_check_timestamp_seconds %d\n", d.lastCheckTime.Unix())
+}
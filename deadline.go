@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+)
+
+// deadlineExitCode is the exit code of the runs stopped by --deadline, so
+// that schedulers tell them from the failures.
+const deadlineExitCode = 3
+
+var (
+	// requestTimeout is how long each request to Vault may take, retries
+	// included, and deadline how long the run may take, without limit when
+	// zero.
+	requestTimeout time.Duration
+	deadline       time.Duration
+	// runDeadline is when the run stops, zero without --deadline.
+	runDeadline time.Time
+
+	// completed is what the run did, reported when it reaches its deadline.
+	completed   []string
+	completedMu sync.Mutex
+)
+
+// startDeadline starts the time the run has with --deadline.
+func startDeadline() {
+	if deadline > 0 {
+		runDeadline = time.Now().Add(deadline)
+	}
+}
+
+// deadlineOptions returns the client options of --request-timeout and
+// --deadline.
+func deadlineOptions() []vaultclient.Option {
+	options := []vaultclient.Option{}
+	if requestTimeout > 0 {
+		options = append(options, vaultclient.WithRequestTimeout(requestTimeout))
+	}
+	if !runDeadline.IsZero() {
+		options = append(options, vaultclient.WithDeadline(runDeadline))
+	}
+	return options
+}
+
+// complete records something the run did, like a policy written.
+func complete(format string, args ...interface{}) {
+	completedMu.Lock()
+	defer completedMu.Unlock()
+	completed = append(completed, fmt.Sprintf(format, args...))
+}
+
+// exitCode returns the exit code of a run that failed with err. When the run
+// reached its deadline, it also prints what it completed before.
+func exitCode(err error) int {
+	reached := !runDeadline.IsZero() && !time.Now().Before(runDeadline)
+	if !reached && !errors.Is(err, vaultclient.ErrDeadline) {
+		return 1
+	}
+
+	completedMu.Lock()
+	defer completedMu.Unlock()
+	if len(completed) == 0 {
+		fmt.Fprintf(os.Stderr, "Reached the deadline of %s before completing anything\n", deadline)
+	} else {
+		fmt.Fprintf(os.Stderr, "Reached the deadline of %s after completing:\n  %s\n", deadline, strings.Join(completed, "\n  "))
+	}
+	return deadlineExitCode
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// denyImpact is what a deny rule does to a rule granting something, when a
+// token has both policies.
+type denyImpact struct {
+	denyPolicy string
+	deny       *policyPath
+	policy     string
+	path       *policyPath
+	effect     string
+}
+
+const (
+	// overriddenEffect is a rule of the same path, merged with the deny.
+	overriddenEffect = "overridden"
+	// partlyOverriddenEffect is a broader rule, which the more specific deny
+	// overrides for the paths it matches.
+	partlyOverriddenEffect = "overridden under the deny"
+	// escapesEffect is a narrower rule, more specific than the deny, which
+	// still grants its paths.
+	escapesEffect = "not denied, more specific"
+)
+
+func denyImpactCommand() *cli.Command {
+	live := false
+	denyPolicies := cli.NewStringSlice()
+
+	return &cli.Command{
+		Name:      "deny-impact",
+		Usage:     "Report the rules of all the policies that the deny rules override, or that escape them, when a token has both",
+		ArgsUsage: "[directory]",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "policy",
+				Usage:       "Only look at the deny rules of this policy, like the ones being changed (can be repeated)",
+				Destination: denyPolicies,
+			},
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Look at the policies of the Vault server instead of a local directory",
+				Destination: &live,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 && !live {
+				return fmt.Errorf("deny-impact requires a directory or --live")
+			}
+
+			return reportDenyImpact(dev, live, c.Args().First(), denyPolicies.Value())
+		},
+	}
+}
+
+func reportDenyImpact(dev, live bool, directory string, denyPolicies []string) error {
+	policies, err := loadPoliciesFrom(dev, live, directory)
+	if err != nil {
+		return err
+	}
+	metadata := map[string]*policyMetadata{}
+	if !live {
+		metadata, err = loadDirectoryMetadata([]string{directory})
+		if err != nil {
+			return err
+		}
+	}
+
+	impacts := findDenyImpacts(policies, denyPolicies)
+	if len(impacts) == 0 {
+		fmt.Println("No deny rule applies to the rules of another path or policy")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DENY\tPOLICY\tOWNER\tPATH\tEFFECT")
+	for _, i := range impacts {
+		fmt.Fprintf(w, "%s:%d %s\t%s:%d\t%s\t%s\t%s\n", i.denyPolicy, i.deny.line, i.deny.path, i.policy, i.path.line,
+			reportOwner(policyMetadataOf(metadata, i.policy)), i.path.path, i.effect)
+	}
+	return w.Flush()
+}
+
+// findDenyImpacts returns, for the deny rules of the policies named in
+// denyPolicies, or of all of them if it is empty, the rules of every policy
+// they override or that escape them. Vault merges the stanzas of a path across
+// the policies of a token, a deny winning, and then applies the most specific
+// path matching a request.
+func findDenyImpacts(policies []*parsedPolicy, denyPolicies []string) []denyImpact {
+	selected := map[string]bool{}
+	for _, name := range denyPolicies {
+		selected[name] = true
+	}
+
+	impacts := []denyImpact{}
+	for _, dp := range policies {
+		if len(selected) > 0 && !selected[dp.name] {
+			continue
+		}
+		for _, deny := range dp.paths {
+			if !containsDeny(deny) {
+				continue
+			}
+			for _, p := range policies {
+				for _, path := range p.paths {
+					effect := denyEffect(deny, path)
+					// In the policy of the deny, a more specific deny carving out
+					// a broader rule is the point, and lint reports the escapes.
+					if effect == "" || (p == dp && effect != overriddenEffect) {
+						continue
+					}
+					impacts = append(impacts, denyImpact{denyPolicy: dp.name, deny: deny, policy: p.name, path: path, effect: effect})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(impacts, func(i, j int) bool {
+		if impacts[i].denyPolicy != impacts[j].denyPolicy {
+			return impacts[i].denyPolicy < impacts[j].denyPolicy
+		}
+		return impacts[i].policy < impacts[j].policy
+	})
+	return impacts
+}
+
+// denyEffect returns what the deny rule does to a rule granting something, or
+// "" if they don't share any path.
+func denyEffect(deny, path *policyPath) string {
+	if path == deny || containsDeny(path) || len(path.Capabilities) == 0 {
+		return ""
+	}
+
+	switch {
+	case path.path == deny.path:
+		return overriddenEffect
+	case coversPath(path.path, deny.path):
+		return partlyOverriddenEffect
+	case coversPath(deny.path, path.path):
+		return escapesEffect
+	}
+	return ""
+}
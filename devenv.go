@@ -0,0 +1,341 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	devEnvContainer = "vault-policies-dev"
+	devEnvStartup   = 30 * time.Second
+	vaultReleases   = "https://releases.hashicorp.com/vault"
+)
+
+// devEnvState is what dev-env up remembers for dev-env down.
+type devEnvState struct {
+	PID       int    `json:"pid,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+func devEnvCommand() *cli.Command {
+	binary := "vault"
+	download := ""
+	docker := false
+	image := "hashicorp/vault"
+
+	return &cli.Command{
+		Name:  "dev-env",
+		Usage: "Start and stop a local Vault dev server, the one the --dev flag uses",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "up",
+				Usage:     "Start a Vault dev server and upload the policies of a local directory to it",
+				ArgsUsage: "[directory]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "vault-binary",
+						Usage:       "Vault binary to run",
+						Value:       binary,
+						Destination: &binary,
+					},
+					&cli.StringFlag{
+						Name:        "download",
+						Usage:       "Version of Vault to download and run, like 1.15.6",
+						Destination: &download,
+					},
+					&cli.BoolFlag{
+						Name:        "docker",
+						Usage:       "Run Vault in a docker container",
+						Destination: &docker,
+					},
+					&cli.StringFlag{
+						Name:        "image",
+						Usage:       "Docker image to run with --docker",
+						Value:       image,
+						Destination: &image,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) > 1 {
+						return fmt.Errorf("dev-env up takes at most a directory")
+					}
+
+					if download != "" {
+						downloaded, err := downloadVault(download)
+						if err != nil {
+							return err
+						}
+						binary = downloaded
+					}
+					if docker {
+						binary = ""
+					}
+
+					return devEnvUp(dryRun, binary, image, c.Args().First())
+				},
+			},
+			{
+				Name:  "down",
+				Usage: "Stop the Vault dev server started by dev-env up",
+				Action: func(c *cli.Context) error {
+					return devEnvDown(dryRun)
+				},
+			},
+		},
+	}
+}
+
+// devEnvUp starts the dev server with binary, or in docker with image if
+// binary is empty, and uploads the policies of directory if set.
+func devEnvUp(dryRun bool, binary, image, directory string) error {
+	client, err := vaultclient.NewDev()
+	if err != nil {
+		return err
+	}
+	if _, err := client.Sys().Health(); err == nil {
+		return fmt.Errorf("a Vault server already answers on %s", vaultclient.DevAddress)
+	}
+
+	var cmd *exec.Cmd
+	if binary != "" {
+		cmd = exec.Command(binary, "server", "-dev",
+			"-dev-root-token-id="+vaultclient.DevToken,
+			"-dev-listen-address="+strings.TrimPrefix(vaultclient.DevAddress, "http://"))
+	} else {
+		cmd = exec.Command("docker", "run", "--detach", "--rm",
+			"--name", devEnvContainer,
+			"--publish", "127.0.0.1:8200:8200",
+			"--env", "VAULT_DEV_ROOT_TOKEN_ID="+vaultclient.DevToken,
+			image)
+	}
+
+	if dryRun {
+		fmt.Println("Would have run", strings.Join(cmd.Args, " "))
+		return nil
+	}
+
+	err = startDevEnv(cmd, binary == "")
+	if err != nil {
+		return err
+	}
+
+	err = waitForVault(devEnvStartup)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Vault dev server running on %s, use --dev to point the commands at it\n", vaultclient.DevAddress)
+
+	if directory == "" {
+		return nil
+	}
+	log("Seeding the dev server with", directory)
+	return uploadPolicies(true, false, conflictFail, []string{directory})
+}
+
+// startDevEnv starts the dev server and remembers how for dev-env down.
+func startDevEnv(cmd *exec.Cmd, docker bool) error {
+	stateFile, err := devEnvStateFile()
+	if err != nil {
+		return err
+	}
+
+	state := &devEnvState{}
+	if docker {
+		cmd.Stdout, cmd.Stderr = io.Discard, os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("unable to start the Vault container: %w", err)
+		}
+		state.Container = devEnvContainer
+	} else {
+		output, err := os.Create(strings.TrimSuffix(stateFile, ".json") + ".log")
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+
+		cmd.Stdout, cmd.Stderr = output, output
+		err = cmd.Start()
+		if err != nil {
+			return fmt.Errorf("unable to start Vault: %w", err)
+		}
+		state.PID = cmd.Process.Pid
+		log("Vault logs are in", output.Name())
+	}
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stateFile, content, 0644)
+}
+
+func devEnvDown(dryRun bool) error {
+	stateFile, err := devEnvStateFile()
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no Vault dev server started by dev-env up")
+	}
+	if err != nil {
+		return err
+	}
+
+	state := devEnvState{}
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", stateFile, err)
+	}
+
+	if dryRun {
+		fmt.Printf("Would have stopped the Vault dev server %+v\n", state)
+		return nil
+	}
+
+	if state.Container != "" {
+		err = exec.Command("docker", "stop", state.Container).Run()
+	} else {
+		var process *os.Process
+		process, err = os.FindProcess(state.PID)
+		if err == nil {
+			err = process.Kill()
+		}
+	}
+	if err != nil {
+		log("Unable to stop the Vault dev server:", err.Error())
+	}
+
+	fmt.Println("Vault dev server stopped")
+	return os.Remove(stateFile)
+}
+
+func waitForVault(timeout time.Duration) error {
+	client, err := vaultclient.NewDev()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		health, err := client.Sys().Health()
+		if err == nil && health.Initialized && !health.Sealed {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Vault dev server not ready after %s", timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// devEnvStateFile returns the file where dev-env up remembers what it started,
+// in the cache directory of the user.
+func devEnvStateFile() (string, error) {
+	directory, err := devEnvCache()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(directory, "dev-env.json"), nil
+}
+
+func devEnvCache() (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	directory := filepath.Join(cache, "vault-policies")
+	return directory, os.MkdirAll(directory, 0755)
+}
+
+// downloadVault downloads a version of Vault from the HashiCorp releases, once,
+// and returns the path to its binary after checking its checksum.
+func downloadVault(version string) (string, error) {
+	cache, err := devEnvCache()
+	if err != nil {
+		return "", err
+	}
+
+	binary := filepath.Join(cache, "vault-"+version)
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	if _, err := os.Stat(binary); err == nil {
+		return binary, nil
+	}
+
+	archive := fmt.Sprintf("vault_%s_%s_%s.zip", version, runtime.GOOS, runtime.GOARCH)
+	fmt.Println("Downloading", archive)
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	base := fmt.Sprintf("%s/%s/", vaultReleases, version)
+	sums, err := download(client, base+fmt.Sprintf("vault_%s_SHA256SUMS", version))
+	if err != nil {
+		return "", err
+	}
+	expected, err := findChecksum(sums, archive)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := download(client, base+archive)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != expected {
+		return "", fmt.Errorf("the checksum of %s doesn't match the release", archive)
+	}
+
+	return binary, extractVault(content, binary)
+}
+
+func extractVault(archive []byte, binary string) error {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range reader.File {
+		if f.Name != "vault" && f.Name != "vault.exe" {
+			continue
+		}
+
+		in, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(binary, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			os.Remove(binary)
+			return err
+		}
+		return out.Close()
+	}
+	return fmt.Errorf("no vault binary in the release archive")
+}
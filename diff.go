@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// lineDiff returns the lines of a unified-like diff going from before to
+// after: unchanged lines start with a space, removed ones with - and added
+// ones with +.
+func lineDiff(before, after string) []string {
+	a := splitLines(before)
+	b := splitLines(after)
+
+	// lengths[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+"+b[j])
+	}
+	return lines
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// policyDiff returns the differences between two contents of a policy, path
+// stanza by path stanza, or as a line diff with --text-diff or when one of
+// them doesn't parse.
+func policyDiff(before, after string) []string {
+	if !textDiff {
+		lines, err := semanticDiff(before, after)
+		if err == nil {
+			return lines
+		}
+		log("Showing a line diff:", err.Error())
+	}
+	return lineDiff(before, after)
+}
+
+// stanza is what a policy grants on a path, once its path stanzas are merged
+// the way Vault merges them.
+type stanza struct {
+	capabilities map[string]bool
+	// settings are the other fields of the stanzas, formatted.
+	settings map[string]string
+}
+
+// semanticDiff returns a line per path whose grants differ: +path for the new
+// ones, -path for the removed ones, and path with the capabilities and
+// settings added and removed for the others.
+func semanticDiff(before, after string) ([]string, error) {
+	a, err := policyStanzas(before)
+	if err != nil {
+		return nil, err
+	}
+	b, err := policyStanzas(after)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]bool{}
+	for path := range a {
+		paths[path] = true
+	}
+	for path := range b {
+		paths[path] = true
+	}
+
+	lines := []string{}
+	for _, path := range sortedKeys(paths) {
+		old, hadOld := a[path]
+		s, hasNew := b[path]
+		switch {
+		case !hadOld:
+			lines = append(lines, "+"+s.describe(path))
+		case !hasNew:
+			lines = append(lines, "-"+old.describe(path))
+		default:
+			delta := stanzaDelta(old, s)
+			if len(delta) > 0 {
+				lines = append(lines, fmt.Sprintf("path %q: %s", path, strings.Join(delta, ", ")))
+			}
+		}
+	}
+	return lines, nil
+}
+
+func policyStanzas(content string) (map[string]*stanza, error) {
+	if content == "" {
+		return map[string]*stanza{}, nil
+	}
+
+	p, err := parsePolicy("", content)
+	if err != nil {
+		return nil, err
+	}
+
+	stanzas := map[string]*stanza{}
+	for _, path := range p.paths {
+		s, ok := stanzas[path.path]
+		if !ok {
+			s = &stanza{capabilities: map[string]bool{}, settings: map[string]string{}}
+			stanzas[path.path] = s
+		}
+		for _, capability := range path.Capabilities {
+			s.capabilities[capability] = true
+		}
+		s.set("min_wrapping_ttl", path.MinWrappingTTL)
+		s.set("max_wrapping_ttl", path.MaxWrappingTTL)
+		s.set("allowed_parameters", path.AllowedParameters)
+		s.set("denied_parameters", path.DeniedParameters)
+		s.set("required_parameters", path.RequiredParameters)
+	}
+	return stanzas, nil
+}
+
+// set keeps a field of a path stanza, unless it is unset or empty.
+func (s *stanza) set(name string, value interface{}) {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || (v.Kind() == reflect.Map || v.Kind() == reflect.Slice) && v.Len() == 0 {
+		return
+	}
+	s.settings[name] = fmt.Sprint(value)
+}
+
+// describe returns the path of a stanza with its capabilities and settings.
+func (s *stanza) describe(path string) string {
+	description := sortedKeys(s.capabilities)
+	names := make([]string, 0, len(s.settings))
+	for name := range s.settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		description = append(description, name+"="+s.settings[name])
+	}
+	if len(description) == 0 {
+		return fmt.Sprintf("path %q", path)
+	}
+	return fmt.Sprintf("path %q: %s", path, strings.Join(description, ", "))
+}
+
+// stanzaDelta lists the capabilities and settings added to and removed from a
+// stanza.
+func stanzaDelta(old, s *stanza) []string {
+	delta := []string{}
+	for _, capability := range sortedKeys(s.capabilities) {
+		if !old.capabilities[capability] {
+			delta = append(delta, "+"+capability)
+		}
+	}
+	for _, capability := range sortedKeys(old.capabilities) {
+		if !s.capabilities[capability] {
+			delta = append(delta, "-"+capability)
+		}
+	}
+
+	names := map[string]bool{}
+	for name := range old.settings {
+		names[name] = true
+	}
+	for name := range s.settings {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		before, hadBefore := old.settings[name]
+		after, hasAfter := s.settings[name]
+		switch {
+		case !hadBefore:
+			delta = append(delta, "+"+name+"="+after)
+		case !hasAfter:
+			delta = append(delta, "-"+name+"="+before)
+		case before != after:
+			delta = append(delta, name+" "+before+" -> "+after)
+		}
+	}
+	return delta
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+func docsCommand() *cli.Command {
+	output := "docs"
+
+	return &cli.Command{
+		Name:  "docs",
+		Usage: "Generate a Markdown page per policy of a local directory, and an index",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Directory where the pages are written",
+				Value:       output,
+				Destination: &output,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("docs requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			return generateDocs(dryRun, directory, output)
+		},
+	}
+}
+
+func generateDocs(dryRun bool, directory, output string) error {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := loadDirectoryMetadata([]string{directory})
+	if err != nil {
+		return err
+	}
+
+	pages := map[string]string{"index.md": policyIndex(policies, metadata)}
+	for _, p := range policies {
+		pages[p.name+".md"] = policyPage(p, metadata[p.name])
+	}
+
+	if !dryRun {
+		err = os.MkdirAll(output, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(pages))
+	for name := range pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		file := filepath.Join(output, name)
+		if dryRun {
+			fmt.Printf("Would have written %s with content:\n%s\n", file, pages[name])
+			continue
+		}
+
+		log("Writing", file)
+		err = os.WriteFile(file, []byte(pages[name]), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	log("Generated the documentation of", fmt.Sprint(len(policies)), "policies in", output)
+	return nil
+}
+
+func policyIndex(policies []*parsedPolicy, metadata map[string]*policyMetadata) string {
+	var b strings.Builder
+	b.WriteString("# Policies\n\n")
+	b.WriteString("| Policy | Description | Owner | Tags |\n")
+	b.WriteString("| --- | --- | --- | --- |\n")
+	for _, p := range policies {
+		m := metadata[p.name]
+		if m == nil {
+			m = &policyMetadata{}
+		}
+		summary := strings.SplitN(policyDescription(p, m), "\n", 2)[0]
+		fmt.Fprintf(&b, "| [%s](%s.md) | %s | %s | %s |\n", p.name, p.name, markdownCell(summary),
+			markdownCell(m.Owner), markdownCell(strings.Join(m.Tags, ", ")))
+	}
+	return b.String()
+}
+
+// policyPage returns the page of a policy, with its metadata unless nil.
+func policyPage(p *parsedPolicy, m *policyMetadata) string {
+	if m == nil {
+		m = &policyMetadata{}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", p.name)
+	if description := policyDescription(p, m); description != "" {
+		b.WriteString(description + "\n\n")
+	}
+	if m.Owner != "" {
+		fmt.Fprintf(&b, "Owner: %s\n\n", m.Owner)
+	}
+	if len(m.Tags) > 0 {
+		fmt.Fprintf(&b, "Tags: %s\n\n", strings.Join(m.Tags, ", "))
+	}
+	if len(m.Links) > 0 {
+		b.WriteString("Links:\n")
+		for _, link := range m.Links {
+			fmt.Fprintf(&b, "- %s\n", link)
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("## Paths\n\n")
+	if len(p.paths) == 0 {
+		b.WriteString("This policy doesn't grant anything.\n\n")
+	} else {
+		b.WriteString("| Path | Capabilities | Parameters |\n")
+		b.WriteString("| --- | --- | --- |\n")
+		for _, path := range p.paths {
+			fmt.Fprintf(&b, "| `%s` | %s | %s |\n", markdownCell(path.path),
+				strings.Join(path.Capabilities, ", "), markdownCell(pathConstraints(path)))
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("## Referenced mounts\n\n")
+	for _, mount := range referencedMounts(p) {
+		fmt.Fprintf(&b, "- `%s`\n", mount)
+	}
+	return b.String()
+}
+
+// pathConstraints describes the parameter and wrapping constraints of a path.
+func pathConstraints(path *policyPath) string {
+	constraints := []string{}
+	if allowed := formatParameters(path.AllowedParameters); allowed != "" {
+		constraints = append(constraints, "allowed: "+allowed)
+	}
+	if denied := formatParameters(path.DeniedParameters); denied != "" {
+		constraints = append(constraints, "denied: "+denied)
+	}
+	if len(path.RequiredParameters) > 0 {
+		constraints = append(constraints, "required: "+strings.Join(path.RequiredParameters, " "))
+	}
+	if path.MinWrappingTTL != nil {
+		constraints = append(constraints, fmt.Sprintf("min wrapping TTL: %v", path.MinWrappingTTL))
+	}
+	if path.MaxWrappingTTL != nil {
+		constraints = append(constraints, fmt.Sprintf("max wrapping TTL: %v", path.MaxWrappingTTL))
+	}
+	return strings.Join(constraints, "; ")
+}
+
+// referencedMounts returns the mounts the paths of a policy are on, sorted.
+func referencedMounts(p *parsedPolicy) []string {
+	unique := map[string]bool{}
+	for _, path := range p.paths {
+		unique[mountName(path.path)+"/"] = true
+	}
+
+	mounts := make([]string, 0, len(unique))
+	for mount := range unique {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+	return mounts
+}
+
+// policyDescription returns the description of the metadata of a policy, or
+// else its leading comment.
+func policyDescription(p *parsedPolicy, m *policyMetadata) string {
+	if m.Description != "" {
+		return m.Description
+	}
+	return p.description
+}
+
+func markdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// duplicateGroup is a set of policies granting exactly the same thing.
+type duplicateGroup struct {
+	// identical is set when the files are the same byte for byte, and not only
+	// once the comments, the formatting and the order of the rules are ignored.
+	identical bool
+	names     []string
+}
+
+func duplicatesCommand() *cli.Command {
+	live := false
+
+	return &cli.Command{
+		Name:      "duplicates",
+		Usage:     "Find the policies with the same content under different names, which could be merged",
+		ArgsUsage: "[directory]",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Look at the policies of the Vault server instead of a local directory",
+				Destination: &live,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 && !live {
+				return fmt.Errorf("duplicates requires a directory or --live")
+			}
+
+			return reportDuplicates(dev, live, c.Args().First())
+		},
+	}
+}
+
+func reportDuplicates(dev, live bool, directory string) error {
+	policies, err := loadPoliciesFrom(dev, live, directory)
+	if err != nil {
+		return err
+	}
+
+	groups := findDuplicates(policies)
+	if len(groups) == 0 {
+		fmt.Printf("No duplicate among %d policies\n", len(policies))
+		return nil
+	}
+
+	redundant := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tCOUNT\tPOLICIES")
+	for _, g := range groups {
+		kind := "equivalent"
+		if g.identical {
+			kind = "identical"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", kind, len(g.names), strings.Join(g.names, ", "))
+		redundant += len(g.names) - 1
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d of %d policies duplicate another one\n", redundant, len(policies))
+	return nil
+}
+
+// findDuplicates groups the policies that grant the same capabilities with
+// the same constraints on the same paths, largest groups first.
+func findDuplicates(policies []*parsedPolicy) []duplicateGroup {
+	byRules := map[string][]*parsedPolicy{}
+	for _, p := range policies {
+		key := rulesDigest(p)
+		byRules[key] = append(byRules[key], p)
+	}
+
+	groups := []duplicateGroup{}
+	for _, same := range byRules {
+		if len(same) < 2 {
+			continue
+		}
+
+		g := duplicateGroup{identical: true}
+		for _, p := range same {
+			g.names = append(g.names, p.name)
+			if p.content != same[0].content {
+				g.identical = false
+			}
+		}
+		sort.Strings(g.names)
+		groups = append(groups, g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].names) != len(groups[j].names) {
+			return len(groups[i].names) > len(groups[j].names)
+		}
+		return groups[i].names[0] < groups[j].names[0]
+	})
+	return groups
+}
+
+// canonicalRule is a path stanza without what doesn't change what it grants:
+// its position, the order of its capabilities and of the parameter values.
+type canonicalRule struct {
+	Path               string              `json:"path"`
+	Capabilities       []string            `json:"capabilities,omitempty"`
+	MinWrappingTTL     string              `json:"min_wrapping_ttl,omitempty"`
+	MaxWrappingTTL     string              `json:"max_wrapping_ttl,omitempty"`
+	AllowedParameters  map[string][]string `json:"allowed_parameters,omitempty"`
+	DeniedParameters   map[string][]string `json:"denied_parameters,omitempty"`
+	RequiredParameters []string            `json:"required_parameters,omitempty"`
+	ControlGroup       *controlGroup       `json:"control_group,omitempty"`
+}
+
+func newCanonicalRule(path *policyPath) canonicalRule {
+	r := canonicalRule{
+		Path:               path.path,
+		Capabilities:       sortedUnique(path.Capabilities),
+		AllowedParameters:  canonicalParameters(path.AllowedParameters),
+		DeniedParameters:   canonicalParameters(path.DeniedParameters),
+		RequiredParameters: sortedUnique(path.RequiredParameters),
+		ControlGroup:       path.ControlGroup,
+	}
+	if path.MinWrappingTTL != nil {
+		r.MinWrappingTTL = fmt.Sprint(path.MinWrappingTTL)
+	}
+	if path.MaxWrappingTTL != nil {
+		r.MaxWrappingTTL = fmt.Sprint(path.MaxWrappingTTL)
+	}
+	return r
+}
+
+// canonicalRules returns the rules of a policy sorted by path.
+func canonicalRules(p *parsedPolicy) []canonicalRule {
+	rules := make([]canonicalRule, 0, len(p.paths))
+	for _, path := range p.paths {
+		rules = append(rules, newCanonicalRule(path))
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Path < rules[j].Path
+	})
+	return rules
+}
+
+// rulesDigest hashes the canonical rules of a policy, the same for policies
+// granting the same thing however they are written.
+func rulesDigest(p *parsedPolicy) string {
+	// Only strings and decoded HCL are marshaled, which can't fail.
+	content, _ := json.Marshal(canonicalRules(p))
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+func canonicalParameters(parameters map[string][]interface{}) map[string][]string {
+	if len(parameters) == 0 {
+		return nil
+	}
+
+	canonical := make(map[string][]string, len(parameters))
+	for name, values := range parameters {
+		strs := make([]string, 0, len(values))
+		for _, v := range values {
+			strs = append(strs, fmt.Sprint(v))
+		}
+		canonical[name] = sortedUnique(strs)
+	}
+	return canonical
+}
+
+// sortedUnique returns a sorted copy of values, without repetitions.
+func sortedUnique(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	unique := sorted[:1]
+	for _, v := range sorted[1:] {
+		if v != unique[len(unique)-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
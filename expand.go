@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// templateSegmentPattern matches the templates of a policy path, which depend
+// on the token and are expanded as if they could be anything.
+var templateSegmentPattern = regexp.MustCompile(`[^/]*\{\{[^}]*\}\}[^/]*`)
+
+// expansionMount is a secret engine or auth method a policy path can match.
+type expansionMount struct {
+	path string
+	kind string
+	m    mount
+}
+
+func expandCommand() *cli.Command {
+	live := false
+	kv := false
+	limit := 50
+
+	return &cli.Command{
+		Name:      "expand",
+		Usage:     "Show the mounts, and with --kv the secrets, that each path of a policy matches on the Vault server today",
+		ArgsUsage: "policy",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "kv",
+				Usage:       "List the secrets of the KV mounts the paths match too, which requires the list capability on them",
+				Destination: &kv,
+			},
+			&cli.IntFlag{
+				Name:        "limit",
+				Usage:       "Number of secrets to show per path, 0 for all of them",
+				Value:       limit,
+				Destination: &limit,
+			},
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Expand the policy of that name on the Vault server instead of a local file",
+				Destination: &live,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("expand requires a policy file, or a policy name with --live")
+			}
+
+			return expandPolicy(dev, live, kv, c.Args().First(), limit)
+		},
+	}
+}
+
+func expandPolicy(dev, live, kv bool, policy string, limit int) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+	p, err := readExpandedPolicy(client, live, policy)
+	if err != nil {
+		return err
+	}
+	mounts, err := listExpansionMounts(client)
+	if err != nil {
+		return err
+	}
+
+	secrets := map[string][]string{}
+	if kv {
+		secrets = listKVRequestPaths(client, p, mounts)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tCAPABILITIES\tMATCHES\tNOTE")
+	for _, path := range p.paths {
+		printExpansion(w, p, path, mounts, secrets, limit)
+	}
+	return w.Flush()
+}
+
+// readExpandedPolicy parses a policy file with its variables substituted, or
+// with live the policy of that name on the server.
+func readExpandedPolicy(client *vaultApi.Client, live bool, policy string) (*parsedPolicy, error) {
+	if live {
+		remote, err := remotePolicies(client, nil)
+		if err != nil {
+			return nil, err
+		}
+		content, err := remote.Get(policy)
+		if err != nil {
+			return nil, err
+		}
+		if content == "" {
+			return nil, fmt.Errorf("no policy %s on the server", policy)
+		}
+		return parsePolicy(policy, content)
+	}
+
+	content, err := os.ReadFile(policy)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := substituteVariables(string(content))
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicy(strings.TrimSuffix(filepath.Base(policy), ".hcl"), rendered)
+}
+
+// listExpansionMounts returns the secret engines and auth methods of the
+// server, sorted by path.
+func listExpansionMounts(client *vaultApi.Client) ([]expansionMount, error) {
+	log("Listing mounts from the Vault server")
+	mounts, err := client.Sys().ListMounts()
+	if err != nil {
+		return nil, err
+	}
+	auths, err := client.Sys().ListAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	all := map[string]expansionMount{}
+	for path, output := range mounts {
+		m := newMount(output)
+		kind := m.Type
+		if version := kvVersion(m); version == "2" {
+			kind += " v2"
+		}
+		all[path] = expansionMount{path: path, kind: kind, m: m}
+	}
+	for path, auth := range auths {
+		all["auth/"+path] = expansionMount{path: "auth/" + path, kind: auth.Type + " auth"}
+	}
+
+	paths := make([]string, 0, len(all))
+	for path := range all {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	sorted := make([]expansionMount, 0, len(paths))
+	for _, path := range paths {
+		sorted = append(sorted, all[path])
+	}
+	return sorted, nil
+}
+
+// listKVRequestPaths returns the request paths of the secrets of the KV mounts
+// by mount, only listing the folders some path of the policy can match. The
+// mounts that can't be listed are skipped with a warning.
+func listKVRequestPaths(client *vaultApi.Client, p *parsedPolicy, mounts []expansionMount) map[string][]string {
+	secrets := map[string][]string{}
+	for _, m := range mounts {
+		if kvVersion(m.m) == "" || !anyPathUnder(p, []string{m.path}) {
+			continue
+		}
+
+		log("Listing the secrets of", m.path)
+		paths := []string{}
+		err := walkKVFolder(client, m, "", p, &paths)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: unable to list the secrets of", m.path+":", err)
+			continue
+		}
+		secrets[m.path] = paths
+	}
+	return secrets
+}
+
+func walkKVFolder(client *vaultApi.Client, m expansionMount, folder string, p *parsedPolicy, paths *[]string) error {
+	list := m.path + folder
+	if kvVersion(m.m) == "2" {
+		list = m.path + "metadata/" + folder
+	}
+	keys, err := listKeys(client, list)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") {
+			*paths = append(*paths, kvRequestPaths(m, folder+key)...)
+			continue
+		}
+		if anyPathUnder(p, kvRequestPaths(m, folder+key)) {
+			err = walkKVFolder(client, m, folder+key, p, paths)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// kvRequestPaths returns the paths of the requests on a secret of a KV mount,
+// its data and metadata for version 2.
+func kvRequestPaths(m expansionMount, key string) []string {
+	if kvVersion(m.m) == "2" {
+		return []string{m.path + "data/" + key, m.path + "metadata/" + key}
+	}
+	return []string{m.path + key}
+}
+
+// anyPathUnder tells if a path of the policy can match a request under one of
+// the prefixes.
+func anyPathUnder(p *parsedPolicy, prefixes []string) bool {
+	for _, path := range p.paths {
+		for _, prefix := range prefixes {
+			if matchesUnder(expansionPattern(path.path), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesUnder tells if a policy path pattern can match a request path under
+// prefix, a path ending with a slash.
+func matchesUnder(pattern, prefix string) bool {
+	glob := strings.HasSuffix(pattern, "*")
+	patternSegments := strings.Split(strings.TrimSuffix(pattern, "*"), "/")
+	prefixSegments := strings.Split(strings.TrimSuffix(prefix, "/"), "/")
+
+	for i, segment := range patternSegments {
+		switch {
+		case i == len(prefixSegments):
+			// The rest of the pattern is under the prefix
+			return true
+		case glob && i == len(patternSegments)-1:
+			return strings.HasPrefix(prefixSegments[i], segment)
+		case segment != "+" && segment != prefixSegments[i]:
+			return false
+		}
+	}
+	return false
+}
+
+// expansionPattern returns a policy path with its templates replaced by +, as
+// they can match anything depending on the token.
+func expansionPattern(path string) string {
+	return templateSegmentPattern.ReplaceAllString(path, "+")
+}
+
+func printExpansion(w *tabwriter.Writer, p *parsedPolicy, path *policyPath, mounts []expansionMount, secrets map[string][]string, limit int) {
+	pattern := expansionPattern(path.path)
+	first := path.path
+	capabilities := strings.Join(path.Capabilities, ",")
+	row := func(matches, note string) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", first, capabilities, matches, note)
+		first, capabilities = "", ""
+	}
+	if pattern != path.path {
+		row("", "templated, expanded for any token")
+	}
+
+	found, shown := 0, 0
+	for _, m := range mounts {
+		if !matchesUnder(pattern, m.path) {
+			continue
+		}
+		found++
+		row(m.path, m.kind)
+
+		for _, requestPath := range secrets[m.path] {
+			if !matchPath(pattern, requestPath) {
+				continue
+			}
+			shown++
+			if limit > 0 && shown > limit {
+				continue
+			}
+			note := ""
+			if best := p.match(requestPath); best != nil && best.path != path.path {
+				note = fmt.Sprintf("%q applies, more specific", best.path)
+			}
+			row(requestPath, note)
+		}
+	}
+
+	if found == 0 {
+		row("-", "no mount matches")
+	}
+	if limit > 0 && shown > limit {
+		row(fmt.Sprintf("... %d more", shown-limit), "")
+	}
+}
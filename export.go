@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// matrixCapabilities are the capability columns of the capability matrix.
+var matrixCapabilities = []string{"create", "read", "update", "patch", "delete", "list", "sudo", "deny"}
+
+func exportCommand() *cli.Command {
+	output := ""
+	live := false
+
+	return &cli.Command{
+		Name:  "export",
+		Usage: "Export the policies in other formats",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "matrix",
+				Usage:     "Export a CSV matrix of the capabilities each policy grants on each path",
+				ArgsUsage: "[directory]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "output",
+						Aliases:     []string{"o"},
+						Usage:       "File to write the matrix to, instead of the standard output",
+						Destination: &output,
+					},
+					&cli.BoolFlag{
+						Name:        "live",
+						Usage:       "Export the policies of the Vault server instead of a local directory",
+						Destination: &live,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) != 1 && !live {
+						return fmt.Errorf("export matrix requires a directory or --live")
+					}
+
+					return exportMatrix(dev, live, c.Args().First(), output)
+				},
+			},
+			exportBundleCommand(),
+			exportCRDCommand(),
+		},
+	}
+}
+
+func exportMatrix(dev, live bool, directory, output string) error {
+	policies, err := loadPoliciesFrom(dev, live, directory)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		return writeMatrix(os.Stdout, policies)
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	err = writeMatrix(file, policies)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to write the matrix to %s: %w", output, err)
+	}
+	return file.Close()
+}
+
+// writeMatrix writes a CSV line per path of each policy, with a column per
+// capability marked with an X when granted, followed by the parameter
+// constraints of the path.
+func writeMatrix(w io.Writer, policies []*parsedPolicy) error {
+	out := csv.NewWriter(w)
+
+	header := append([]string{"policy", "path"}, matrixCapabilities...)
+	header = append(header, "allowed_parameters", "denied_parameters", "required_parameters")
+	err := out.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range policies {
+		for _, path := range p.paths {
+			granted := map[string]bool{}
+			for _, capability := range path.Capabilities {
+				granted[capability] = true
+			}
+
+			record := []string{p.name, path.path}
+			for _, capability := range matrixCapabilities {
+				mark := ""
+				if granted[capability] {
+					mark = "X"
+				}
+				record = append(record, mark)
+			}
+			record = append(record,
+				formatParameters(path.AllowedParameters),
+				formatParameters(path.DeniedParameters),
+				strings.Join(path.RequiredParameters, " "))
+
+			err = out.Write(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// formatParameters formats parameter constraints as name=value|value, or just
+// name when any value goes, sorted by name and separated by spaces.
+func formatParameters(parameters map[string][]interface{}) string {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		values := make([]string, 0, len(parameters[name]))
+		for _, value := range parameters[name] {
+			values = append(values, fmt.Sprint(value))
+		}
+		if len(values) == 0 {
+			formatted = append(formatted, name)
+			continue
+		}
+		formatted = append(formatted, name+"="+strings.Join(values, "|"))
+	}
+	return strings.Join(formatted, " ")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/hcl/hcl/printer"
+	"github.com/urfave/cli/v2"
+)
+
+func formatCommand() *cli.Command {
+	check := false
+
+	return &cli.Command{
+		Name:  "fmt",
+		Usage: "Rewrite the policy files of a local directory in the canonical HCL format",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "check",
+				Usage:       "List the files not in the canonical format and fail, instead of rewriting them",
+				Destination: &check,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("fmt requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			return formatPolicies(dryRun, check, directory)
+		},
+	}
+}
+
+func formatPolicies(dryRun, check bool, directory string) error {
+	unformatted := 0
+	err := walkDirectoryPolicyFiles(directory, func(file, policy string, content []byte) error {
+		formatted, err := formatPolicy(content)
+		if err != nil {
+			return fmt.Errorf("unable to format %s: %w", file, err)
+		}
+		if bytes.Equal(formatted, content) {
+			return nil
+		}
+
+		unformatted++
+		switch {
+		case check:
+			fmt.Println(file)
+			return nil
+		case dryRun:
+			fmt.Printf("Would have formatted %s\n", file)
+			return nil
+		}
+		log("Formatting", file)
+		// The file exists, and so keeps its permissions.
+		return os.WriteFile(file, formatted, 0644)
+	})
+	if err != nil {
+		return err
+	}
+
+	if check && unformatted > 0 {
+		return fmt.Errorf("%d files not formatted, run vault-policies fmt", unformatted)
+	}
+	return nil
+}
+
+// formatPolicy returns a policy in the canonical HCL format.
+func formatPolicy(content []byte) ([]byte, error) {
+	return printer.Format(content)
+}
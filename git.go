@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runGit runs git in directory and returns what it printed.
+func runGit(directory string, args ...string) (string, error) {
+	output, err := exec.Command("git", append([]string{"-C", directory}, args...)...).Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w", args[0], commandError(err))
+	}
+	return string(output), nil
+}
+
+// commitBackup commits the files of a backup changed in directory, with a
+// message telling where and when they were backed up from and what changed,
+// and pushes the commit if asked to.
+func commitBackup(directory, address string, push bool) error {
+	_, err := runGit(directory, "add", "--all", "--", ".")
+	if err != nil {
+		return err
+	}
+
+	status, err := runGit(directory, "status", "--porcelain", "--untracked-files=no", "--", ".")
+	if err != nil {
+		return err
+	}
+	summary, files := backupChanges(status)
+	if len(files) == 0 {
+		log("No change to commit")
+		return nil
+	}
+
+	message := fmt.Sprintf("Backup of the policies of %s\n\nBacked up at %s: %s.\n\n%s\n",
+		address, time.Now().UTC().Format(time.RFC3339), summary, strings.Join(files, "\n"))
+	// Only the files of the backup are committed, whatever else is staged.
+	_, err = runGit(directory, "commit", "--quiet", "--message", message, "--", ".")
+	if err != nil {
+		return err
+	}
+	log("Committed", summary)
+
+	if push {
+		_, err = runGit(directory, "push", "--quiet")
+		if err != nil {
+			return err
+		}
+		log("Pushed the backup")
+	}
+	return nil
+}
+
+// backupChanges summarizes the staged changes of git status --porcelain and
+// lists them, one per line.
+func backupChanges(status string) (string, []string) {
+	count := map[string]int{}
+	files := []string{}
+	for _, line := range strings.Split(status, "\n") {
+		if len(line) < 4 || line[0] == ' ' {
+			continue
+		}
+
+		action := actionUpdate
+		switch line[0] {
+		case 'A':
+			action = actionCreate
+		case 'D':
+			action = actionDelete
+		}
+		count[action]++
+		files = append(files, action+" "+line[3:])
+	}
+
+	return fmt.Sprintf("%d added, %d modified, %d deleted", count[actionCreate], count[actionUpdate], count[actionDelete]), files
+}
+
+// existingParent returns path, or its closest parent when it doesn't exist
+// yet.
+func existingParent(path string) string {
+	for {
+		_, err := os.Stat(path)
+		if !errors.Is(err, fs.ErrNotExist) || filepath.Dir(path) == path {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// commandError adds what a failed command printed to its error.
+func commandError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fynelabs/vault-policies/pkg/store"
+	"github.com/urfave/cli/v2"
+)
+
+func gitHookCommand() *cli.Command {
+	mountsDirectory := ""
+	refs := cli.NewStringSlice()
+	listen := ":8080"
+
+	mountsFlag := func() cli.Flag {
+		return &cli.StringFlag{
+			Name:        "mounts",
+			Usage:       "Directory holding a mounts backup, used to check the mounts referenced by the policies",
+			Destination: &mountsDirectory,
+		}
+	}
+	refsFlag := func() cli.Flag {
+		return &cli.StringSliceFlag{
+			Name:        "ref",
+			Usage:       "Only check the pushed refs matching this glob pattern, like refs/heads/main (can be repeated)",
+			Destination: refs,
+		}
+	}
+	newContext := func() (*lintContext, error) {
+		return newLintContext(false, false, mountsDirectory)
+	}
+
+	return &cli.Command{
+		Name:  "hook",
+		Usage: "Check policy changes from git hooks",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "pre-commit",
+				Usage:     "Check the format, the validity and the lint of the staged policy files, or of the files given by the pre-commit framework, and fail on any problem",
+				ArgsUsage: "[file...]",
+				Flags:     []cli.Flag{mountsFlag()},
+				Action: func(c *cli.Context) error {
+					ctx, err := newContext()
+					if err != nil {
+						return err
+					}
+
+					return preCommit(ctx, c.Args().Slice())
+				},
+			},
+			{
+				Name:  "pre-receive",
+				Usage: "Check the policy files changed by the refs pushed, read from the standard input as a git pre-receive hook, and reject the push on any problem",
+				Flags: []cli.Flag{mountsFlag(), refsFlag()},
+				Action: func(c *cli.Context) error {
+					ctx, err := newContext()
+					if err != nil {
+						return err
+					}
+
+					return preReceive(ctx, refs.Value(), os.Stdin)
+				},
+			},
+			{
+				Name:      "update",
+				Usage:     "Check the policy files changed by a pushed ref as a git update hook, and reject it on any problem",
+				ArgsUsage: "ref old new",
+				Flags:     []cli.Flag{mountsFlag(), refsFlag()},
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) != 3 {
+						return fmt.Errorf("update requires a ref, its old and its new revisions")
+					}
+					ctx, err := newContext()
+					if err != nil {
+						return err
+					}
+
+					args := c.Args().Slice()
+					return preReceive(ctx, refs.Value(), strings.NewReader(args[1]+" "+args[2]+" "+args[0]+"\n"))
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "Serve the checks of pre-receive over HTTP for hosted git, as POST /check of the changed files",
+				Flags: []cli.Flag{
+					mountsFlag(),
+					&cli.StringFlag{
+						Name:        "listen",
+						Usage:       "Address to listen on",
+						Value:       listen,
+						Destination: &listen,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					ctx, err := newContext()
+					if err != nil {
+						return err
+					}
+
+					return serveChecks(ctx, listen)
+				},
+			},
+		},
+	}
+}
+
+// preCommit checks the staged content of the policy files, or the content of
+// files when given.
+func preCommit(ctx *lintContext, files []string) error {
+	read := func(file string) ([]byte, error) {
+		return os.ReadFile(file)
+	}
+
+	if len(files) == 0 {
+		top, err := runGit(".", "rev-parse", "--show-toplevel")
+		if err != nil {
+			return err
+		}
+		top = strings.TrimSpace(top)
+
+		staged, err := runGit(top, "diff", "--cached", "--name-only", "-z", "--diff-filter=ACMR")
+		if err != nil {
+			return err
+		}
+		files = splitNull(staged)
+		read = func(file string) ([]byte, error) {
+			content, err := runGit(top, "show", ":"+file)
+			return []byte(content), err
+		}
+	}
+
+	findings, err := checkPolicyFiles(files, read, ctx)
+	if err != nil {
+		return err
+	}
+	return reportFindings(findings)
+}
+
+// preReceive checks the policy files changed by each ref of the lines of a
+// pre-receive hook, old revision, new revision and ref name, which match refs
+// if set. Deleted refs and files aren't checked.
+func preReceive(ctx *lintContext, refs []string, updates io.Reader) error {
+	problems := 0
+	scanner := bufio.NewScanner(updates)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return fmt.Errorf("expected an old revision, a new revision and a ref, got %q", scanner.Text())
+		}
+		old, revision, ref := fields[0], fields[1], fields[2]
+		if isZeroRevision(revision) || len(refs) > 0 && !matchesAny(refs, ref) {
+			continue
+		}
+
+		changed := []string{"diff", "--name-only", "-z", "--diff-filter=ACMR", old, revision}
+		if isZeroRevision(old) {
+			changed = []string{"ls-tree", "-r", "--name-only", "-z", revision}
+		}
+		files, err := runGit(".", changed...)
+		if err != nil {
+			return err
+		}
+
+		findings, err := checkPolicyFiles(splitNull(files), func(file string) ([]byte, error) {
+			content, err := runGit(".", "show", revision+":"+file)
+			return []byte(content), err
+		}, ctx)
+		if err != nil {
+			return err
+		}
+
+		if len(findings) > 0 {
+			fmt.Printf("Rejecting %s:\n", ref)
+			for _, f := range findings {
+				fmt.Println(f)
+			}
+		}
+		problems += len(findings)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found, push rejected", problems)
+	}
+	return nil
+}
+
+// checkRequest is the body of POST /check: the content of the changed files
+// by path.
+type checkRequest struct {
+	Files map[string]string `json:"files"`
+}
+
+type jsonFinding struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// serveChecks answers POST /check with the problems found in the policy files
+// of the request, with the status 422 when there are some.
+func serveChecks(ctx *lintContext, listen string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("/check requires POST"))
+			return
+		}
+
+		request := checkRequest{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(&request)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("unable to read the request: %w", err))
+			return
+		}
+
+		files := make([]string, 0, len(request.Files))
+		for file := range request.Files {
+			files = append(files, file)
+		}
+		findings, err := checkPolicyFiles(files, func(file string) ([]byte, error) {
+			return []byte(request.Files[file]), nil
+		}, ctx)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result := []jsonFinding{}
+		for _, f := range findings {
+			result = append(result, jsonFinding{File: f.file, Line: f.line, Rule: f.rule, Message: f.message})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(result) > 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"findings": result})
+	})
+
+	fmt.Printf("Serving the policy checks on %s\n", listen)
+	return http.ListenAndServe(listen, mux)
+}
+
+// checkPolicyFiles returns the problems of the .hcl files among files, sorted,
+// reading them with read.
+func checkPolicyFiles(files []string, read func(file string) ([]byte, error), ctx *lintContext) ([]finding, error) {
+	findings := []finding{}
+	for _, file := range files {
+		if filepath.Ext(file) != ".hcl" {
+			continue
+		}
+
+		content, err := read(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", file, err)
+		}
+		findings = append(findings, checkPolicyFile(file, store.NormalizeText(content), ctx)...)
+	}
+
+	sortFindings(findings)
+	return findings, nil
+}
+
+func reportFindings(findings []finding) error {
+	for _, f := range findings {
+		fmt.Println(f)
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("%d problems found", len(findings))
+	}
+	return nil
+}
+
+// checkPolicyFile returns the problems of format, validity and lint of a
+// policy file.
+func checkPolicyFile(file string, content []byte, ctx *lintContext) []finding {
+	policy := store.PolicyName(strings.TrimSuffix(filepath.Base(file), ".hcl"))
+
+	findings := lintPolicy(file, policy, content, ctx)
+	if len(findings) == 1 && findings[0].rule == "syntax" {
+		return findings
+	}
+
+	formatted, err := formatPolicy(content)
+	if err == nil && !bytes.Equal(formatted, content) {
+		findings = append(findings, finding{
+			file:    file,
+			policy:  policy,
+			line:    firstDifferentLine(string(content), string(formatted)),
+			rule:    "format",
+			message: "not in the canonical format, run vault-policies fmt",
+		})
+	}
+
+	p, err := parsePolicy(policy, string(content))
+	if err != nil {
+		return findings
+	}
+	for _, path := range p.paths {
+		for _, capability := range path.Capabilities {
+			if !validCapabilities[capability] {
+				findings = append(findings, finding{
+					file:    file,
+					policy:  policy,
+					line:    path.line,
+					rule:    "capabilities",
+					message: fmt.Sprintf("path %q uses the unknown capability %q", path.path, capability),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// firstDifferentLine returns the number of the first line that differs
+// between a and b.
+func firstDifferentLine(a, b string) int {
+	linesA, linesB := splitLines(a), splitLines(b)
+	for i := range linesA {
+		if i >= len(linesB) || linesA[i] != linesB[i] {
+			return i + 1
+		}
+	}
+	return len(linesA) + 1
+}
+
+// splitNull splits the output of a git command run with -z.
+func splitNull(output string) []string {
+	if output == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(output, "\x00"), "\x00")
+}
+
+// isZeroRevision tells if revision is the null object name git uses for
+// created and deleted refs.
+func isZeroRevision(revision string) bool {
+	return strings.Trim(revision, "0") == ""
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// graphNode is a policy, a path, a mount or an object holding policies.
+type graphNode struct {
+	id    string
+	kind  string
+	label string
+}
+
+type graphEdge struct {
+	from, to string
+	label    string
+}
+
+// policyGraph is a graph of the policies and what they are related to, with
+// its nodes in the order they were added.
+type policyGraph struct {
+	nodes []*graphNode
+	byKey map[string]*graphNode
+	edges []graphEdge
+}
+
+func newPolicyGraph() *policyGraph {
+	return &policyGraph{byKey: map[string]*graphNode{}}
+}
+
+// node returns the node of the given kind and label, adding it if needed.
+func (g *policyGraph) node(kind, label string) string {
+	key := kind + " " + label
+	if n, ok := g.byKey[key]; ok {
+		return n.id
+	}
+
+	n := &graphNode{id: fmt.Sprintf("n%d", len(g.nodes)+1), kind: kind, label: label}
+	g.nodes = append(g.nodes, n)
+	g.byKey[key] = n
+	return n.id
+}
+
+func (g *policyGraph) edge(from, to, label string) {
+	g.edges = append(g.edges, graphEdge{from: from, to: to, label: label})
+}
+
+func graphCommand() *cli.Command {
+	format := "dot"
+	output := ""
+	paths := false
+	live := false
+
+	return &cli.Command{
+		Name:  "graph",
+		Usage: "Draw the policies of a local directory, the mounts and paths they touch and what they are attached to, as DOT or Mermaid",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "Format of the graph, dot or mermaid",
+				Value:       format,
+				Destination: &format,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "File to write the graph to, instead of the standard output",
+				Destination: &output,
+			},
+			&cli.BoolFlag{
+				Name:        "paths",
+				Usage:       "Draw each path between the policies and their mounts",
+				Destination: &paths,
+			},
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Connect to Vault to draw the groups, entities and roles holding the policies",
+				Destination: &live,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("graph requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			return drawGraph(dev, live, paths, format, directory, output)
+		},
+	}
+}
+
+func drawGraph(dev, live, paths bool, format, directory, output string) error {
+	render := map[string]func(w io.Writer, g *policyGraph){
+		"dot":     renderDot,
+		"mermaid": renderMermaid,
+	}[format]
+	if render == nil {
+		return fmt.Errorf("unknown graph format %s, expected dot or mermaid", format)
+	}
+
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+
+	g := newPolicyGraph()
+	addPolicies(g, policies, paths)
+
+	holders, err := graphHolders(dev, live, directory)
+	if err != nil {
+		return err
+	}
+	for _, holder := range holders {
+		for _, policy := range holder.policies {
+			g.edge(g.node("holder", holder.name), g.node("policy", policy), "")
+		}
+	}
+
+	if output == "" {
+		render(os.Stdout, g)
+		return nil
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	render(file, g)
+	return file.Close()
+}
+
+// addPolicies adds the policies to the graph, linked to the mounts they touch
+// with the capabilities they grant, or to each of their paths.
+func addPolicies(g *policyGraph, policies []*parsedPolicy, paths bool) {
+	for _, p := range policies {
+		policy := g.node("policy", p.name)
+
+		capabilities := map[string]map[string]bool{}
+		mounts := []string{}
+		for _, path := range p.paths {
+			mount := mountName(path.path) + "/"
+			if paths {
+				node := g.node("path", path.path)
+				g.edge(policy, node, strings.Join(path.Capabilities, ", "))
+				g.edge(node, g.node("mount", mount), "")
+				continue
+			}
+
+			if capabilities[mount] == nil {
+				capabilities[mount] = map[string]bool{}
+				mounts = append(mounts, mount)
+			}
+			for _, capability := range path.Capabilities {
+				capabilities[mount][capability] = true
+			}
+		}
+
+		for _, mount := range mounts {
+			g.edge(policy, g.node("mount", mount), strings.Join(sortedKeys(capabilities[mount]), ", "))
+		}
+	}
+}
+
+// graphHolders returns what holds the policies: the groups of the attachments
+// file of the directory and, when connected, the objects of the server.
+func graphHolders(dev, live bool, directory string) ([]policyHolder, error) {
+	holders := []policyHolder{}
+
+	file := filepath.Join(directory, attachmentsFile)
+	if _, err := os.Stat(file); err == nil {
+		a, err := loadAttachments(file)
+		if err != nil {
+			return nil, err
+		}
+		groups := make([]string, 0, len(a.Groups))
+		for group := range a.Groups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			holders = append(holders, policyHolder{name: "group " + group, policies: a.Groups[group]})
+		}
+	}
+
+	if !live {
+		return holders, nil
+	}
+
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := policyHolders(client)
+	if err != nil {
+		return nil, err
+	}
+	return append(holders, remote...), nil
+}
+
+func renderDot(w io.Writer, g *policyGraph) {
+	shapes := map[string]string{"policy": "box", "path": "note", "mount": "cylinder", "holder": "ellipse"}
+
+	fmt.Fprintln(w, "digraph policies {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, n := range g.nodes {
+		fmt.Fprintf(w, "  %s [label=%q shape=%s];\n", n.id, n.label, shapes[n.kind])
+	}
+	for _, e := range g.edges {
+		if e.label == "" {
+			fmt.Fprintf(w, "  %s -> %s;\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(w, "  %s -> %s [label=%q];\n", e.from, e.to, e.label)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func renderMermaid(w io.Writer, g *policyGraph) {
+	shapes := map[string]string{"policy": "[%s]", "path": "[/%s/]", "mount": "[(%s)]", "holder": "([%s])"}
+
+	fmt.Fprintln(w, "graph LR")
+	for _, n := range g.nodes {
+		label := fmt.Sprintf("%q", strings.ReplaceAll(n.label, `"`, "#quot;"))
+		fmt.Fprintf(w, "  %s"+shapes[n.kind]+"\n", n.id, label)
+	}
+	for _, e := range g.edges {
+		if e.label == "" {
+			fmt.Fprintf(w, "  %s --> %s\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(w, "  %s -->|%s| %s\n", e.from, e.label, e.to)
+		}
+	}
+}
+
+// sortedKeys returns the keys of a set, sorted.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+)
+
+// headerFlags are the headers of --header, like "X-Identity: value".
+var headerFlags []string
+
+// headerOptions returns the client option adding the headers of the active
+// profile and of --header to every request, those of --header replacing
+// those of the profile with the same name.
+func headerOptions() ([]vaultclient.Option, error) {
+	headers := http.Header{}
+	if activeProfile != nil {
+		for name, value := range activeProfile.Headers {
+			headers.Set(name, value)
+		}
+	}
+
+	flags := http.Header{}
+	for _, header := range headerFlags {
+		name, value, found := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected 'Name: value'", header)
+		}
+		flags.Add(name, strings.TrimSpace(value))
+	}
+	for name, values := range flags {
+		headers[name] = values
+	}
+
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	return []vaultclient.Option{vaultclient.WithHeaders(headers)}, nil
+}
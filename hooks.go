@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The lifecycle points of a run where hooks are called.
+const (
+	hookBeforePlan  = "before_plan"
+	hookBeforeApply = "before_apply"
+	hookAfterChange = "after_change"
+	hookAfterCanary = "after_canary"
+	hookAfterRun    = "after_run"
+	hookDrift       = "drift"
+)
+
+// hookTimeout bounds how long a hook may run.
+const hookTimeout = time.Minute
+
+// hook is a program to run, or a webhook to call, with the JSON payload of an
+// event on its standard input or as body. A hook scoped to policy name
+// patterns is only called for the changes of matching policies.
+type hook struct {
+	Exec     []string          `yaml:"exec"`
+	Webhook  string            `yaml:"webhook"`
+	Policies []string          `yaml:"policies"`
+	Env      map[string]string `yaml:"env"`
+
+	env map[string]*template.Template
+}
+
+// hookEnvironment is what the env templates of a hook are executed with.
+type hookEnvironment struct {
+	Event  string
+	Kind   string
+	Name   string
+	Action string
+}
+
+// hooks are the hooks of each event, as declared in the file of --hooks.
+type hooks map[string][]hook
+
+type hookPayload struct {
+	Event     string       `json:"event"`
+	Directory string       `json:"directory,omitempty"`
+	Changes   []jsonChange `json:"changes,omitempty"`
+	Change    *jsonChange  `json:"change,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	ChangeRef string       `json:"change_ref,omitempty"`
+	RunID     string       `json:"run_id"`
+}
+
+var (
+	hooksFile   = ""
+	activeHooks = hooks{}
+)
+
+func loadHooks(file string) (hooks, error) {
+	if file == "" {
+		return hooks{}, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hooks{}
+	err = yaml.Unmarshal(content, &h)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+
+	events := make([]string, 0, len(h))
+	for event := range h {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+
+	for _, event := range events {
+		eventHooks := h[event]
+		switch event {
+		case hookBeforePlan, hookBeforeApply, hookAfterChange, hookAfterCanary, hookAfterRun, hookDrift:
+		default:
+			return nil, fmt.Errorf("unknown hook event %s in %s", event, file)
+		}
+
+		for i := range eventHooks {
+			err = eventHooks[i].validate(event)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s hook in %s: %w", event, file, err)
+			}
+		}
+	}
+	return h, nil
+}
+
+func (h *hook) validate(event string) error {
+	if (len(h.Exec) == 0) == (h.Webhook == "") {
+		return fmt.Errorf("it needs either exec or webhook")
+	}
+	if len(h.Policies) > 0 && event == hookBeforePlan {
+		return fmt.Errorf("nothing is planned yet to match its policies")
+	}
+	if len(h.Env) > 0 && len(h.Exec) == 0 {
+		return fmt.Errorf("only exec hooks have an environment")
+	}
+
+	for _, pattern := range h.Policies {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("bad policy pattern %s: %w", pattern, err)
+		}
+	}
+
+	h.env = map[string]*template.Template{}
+	for _, name := range sortedEnvNames(h.Env) {
+		t, err := template.New(name).Option("missingkey=error").Parse(h.Env[name])
+		if err != nil {
+			return fmt.Errorf("bad template for %s: %w", name, err)
+		}
+		h.env[name] = t
+	}
+	return nil
+}
+
+// runHooks calls the hooks of an event in order, and stops at the first one
+// that fails. Hooks are never called on a dry run.
+func runHooks(dryRun bool, event string, payload hookPayload) error {
+	if dryRun || len(activeHooks[event]) == 0 {
+		return nil
+	}
+
+	payload.Event = event
+	payload.ChangeRef = changeRef
+	payload.RunID = runID
+	for _, h := range activeHooks[event] {
+		scoped, ok := h.scope(payload)
+		if !ok {
+			continue
+		}
+
+		log("Running", event, "hook", h.String())
+		err := h.run(scoped)
+		if err != nil {
+			return fmt.Errorf("%s hook %s failed: %w", event, h, err)
+		}
+	}
+	return nil
+}
+
+// scope returns the payload with only the changes of the policies the hook
+// is scoped to, and false if there are none.
+func (h hook) scope(payload hookPayload) (hookPayload, bool) {
+	if len(h.Policies) == 0 {
+		return payload, true
+	}
+
+	if payload.Change != nil {
+		return payload, h.matches(*payload.Change)
+	}
+
+	changes := []jsonChange{}
+	for _, c := range payload.Changes {
+		if h.matches(c) {
+			changes = append(changes, c)
+		}
+	}
+	payload.Changes = changes
+	return payload, len(changes) > 0
+}
+
+func (h hook) matches(c jsonChange) bool {
+	if c.Kind != "policy" {
+		return false
+	}
+
+	return matchesAny(h.Policies, c.Name)
+}
+
+// warnHooks runs the hooks of an event after changes were made, when a
+// failing hook can't undo them anymore and is only reported.
+func warnHooks(event string, payload hookPayload) {
+	err := runHooks(false, event, payload)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+}
+
+func (h hook) run(payload hookPayload) error {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	if len(h.Exec) > 0 {
+		env, err := h.environment(payload)
+		if err != nil {
+			return err
+		}
+
+		cmd := exec.CommandContext(ctx, h.Exec[0], h.Exec[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdin = bytes.NewReader(content)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Webhook, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// environment returns the variables describing the event, and the change for
+// after_change, followed by the env templates of the hook.
+func (h hook) environment(payload hookPayload) ([]string, error) {
+	data := hookEnvironment{Event: payload.Event}
+	env := []string{"VAULT_POLICIES_EVENT=" + payload.Event, "VAULT_POLICIES_RUN_ID=" + payload.RunID}
+	if payload.ChangeRef != "" {
+		env = append(env, "VAULT_POLICIES_CHANGE_REF="+payload.ChangeRef)
+	}
+	if c := payload.Change; c != nil {
+		data.Kind, data.Name, data.Action = c.Kind, c.Name, c.Action
+		env = append(env,
+			"VAULT_POLICIES_KIND="+c.Kind,
+			"VAULT_POLICIES_NAME="+c.Name,
+			"VAULT_POLICIES_ACTION="+c.Action,
+			"VAULT_POLICIES_DIFF="+strings.Join(c.Diff, "\n"))
+	}
+
+	for _, name := range sortedTemplateNames(h.env) {
+		var value strings.Builder
+		err := h.env[name].Execute(&value, data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render %s: %w", name, err)
+		}
+		env = append(env, name+"="+value.String())
+	}
+	return env, nil
+}
+
+func sortedTemplateNames(templates map[string]*template.Template) []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedEnvNames(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h hook) String() string {
+	if len(h.Exec) > 0 {
+		return strings.Join(h.Exec, " ")
+	}
+	return h.Webhook
+}
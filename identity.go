@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// Groups are stored with the names of their members instead of their ids, as
+// ids are generated by each Vault server.
+var groupsResource = &resource{
+	name:  "groups",
+	kind:  "group",
+	path:  "identity/group/name",
+	read:  readGroup,
+	write: writeGroup,
+}
+
+var groupFields = []string{"type", "policies", "metadata", "member_entity_ids", "member_group_ids"}
+
+var entitiesResource = &resource{
+	name:   "entities",
+	kind:   "entity",
+	path:   "identity/entity/name",
+	fields: []string{"policies", "metadata", "disabled"},
+}
+
+func readGroup(client *vaultApi.Client, path string) (map[string]interface{}, error) {
+	data, err := readFields(client, path, groupFields)
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := identityNames(client, "identity/entity/id/", data["member_entity_ids"])
+	if err != nil {
+		return nil, err
+	}
+	groups, err := identityNames(client, "identity/group/id/", data["member_group_ids"])
+	if err != nil {
+		return nil, err
+	}
+
+	delete(data, "member_entity_ids")
+	delete(data, "member_group_ids")
+	data["member_entity_names"] = entities
+	data["member_group_names"] = groups
+
+	return pruneEmpty(data), nil
+}
+
+func writeGroup(client *vaultApi.Client, path string, data map[string]interface{}) error {
+	payload := make(map[string]interface{})
+	for field, value := range data {
+		payload[field] = value
+	}
+
+	entityIDs, err := identityIDs(client, "identity/entity/name/", data["member_entity_names"], false)
+	if err != nil {
+		return err
+	}
+	// Member groups might only be defined later in the directory, so they are
+	// created empty here and filled when their own file is restored.
+	groupIDs, err := identityIDs(client, "identity/group/name/", data["member_group_names"], true)
+	if err != nil {
+		return err
+	}
+
+	delete(payload, "member_entity_names")
+	delete(payload, "member_group_names")
+	payload["member_entity_ids"] = entityIDs
+	payload["member_group_ids"] = groupIDs
+
+	return writeData(client, path, payload)
+}
+
+// identityNames resolves a list of identity ids into the names they refer to.
+func identityNames(client *vaultApi.Client, prefix string, ids interface{}) ([]string, error) {
+	list, _ := ids.([]interface{})
+
+	names := []string{}
+	for _, id := range list {
+		secret, err := client.Logical().Read(prefix + fmt.Sprint(id))
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil || secret.Data == nil {
+			return nil, fmt.Errorf("unable to find %s%v", prefix, id)
+		}
+		names = append(names, fmt.Sprint(secret.Data["name"]))
+	}
+
+	// Vault doesn't keep the members in any order, sort them so that backups
+	// only change when the members do.
+	sort.Strings(names)
+	return names, nil
+}
+
+// identityIDs resolves a list of identity names into their ids, creating the
+// missing ones when create is set.
+func identityIDs(client *vaultApi.Client, prefix string, names interface{}, create bool) ([]string, error) {
+	list, _ := names.([]interface{})
+
+	ids := []string{}
+	for _, name := range list {
+		path := prefix + fmt.Sprint(name)
+
+		secret, err := client.Logical().Read(path)
+		if err != nil {
+			return nil, err
+		}
+		if (secret == nil || secret.Data == nil) && create {
+			log("Creating", path)
+			secret, err = client.Logical().Write(path, map[string]interface{}{})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if secret == nil || secret.Data == nil {
+			return nil, fmt.Errorf("unable to find %s", path)
+		}
+		ids = append(ids, fmt.Sprint(secret.Data["id"]))
+	}
+	return ids, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// kvPath is a path of a KV v1 or v2 mount, under which the tool keeps its
+// own entries.
+type kvPath struct {
+	client *vaultApi.Client
+	// data is where each entry is read and written, and list where the
+	// entries are listed and deleted.
+	data string
+	list string
+	v2   bool
+}
+
+func newKVPath(client *vaultApi.Client, path string) (*kvPath, error) {
+	mounts, err := client.Sys().ListMounts()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the mount of %s: %w", path, err)
+	}
+
+	path = strings.Trim(path, "/") + "/"
+	best := ""
+	for mountPath := range mounts {
+		if strings.HasPrefix(path, mountPath) && len(mountPath) > len(best) {
+			best = mountPath
+		}
+	}
+	if best == "" {
+		return nil, fmt.Errorf("no mount holds %s", path)
+	}
+
+	rest := strings.TrimPrefix(path, best)
+	switch kvVersion(newMount(mounts[best])) {
+	case "2":
+		return &kvPath{client: client, data: best + "data/" + rest, list: best + "metadata/" + rest, v2: true}, nil
+	case "1":
+		return &kvPath{client: client, data: path, list: path}, nil
+	}
+	return nil, fmt.Errorf("%s isn't on a KV mount", path)
+}
+
+// names returns the names of the entries, without the subdirectories.
+func (k *kvPath) names() ([]string, error) {
+	keys, err := listKeys(k.client, k.list)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/") {
+			names = append(names, key)
+		}
+	}
+	return names, nil
+}
+
+// read returns the data of an entry, nil if it doesn't exist, and its version
+// on a KV v2 mount.
+func (k *kvPath) read(name string) (map[string]interface{}, int, error) {
+	secret, err := k.client.Logical().Read(k.data + name)
+	if err != nil || secret == nil || secret.Data == nil {
+		return nil, 0, err
+	}
+	if !k.v2 {
+		return secret.Data, 0, nil
+	}
+
+	data, _ := secret.Data["data"].(map[string]interface{})
+	metadata, _ := secret.Data["metadata"].(map[string]interface{})
+	version, _ := metadata["version"].(json.Number)
+	n, _ := version.Int64()
+	return data, int(n), nil
+}
+
+// write creates or replaces an entry. On a KV v2 mount, with cas set to 0 or
+// more, it only does if the version of the entry is still cas, 0 for none.
+func (k *kvPath) write(name string, data map[string]interface{}, cas int) error {
+	if k.v2 {
+		body := map[string]interface{}{"data": data}
+		if cas >= 0 {
+			body["options"] = map[string]interface{}{"cas": cas}
+		}
+		data = body
+	}
+	_, err := k.client.Logical().Write(k.data+name, data)
+	return err
+}
+
+// delete removes an entry, with all its versions on a KV v2 mount.
+func (k *kvPath) delete(name string) error {
+	_, err := k.client.Logical().Delete(k.list + name)
+	return err
+}
+
+// kvData converts v into the data of a KV entry, through its JSON encoding.
+func kvData(v interface{}) (map[string]interface{}, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{}
+	err = json.Unmarshal(content, &data)
+	return data, err
+}
+
+// decodeKVData converts the data of a KV entry into v, through its JSON
+// encoding.
+func decodeKVData(data map[string]interface{}, v interface{}) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// finding is a problem reported by a lint rule.
+type finding struct {
+	file    string
+	policy  string
+	line    int
+	rule    string
+	message string
+	// fix, if set, is the rewrite of the policy file that solves the problem.
+	fix *pathFix
+}
+
+func (f finding) String() string {
+	location := f.policy
+	if f.file != "" {
+		location = f.file
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", location, f.line, f.rule, f.message)
+}
+
+// pathFix replaces the name of a path stanza of a policy file.
+type pathFix struct {
+	offset int
+	old    string
+	new    string
+}
+
+// lintContext is what the lint rules know about the target Vault server.
+type lintContext struct {
+	// mounts are the enabled secret engines, and the auth methods prefixed
+	// with auth/, by path, or nil if they are unknown.
+	mounts map[string]mount
+	// authMounts is set when the auth methods are part of mounts.
+	authMounts bool
+	// client is the Vault server checked with --live, nil otherwise.
+	client *vaultApi.Client
+	// groups caches the identity groups read from client, nil for those that
+	// don't exist.
+	groups map[string]*vaultApi.Secret
+
+	lintOptions
+}
+
+// lintOptions are the settings of the lint rules given on the command line.
+type lintOptions struct {
+	// noWrapping are the paths whose clients can't unwrap responses.
+	noWrapping []string
+	// maxSize and maxPaths are the limits of the policies, the default size
+	// when 0 and no limit of paths.
+	maxSize  int
+	maxPaths int
+}
+
+// mountPaths returns the paths of the known mounts, sorted.
+func (ctx *lintContext) mountPaths() []string {
+	paths := make([]string, 0, len(ctx.mounts))
+	for path := range ctx.mounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// mountOf returns the mount holding path, if there is one.
+func (ctx *lintContext) mountOf(path string) (string, mount, bool) {
+	best := ""
+	for mountPath := range ctx.mounts {
+		if strings.HasPrefix(path, mountPath) && len(mountPath) > len(best) {
+			best = mountPath
+		}
+	}
+	if best == "" {
+		return "", mount{}, false
+	}
+	return best, ctx.mounts[best], true
+}
+
+type lintRule func(p *parsedPolicy, ctx *lintContext) []finding
+
+var lintRules = []lintRule{
+	lintUnknownMounts,
+	lintKVPaths,
+	lintTemplates,
+	lintShadowed,
+	lintParameters,
+	lintControlGroups,
+	lintWrapping,
+	lintSize,
+	lintSecrets,
+}
+
+func lintCommand() *cli.Command {
+	mountsDirectory := ""
+	live := false
+	fix := false
+	noWrapping := cli.NewStringSlice()
+	options := lintOptions{maxSize: defaultMaxPolicySize}
+
+	return &cli.Command{
+		Name:  "lint",
+		Usage: "Check the policies of a local directory for common mistakes",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "mounts",
+				Usage:       "Directory holding a mounts backup, used to check the mounts referenced by the policies",
+				Destination: &mountsDirectory,
+			},
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Connect to Vault to check the mounts and the identity groups referenced by the policies",
+				Destination: &live,
+			},
+			&cli.BoolFlag{
+				Name:        "fix",
+				Usage:       "Rewrite the policy files to fix the problems that can be fixed automatically",
+				Destination: &fix,
+			},
+			&cli.StringSliceFlag{
+				Name:        "no-wrapping",
+				Usage:       "Path whose clients can't unwrap responses, like secret/data/ci/*, which the policies must not require wrapping on (can be repeated)",
+				Destination: noWrapping,
+			},
+			maxSizeFlag(&options.maxSize),
+			&cli.IntFlag{
+				Name:        "max-paths",
+				Usage:       "Number of paths a policy may have, 0 for no limit",
+				Destination: &options.maxPaths,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("lint requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			if options.maxSize < 1 {
+				return fmt.Errorf("--max-size must be at least 1, not %d", options.maxSize)
+			}
+
+			options.noWrapping = noWrapping.Value()
+			return lint(dev, dryRun, live, fix, mountsDirectory, directory, options)
+		},
+	}
+}
+
+func lint(dev, dryRun, live, fix bool, mountsDirectory, directory string, options lintOptions) error {
+	ctx, err := newLintContext(dev, live, mountsDirectory)
+	if err != nil {
+		return err
+	}
+	ctx.lintOptions = options
+
+	findings, err := lintPolicies(directory, ctx)
+	if err != nil {
+		return err
+	}
+
+	if fix {
+		findings, err = fixFindings(findings, dryRun)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range findings {
+		fmt.Println(f)
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("%d problems found", len(findings))
+	}
+
+	log("No problem found")
+	return nil
+}
+
+func newLintContext(dev, live bool, mountsDirectory string) (*lintContext, error) {
+	ctx := &lintContext{}
+
+	if live {
+		client, err := selectNewVault(dev)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx.mounts, err = liveMounts(client)
+		if err != nil {
+			return nil, err
+		}
+		ctx.authMounts = true
+		ctx.client = client
+		ctx.groups = map[string]*vaultApi.Secret{}
+	} else if mountsDirectory != "" {
+		// A mounts backup only holds the secret engines that can be managed,
+		// but the system ones are always there.
+		ctx.mounts = map[string]mount{"auth/token/": {Type: "token"}}
+		for path := range systemMounts {
+			ctx.mounts[path] = mount{Type: strings.TrimSuffix(path, "/")}
+		}
+		err := walkDirectoryMounts(secretEngines, mountsDirectory, func(path string, m mount) error {
+			ctx.mounts[path] = m
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ctx, nil
+}
+
+func lintPolicies(directory string, ctx *lintContext) ([]finding, error) {
+	findings := []finding{}
+
+	log("Walking directory", directory)
+	err := walkDirectoryPolicyFiles(directory, func(file, policy string, content []byte) error {
+		findings = append(findings, lintPolicy(file, policy, content, ctx)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortFindings(findings)
+	return findings, nil
+}
+
+// lintPolicy returns the problems the lint rules find in a policy file, or its
+// syntax error.
+func lintPolicy(file, policy string, content []byte, ctx *lintContext) []finding {
+	p, err := parsePolicy(policy, string(content))
+	if err != nil {
+		return []finding{{file: file, policy: policy, rule: "syntax", message: err.Error()}}
+	}
+
+	findings := []finding{}
+	for _, rule := range lintRules {
+		for _, f := range rule(p, ctx) {
+			f.file = file
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// sortFindings sorts findings by file and line.
+func sortFindings(findings []finding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].file != findings[j].file {
+			return findings[i].file < findings[j].file
+		}
+		return findings[i].line < findings[j].line
+	})
+}
+
+// fixFindings rewrites the policy files to apply the fixes of findings, and
+// returns the findings that couldn't be fixed.
+func fixFindings(findings []finding, dryRun bool) ([]finding, error) {
+	remaining := []finding{}
+	fixes := map[string][]finding{}
+	files := []string{}
+	for _, f := range findings {
+		if f.fix == nil {
+			remaining = append(remaining, f)
+			continue
+		}
+		if _, ok := fixes[f.file]; !ok {
+			files = append(files, f.file)
+		}
+		fixes[f.file] = append(fixes[f.file], f)
+	}
+
+	for _, file := range files {
+		unfixed, err := fixFile(file, fixes[file], dryRun)
+		if err != nil {
+			return nil, err
+		}
+		remaining = append(remaining, unfixed...)
+	}
+	return remaining, nil
+}
+
+func fixFile(file string, findings []finding, dryRun bool) ([]finding, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].fix.offset < findings[j].fix.offset
+	})
+
+	unfixed := []finding{}
+	fixed := []byte{}
+	start := 0
+	for _, f := range findings {
+		old := fmt.Sprintf("%q", f.fix.old)
+		end := f.fix.offset + len(old)
+		if f.fix.offset < start || end > len(content) || string(content[f.fix.offset:end]) != old {
+			unfixed = append(unfixed, f)
+			continue
+		}
+
+		fixed = append(fixed, content[start:f.fix.offset]...)
+		fixed = append(fixed, fmt.Sprintf("%q", f.fix.new)...)
+		start = end
+		if dryRun {
+			fmt.Println("Would have fixed", f)
+		} else {
+			fmt.Println("Fixed", f)
+		}
+	}
+	fixed = append(fixed, content[start:]...)
+
+	if dryRun || len(unfixed) == len(findings) {
+		return unfixed, nil
+	}
+
+	err = os.WriteFile(file, fixed, info.Mode().Perm())
+	if err != nil {
+		return nil, fmt.Errorf("unable to write the fixed policy %s: %w", file, err)
+	}
+	return unfixed, nil
+}
+
+func liveMounts(client *vaultApi.Client) (map[string]mount, error) {
+	mounts, err := client.Sys().ListMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	auths, err := client.Sys().ListAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]mount, len(mounts)+len(auths))
+	for path, output := range mounts {
+		result[path] = newMount(output)
+	}
+	for path, output := range auths {
+		result["auth/"+path] = newMount(output)
+	}
+	return result, nil
+}
+
+// lintUnknownMounts reports the paths that can't match any enabled mount,
+// usually because of a typo like secrets/ instead of secret/.
+func lintUnknownMounts(p *parsedPolicy, ctx *lintContext) []finding {
+	if ctx.mounts == nil {
+		return nil
+	}
+
+	findings := []finding{}
+	for _, path := range p.paths {
+		// Only the part before the first wildcard is known for sure
+		literal := path.path
+		if i := strings.IndexAny(literal, "*+"); i >= 0 {
+			literal = literal[:i]
+		}
+		if literal == "" || (!ctx.authMounts && strings.HasPrefix(literal, "auth/")) {
+			continue
+		}
+
+		paths := ctx.mountPaths()
+		if matchesMount(literal, paths) {
+			continue
+		}
+
+		message := fmt.Sprintf("path %q doesn't match any enabled mount", path.path)
+		if suggestion := closestMount(literal, paths); suggestion != "" {
+			message += fmt.Sprintf(", did you mean %s?", suggestion)
+		}
+		findings = append(findings, finding{
+			policy:  p.name,
+			line:    path.line,
+			rule:    "unknown-mount",
+			message: message,
+		})
+	}
+	return findings
+}
+
+// kvV2Prefixes are the first segments of the paths of a KV v2 mount.
+var kvV2Prefixes = map[string]bool{
+	"config":   true,
+	"data":     true,
+	"delete":   true,
+	"destroy":  true,
+	"metadata": true,
+	"subkeys":  true,
+	"undelete": true,
+}
+
+// lintKVPaths reports the paths addressing a KV v2 mount as if it were a KV
+// v1 one, which grant nothing as every KV v2 request goes through data/ or
+// metadata/, and the paths using data/ on a KV v1 mount.
+func lintKVPaths(p *parsedPolicy, ctx *lintContext) []finding {
+	findings := []finding{}
+	for _, path := range p.paths {
+		mountPath, m, ok := ctx.mountOf(path.path)
+		if !ok {
+			continue
+		}
+
+		rest := path.path[len(mountPath):]
+		segment := strings.SplitN(rest, "/", 2)[0]
+		if segment == "" || strings.ContainsAny(segment, "*+") {
+			continue
+		}
+
+		f := finding{policy: p.name, line: path.line}
+		switch kvVersion(m) {
+		case "2":
+			if kvV2Prefixes[segment] {
+				continue
+			}
+			f.rule = "kv-v2-path"
+			f.message = fmt.Sprintf("path %q is on the KV v2 mount %s but doesn't go through data/ or metadata/", path.path, mountPath)
+			f.fix = &pathFix{offset: path.offset, old: path.path, new: mountPath + "data/" + rest}
+		case "1":
+			if segment != "data" && segment != "metadata" {
+				continue
+			}
+			f.rule = "kv-v1-path"
+			f.message = fmt.Sprintf("path %q uses %s/ on the KV v1 mount %s, which has no such prefix", path.path, segment, mountPath)
+			if strings.HasPrefix(rest, "data/") {
+				f.fix = &pathFix{offset: path.offset, old: path.path, new: mountPath + strings.TrimPrefix(rest, "data/")}
+			}
+		default:
+			continue
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// kvVersion returns the version of a KV mount, or an empty string if m isn't
+// a KV mount.
+func kvVersion(m mount) string {
+	switch m.Type {
+	case "kv":
+		if m.Options["version"] == "2" {
+			return "2"
+		}
+		return "1"
+	case "generic":
+		return "1"
+	}
+	return ""
+}
+
+func matchesMount(literal string, mounts []string) bool {
+	for _, mount := range mounts {
+		if strings.HasPrefix(literal, mount) || strings.HasPrefix(mount, literal) || literal+"/" == mount {
+			return true
+		}
+	}
+	return false
+}
+
+// closestMount returns the mount whose name is the closest to the one in
+// literal, if it is close enough to be a typo.
+func closestMount(literal string, mounts []string) string {
+	segment := mountName(literal)
+
+	best, bestDistance := "", 3
+	for _, mount := range mounts {
+		distance := editDistance(segment, mountName(mount))
+		if distance < bestDistance {
+			best, bestDistance = mount, distance
+		}
+	}
+	return best
+}
+
+// mountName returns the first segment of path, or the first two for the auth
+// methods.
+func mountName(path string) string {
+	segments := strings.SplitN(path, "/", 3)
+	if segments[0] == "auth" && len(segments) > 1 {
+		return segments[0] + "/" + segments[1]
+	}
+	return segments[0]
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+var (
+	// lockPath is the KV entry locking Vault while a run changes it, no lock
+	// being taken when empty.
+	lockPath    = ""
+	lockTTL     = 30 * time.Minute
+	forceUnlock = false
+
+	// heldRunLock is the lock held by the apply running, if any.
+	heldRunLock *heldLock
+)
+
+// runLock is the KV entry of the run holding the lock.
+type runLock struct {
+	RunID    string    `json:"run_id"`
+	Owner    string    `json:"owner"`
+	Host     string    `json:"host"`
+	PID      int       `json:"pid"`
+	Command  string    `json:"command"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (l *runLock) String() string {
+	return fmt.Sprintf("held by run %s of %s on %s (pid %d) since %s, running %q, until %s", l.RunID, l.Owner, l.Host, l.PID,
+		l.Acquired.Format(time.RFC3339), l.Command, l.Expires.Format(time.RFC3339))
+}
+
+// acquireLock takes the lock of --lock-path, unless another run holds it and
+// it didn't expire, and returns the function releasing it. On a KV v2 mount,
+// two runs can't both take it, while on a KV v1 mount the last one wins. The
+// lock is renewed while the run holds it, so that long applies keep it, and
+// the changes stop once it is lost.
+func acquireLock(client *vaultApi.Client) (func(), error) {
+	if lockPath == "" {
+		return func() {}, nil
+	}
+	if client == nil {
+		return nil, fmt.Errorf("no Vault to take the lock %s in", lockPath)
+	}
+
+	kv, err := newKVPath(client, path.Dir(lockPath))
+	if err != nil {
+		return nil, fmt.Errorf("unable to take the lock %s: %w", lockPath, err)
+	}
+	name := path.Base(lockPath)
+
+	data, version, err := kv.read(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the lock %s: %w", lockPath, err)
+	}
+	if data != nil {
+		held := &runLock{}
+		err = decodeKVData(data, held)
+		switch {
+		case err != nil && !forceUnlock:
+			return nil, fmt.Errorf("invalid lock %s, remove it with --force-unlock: %w", lockPath, err)
+		case forceUnlock:
+			fmt.Fprintln(os.Stderr, "Warning: removing the lock", lockPath, held)
+		case time.Now().Before(held.Expires):
+			return nil, fmt.Errorf("another run holds the lock %s: %s, wait for it or use --force-unlock if it is stuck", lockPath, held)
+		}
+	}
+
+	h := &heldLock{kv: kv, name: name, lock: newRunLock(client), stop: make(chan struct{})}
+	data, err = kvData(h.lock)
+	if err != nil {
+		return nil, err
+	}
+	err = kv.write(name, data, version)
+	if err == nil {
+		err = h.check()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to take the lock %s, another run may have taken it: %w", lockPath, err)
+	}
+	log("Took the lock", lockPath)
+
+	heldRunLock = h
+	go h.renew(lockTTL / 3)
+	return h.release, nil
+}
+
+// heldLock is the lock taken by this run, and the version of its KV entry.
+type heldLock struct {
+	kv      *kvPath
+	name    string
+	lock    *runLock
+	stop    chan struct{}
+	mu      sync.Mutex
+	version int
+	// lost is why the lock was lost, by failing to renew it or because
+	// another run took it over.
+	lost     error
+	released bool
+}
+
+// lockLost returns why the lock of the apply running was lost, nil while it
+// holds it or when it took none.
+func lockLost() error {
+	h := heldRunLock
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lost
+}
+
+// check fails unless the lock is still held by this run, and updates its
+// version.
+func (h *heldLock) check() error {
+	data, version, err := h.kv.read(h.name)
+	if err != nil {
+		return err
+	}
+	current := &runLock{}
+	if data != nil {
+		err = decodeKVData(data, current)
+		if err != nil {
+			return err
+		}
+	}
+	if current.RunID != h.lock.RunID {
+		return fmt.Errorf("the lock is now held by run %q", current.RunID)
+	}
+	h.version = version
+	return nil
+}
+
+// write replaces the lock until expires, if its entry didn't change since it
+// was last checked. Only KV v2 mounts check it.
+func (h *heldLock) write(expires time.Time) error {
+	err := h.check()
+	if err != nil {
+		return err
+	}
+	h.lock.Expires = expires
+	data, err := kvData(h.lock)
+	if err != nil {
+		return err
+	}
+	return h.kv.write(h.name, data, h.version)
+}
+
+// renew pushes the expiry of the lock back every interval until released. It
+// gives up once renewing fails, the lock then being lost: another run may
+// take it when it expires.
+func (h *heldLock) renew(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		h.mu.Lock()
+		if h.released {
+			// Released while waiting for it
+			h.mu.Unlock()
+			return
+		}
+		err := h.write(time.Now().UTC().Add(lockTTL))
+		if err != nil {
+			h.lost = fmt.Errorf("lost the lock %s, unable to renew it: %w", lockPath, err)
+			fmt.Fprintln(os.Stderr, "Warning:", h.lost.Error()+", stopping before the next change")
+		} else {
+			log("Renewed the lock", lockPath)
+		}
+		h.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// release gives the lock up, unless another run took it over. On a KV v2
+// mount, the lock is marked expired with a check-and-set of its version
+// rather than deleted, so that a run taking it meanwhile keeps it.
+func (h *heldLock) release() {
+	close(h.stop)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.released = true
+	if heldRunLock == h {
+		heldRunLock = nil
+	}
+
+	var err error
+	if h.kv.v2 {
+		err = h.write(time.Now().UTC())
+	} else {
+		err = h.check()
+		if err == nil {
+			err = h.kv.delete(h.name)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: unable to release the lock", lockPath+":", err)
+	}
+}
+
+func newRunLock(client *vaultApi.Client) *runLock {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	now := time.Now().UTC()
+	return &runLock{
+		RunID:    runID,
+		Owner:    currentPrincipal(client),
+		Host:     host,
+		PID:      os.Getpid(),
+		Command:  strings.Join(os.Args, " "),
+		Acquired: now,
+		Expires:  now.Add(lockTTL),
+	}
+}
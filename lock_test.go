@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+func TestAcquireLock(t *testing.T) {
+	kv, client := newTestLockVault(t)
+
+	release, err := acquireLock(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held := kv.lock(t); held.RunID != "run-1" || !held.Expires.After(time.Now()) {
+		t.Fatalf("got lock %s, expected run-1 to hold it", held)
+	}
+
+	runID = "run-2"
+	_, err = acquireLock(client)
+	if err == nil || !strings.Contains(err.Error(), "another run holds the lock") {
+		t.Fatalf("got error %v taking the lock held, expected another run to hold it", err)
+	}
+
+	runID = "run-1"
+	release()
+	if held := kv.lock(t); held.RunID != "run-1" || held.Expires.After(time.Now()) {
+		t.Fatalf("got lock %s after its release, expected it expired", held)
+	}
+
+	runID = "run-2"
+	release, err = acquireLock(client)
+	if err != nil {
+		t.Fatalf("unable to take the lock released: %v", err)
+	}
+	release()
+}
+
+func TestRenewLock(t *testing.T) {
+	kv, client := newTestLockVault(t)
+	lockTTL = 300 * time.Millisecond
+
+	release, err := acquireLock(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	expires := kv.lock(t).Expires
+
+	time.Sleep(lockTTL)
+	if held := kv.lock(t); !held.Expires.After(expires) || kv.version() < 3 {
+		t.Errorf("got lock %s at version %d, expected it renewed after %s", held, kv.version(), expires)
+	}
+	if err := lockLost(); err != nil {
+		t.Errorf("lost the lock renewed: %v", err)
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	tests := []struct {
+		name string
+		lose func(kv *testLockVault)
+		err  string
+	}{
+		{
+			name: "taken over",
+			lose: func(kv *testLockVault) {
+				kv.put(map[string]interface{}{"run_id": "run-2", "expires": time.Now().Add(time.Hour)})
+			},
+			err: `the lock is now held by run "run-2"`,
+		},
+		{
+			name: "renewal failing",
+			lose: func(kv *testLockVault) {
+				kv.mu.Lock()
+				kv.failWrites = true
+				kv.mu.Unlock()
+			},
+			err: "unable to renew it",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kv, client := newTestLockVault(t)
+			lockTTL = 90 * time.Millisecond
+
+			release, err := acquireLock(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.lose(kv)
+			deadline := time.Now().Add(5 * time.Second)
+			for lockLost() == nil && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			written := false
+			applied, err := applyAll([]change{{action: actionCreate, kind: "policy", name: "app", apply: func() error {
+				written = true
+				return nil
+			}}})
+			if written || len(applied) != 0 || err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %d changes applied and error %v once the lock was lost, expected none and %q", len(applied), err, test.err)
+			}
+
+			held := kv.lock(t)
+			release()
+			if after := kv.lock(t); after.RunID != held.RunID || !after.Expires.Equal(held.Expires) {
+				t.Errorf("got lock %s after the release, expected %s left as it was", after, held)
+			}
+			if err := lockLost(); err != nil {
+				t.Errorf("got %v after the release, expected no lock held", err)
+			}
+		})
+	}
+}
+
+// testLockVault is a Vault with a KV v2 mount at secret/ holding a single
+// entry, the lock, whose writes check its version as Vault does.
+type testLockVault struct {
+	mu         sync.Mutex
+	data       map[string]interface{}
+	versions   int
+	failWrites bool
+}
+
+func newTestLockVault(t *testing.T) (*testLockVault, *vaultApi.Client) {
+	previousPath, previousTTL, previousRunID := lockPath, lockTTL, runID
+	t.Cleanup(func() {
+		lockPath, lockTTL, runID = previousPath, previousTTL, previousRunID
+	})
+	lockPath, runID = "secret/locks/apply", "run-1"
+
+	kv := &testLockVault{}
+	server := httptest.NewServer(kv)
+	t.Cleanup(server.Close)
+
+	client, err := vaultApi.NewClient(&vaultApi.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("root")
+	return kv, client
+}
+
+func (kv *testLockVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	switch {
+	case r.URL.Path == "/v1/sys/mounts":
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"secret/": map[string]interface{}{"type": "kv", "options": map[string]interface{}{"version": "2"}},
+		}})
+	case r.URL.Path == "/v1/secret/data/locks/apply" && r.Method == http.MethodGet:
+		if kv.data == nil {
+			reply(http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"data":     kv.data,
+			"metadata": map[string]interface{}{"version": kv.versions},
+		}})
+	case r.URL.Path == "/v1/secret/data/locks/apply":
+		body := struct {
+			Data    map[string]interface{} `json:"data"`
+			Options struct {
+				CAS *int `json:"cas"`
+			} `json:"options"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case err != nil || kv.failWrites:
+			reply(http.StatusInternalServerError, map[string]interface{}{"errors": []string{"unable to write"}})
+		case body.Options.CAS != nil && *body.Options.CAS != kv.versions:
+			reply(http.StatusBadRequest, map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+		default:
+			kv.data = body.Data
+			kv.versions++
+			reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"version": kv.versions}})
+		}
+	case r.URL.Path == "/v1/secret/metadata/locks/apply" && r.Method == http.MethodDelete:
+		kv.data = nil
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		reply(http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+// put writes the lock as another run would.
+func (kv *testLockVault) put(data map[string]interface{}) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.data = data
+	kv.versions++
+}
+
+func (kv *testLockVault) lock(t *testing.T) *runLock {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	held := &runLock{}
+	err := decodeKVData(kv.data, held)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return held
+}
+
+func (kv *testLockVault) version() int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.versions
+}
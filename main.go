@@ -3,22 +3,53 @@ package main
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
-
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/policysync"
+	"github.com/fynelabs/vault-policies/pkg/store"
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
 	vaultApi "github.com/hashicorp/vault/api"
 	"github.com/urfave/cli/v2"
 )
 
-var debug = false
+// Policies that Vault creates itself and refuses to delete.
+var builtinPolicies = policysync.Builtin
+
+var (
+	debug  = false
+	dev    = false
+	dryRun = false
+
+	textDiff = false
+
+	maxPolicySize  int64 = store.DefaultMaxSize
+	followSymlinks       = false
+)
 
 func main() {
-	dev := false
-	dryRun := false
+	normalizeBackup := false
+	fileMode := "0600"
+	dirMode := "0700"
+	layout := layoutFlat
+	separator := "-"
+	gitCommit := false
+	gitPush := false
+	only := cli.NewStringSlice()
+	maxDeletions := "50%"
+	force := false
+	onConflict := conflictFail
+	interactive := false
 
 	app := &cli.App{
-		Name:        "vault-policies",
-		Usage:       "An helper to keep vault policies in sync with your code.",
-		Description: "vault-policies is a tool to keep your vault policies synchronized with your code and easier to integrate in your release process.",
+		Name:                 "vault-policies",
+		Usage:                "An helper to keep vault policies in sync with your code.",
+		Description:          "vault-policies is a tool to keep your vault policies synchronized with your code and easier to integrate in your release process.",
+		EnableBashCompletion: true,
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:        "dev",
@@ -35,11 +66,246 @@ func main() {
 				Usage:       "Enable debug mode",
 				Destination: &debug,
 			},
+			&cli.StringFlag{
+				Name:        "log-format",
+				Usage:       "Format of the debug logs: text, or json with the id of the run and of each request to Vault",
+				Value:       logFormat,
+				Destination: &logFormat,
+			},
+			&cli.StringFlag{
+				Name:        "timings",
+				Usage:       "Report the durations of the requests to Vault by operation at the end of the run, as text or json, on stderr",
+				Destination: &timingsFormat,
+			},
+			&cli.BoolFlag{
+				Name:        "text-diff",
+				Usage:       "Show the changes of policies as line diffs instead of the capabilities and settings changed on each path",
+				Destination: &textDiff,
+			},
+			&cli.Int64Flag{
+				Name:        "max-policy-size",
+				Usage:       "Size in bytes above which a policy file is an error rather than read",
+				Value:       maxPolicySize,
+				Destination: &maxPolicySize,
+			},
+			&cli.BoolFlag{
+				Name:        "follow-symlinks",
+				Usage:       "Follow the symbolic links of policy directories, which are otherwise skipped",
+				Destination: &followSymlinks,
+			},
+			&cli.StringFlag{
+				Name:        "proxy",
+				Usage:       "URL of the HTTP, HTTPS or SOCKS5 proxy to reach Vault through, instead of the one of HTTP_PROXY, HTTPS_PROXY and NO_PROXY",
+				Destination: &proxy,
+			},
+			&cli.StringSliceFlag{
+				Name:  "header",
+				Usage: "Header added to every request to Vault, like 'X-Identity: value' (can be repeated)",
+			},
+			&cli.DurationFlag{
+				Name:        "request-timeout",
+				Usage:       "How long each request to Vault may take, retries included, like 30s (default: 60s, or VAULT_CLIENT_TIMEOUT)",
+				Destination: &requestTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "throttle",
+				Usage:       "Most calls changing Vault per period, like 5/s or 100/m, spaced evenly so that large restores don't load its storage and audit devices (default: the throttle of the profile)",
+				Destination: &throttleFlag,
+			},
+			&cli.StringFlag{
+				Name:        "on-secondary",
+				Usage:       "What to do when Vault is a performance or DR replication secondary: refuse to change its policies, or primary to read and write them on its primary",
+				Value:       onSecondary,
+				Destination: &onSecondary,
+			},
+			&cli.DurationFlag{
+				Name:        "deadline",
+				Usage:       "How long the run may take, like 10m, after which it stops, reports what it completed and exits with code 3",
+				Destination: &deadline,
+			},
+			&cli.StringFlag{
+				Name:        "ca-cert",
+				Usage:       "PEM file of the CA certificates to verify Vault with, instead of VAULT_CACERT",
+				Destination: &tlsFlags.CACert,
+			},
+			&cli.StringFlag{
+				Name:        "ca-path",
+				Usage:       "Directory of PEM files of the CA certificates to verify Vault with, instead of VAULT_CAPATH",
+				Destination: &tlsFlags.CAPath,
+			},
+			&cli.StringFlag{
+				Name:        "client-cert",
+				Usage:       "PEM file of the certificate to authenticate to Vault with, instead of VAULT_CLIENT_CERT",
+				Destination: &tlsFlags.ClientCert,
+			},
+			&cli.StringFlag{
+				Name:        "client-key",
+				Usage:       "PEM file of the private key of --client-cert, instead of VAULT_CLIENT_KEY",
+				Destination: &tlsFlags.ClientKey,
+			},
+			&cli.StringFlag{
+				Name:        "tls-server-name",
+				Usage:       "Name expected in the certificate of Vault and sent with SNI, instead of VAULT_TLS_SERVER_NAME",
+				Destination: &tlsFlags.ServerName,
+			},
+			&cli.BoolFlag{
+				Name:        "tls-skip-verify",
+				Usage:       "Don't verify the certificate of Vault, like VAULT_SKIP_VERIFY, for tests only",
+				Destination: &tlsFlags.SkipVerify,
+			},
+			&cli.StringFlag{
+				Name:        "tls-min-version",
+				Usage:       "Lowest TLS version accepted from Vault: 1.2 or 1.3",
+				Destination: &tlsFlags.MinVersion,
+			},
+			&cli.StringFlag{
+				Name:        "record",
+				Usage:       "Record the requests to Vault and their responses, without the token, in a cassette file",
+				Destination: &recordFile,
+			},
+			&cli.StringFlag{
+				Name:        "replay",
+				Usage:       "Answer the requests to Vault from a cassette file recorded with --record, without network access or credentials",
+				Destination: &replayFile,
+			},
+			&cli.StringFlag{
+				Name:        "hooks",
+				Usage:       "YAML file declaring the programs and webhooks to call before planning, before applying, after each change and after a run",
+				Destination: &hooksFile,
+			},
+			&cli.StringFlag{
+				Name:        "change-ref",
+				Usage:       "Change ticket the changes are made for, passed to the hooks and stamped in a comment at the top of the policies written",
+				Destination: &changeRef,
+			},
+			&cli.StringFlag{
+				Name:        "run-id",
+				Usage:       "Id of the run, recorded in the audit trail and passed to the hooks, generated when not set",
+				Destination: &runID,
+			},
+			&cli.StringFlag{
+				Name:        "audit-trail",
+				Usage:       "File to append every change made to Vault to, each entry holding the hash of the previous one so that the file can be checked with verify-audit",
+				Destination: &auditTrailFile,
+			},
+			&cli.StringFlag{
+				Name:        "profiles",
+				Usage:       "YAML file declaring the Vault servers the commands can target, and how their changes are approved",
+				Destination: &profilesFile,
+			},
+			&cli.StringFlag{
+				Name:        "profile",
+				Usage:       "Profile of the file of --profiles to target",
+				Destination: &profileName,
+			},
+			&cli.BoolFlag{
+				Name:        "yes",
+				Usage:       "Confirm the changes to the Vault of a prod profile, and those of apply-bundle without asking",
+				Destination: &confirmed,
+			},
+			&cli.StringFlag{
+				Name:        "lock-path",
+				Usage:       "KV path of the lock taken while changing Vault, so that two runs don't interleave their changes, like secret/vault-policies/lock",
+				Destination: &lockPath,
+			},
+			&cli.DurationFlag{
+				Name:        "lock-ttl",
+				Usage:       "How long the lock of a run that didn't release it holds",
+				Value:       lockTTL,
+				Destination: &lockTTL,
+			},
+			&cli.BoolFlag{
+				Name:        "force-unlock",
+				Usage:       "Take the lock of --lock-path even if another run holds it, telling which one",
+				Destination: &forceUnlock,
+			},
+			&cli.StringFlag{
+				Name:        "metadata-path",
+				Usage:       "Path of the KV mount where the metadata of the policies, from their .meta.yaml files, are kept",
+				Value:       metadataPath,
+				Destination: &metadataPath,
+			},
+			&cli.StringSliceFlag{
+				Name:  "tag",
+				Usage: "Only work on the policies whose .meta.yaml file has this tag, or owner=<owner> for their owner (can be repeated)",
+			},
+			&cli.StringFlag{
+				Name:        "backend",
+				Usage:       "Where the policies are served from: vault, or memory[:seed] for an in-process Vault seeded from a directory or YAML file, lost at exit",
+				Value:       backend,
+				Destination: &backend,
+			},
+		},
+		Before: func(c *cli.Context) error {
+			err := checkGlobalFlags()
+			if err != nil {
+				return err
+			}
+
+			tagFilters = c.StringSlice("tag")
+			headerFlags = c.StringSlice("header")
+			startDeadline()
+			if runID == "" {
+				runID = newRunID()
+			}
+
+			activeProfile, err = loadProfile(profilesFile, profileName)
+			if err != nil {
+				return err
+			}
+
+			h, err := loadHooks(hooksFile)
+			if err != nil {
+				return err
+			}
+			activeHooks = h
+			return nil
 		},
 		Commands: []*cli.Command{
 			{
 				Name:  "backup",
 				Usage: "Backup your policies from a Vault into the specified local directory",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:        "normalize",
+						Usage:       "Write the policies with Unix line endings and without byte order mark",
+						Destination: &normalizeBackup,
+					},
+					&cli.StringFlag{
+						Name:        "file-mode",
+						Usage:       "Permissions, in octal, of the policy files written",
+						Value:       fileMode,
+						Destination: &fileMode,
+					},
+					&cli.StringFlag{
+						Name:        "dir-mode",
+						Usage:       "Permissions, in octal, of the directories created when missing",
+						Value:       dirMode,
+						Destination: &dirMode,
+					},
+					&cli.StringFlag{
+						Name:        "layout",
+						Usage:       "How to organize the new policy files: flat, by-prefix in a subdirectory per name prefix, or by-namespace in a subdirectory per Vault Enterprise namespace",
+						Value:       layout,
+						Destination: &layout,
+					},
+					&cli.StringFlag{
+						Name:        "separator",
+						Usage:       "Separator ending the name prefixes of the by-prefix layout",
+						Value:       separator,
+						Destination: &separator,
+					},
+					&cli.BoolFlag{
+						Name:        "git-commit",
+						Usage:       "Commit the changed files when the directory is in a git repository",
+						Destination: &gitCommit,
+					},
+					&cli.BoolFlag{
+						Name:        "git-push",
+						Usage:       "Push the commit of --git-commit",
+						Destination: &gitPush,
+					},
+				},
 				Action: func(c *cli.Context) error {
 					if len(c.Args().Slice()) != 1 {
 						return fmt.Errorf("backup requires a directory")
@@ -47,192 +313,630 @@ func main() {
 
 					directory := c.Args().Slice()[0]
 
-					return backupPolicies(dev, dryRun, directory)
+					options, err := newBackupOptions(fileMode, dirMode, layout, separator)
+					if err != nil {
+						return err
+					}
+					options.normalize = normalizeBackup
+					if gitPush && !gitCommit {
+						return fmt.Errorf("--git-push requires --git-commit")
+					}
+					options.gitCommit, options.gitPush = gitCommit, gitPush
+
+					return backupPolicies(dev, dryRun, options, directory)
 				},
 			},
 			{
-				Name:  "upload",
-				Usage: "Upload policies from a directory into Vault (will overwrite existing policies, but won't remove any existing policies)",
+				Name:      "upload",
+				Usage:     "Upload policies from a directory into Vault (will overwrite existing policies, but won't remove any existing policies)",
+				ArgsUsage: "directory [overlay directory...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "on-conflict",
+						Usage:       "What to do with the policies changed both in Vault and in the directory since it was last backed up or restored: fail, ours to overwrite them, theirs to keep them, or interactive to ask for each",
+						Value:       onConflict,
+						Destination: &onConflict,
+					},
+					concurrencyFlag(),
+				},
 				Action: func(c *cli.Context) error {
-					if len(c.Args().Slice()) != 1 {
+					if len(c.Args().Slice()) < 1 {
 						return fmt.Errorf("upload requires a directory")
 					}
+					err := checkSyncFlags(onConflict)
+					if err != nil {
+						return err
+					}
 
-					directory := c.Args().Slice()[0]
-
-					return uploadPolicies(dev, dryRun, directory)
+					return uploadPolicies(dev, dryRun, onConflict, c.Args().Slice())
 				},
 			},
 			{
-				Name:  "restore",
-				Usage: "Restore your policies from a local directory into Vault (will overwrite existing policies, and remove any existing policies not present in the local directory)",
+				Name:      "restore",
+				Usage:     "Restore your policies from a local directory into Vault (will overwrite existing policies, and remove any existing policies not present in the local directory)",
+				ArgsUsage: "directory [overlay directory...]",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:        "only",
+						Usage:       "Only create, update and delete the policies whose names match this glob pattern, leaving the others and the group attachments untouched (can be repeated)",
+						Destination: only,
+					},
+					&cli.StringFlag{
+						Name:        "max-deletions",
+						Usage:       "Most policies a restore may delete, as a number or a percentage of the policies in Vault, above which it is refused unless forced",
+						Value:       maxDeletions,
+						Destination: &maxDeletions,
+					},
+					&cli.BoolFlag{
+						Name:        "force",
+						Usage:       "Restore even if it deletes more policies than --max-deletions",
+						Destination: &force,
+					},
+					&cli.StringFlag{
+						Name:        "on-conflict",
+						Usage:       "What to do with the policies changed both in Vault and in the directory since it was last backed up or restored: fail, ours to overwrite them, theirs to keep them, or interactive to ask for each",
+						Value:       onConflict,
+						Destination: &onConflict,
+					},
+					&cli.BoolFlag{
+						Name:        "interactive",
+						Usage:       "Show each change with its diff and ask whether to make it",
+						Destination: &interactive,
+					},
+					concurrencyFlag(),
+				},
 				Action: func(c *cli.Context) error {
-					if len(c.Args().Slice()) != 1 {
+					if len(c.Args().Slice()) < 1 {
 						return fmt.Errorf("restore requires a directory")
 					}
 
-					directory := c.Args().Slice()[0]
+					for _, pattern := range only.Value() {
+						if _, err := path.Match(pattern, ""); err != nil {
+							return fmt.Errorf("bad policy pattern %s: %w", pattern, err)
+						}
+					}
+					err := checkSyncFlags(onConflict)
+					if err != nil {
+						return err
+					}
 
-					return restorePolicies(dev, dryRun, directory)
+					limit, err := newDeletionLimit(maxDeletions, force)
+					if err != nil {
+						return err
+					}
+					options := restoreOptions{only: only.Value(), onConflict: onConflict, interactive: interactive, maxDeletions: limit}
+
+					return restorePolicies(dev, dryRun, options, c.Args().Slice())
 				},
 			},
+			applyCommand(),
+			applyBundleCommand(),
+			approveCommand(),
+			attachCommand(),
+			auditScoreCommand(),
+			benchCommand(),
+			breadthCommand(),
+			changelogCommand(),
+			completionCommand(),
+			coverageCommand(),
+			daemonCommand(),
+			denyImpactCommand(),
+			devEnvCommand(),
+			detachCommand(),
+			docsCommand(),
+			duplicatesCommand(),
+			expandCommand(),
+			exportCommand(),
+			extractSnapshotCommand(),
+			formatCommand(),
+			gitHookCommand(),
+			graphCommand(),
+			importCommand(),
+			lintCommand(),
+			mountsCommand(secretEngines),
+			mountsCommand(authMethods),
+			planCommand(),
+			privilegedCommand(),
+			reportCommand(),
+			rolloutCommand(),
+			selfUpdateCommand(),
+			serveCommand(),
+			similarCommand(),
+			sizesCommand(),
+			suggestCommand(),
+			testCommand(),
+			tokenScanCommand(),
+			tuiCommand(),
+			unusedCommand(),
+			usageCommand(),
+			verifyAuditCommand(),
+			versionCommand(),
+			whoUsesCommand(),
+			resourceCommand(groupsResource, "Synchronize identity groups, and the policies attached to them, between Vault and a local directory"),
+			resourceCommand(entitiesResource, "Synchronize identity entities, and the policies attached to them, between Vault and a local directory"),
+			resourceCommand(approleRolesResource, "Synchronize AppRole role definitions, without their secret ids, between Vault and a local directory"),
+			resourceCommand(kubernetesRolesResource, "Synchronize Kubernetes auth roles between Vault and a local directory"),
+			resourceCommand(tokenRolesResource, "Synchronize token roles, and the policies they allow, between Vault and a local directory"),
+			resourceCommand(databaseRolesResource, "Synchronize database secret engine roles, with their creation statements, between Vault and a local directory"),
+			resourceCommand(rateLimitQuotasResource, "Synchronize rate limit quotas between Vault and a local directory"),
+			resourceCommand(leaseCountQuotasResource, "Synchronize lease count quotas (Vault Enterprise) between Vault and a local directory"),
+			oidcCommand(),
+			resourceCommand(egpBindingsResource, "Synchronize the paths and enforcement levels of Sentinel EGP policies (Vault Enterprise) between Vault and a local directory"),
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	code := run(app)
+	reportTimings()
+	if code != 0 {
+		os.Exit(code)
 	}
 }
 
-func backupPolicies(dev, dryRun bool, directory string) error {
-	log("Backing policies to", directory)
+// run runs the app and returns its exit code, after printing its error.
+func run(app *cli.App) int {
+	err := app.Run(os.Args)
+	if err == nil {
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, err)
+	return exitCode(err)
+}
+
+// uploadPolicies uploads the policies of directories, those of the later ones
+// replacing those of the same name of the earlier ones.
+func uploadPolicies(dev, dryRun bool, onConflict string, directories []string) error {
+	log("Uploading policies from", strings.Join(directories, ", "))
 	client, err := selectNewVault(dev)
 	if err != nil {
 		return err
 	}
 
-	err = walkRemotePolicies(client, func(policy, content string) error {
-		if dryRun {
-			fmt.Printf("Would have written %s.hcl with content:\n", policy)
-			fmt.Println(content)
-		} else {
-			log(fmt.Sprintf("Writing %s.hcl", policy))
-			err = os.WriteFile(filepath.Join(directory, policy+".hcl"), []byte(content), 0644)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
+	err = runHooks(dryRun, hookBeforePlan, hookPayload{Directory: strings.Join(directories, string(os.PathListSeparator))})
 	if err != nil {
 		return err
 	}
 
-	log("Done backing up")
-	return nil
-}
+	source, err := policySource(directories)
+	if err != nil {
+		return err
+	}
 
-func uploadPolicies(dev, dryRun bool, directory string) error {
-	log("Uploading policies from", directory)
-	client, err := selectNewVault(dev)
+	changes, err := planPolicyChanges(client, source)
+	if err != nil {
+		return err
+	}
+
+	metadataChanges, err := planMetadataChanges(client, directories, false)
 	if err != nil {
 		return err
 	}
+	changes = append(changes, metadataChanges...)
 
-	log("Walking directory", directory)
-	defer log("Done uploading policies")
-	return walkDirectoryPolicies(directory, func(policy string, content []byte) error {
-		if dryRun {
-			fmt.Printf("Would have written policy %s with content:\n", policy)
-			fmt.Println(string(content))
-		} else {
-			log("Setting policy", policy)
-			client.Sys().PutPolicy(policy, string(content))
+	// Upload never removes policies.
+	uploads := []change{}
+	for _, c := range changes {
+		if c.action != actionDelete {
+			uploads = append(uploads, c)
 		}
+	}
 
-		return nil
-	})
+	names, err := source.List()
+	if err != nil {
+		return err
+	}
+	local := map[string]bool{}
+	for _, name := range names {
+		local[name] = true
+	}
+	base := &baseSync{client: client, directory: directories[0], onConflict: onConflict, scope: func(name string) bool {
+		return local[name]
+	}}
+
+	err = applySyncChanges(uploads, dryRun, base)
+	if err != nil {
+		return err
+	}
+
+	log("Done uploading policies")
+	return nil
+}
+
+// restoreOptions are how a restore selects the changes it makes.
+type restoreOptions struct {
+	// only restores just the policies matching these patterns, and no
+	// attachments.
+	only []string
+	// maxDeletions refuses the restore if it deletes more policies, unless
+	// nil.
+	maxDeletions *deletionLimit
+	// onConflict tells what to do with the policies changed in both Vault
+	// and the directory since its base.
+	onConflict string
+	// interactive asks for each change whether to make it.
+	interactive bool
 }
 
-func restorePolicies(dev, dryRun bool, directory string) error {
-	log("Restoring policies from", directory)
+// restorePolicies restores the policies of directories, those of the later
+// ones replacing those of the same name of the earlier ones, and the
+// attachments of the last directory having an attachments file.
+func restorePolicies(dev, dryRun bool, options restoreOptions, directories []string) error {
+	log("Restoring policies from", strings.Join(directories, ", "))
 	client, err := selectNewVault(dev)
 	if err != nil {
 		return err
 	}
 
-	remotePolicies := make(map[string]string)
+	err = runHooks(dryRun, hookBeforePlan, hookPayload{Directory: strings.Join(directories, string(os.PathListSeparator))})
+	if err != nil {
+		return err
+	}
 
-	err = walkRemotePolicies(client, func(policy, content string) error {
-		remotePolicies[policy] = content
-		return nil
-	})
+	source, err := policySource(directories)
 	if err != nil {
 		return err
 	}
 
-	localPolicies := make(map[string]string)
+	changes, err := planPolicyChanges(client, source)
+	if err != nil {
+		return err
+	}
 
-	log("Walking directory", directory)
-	err = walkDirectoryPolicies(directory, func(policy string, content []byte) error {
-		log("Found policy", policy)
-		localPolicies[policy] = string(content)
-		return nil
-	})
+	metadataChanges, err := planMetadataChanges(client, directories, true)
 	if err != nil {
 		return err
 	}
+	changes = append(changes, metadataChanges...)
 
-	log("Deleting policies not present in the directory")
-	for policy := range remotePolicies {
-		if _, ok := localPolicies[policy]; !ok {
-			if dryRun {
-				fmt.Printf("Would have deleted policy %s\n", policy)
-			} else {
-				client.Sys().DeletePolicy(policy)
-			}
+	if len(options.only) > 0 {
+		changes = selectChanges(changes, options.only)
+	} else {
+		attachmentChanges, err := planDirectoryAttachments(client, attachmentsDirectory(directories))
+		if err != nil {
+			return err
 		}
+		changes = append(changes, attachmentChanges...)
 	}
 
-	log("Writing policies back to the Vault server when needed")
-	for policy := range localPolicies {
-		if _, ok := remotePolicies[policy]; ok {
-			if remotePolicies[policy] == localPolicies[policy] {
-				continue
-			}
+	base := &baseSync{client: client, directory: directories[0], onConflict: options.onConflict}
+	if len(options.only) > 0 {
+		base.scope = func(name string) bool {
+			return matchesAny(options.only, name)
 		}
+	}
+	changes, err = options.check(client, base, changes)
+	if err != nil {
+		return err
+	}
 
-		if dryRun {
-			fmt.Printf("Would have written policy %s with content:\n", policy)
-			fmt.Println(localPolicies[policy])
-		} else {
-			log("Setting policy", policy)
-			client.Sys().PutPolicy(policy, localPolicies[policy])
+	if !dryRun && len(changes) > 0 {
+		queued, err := queueOutsideApplyWindow(client, directories, changes, time.Now())
+		if queued || err != nil {
+			return err
 		}
 	}
 
+	err = applySyncChanges(changes, dryRun, base)
+	if err != nil {
+		return err
+	}
+
 	log("Done restoring policies")
 	return nil
 }
 
-func walkDirectoryPolicies(directory string, f func(policy string, content []byte) error) error {
-	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+// check returns the changes the restore makes, once the conflicts with the
+// base resolved and, when interactive, those chosen, failing if they delete
+// too many policies.
+func (o restoreOptions) check(client *vaultApi.Client, base *baseSync, changes []change) ([]change, error) {
+	changes, err := base.resolve(changes)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.interactive {
+		changes, err = chooseChanges(changes, os.Stdin)
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
 
-		if info.IsDir() {
-			return nil
+	err = checkDeletions(client, changes, o.maxDeletions)
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// skippedPolicies returns the policies planned changes but applied ones
+// don't, left as they are in Vault after a conflict or a choice, so that
+// their base isn't moved to a state the directory was never synced to.
+func skippedPolicies(planned, applied []change) map[string]bool {
+	skipped := map[string]bool{}
+	for _, c := range planned {
+		if c.kind == "policy" {
+			skipped[c.name] = true
 		}
+	}
+	for _, c := range applied {
+		if c.kind == "policy" {
+			delete(skipped, c.name)
+		}
+	}
+	return skipped
+}
 
-		if filepath.Ext(path) != ".hcl" {
-			return nil
+// selectChanges returns the changes of the policies matching the patterns.
+func selectChanges(changes []change, patterns []string) []change {
+	selected := []change{}
+	for _, c := range changes {
+		if matchesAny(patterns, c.name) {
+			selected = append(selected, c)
 		}
+	}
+	return selected
+}
 
-		content, err := os.ReadFile(path)
-		if err != nil {
-			return err
+// deletionLimit is the most policies a restore may delete, either a number
+// or a percentage of the policies of Vault that can be deleted.
+type deletionLimit struct {
+	value   float64
+	percent bool
+	text    string
+}
+
+func parseDeletionLimit(limit string) (deletionLimit, error) {
+	value, err := strconv.ParseFloat(strings.TrimSuffix(limit, "%"), 64)
+	if err != nil || value < 0 {
+		return deletionLimit{}, fmt.Errorf("invalid deletion limit %s, expected a number or a percentage", limit)
+	}
+	return deletionLimit{value: value, percent: strings.HasSuffix(limit, "%"), text: limit}, nil
+}
+
+// checkGlobalFlags validates the flags shared by all the commands.
+func checkGlobalFlags() error {
+	if recordFile != "" && replayFile != "" {
+		return fmt.Errorf("--record and --replay can't be used together")
+	}
+
+	err := checkBackend()
+	if err != nil {
+		return err
+	}
+	err = checkLogFormat()
+	if err != nil {
+		return err
+	}
+	err = checkOnSecondary()
+	if err != nil {
+		return err
+	}
+	return checkTimingsFormat()
+}
+
+// checkSyncFlags validates the flags shared by upload and restore.
+func checkSyncFlags(onConflict string) error {
+	err := checkConflictStrategy(onConflict)
+	if err != nil {
+		return err
+	}
+	return checkConcurrency()
+}
+
+// newDeletionLimit parses the --max-deletions of the commands restoring a
+// directory, which is lifted with --force.
+func newDeletionLimit(maxDeletions string, force bool) (*deletionLimit, error) {
+	if force {
+		return nil, nil
+	}
+	l, err := parseDeletionLimit(maxDeletions)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// checkDeletions fails if the changes delete more policies than limit, so that
+// restoring an empty or wrong directory doesn't wipe Vault out. Every command
+// applying a restore checks its changes, whether run from the command line,
+// the HTTP API or the daemon. A nil limit allows any deletion.
+func checkDeletions(client *vaultApi.Client, changes []change, limit *deletionLimit) error {
+	if limit == nil {
+		return nil
+	}
+	deletions := 0
+	for _, c := range changes {
+		if c.kind == "policy" && c.action == actionDelete {
+			deletions++
+		}
+	}
+	if deletions == 0 {
+		return nil
+	}
+
+	names, err := store.NewVault(client).List()
+	if err != nil {
+		return err
+	}
+	existing := 0
+	for _, name := range names {
+		if !builtinPolicies[name] {
+			existing++
+		}
+	}
+
+	max := limit.value
+	if limit.percent {
+		max = max * float64(existing) / 100
+	}
+
+	if float64(deletions) > max {
+		return fmt.Errorf("the changes would delete %d of the %d policies in Vault, more than --max-deletions %s, use --force if this is intended", deletions, existing, limit.text)
+	}
+	return nil
+}
+
+// attachmentsDirectory returns the last of directories having an attachments
+// file, or the last one if none has.
+func attachmentsDirectory(directories []string) string {
+	for i := len(directories) - 1; i >= 0; i-- {
+		if _, err := os.Stat(filepath.Join(directories[i], attachmentsFile)); err == nil {
+			return directories[i]
+		}
+	}
+	return directories[len(directories)-1]
+}
+
+// applyPolicyChange makes a change to the policies of Vault, stamping the
+// content written with the change ticket.
+func applyPolicyChange(remote store.Store, c policysync.Change) error {
+	c.Content = stampChangeRef(c.Content)
+	return policysync.ApplyChange(remote, c)
+}
+
+// matchesAny tells whether name matches one of the glob patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// planRestore returns the changes restoring the policies and attachments of
+// directory would make.
+func planRestore(client *vaultApi.Client, directory string) ([]change, error) {
+	changes, err := planPolicies(client, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	attachmentChanges, err := planDirectoryAttachments(client, directory)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, attachmentChanges...), nil
+}
+
+// planPolicies returns the changes needed for the policies in Vault to match
+// the directory, deletions first.
+func planPolicies(client *vaultApi.Client, directory string) ([]change, error) {
+	log("Comparing the policies of Vault with", directory)
+	return planPolicyChanges(client, policyDirectory(directory))
+}
+
+// policySource returns the store of the policies of directories, reporting
+// which file each policy comes from when there are several directories.
+func policySource(directories []string) (store.Store, error) {
+	if len(directories) == 1 {
+		return policyDirectory(directories[0]), nil
+	}
+
+	overlay := store.NewOverlay()
+	for _, directory := range directories {
+		overlay.Directories = append(overlay.Directories, policyDirectory(directory))
+	}
+
+	sources, err := overlay.Sources()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		files := sources[name]
+		fmt.Printf("Policy %s from %s", name, files[len(files)-1])
+		if len(files) > 1 {
+			fmt.Printf(", overriding %s", strings.Join(files[:len(files)-1], ", "))
 		}
+		fmt.Println()
+	}
+	return overlay, nil
+}
 
-		// Guess the policy name from the file name
-		policy := filepath.Base(path)
-		policy = policy[:len(policy)-len(filepath.Ext(policy))]
+// planPolicyChanges returns the changes needed for the policies in Vault to
+// match those of source, once their variables are substituted, deletions
+// first.
+func planPolicyChanges(client *vaultApi.Client, source store.Store) ([]change, error) {
+	source = substitutedStore{Store: source}
+	remote, err := remotePolicies(client, source)
+	if err != nil {
+		return nil, err
+	}
+	policyChanges, err := policysync.Diff(source, remote)
+	if err != nil {
+		return nil, err
+	}
 
+	changes := make([]change, 0, len(policyChanges))
+	for _, c := range policyChanges {
+		c := c
+		pc := change{
+			action:   string(c.Action),
+			kind:     "policy",
+			name:     c.Name,
+			content:  c.Content,
+			previous: c.Previous,
+			apply: func() error {
+				return applyPolicyChange(remote, c)
+			},
+		}
+		if c.Action == policysync.Update {
+			pc.details = policyDiff(c.Previous, c.Content)
+		}
+		changes = append(changes, pc)
+	}
+
+	return changes, nil
+}
+
+func walkDirectoryPolicies(directory string, f func(policy string, content []byte) error) error {
+	return walkDirectoryPolicyFiles(directory, func(file, policy string, content []byte) error {
 		return f(policy, content)
 	})
 }
 
+// walkDirectoryPolicyFiles is walkDirectoryPolicies for the callers that also
+// need the file each policy comes from.
+func walkDirectoryPolicyFiles(directory string, f func(file, policy string, content []byte) error) error {
+	return policyDirectory(directory).Walk(f)
+}
+
+// policyDirectory returns the store of the policies of a local directory,
+// warning about the files named differently than their policy and the symbolic
+// links skipped.
+func policyDirectory(directory string) *store.Directory {
+	d := store.NewDirectory(directory)
+	d.MaxSize = maxPolicySize
+	d.FollowSymlinks = followSymlinks
+	d.Warn = func(message string) {
+		fmt.Fprintln(os.Stderr, "Warning:", message)
+	}
+	if len(tagFilters) > 0 {
+		d.Filter = tagFilter
+	}
+	return d
+}
+
 func walkRemotePolicies(client *vaultApi.Client, f func(policy string, content string) error) error {
 	log("Listing policies from the Vault server")
-	policies, err := client.Sys().ListPolicies()
+	remote, err := remotePolicies(client, nil)
+	if err != nil {
+		return err
+	}
+	policies, err := remote.List()
 	if err != nil {
 		return err
 	}
 
 	for _, policy := range policies {
 		log("Getting policy", policy)
-		content, err := client.Sys().GetPolicy(policy)
+		content, err := remote.Get(policy)
 		if err != nil {
 			return err
 		}
@@ -246,56 +950,65 @@ func walkRemotePolicies(client *vaultApi.Client, f func(policy string, content s
 	return nil
 }
 
-func newVault(address string, token string, CAPath string, ClientCert string, ClientKey string) (*vaultApi.Client, error) {
-	config := vaultApi.DefaultConfig()
-
-	config.Address = address
-
-	if CAPath != "" && ClientCert != "" && ClientKey != "" {
-		config.ConfigureTLS(&vaultApi.TLSConfig{
-			CACert:     CAPath,
-			ClientCert: ClientCert,
-			ClientKey:  ClientKey,
-		})
+func selectNewVault(dev bool) (*vaultApi.Client, error) {
+	client, err := newVault(dev)
+	if err != nil {
+		return nil, err
 	}
-
-	client, err := vaultApi.NewClient(config)
+	err = redirectToPrimary(client)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize Vault developer client: %w", err)
+		return nil, err
 	}
-
-	client.SetToken(token)
-
+	trailVault = client
 	return client, nil
 }
 
-func newVaultDev() (*vaultApi.Client, error) {
-	return newVault("http://127.0.0.1:8200", "dev-only-token", "", "", "")
-}
+func newVault(dev bool) (*vaultApi.Client, error) {
+	if replayFile != "" {
+		return newReplayVault()
+	}
 
-func selectNewVault(dev bool) (*vaultApi.Client, error) {
-	if dev {
-		return newVaultDev()
+	if backend != "vault" {
+		return newMemoryVault()
 	}
 
-	home, err := os.UserHomeDir()
+	// The headers, the correlation ids, the deadline and the throttle wrap the
+	// transport, and the recording wraps them.
+	wrappers, err := headerOptions()
+	if err != nil {
+		return nil, err
+	}
+	wrappers = append(wrappers, correlationOption())
+	wrappers = append(wrappers, deadlineOptions()...)
+	throttle, err := throttleOptions()
 	if err != nil {
 		return nil, err
 	}
+	wrappers = append(wrappers, throttle...)
 
-	token, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if dev {
+		return vaultclient.NewDev(append(wrappers, recordingOption(vaultclient.DevAddress)...)...)
+	}
+
+	tls, err := tlsOptions()
 	if err != nil {
 		return nil, err
 	}
 
-	return newVault(os.Getenv("VAULT_ADDR"), string(token),
-		os.Getenv("VAULT_CACERT"),
-		os.Getenv("VAULT_CLIENT_CERT"),
-		os.Getenv("VAULT_CLIENT_KEY"))
+	// The profile tunes the transport that the others wrap.
+	options := append(tls, profileOptions()...)
+	options = append(options, wrappers...)
+	options = append(options, recordingOption(profileAddress())...)
+	return vaultclient.NewFromEnvironment(options...)
 }
 
 func log(message ...string) {
-	if debug {
-		fmt.Println(message)
+	if !debug {
+		return
+	}
+	if logFormat == logFormatJSON {
+		writeLog(logEntry{Message: strings.Join(message, " ")})
+		return
 	}
+	fmt.Println(message)
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDeletionLimit(t *testing.T) {
+	tests := []struct {
+		limit    string
+		expected deletionLimit
+		err      bool
+	}{
+		{limit: "50%", expected: deletionLimit{value: 50, percent: true, text: "50%"}},
+		{limit: "12.5%", expected: deletionLimit{value: 12.5, percent: true, text: "12.5%"}},
+		{limit: "10", expected: deletionLimit{value: 10, text: "10"}},
+		{limit: "0", expected: deletionLimit{value: 0, text: "0"}},
+		{limit: "-1", err: true},
+		{limit: "half", err: true},
+		{limit: "%", err: true},
+		{limit: "", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseDeletionLimit(test.limit)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseDeletionLimit(%q) didn't fail", test.limit)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDeletionLimit(%q): %v", test.limit, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("parseDeletionLimit(%q) = %+v, expected %+v", test.limit, got, test.expected)
+		}
+	}
+}
+
+func TestNewDeletionLimit(t *testing.T) {
+	limit, err := newDeletionLimit("bad", true)
+	if limit != nil || err != nil {
+		t.Errorf("--force returned %v, %v, expected no limit", limit, err)
+	}
+	if _, err = newDeletionLimit("bad", false); err == nil {
+		t.Error("an invalid limit didn't fail")
+	}
+	limit, err = newDeletionLimit("3", false)
+	if err != nil || limit == nil || limit.value != 3 {
+		t.Errorf("got %v, %v, expected a limit of 3", limit, err)
+	}
+}
+
+func TestSkippedPolicies(t *testing.T) {
+	planned := []change{
+		{action: actionCreate, kind: "policy", name: "a"},
+		{action: actionUpdate, kind: "policy", name: "b"},
+		{action: actionDelete, kind: "policy", name: "c"},
+		{action: actionUpdate, kind: "attachment", name: "d"},
+	}
+	applied := []change{planned[0], planned[3]}
+
+	expected := map[string]bool{"b": true, "c": true}
+	if got := skippedPolicies(planned, applied); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fynelabs/vault-policies/pkg/store"
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+	vaultApi "github.com/hashicorp/vault/api"
+	"gopkg.in/yaml.v3"
+)
+
+const memoryBackend = "memory"
+
+var (
+	backend = "vault"
+
+	// activeMemoryVault is shared by the clients of a command, so that they
+	// see the changes of each other.
+	activeMemoryVault *memoryVault
+)
+
+// memorySeed is the content of a seed file of the memory backend.
+type memorySeed struct {
+	Policies map[string]string `yaml:"policies"`
+}
+
+// memoryVault answers the Vault HTTP API in memory, with a fresh server for
+// each command. Policies, mounts, auth methods and identities by name behave
+// like Vault, and any other path stores what is written to it.
+type memoryVault struct {
+	mu   sync.Mutex
+	data map[string]map[string]interface{}
+	ids  int
+}
+
+// checkBackend validates the --backend flag.
+func checkBackend() error {
+	name := strings.SplitN(backend, ":", 2)[0]
+	if name != "vault" && name != memoryBackend {
+		return fmt.Errorf("unknown backend %s, expected vault or memory[:seed]", backend)
+	}
+	if name == "vault" && backend != "vault" {
+		return fmt.Errorf("the vault backend takes no seed")
+	}
+	return nil
+}
+
+// newMemoryVault returns a client of the in-memory Vault of the command,
+// seeded on first use with the policies of the file or directory following
+// memory: in --backend.
+func newMemoryVault() (*vaultApi.Client, error) {
+	if activeMemoryVault == nil {
+		seed := strings.TrimPrefix(strings.TrimPrefix(backend, memoryBackend), ":")
+		m, err := startMemoryVault(seed)
+		if err != nil {
+			return nil, err
+		}
+		activeMemoryVault = m
+	}
+
+	return vaultclient.New(vaultclient.DevAddress, vaultclient.DevToken, "", "", "", vaultclient.WithTransport(func(http.RoundTripper) http.RoundTripper {
+		return activeMemoryVault
+	}))
+}
+
+// startMemoryVault returns an in-memory Vault with the built-in policies and
+// mounts of a dev server, and the policies of seed, either a directory or a
+// YAML file with a policies map.
+func startMemoryVault(seed string) (*memoryVault, error) {
+	m := &memoryVault{data: map[string]map[string]interface{}{
+		"sys/mounts/cubbyhole/": {"type": "cubbyhole", "config": map[string]interface{}{}},
+		"sys/mounts/identity/":  {"type": "identity", "config": map[string]interface{}{}},
+		"sys/mounts/secret/":    {"type": "kv", "options": map[string]interface{}{"version": "2"}, "config": map[string]interface{}{}},
+		"sys/mounts/sys/":       {"type": "system", "config": map[string]interface{}{}},
+		"sys/auth/token/":       {"type": "token", "config": map[string]interface{}{}},
+	}}
+	m.putPolicy("default", "")
+	m.putPolicy("root", "")
+
+	if seed != "" {
+		err := m.seed(seed)
+		if err != nil {
+			return nil, fmt.Errorf("unable to seed the memory backend: %w", err)
+		}
+	}
+	return m, nil
+}
+
+func (m *memoryVault) seed(seed string) error {
+	info, err := os.Stat(seed)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return store.NewDirectory(seed).Walk(func(file, name string, content []byte) error {
+			m.putPolicy(name, string(content))
+			return nil
+		})
+	}
+
+	content, err := os.ReadFile(seed)
+	if err != nil {
+		return err
+	}
+
+	s := memorySeed{}
+	err = yaml.Unmarshal(content, &s)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %w", seed, err)
+	}
+	for name, policy := range s.Policies {
+		m.putPolicy(name, policy)
+	}
+	return nil
+}
+
+func (m *memoryVault) putPolicy(name, content string) {
+	m.data["sys/policies/acl/"+name] = map[string]interface{}{"name": name, "policy": content}
+}
+
+// RoundTrip answers the requests of the clients without any network.
+func (m *memoryVault) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	resp := w.Result()
+	resp.Request = r
+	return resp, nil
+}
+
+// ServeHTTP answers a request of the Vault API.
+func (m *memoryVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	body := map[string]interface{}{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	switch {
+	case path == "sys/health":
+		memoryReply(w, http.StatusOK, map[string]interface{}{"initialized": true, "sealed": false, "standby": false, "version": "memory", "cluster_name": "memory", "cluster_id": "memory"})
+	case (path == "sys/mounts" || path == "sys/auth") && r.Method == http.MethodGet:
+		memoryReply(w, http.StatusOK, map[string]interface{}{"data": m.children(path + "/")})
+	case r.Method == "LIST" || r.URL.Query().Get("list") == "true":
+		m.list(w, m.kvData(path))
+	case r.Method == http.MethodGet:
+		m.read(w, path)
+	case r.Method == http.MethodDelete:
+		delete(m.data, mountKey(m.kvData(path)))
+		memoryReply(w, http.StatusNoContent, nil)
+	default:
+		m.write(w, path, body)
+	}
+}
+
+func (m *memoryVault) list(w http.ResponseWriter, path string) {
+	keys := []string{}
+	for key := range m.children(strings.TrimSuffix(path, "/") + "/") {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		memoryReply(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+		return
+	}
+
+	sort.Strings(keys)
+	memoryReply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+}
+
+func (m *memoryVault) read(w http.ResponseWriter, path string) {
+	data, ok := m.data[mountKey(path)]
+	if !ok {
+		memoryReply(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+		return
+	}
+	memoryReply(w, http.StatusOK, map[string]interface{}{"data": data})
+}
+
+// write creates or updates the object of path, giving an id to the identities
+// created by name.
+func (m *memoryVault) write(w http.ResponseWriter, path string, body map[string]interface{}) {
+	if strings.HasSuffix(path, "/tune") && strings.HasPrefix(path, "sys/") {
+		path = strings.TrimSuffix(path, "/tune")
+		body = map[string]interface{}{"config": body}
+	}
+
+	key := mountKey(path)
+	data, exists := m.data[key]
+	if !exists {
+		data = map[string]interface{}{}
+	}
+	for k, v := range body {
+		data[k] = v
+	}
+	m.data[key] = data
+
+	identity := strings.SplitN(path, "/name/", 2)
+	if !strings.HasPrefix(path, "identity/") || len(identity) != 2 {
+		memoryReply(w, http.StatusNoContent, nil)
+		return
+	}
+
+	if !exists {
+		m.ids++
+		data["id"] = fmt.Sprintf("memory-%d", m.ids)
+		data["name"] = identity[1]
+	}
+	m.data[identity[0]+"/id/"+data["id"].(string)] = data
+	memoryReply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"id": data["id"], "name": data["name"]}})
+}
+
+// kvData returns the data path of a metadata path of a KV v2 mount, where
+// the secrets are listed and deleted, and path otherwise.
+func (m *memoryVault) kvData(path string) string {
+	for key, data := range m.data {
+		mountPath := strings.TrimPrefix(key, "sys/mounts/")
+		options, _ := data["options"].(map[string]interface{})
+		if mountPath == key || data["type"] != "kv" || options["version"] != "2" || !strings.HasPrefix(path, mountPath+"metadata/") {
+			continue
+		}
+		return mountPath + "data/" + strings.TrimPrefix(path, mountPath+"metadata/")
+	}
+	return path
+}
+
+// children returns the objects under prefix, by their next path segment.
+func (m *memoryVault) children(prefix string) map[string]interface{} {
+	children := map[string]interface{}{}
+	for key, data := range m.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 && i < len(rest)-1 {
+			children[rest[:i+1]] = map[string]interface{}{}
+			continue
+		}
+		children[rest] = data
+	}
+	return children
+}
+
+// mountKey returns where the object of path is kept: mounts and auth methods
+// always end with a slash.
+func mountKey(path string) string {
+	if (strings.HasPrefix(path, "sys/mounts/") || strings.HasPrefix(path, "sys/auth/")) && !strings.HasSuffix(path, "/") {
+		return path + "/"
+	}
+	return path
+}
+
+func memoryReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"gopkg.in/yaml.v3"
+)
+
+// metadataSuffix replaces the .hcl extension of a policy file for the file
+// holding its metadata.
+const metadataSuffix = ".meta.yaml"
+
+// metadataPath is where the metadata of the policies are kept in Vault, on a
+// KV mount.
+var metadataPath = "secret/vault-policies/metadata"
+
+// policyMetadata is what a team tells about a policy next to it.
+type policyMetadata struct {
+	Owner       string   `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
+	Links       []string `yaml:"links,omitempty" json:"links,omitempty"`
+	Tags        []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+func metadataFile(policyFile string) string {
+	return strings.TrimSuffix(policyFile, ".hcl") + metadataSuffix
+}
+
+// loadDirectoryMetadata returns the metadata of the policies of directories
+// having some, by name, the policies of the later directories replacing those
+// of the earlier ones with their metadata.
+func loadDirectoryMetadata(directories []string) (map[string]*policyMetadata, error) {
+	metadata := map[string]*policyMetadata{}
+	for _, directory := range directories {
+		err := walkDirectoryPolicyFiles(directory, func(file, policy string, content []byte) error {
+			m, err := readMetadata(metadataFile(file))
+			if err != nil {
+				return err
+			}
+
+			if m == nil {
+				delete(metadata, policy)
+			} else {
+				metadata[policy] = m
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
+
+// readMetadata returns the metadata of file, or nil if it doesn't exist.
+func readMetadata(file string) (*policyMetadata, error) {
+	content, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &policyMetadata{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(m)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+	return m, nil
+}
+
+func (m *policyMetadata) yaml() string {
+	content, err := yaml.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+// metadataStore keeps the metadata of the policies at metadataPath, on a KV
+// v1 or v2 mount.
+type metadataStore struct {
+	*kvPath
+}
+
+func newMetadataStore(client *vaultApi.Client) (*metadataStore, error) {
+	k, err := newKVPath(client, metadataPath)
+	if err != nil {
+		return nil, err
+	}
+	return &metadataStore{kvPath: k}, nil
+}
+
+// load returns the metadata of the policies, by name.
+func (s *metadataStore) load() (map[string]*policyMetadata, error) {
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]*policyMetadata{}
+	for _, name := range names {
+		data, _, err := s.read(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the metadata of policy %s: %w", name, err)
+		}
+		if data == nil {
+			continue
+		}
+
+		m := &policyMetadata{}
+		err = decodeKVData(data, m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata of policy %s: %w", name, err)
+		}
+		metadata[name] = m
+	}
+	return metadata, nil
+}
+
+func (s *metadataStore) put(name string, m *policyMetadata) error {
+	data, err := kvData(m)
+	if err != nil {
+		return err
+	}
+	return s.write(name, data, -1)
+}
+
+// planMetadataChanges returns the changes making the metadata of the policies
+// in Vault match the metadata files of directories, deleting the metadata
+// of the policies without any if deletes is set. Vault isn't required to
+// have the metadata mount while no policy has metadata.
+func planMetadataChanges(client *vaultApi.Client, directories []string, deletes bool) ([]change, error) {
+	local, err := loadDirectoryMetadata(directories)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newMetadataStore(client)
+	var remote map[string]*policyMetadata
+	if err == nil {
+		remote, err = s.load()
+	}
+	if err != nil && len(local) == 0 {
+		log("Skipping the metadata of the policies:", err.Error())
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []change{}
+	for _, name := range sortedMetadataNames(local) {
+		name := name
+		m, previous := local[name], remote[name]
+		c := change{kind: "metadata", name: name, content: m.yaml(), apply: func() error {
+			return s.put(name, m)
+		}}
+		switch {
+		case previous == nil:
+			c.action = actionCreate
+		case !reflect.DeepEqual(m, previous):
+			c.action, c.previous = actionUpdate, previous.yaml()
+			c.details = lineDiff(c.previous, c.content)
+		default:
+			continue
+		}
+		changes = append(changes, c)
+	}
+
+	for _, name := range sortedMetadataNames(remote) {
+		if _, ok := local[name]; ok || !deletes || !tagsMatch(remote[name]) {
+			continue
+		}
+
+		name := name
+		changes = append(changes, change{action: actionDelete, kind: "metadata", name: name, previous: remote[name].yaml(), apply: func() error {
+			return s.delete(name)
+		}})
+	}
+	return changes, nil
+}
+
+// backupMetadata writes the metadata of the policies of Vault next to the
+// files of the policies in directory.
+func backupMetadata(client *vaultApi.Client, dryRun bool, options backupOptions, directory string) error {
+	s, err := newMetadataStore(client)
+	var metadata map[string]*policyMetadata
+	if err == nil {
+		metadata, err = s.load()
+	}
+	if err != nil {
+		log("Skipping the metadata of the policies:", err.Error())
+		return nil
+	}
+
+	local := policyDirectory(directory)
+	local.Layout = options.policyLayout
+	local.Shallow = options.layout == layoutByNamespace
+	local.Filter = nil
+	for _, name := range sortedMetadataNames(metadata) {
+		if !tagsMatch(metadata[name]) {
+			continue
+		}
+
+		policyFile, err := local.File(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			policyFile, err = filepath.Join(directory, options.policyLayout(name)), nil
+		}
+		if err != nil {
+			return err
+		}
+
+		file := metadataFile(policyFile)
+		if dryRun {
+			fmt.Printf("Would have written %s with content:\n%s\n", file, metadata[name].yaml())
+			continue
+		}
+
+		log("Writing", file)
+		err = os.WriteFile(file, []byte(metadata[name].yaml()), options.fileMode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedMetadataNames(metadata map[string]*policyMetadata) []string {
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
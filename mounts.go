@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// Mounts that are always present on a Vault server and can not be enabled or
+// disabled by an operator.
+var systemMounts = map[string]bool{
+	"cubbyhole/": true,
+	"identity/":  true,
+	"sys/":       true,
+}
+
+type mountConfig struct {
+	DefaultLeaseTTL           int      `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL               int      `json:"max_lease_ttl,omitempty"`
+	ForceNoCache              bool     `json:"force_no_cache,omitempty"`
+	AuditNonHMACRequestKeys   []string `json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys  []string `json:"audit_non_hmac_response_keys,omitempty"`
+	ListingVisibility         string   `json:"listing_visibility,omitempty"`
+	PassthroughRequestHeaders []string `json:"passthrough_request_headers,omitempty"`
+	AllowedResponseHeaders    []string `json:"allowed_response_headers,omitempty"`
+	TokenType                 string   `json:"token_type,omitempty"`
+}
+
+// mount is the on disk representation of a secret engine or auth method
+// mount. It only contains the settings an operator controls, not the server
+// generated ones like the UUID or the accessor.
+type mount struct {
+	Type                  string            `json:"type"`
+	Description           string            `json:"description,omitempty"`
+	Local                 bool              `json:"local,omitempty"`
+	SealWrap              bool              `json:"seal_wrap,omitempty"`
+	ExternalEntropyAccess bool              `json:"external_entropy_access,omitempty"`
+	Options               map[string]string `json:"options,omitempty"`
+	Config                mountConfig       `json:"config"`
+}
+
+// mountTable is a table of mounts of Vault, the secret engines or the auth
+// methods, which are enabled, tuned and disabled the same way.
+type mountTable struct {
+	// name is that of the command and of the subdirectory of a bundle, kind
+	// that of the changes, and description what the mounts are.
+	name, kind, description string
+	// system lists the mounts always present, which can not be enabled or
+	// disabled by an operator.
+	system  map[string]bool
+	list    func(sys *vaultApi.Sys) (map[string]*vaultApi.MountOutput, error)
+	enable  func(sys *vaultApi.Sys, path string, input *vaultApi.MountInput) error
+	disable func(sys *vaultApi.Sys, path string) error
+	// tunePrefix is the prefix of the path of a mount to tune it.
+	tunePrefix string
+}
+
+var secretEngines = &mountTable{
+	name:        "mounts",
+	kind:        "mount",
+	description: "secret engine mounts",
+	system:      systemMounts,
+	list:        (*vaultApi.Sys).ListMounts,
+	enable:      (*vaultApi.Sys).Mount,
+	disable:     (*vaultApi.Sys).Unmount,
+}
+
+var authMethods = &mountTable{
+	name:        "auth-methods",
+	kind:        "auth method",
+	description: "auth methods",
+	system:      map[string]bool{"token/": true},
+	list:        (*vaultApi.Sys).ListAuth,
+	enable:      (*vaultApi.Sys).EnableAuthWithOptions,
+	disable:     (*vaultApi.Sys).DisableAuth,
+	tunePrefix:  "auth/",
+}
+
+func mountsCommand(t *mountTable) *cli.Command {
+	allowDisable := false
+	fileMode := "0600"
+	dirMode := "0700"
+
+	return &cli.Command{
+		Name:  t.name,
+		Usage: fmt.Sprintf("Synchronize %s between Vault and a local directory", t.description),
+		Subcommands: []*cli.Command{
+			{
+				Name:  "backup",
+				Usage: fmt.Sprintf("Backup the %s from a Vault into the specified local directory", t.description),
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "file-mode",
+						Usage:       "Permissions, in octal, of the mount files written",
+						Value:       fileMode,
+						Destination: &fileMode,
+					},
+					&cli.StringFlag{
+						Name:        "dir-mode",
+						Usage:       "Permissions, in octal, of the directories created when missing",
+						Value:       dirMode,
+						Destination: &dirMode,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) != 1 {
+						return fmt.Errorf("%s backup requires a directory", t.name)
+					}
+
+					directory := c.Args().Slice()[0]
+					f, err := parseFileMode(fileMode)
+					if err != nil {
+						return err
+					}
+					d, err := parseDirMode(dirMode)
+					if err != nil {
+						return err
+					}
+
+					return backupMounts(t, dev, dryRun, directory, f, d)
+				},
+			},
+			{
+				Name:  "diff",
+				Usage: fmt.Sprintf("Show the differences between the %s in a local directory and in Vault", t.description),
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) != 1 {
+						return fmt.Errorf("%s diff requires a directory", t.name)
+					}
+
+					directory := c.Args().Slice()[0]
+
+					return diffMounts(t, dev, directory)
+				},
+			},
+			{
+				Name:  "apply",
+				Usage: fmt.Sprintf("Enable and tune the %s from a local directory into Vault (those missing from the directory are only disabled with --allow-disable)", t.description),
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:        "allow-disable",
+						Usage:       fmt.Sprintf("Disable the %s not present in the directory and recreate those whose type changed", t.description),
+						Destination: &allowDisable,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) != 1 {
+						return fmt.Errorf("%s apply requires a directory", t.name)
+					}
+
+					directory := c.Args().Slice()[0]
+
+					return applyMounts(t, dev, dryRun, allowDisable, directory)
+				},
+			},
+		},
+	}
+}
+
+func backupMounts(t *mountTable, dev, dryRun bool, directory string, fileMode, dirMode os.FileMode) error {
+	log("Backing", t.description, "to", directory)
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	err = walkRemoteMounts(client, t, func(path string, m mount) error {
+		content, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		file := mountFile(directory, path)
+		if dryRun {
+			fmt.Printf("Would have written %s with content:\n", file)
+			fmt.Println(string(content))
+			return nil
+		}
+
+		log("Writing", file)
+		err = os.MkdirAll(filepath.Dir(file), dirMode)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(file, append(content, '\n'), fileMode)
+	})
+	if err != nil {
+		return err
+	}
+
+	log("Done backing up", t.description)
+	return nil
+}
+
+func diffMounts(t *mountTable, dev bool, directory string) error {
+	log("Comparing", t.description, "with", directory)
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	changes, err := planMounts(client, t, directory, true)
+	if err != nil {
+		return err
+	}
+
+	printPlan(changes)
+	return nil
+}
+
+func applyMounts(t *mountTable, dev, dryRun, allowDisable bool, directory string) error {
+	log("Applying", t.description, "from", directory)
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	err = runHooks(dryRun, hookBeforePlan, hookPayload{Directory: directory})
+	if err != nil {
+		return err
+	}
+
+	changes, err := planMounts(client, t, directory, allowDisable)
+	if err != nil {
+		return err
+	}
+
+	err = applyChanges(changes, dryRun)
+	if err != nil {
+		return err
+	}
+
+	log("Done applying", t.description)
+	return nil
+}
+
+// planMounts returns the changes needed for the mounts in Vault to match the
+// directory. Unless allowDisable is set, the changes that would disable a
+// mount, and lose its secrets, are left out of the plan.
+func planMounts(client *vaultApi.Client, t *mountTable, directory string, allowDisable bool) ([]change, error) {
+	localMounts, remoteMounts, err := loadMounts(client, t, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []change{}
+	for _, path := range sortedMountPaths(localMounts, remoteMounts) {
+		path := path
+		local, inLocal := localMounts[path]
+		remote, inRemote := remoteMounts[path]
+
+		c := change{
+			kind:    t.kind,
+			name:    path,
+			details: diffFields(remote, local),
+		}
+
+		switch {
+		case !inRemote:
+			c.action = actionCreate
+			c.details = nil
+			c.content = canonicalJSON(local)
+			c.apply = func() error {
+				return t.enableMount(client, path, local)
+			}
+		case !inLocal:
+			if !allowDisable {
+				fmt.Printf("Not disabling %s %s missing from the directory (use --allow-disable)\n", t.kind, path)
+				continue
+			}
+			c.action = actionDelete
+			c.details = nil
+			c.apply = func() error {
+				return t.disable(client.Sys(), path)
+			}
+		case remote.needsRecreate(local):
+			if !allowDisable {
+				fmt.Printf("Not recreating %s %s whose type or immutable settings changed (use --allow-disable)\n", t.kind, path)
+				continue
+			}
+			c.action = actionRecreate
+			c.apply = func() error {
+				err := t.disable(client.Sys(), path)
+				if err != nil {
+					return err
+				}
+				return t.enableMount(client, path, local)
+			}
+		case !reflect.DeepEqual(local, remote):
+			c.action = actionUpdate
+			c.apply = func() error {
+				return client.Sys().TuneMount(t.tunePrefix+path, local.configInput())
+			}
+		default:
+			continue
+		}
+
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+func (t *mountTable) enableMount(client *vaultApi.Client, path string, m mount) error {
+	return t.enable(client.Sys(), path, &vaultApi.MountInput{
+		Type:                  m.Type,
+		Description:           m.Description,
+		Config:                m.configInput(),
+		Local:                 m.Local,
+		SealWrap:              m.SealWrap,
+		ExternalEntropyAccess: m.ExternalEntropyAccess,
+		Options:               m.Options,
+	})
+}
+
+func loadMounts(client *vaultApi.Client, t *mountTable, directory string) (map[string]mount, map[string]mount, error) {
+	localMounts := make(map[string]mount)
+
+	log("Walking directory", directory)
+	err := walkDirectoryMounts(t, directory, func(path string, m mount) error {
+		log("Found", t.kind, path)
+		localMounts[path] = m
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remoteMounts := make(map[string]mount)
+	err = walkRemoteMounts(client, t, func(path string, m mount) error {
+		remoteMounts[path] = m
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return localMounts, remoteMounts, nil
+}
+
+func walkDirectoryMounts(t *mountTable, directory string, f func(path string, m mount) error) error {
+	return filepath.Walk(directory, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		if filepath.Ext(file) != ".json" {
+			return nil
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		var m mount
+		err = json.Unmarshal(content, &m)
+		if err != nil {
+			return fmt.Errorf("unable to parse mount %s: %w", file, err)
+		}
+
+		// The mount path is the file path relative to the directory
+		rel, err := filepath.Rel(directory, file)
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(strings.TrimSuffix(rel, ".json")) + "/"
+
+		if t.system[path] {
+			log("Ignoring system", t.kind, path)
+			return nil
+		}
+
+		return f(path, m.normalize())
+	})
+}
+
+func walkRemoteMounts(client *vaultApi.Client, t *mountTable, f func(path string, m mount) error) error {
+	log("Listing", t.description, "from the Vault server")
+	mounts, err := t.list(client.Sys())
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(mounts))
+	for path := range mounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if t.system[path] {
+			continue
+		}
+
+		err = f(path, newMount(mounts[path]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newMount(output *vaultApi.MountOutput) mount {
+	m := mount{
+		Type:                  output.Type,
+		Description:           output.Description,
+		Local:                 output.Local,
+		SealWrap:              output.SealWrap,
+		ExternalEntropyAccess: output.ExternalEntropyAccess,
+		Options:               output.Options,
+		Config: mountConfig{
+			DefaultLeaseTTL:           output.Config.DefaultLeaseTTL,
+			MaxLeaseTTL:               output.Config.MaxLeaseTTL,
+			ForceNoCache:              output.Config.ForceNoCache,
+			AuditNonHMACRequestKeys:   output.Config.AuditNonHMACRequestKeys,
+			AuditNonHMACResponseKeys:  output.Config.AuditNonHMACResponseKeys,
+			ListingVisibility:         output.Config.ListingVisibility,
+			PassthroughRequestHeaders: output.Config.PassthroughRequestHeaders,
+			AllowedResponseHeaders:    output.Config.AllowedResponseHeaders,
+			TokenType:                 output.Config.TokenType,
+		},
+	}
+
+	return m.normalize()
+}
+
+// normalize makes empty collections nil so that a mount read from a file and
+// the same mount read from Vault compare equal.
+func (m mount) normalize() mount {
+	if len(m.Options) == 0 {
+		m.Options = nil
+	}
+	if len(m.Config.AuditNonHMACRequestKeys) == 0 {
+		m.Config.AuditNonHMACRequestKeys = nil
+	}
+	if len(m.Config.AuditNonHMACResponseKeys) == 0 {
+		m.Config.AuditNonHMACResponseKeys = nil
+	}
+	if len(m.Config.PassthroughRequestHeaders) == 0 {
+		m.Config.PassthroughRequestHeaders = nil
+	}
+	if len(m.Config.AllowedResponseHeaders) == 0 {
+		m.Config.AllowedResponseHeaders = nil
+	}
+	return m
+}
+
+// needsRecreate reports whether going from m to target changes settings that
+// can only be set when the mount is enabled.
+func (m mount) needsRecreate(target mount) bool {
+	return m.Type != target.Type ||
+		m.Local != target.Local ||
+		m.SealWrap != target.SealWrap ||
+		m.ExternalEntropyAccess != target.ExternalEntropyAccess
+}
+
+func (m mount) configInput() vaultApi.MountConfigInput {
+	description := m.Description
+
+	return vaultApi.MountConfigInput{
+		Options:                   m.Options,
+		DefaultLeaseTTL:           fmt.Sprintf("%ds", m.Config.DefaultLeaseTTL),
+		Description:               &description,
+		MaxLeaseTTL:               fmt.Sprintf("%ds", m.Config.MaxLeaseTTL),
+		ForceNoCache:              m.Config.ForceNoCache,
+		AuditNonHMACRequestKeys:   m.Config.AuditNonHMACRequestKeys,
+		AuditNonHMACResponseKeys:  m.Config.AuditNonHMACResponseKeys,
+		ListingVisibility:         m.Config.ListingVisibility,
+		PassthroughRequestHeaders: m.Config.PassthroughRequestHeaders,
+		AllowedResponseHeaders:    m.Config.AllowedResponseHeaders,
+		TokenType:                 m.Config.TokenType,
+	}
+}
+
+func mountFile(directory, path string) string {
+	return filepath.Join(directory, filepath.FromSlash(strings.TrimSuffix(path, "/"))+".json")
+}
+
+func sortedMountPaths(localMounts, remoteMounts map[string]mount) []string {
+	paths := make([]string, 0, len(localMounts)+len(remoteMounts))
+	for path := range localMounts {
+		paths = append(paths, path)
+	}
+	for path := range remoteMounts {
+		if _, ok := localMounts[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// The OIDC objects in the order they have to be restored, as each of them can
+// reference the ones before it.
+var oidcResources = []*resource{
+	{
+		name:   "keys",
+		kind:   "OIDC key",
+		path:   "identity/oidc/key",
+		fields: []string{"algorithm", "allowed_client_ids", "rotation_period", "verification_ttl"},
+	},
+	{
+		name:  "assignments",
+		kind:  "OIDC assignment",
+		path:  "identity/oidc/assignment",
+		read:  readOIDCAssignment,
+		write: writeOIDCAssignment,
+	},
+	{
+		name:   "scopes",
+		kind:   "OIDC scope",
+		path:   "identity/oidc/scope",
+		fields: []string{"description", "template"},
+	},
+	{
+		name:   "clients",
+		kind:   "OIDC client",
+		path:   "identity/oidc/client",
+		fields: []string{"access_token_ttl", "assignments", "client_type", "id_token_ttl", "key", "redirect_uris"},
+	},
+	{
+		name:   "providers",
+		kind:   "OIDC provider",
+		path:   "identity/oidc/provider",
+		fields: []string{"allowed_client_ids", "issuer", "scopes_supported"},
+	},
+	{
+		name:   "roles",
+		kind:   "OIDC role",
+		path:   "identity/oidc/role",
+		fields: []string{"key", "template", "ttl"},
+	},
+}
+
+func oidcCommand() *cli.Command {
+	commands := make([]*cli.Command, 0, len(oidcResources))
+	for _, r := range oidcResources {
+		commands = append(commands, resourceCommand(r, "Synchronize the "+r.kind+"s between Vault and a local directory"))
+	}
+
+	return &cli.Command{
+		Name:        "oidc",
+		Usage:       "Synchronize the identity OIDC provider configuration between Vault and a local directory",
+		Subcommands: commands,
+	}
+}
+
+// Assignments are stored with the names of the entities and groups they
+// contain, as their ids are generated by each Vault server.
+func readOIDCAssignment(client *vaultApi.Client, path string) (map[string]interface{}, error) {
+	data, err := readFields(client, path, []string{"entity_ids", "group_ids"})
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := identityNames(client, "identity/entity/id/", data["entity_ids"])
+	if err != nil {
+		return nil, err
+	}
+	groups, err := identityNames(client, "identity/group/id/", data["group_ids"])
+	if err != nil {
+		return nil, err
+	}
+
+	return pruneEmpty(map[string]interface{}{
+		"entity_names": entities,
+		"group_names":  groups,
+	}), nil
+}
+
+func writeOIDCAssignment(client *vaultApi.Client, path string, data map[string]interface{}) error {
+	entityIDs, err := identityIDs(client, "identity/entity/name/", data["entity_names"], false)
+	if err != nil {
+		return err
+	}
+	groupIDs, err := identityIDs(client, "identity/group/name/", data["group_names"], false)
+	if err != nil {
+		return err
+	}
+
+	return writeData(client, path, map[string]interface{}{
+		"entity_ids": entityIDs,
+		"group_ids":  groupIDs,
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parameterCapabilities are the capabilities of the requests whose parameters
+// Vault checks against the constraints of a path.
+var parameterCapabilities = []string{"create", "update", "patch"}
+
+// lintParameters reports the parameter constraints of the paths that Vault
+// accepts but that don't do what they say: parameters both allowed and denied,
+// required but forbidden, values that can't match, or constraints on paths
+// that take no parameters.
+func lintParameters(p *parsedPolicy, ctx *lintContext) []finding {
+	findings := []finding{}
+	for _, path := range p.paths {
+		for _, problem := range parameterProblems(path) {
+			findings = append(findings, finding{
+				policy:  p.name,
+				line:    path.line,
+				rule:    "parameters",
+				message: fmt.Sprintf("path %q: %s", path.path, problem),
+			})
+		}
+	}
+	return findings
+}
+
+func parameterProblems(path *policyPath) []string {
+	if len(path.AllowedParameters) == 0 && len(path.DeniedParameters) == 0 && len(path.RequiredParameters) == 0 {
+		return nil
+	}
+
+	problems := []string{}
+	if !grantsParameters(path) {
+		problems = append(problems, "parameter constraints only apply to create, update and patch, which the path doesn't grant")
+	}
+	problems = append(problems, parameterNameProblems("allowed_parameters", path.AllowedParameters)...)
+	problems = append(problems, parameterNameProblems("denied_parameters", path.DeniedParameters)...)
+
+	_, denyAll := path.DeniedParameters["*"]
+	if denyAll && len(path.DeniedParameters["*"]) == 0 && len(path.AllowedParameters) > 0 {
+		problems = append(problems, `denied_parameters "*" = [] denies every parameter, allowed_parameters have no effect`)
+	}
+
+	for _, name := range sortedParameterNames(path.AllowedParameters) {
+		denied, ok := path.DeniedParameters[name]
+		if !ok || name == "*" {
+			continue
+		}
+		if len(denied) == 0 {
+			problems = append(problems, fmt.Sprintf("parameter %s is allowed but denied with any value, denied wins", name))
+			continue
+		}
+		for _, value := range path.AllowedParameters[name] {
+			if containsValue(denied, value) {
+				problems = append(problems, fmt.Sprintf("value %v of parameter %s is allowed but denied, denied wins", value, name))
+			}
+		}
+	}
+
+	for _, name := range path.RequiredParameters {
+		if name == "" {
+			problems = append(problems, "required_parameters has an empty name")
+			continue
+		}
+		if denied, ok := path.DeniedParameters[name]; ok && len(denied) == 0 {
+			problems = append(problems, fmt.Sprintf("parameter %s is required but denied with any value, no request can succeed", name))
+		}
+		if !parameterAllowed(path.AllowedParameters, name) {
+			problems = append(problems, fmt.Sprintf("parameter %s is required but not in allowed_parameters, no request can succeed", name))
+		}
+	}
+	return problems
+}
+
+// grantsParameters tells if the path grants a capability whose requests have
+// their parameters checked.
+func grantsParameters(path *policyPath) bool {
+	for _, c := range parameterCapabilities {
+		if path.allows(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// parameterNameProblems reports the names Vault takes literally while they look
+// like patterns, and the values that can never be equal to a parameter.
+func parameterNameProblems(block string, parameters map[string][]interface{}) []string {
+	problems := []string{}
+	for _, name := range sortedParameterNames(parameters) {
+		if name != "*" && strings.Contains(name, "*") {
+			problems = append(problems, fmt.Sprintf(`%s %q: only "*" is a wildcard in the names of parameters`, block, name))
+		}
+		for _, value := range parameters[name] {
+			switch value.(type) {
+			case string, int, int64, float64, bool:
+			default:
+				problems = append(problems, fmt.Sprintf("%s %s: value %v isn't a string, a number or a boolean, it never matches", block, name, value))
+			}
+		}
+	}
+	return problems
+}
+
+// parameterAllowed tells if allowed_parameters let a parameter through, with
+// any value. No allowed_parameters allows everything.
+func parameterAllowed(allowed map[string][]interface{}, name string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	_, ok := allowed[name]
+	_, any := allowed["*"]
+	return ok || any
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if fmt.Sprint(v) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedParameterNames(parameters map[string][]interface{}) []string {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
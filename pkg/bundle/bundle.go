@@ -0,0 +1,243 @@
+// Package bundle reads and writes policy bundles, .vpb files holding a set of
+// policies with their metadata, where they come from and the hash of their
+// content. A bundle is a gzipped JSON document, which the CLI, the daemon and
+// the HTTP API exchange:
+//
+//	b, err := bundle.ReadFile("policies.vpb")
+//	...
+//	changes, err := policysync.Sync(b, store.NewVault(client))
+package bundle
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Extension is the extension of the bundle files.
+const Extension = ".vpb"
+
+// ContentType is the media type of the bundles served over HTTP.
+const ContentType = "application/vnd.vault-policies.bundle+gzip"
+
+// Format is the version of the format of the bundles written. It only changes
+// when readers of the previous version couldn't read them correctly, fields
+// being added without changing it.
+const Format = 1
+
+// Bundle is a set of policies. It is a store, whose changes are kept in memory
+// until it is written.
+type Bundle struct {
+	Format  int       `json:"format"`
+	Created time.Time `json:"created"`
+	Source  Source    `json:"source"`
+	// Policies are sorted by name.
+	Policies []*Policy `json:"policies"`
+}
+
+// Source is where the policies of a bundle come from: a Vault cluster, or a
+// directory.
+type Source struct {
+	Address     string `json:"address,omitempty"`
+	ClusterName string `json:"cluster_name,omitempty"`
+	ClusterID   string `json:"cluster_id,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Directory   string `json:"directory,omitempty"`
+}
+
+// Policy is a policy of a bundle.
+type Policy struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	// SHA256 is the hex-encoded SHA-256 hash of the content.
+	SHA256   string    `json:"sha256"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// Metadata is what is known of a policy besides its content.
+type Metadata struct {
+	Owner       string   `json:"owner,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Links       []string `json:"links,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// HashError is the error of a policy whose content doesn't match its hash,
+// because the bundle was corrupted or edited by hand.
+type HashError struct {
+	Name string
+}
+
+func (e *HashError) Error() string {
+	return fmt.Sprintf("the content of policy %s doesn't match its hash", e.Name)
+}
+
+// New returns an empty bundle of the policies of source.
+func New(source Source) *Bundle {
+	return &Bundle{Format: Format, Created: time.Now().UTC(), Source: source}
+}
+
+// Hash returns the hash of the content of a policy, as recorded in bundles.
+func Hash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Read reads a bundle, checking the hash of each policy.
+func Read(r io.Reader) (*Bundle, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the bundle: %w", err)
+	}
+	defer gz.Close()
+
+	b := &Bundle{}
+	err = json.NewDecoder(gz).Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the bundle: %w", err)
+	}
+	if b.Format < 1 || b.Format > Format {
+		return nil, fmt.Errorf("unable to read the bundle: format %d isn't supported, only up to %d", b.Format, Format)
+	}
+
+	seen := map[string]bool{}
+	for _, p := range b.Policies {
+		if seen[p.Name] {
+			return nil, fmt.Errorf("unable to read the bundle: policy %s is there twice", p.Name)
+		}
+		seen[p.Name] = true
+		if Hash(p.Content) != p.SHA256 {
+			return nil, &HashError{Name: p.Name}
+		}
+	}
+	b.sort()
+	return b, nil
+}
+
+// ReadFile reads the bundle of file.
+func ReadFile(file string) (*Bundle, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return b, nil
+}
+
+// Write writes the bundle, its policies sorted by name.
+func (b *Bundle) Write(w io.Writer) error {
+	b.sort()
+
+	gz := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gz)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(b)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// WriteFile writes the bundle to file, replacing it once written.
+func (b *Bundle) WriteFile(file string) error {
+	temporary := file + ".tmp"
+	f, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+
+	err = b.Write(f)
+	if err != nil {
+		f.Close()
+		os.Remove(temporary)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, file)
+}
+
+// Policy returns the policy of that name, or nil.
+func (b *Bundle) Policy(name string) *Policy {
+	i := b.index(name)
+	if i < 0 {
+		return nil
+	}
+	return b.Policies[i]
+}
+
+// List returns the names of the policies, sorted.
+func (b *Bundle) List() ([]string, error) {
+	b.sort()
+
+	names := make([]string, 0, len(b.Policies))
+	for _, p := range b.Policies {
+		names = append(names, p.Name)
+	}
+	return names, nil
+}
+
+// Get returns the content of a policy.
+func (b *Bundle) Get(name string) (string, error) {
+	p := b.Policy(name)
+	if p == nil {
+		return "", fmt.Errorf("no policy %s in the bundle", name)
+	}
+	return p.Content, nil
+}
+
+// Put creates or replaces a policy, keeping its metadata.
+func (b *Bundle) Put(name, content string) error {
+	if p := b.Policy(name); p != nil {
+		p.Content, p.SHA256 = content, Hash(content)
+		return nil
+	}
+
+	i := sort.Search(len(b.Policies), func(i int) bool {
+		return b.Policies[i].Name > name
+	})
+	b.Policies = append(b.Policies, nil)
+	copy(b.Policies[i+1:], b.Policies[i:])
+	b.Policies[i] = &Policy{Name: name, Content: content, SHA256: Hash(content)}
+	return nil
+}
+
+// Delete removes a policy.
+func (b *Bundle) Delete(name string) error {
+	i := b.index(name)
+	if i >= 0 {
+		b.Policies = append(b.Policies[:i], b.Policies[i+1:]...)
+	}
+	return nil
+}
+
+// index returns the position of a policy, or -1, the policies being sorted.
+func (b *Bundle) index(name string) int {
+	i := sort.Search(len(b.Policies), func(i int) bool {
+		return b.Policies[i].Name >= name
+	})
+	if i < len(b.Policies) && b.Policies[i].Name == name {
+		return i
+	}
+	return -1
+}
+
+func (b *Bundle) sort() {
+	sort.SliceStable(b.Policies, func(i, j int) bool {
+		return b.Policies[i].Name < b.Policies[j].Name
+	})
+}
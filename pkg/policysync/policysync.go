@@ -0,0 +1,230 @@
+// Package policysync computes and applies the changes making the policies of a
+// store match those of another one, typically a Vault server and a local
+// directory:
+//
+//	client, err := vaultclient.NewFromEnvironment()
+//	...
+//	changes, err := policysync.Sync(store.NewDirectory("policies"), store.NewVault(client))
+package policysync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fynelabs/vault-policies/pkg/store"
+	"github.com/hashicorp/hcl/hcl/scanner"
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+// Action is what a change does to a policy.
+type Action string
+
+// The actions of a change.
+const (
+	Create Action = "+"
+	Update Action = "~"
+	Delete Action = "-"
+)
+
+// Builtin are the policies that Vault creates itself and refuses to delete.
+var Builtin = map[string]bool{
+	"default": true,
+	"root":    true,
+}
+
+// Change is the creation, update or deletion of a policy.
+type Change struct {
+	Action Action
+	Name   string
+	// Content is the new content of a created or updated policy.
+	Content string
+	// Previous is the content of an updated or deleted policy before the
+	// change.
+	Previous string
+}
+
+// Load returns the content of all the policies of a store, by name. Walk
+// suits large stores better, as it reads the policies one at a time.
+func Load(s store.Store) (map[string]string, error) {
+	policies := map[string]string{}
+	err := Walk(s, func(name, content string) error {
+		policies[name] = content
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// Walk calls f with the name and content of each policy of a store, sorted by
+// name, reading them one at a time.
+func Walk(s store.Store, f func(name, content string) error) error {
+	names, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		content, err := get(s, name)
+		if err != nil {
+			return err
+		}
+		err = f(name, content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func get(s store.Store, name string) (string, error) {
+	content, err := s.Get(name)
+	if err != nil {
+		return "", fmt.Errorf("unable to get policy %s: %w", name, err)
+	}
+	return content, nil
+}
+
+// Diff returns the changes making the policies of target match those of
+// source: the deletions first, then the creations and updates, each sorted by
+// name. Built-in policies are never deleted, and policies differing only by
+// their comments or formatting are not updated. The policies are compared one
+// at a time, and only the contents of those changing are kept, so that large
+// stores don't take much memory.
+func Diff(source, target store.Store) ([]Change, error) {
+	names, err := source.List()
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	targetNames, err := target.List()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(targetNames))
+	for _, name := range targetNames {
+		existing[name] = true
+	}
+
+	changes := []Change{}
+	for _, name := range targetNames {
+		if wanted[name] || Builtin[name] {
+			continue
+		}
+		previous, err := get(target, name)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, Change{Action: Delete, Name: name, Previous: previous})
+	}
+
+	for _, name := range names {
+		content, err := get(source, name)
+		if err != nil {
+			return nil, err
+		}
+		if !existing[name] {
+			changes = append(changes, Change{Action: Create, Name: name, Content: content})
+			continue
+		}
+
+		current, err := get(target, name)
+		if err != nil {
+			return nil, err
+		}
+		if !Equal(current, content) {
+			changes = append(changes, Change{Action: Update, Name: name, Content: content, Previous: current})
+		}
+	}
+	return changes, nil
+}
+
+// Equal tells whether two policies have the same content once normalized.
+func Equal(a, b string) bool {
+	return a == b || Normalize(a) == Normalize(b)
+}
+
+// Normalize returns the HCL tokens of a policy separated by single spaces,
+// without its comments, the optional = before objects and the trailing commas,
+// so that policies Vault or an editor formatted differently compare equal. A
+// policy that doesn't scan is returned without its surrounding whitespace.
+func Normalize(content string) string {
+	s := scanner.New([]byte(content))
+	s.Error = func(token.Pos, string) {}
+
+	tokens := []token.Token{}
+	for {
+		tok := s.Scan()
+		switch tok.Type {
+		case token.EOF:
+			return joinTokens(tokens)
+		case token.ILLEGAL:
+			return strings.TrimSpace(content)
+		case token.COMMENT:
+			continue
+		case token.LBRACE:
+			tokens = dropLast(tokens, token.ASSIGN)
+		case token.RBRACK, token.RBRACE:
+			tokens = dropLast(tokens, token.COMMA)
+		}
+		if s.ErrorCount > 0 {
+			return strings.TrimSpace(content)
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+func dropLast(tokens []token.Token, t token.Type) []token.Token {
+	if len(tokens) > 0 && tokens[len(tokens)-1].Type == t {
+		return tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+func joinTokens(tokens []token.Token) string {
+	text := make([]string, len(tokens))
+	for i, tok := range tokens {
+		text[i] = tok.Text
+	}
+	return strings.Join(text, " ")
+}
+
+// Apply makes the changes to target, stopping at the first error.
+func Apply(target store.Store, changes []Change) error {
+	for _, c := range changes {
+		err := ApplyChange(target, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyChange makes a single change to target.
+func ApplyChange(target store.Store, c Change) error {
+	var err error
+	if c.Action == Delete {
+		err = target.Delete(c.Name)
+	} else {
+		err = target.Put(c.Name, c.Content)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to apply the change to policy %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// Sync makes the policies of target match those of source, and returns the
+// changes it made.
+func Sync(source, target store.Store) ([]Change, error) {
+	changes, err := Diff(source, target)
+	if err != nil {
+		return nil, err
+	}
+	return changes, Apply(target, changes)
+}
@@ -0,0 +1,60 @@
+package policysync
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name:     "whitespace",
+			content:  "path \"secret/*\" {\n\tcapabilities   = [\"read\",\n \"list\"]\n}\n",
+			expected: `path "secret/*" { capabilities = [ "read" , "list" ] }`,
+		},
+		{
+			name:     "comments",
+			content:  "# Team app\npath \"secret/*\" { // read only\n  capabilities = [\"read\"] /* for now */\n}",
+			expected: `path "secret/*" { capabilities = [ "read" ] }`,
+		},
+		{
+			name:     "assignment of an object",
+			content:  `path "secret/*" = { capabilities = ["read"] }`,
+			expected: `path "secret/*" { capabilities = [ "read" ] }`,
+		},
+		{
+			name:     "trailing commas",
+			content:  "path \"secret/*\" {\n  capabilities = [\"read\", \"list\",]\n}",
+			expected: `path "secret/*" { capabilities = [ "read" , "list" ] }`,
+		},
+		{
+			name:     "empty",
+			content:  "\n# nothing\n",
+			expected: "",
+		},
+		{
+			name:     "doesn't scan",
+			content:  "  path \"secret/* {\n",
+			expected: "path \"secret/* {",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Normalize(test.content); got != test.expected {
+				t.Errorf("got %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := "path \"secret/*\" {\n  capabilities = [\"read\"]\n}\n"
+	if !Equal(a, "# formatted\npath \"secret/*\" = { capabilities = [\"read\",] }") {
+		t.Error("the same policy formatted differently isn't equal")
+	}
+	if Equal(a, `path "secret/*" { capabilities = ["list"] }`) {
+		t.Error("different policies are equal")
+	}
+}
@@ -0,0 +1,199 @@
+// Package policysynctest runs disposable Vault dev servers in docker containers
+// for black-box tests of the tools embedding policy synchronization:
+//
+//	func TestSync(t *testing.T) {
+//		v := policysynctest.Start(t)
+//		v.LoadFixtures("testdata/before")
+//
+//		_, err := policysync.Sync(store.NewDirectory("testdata/after"), v.Store())
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		v.AssertMatches("testdata/after")
+//	}
+//
+// Tests are skipped when docker isn't available.
+package policysynctest
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/policysync"
+	"github.com/fynelabs/vault-policies/pkg/store"
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// DefaultImage is the docker image of Vault started by Start.
+const DefaultImage = "hashicorp/vault"
+
+// startupTimeout bounds how long Vault may take to answer once its container
+// started.
+const startupTimeout = 30 * time.Second
+
+// Vault is a Vault dev server running in a container for the duration of a
+// test.
+type Vault struct {
+	// Client is authenticated with the root token.
+	Client *vaultApi.Client
+
+	t         testing.TB
+	container string
+}
+
+// Option changes how Start runs Vault.
+type Option func(*options)
+
+type options struct {
+	image string
+}
+
+// WithImage runs another image than DefaultImage, like a given version of
+// Vault or Vault Enterprise.
+func WithImage(image string) Option {
+	return func(o *options) {
+		o.image = image
+	}
+}
+
+// Start runs a Vault dev server in a new container, removed at the end of the
+// test, and waits for it to answer.
+func Start(t testing.TB, opts ...Option) *Vault {
+	t.Helper()
+
+	o := &options{image: DefaultImage}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is required to run Vault")
+	}
+
+	output, err := exec.Command("docker", "run", "--detach", "--rm",
+		"--publish", "127.0.0.1::8200",
+		"--env", "VAULT_DEV_ROOT_TOKEN_ID="+vaultclient.DevToken,
+		o.image).Output()
+	if err != nil {
+		t.Fatalf("unable to start Vault in docker: %v", commandError(err))
+	}
+
+	v := &Vault{t: t, container: strings.TrimSpace(string(output))}
+	t.Cleanup(v.stop)
+
+	output, err = exec.Command("docker", "port", v.container, "8200/tcp").Output()
+	if err != nil {
+		t.Fatalf("unable to find the port of Vault: %v", commandError(err))
+	}
+	address := strings.TrimSpace(strings.Split(string(output), "\n")[0])
+
+	v.Client, err = vaultclient.New("http://"+address, vaultclient.DevToken, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = v.wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func (v *Vault) stop() {
+	err := exec.Command("docker", "rm", "--force", v.container).Run()
+	if err != nil {
+		v.t.Logf("unable to remove the container %s: %v", v.container, err)
+	}
+}
+
+func (v *Vault) wait() error {
+	deadline := time.Now().Add(startupTimeout)
+	for {
+		health, err := v.Client.Sys().Health()
+		if err == nil && health.Initialized && !health.Sealed {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("vault not ready after %s: %v", startupTimeout, err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// Store returns the policies of the server.
+func (v *Vault) Store() *store.Vault {
+	return store.NewVault(v.Client)
+}
+
+// LoadFixtures writes the policies of a local directory to the server.
+func (v *Vault) LoadFixtures(directory string) {
+	v.t.Helper()
+
+	policies, err := policysync.Load(store.NewDirectory(directory))
+	if err != nil {
+		v.t.Fatalf("unable to load the fixtures of %s: %v", directory, err)
+	}
+
+	for name, content := range policies {
+		err = v.Client.Sys().PutPolicy(name, content)
+		if err != nil {
+			v.t.Fatalf("unable to write policy %s: %v", name, err)
+		}
+	}
+}
+
+// AssertPolicy fails the test unless the server has the policy with exactly
+// this content.
+func (v *Vault) AssertPolicy(name, content string) {
+	v.t.Helper()
+
+	actual, err := v.Client.Sys().GetPolicy(name)
+	switch {
+	case err != nil:
+		v.t.Errorf("unable to get policy %s: %v", name, err)
+	case actual == "" && content != "":
+		v.t.Errorf("policy %s is missing", name)
+	case actual != content:
+		v.t.Errorf("policy %s is\n%s\nexpected\n%s", name, actual, content)
+	}
+}
+
+// AssertNoPolicy fails the test if the server has the policy.
+func (v *Vault) AssertNoPolicy(name string) {
+	v.t.Helper()
+
+	actual, err := v.Client.Sys().GetPolicy(name)
+	switch {
+	case err != nil:
+		v.t.Errorf("unable to get policy %s: %v", name, err)
+	case actual != "":
+		v.t.Errorf("policy %s exists", name)
+	}
+}
+
+// AssertMatches fails the test unless the policies of the server are exactly
+// those of a local directory, apart from the built-in ones.
+func (v *Vault) AssertMatches(directory string) {
+	v.t.Helper()
+
+	changes, err := policysync.Diff(store.NewDirectory(directory), v.Store())
+	if err != nil {
+		v.t.Fatalf("unable to compare the server with %s: %v", directory, err)
+	}
+
+	for _, c := range changes {
+		v.t.Errorf("policy %s differs from %s (%s)", c.Name, directory, c.Action)
+	}
+}
+
+// commandError adds the standard error of a failed command to its error.
+func commandError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
@@ -0,0 +1,511 @@
+// Package store reads and writes Vault ACL policies, either in a local
+// directory holding a <name>.hcl file per policy or on a Vault server.
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// Store holds policies by name.
+type Store interface {
+	// List returns the names of the policies, sorted.
+	List() ([]string, error)
+	// Get returns the content of a policy.
+	Get(name string) (string, error)
+	// Put creates or replaces a policy.
+	Put(name, content string) error
+	// Delete removes a policy.
+	Delete(name string) error
+}
+
+// DefaultMaxSize is the largest policy file a Directory reads by default.
+const DefaultMaxSize = 1 << 20
+
+// Directory is a local directory holding a <name>.hcl file per policy. Files
+// in subdirectories are policies too, named after their file only. Like Vault,
+// policy names are lowercased and trimmed, so Admin.hcl holds policy admin.
+type Directory struct {
+	Path string
+	// Warn, if set, is called once for each file whose name Vault changes
+	// into the name of its policy, and for each symbolic link skipped.
+	Warn func(message string)
+	// MaxSize is the size above which a policy file is an error rather than
+	// read, DefaultMaxSize when not set.
+	MaxSize int64
+	// FollowSymlinks reads the files and walks the directories symbolic
+	// links point to, which are otherwise skipped.
+	FollowSymlinks bool
+	// NormalizeWrites removes the byte order mark and carriage returns of
+	// the policies Put writes, as they are when read.
+	NormalizeWrites bool
+	// FileMode is the permissions of the files Put writes, 0644 when not
+	// set.
+	FileMode os.FileMode
+	// DirMode is the permissions of the subdirectories Put creates, 0755 when
+	// not set.
+	DirMode os.FileMode
+	// Layout returns where Put writes a new policy, relative to the
+	// directory, <name>.hcl at its root when not set.
+	Layout func(name string) string
+	// Shallow only reads the files at the root of the directory, not those of
+	// its subdirectories.
+	Shallow bool
+	// Filter, if set, tells whether the policy of a file is part of the
+	// directory, the files it rejects being ignored.
+	Filter func(file, name string) (bool, error)
+
+	warned map[string]bool
+	// files are the files of the policies by name, read once for Get and
+	// File rather than walking the directory for each policy, and kept up to
+	// date by Put and Delete.
+	files map[string]string
+}
+
+// NewDirectory returns the store of the policies in the directory at path.
+func NewDirectory(path string) *Directory {
+	return &Directory{Path: path}
+}
+
+// Walk calls f with the file, name and content of each policy of the
+// directory, sorted by name and then by file.
+func (d *Directory) Walk(f func(file, name string, content []byte) error) error {
+	return d.walkFiles(func(file, name string) error {
+		content, err := d.read(file)
+		if err != nil {
+			return err
+		}
+
+		return f(file, name, content)
+	})
+}
+
+// policyFile is a file of a directory holding a policy.
+type policyFile struct {
+	file, name string
+}
+
+// walkFiles is Walk without reading the files.
+func (d *Directory) walkFiles(f func(file, name string) error) error {
+	files := []policyFile{}
+	err := d.collect(d.Path, map[string]bool{}, &files)
+	if err != nil {
+		return err
+	}
+
+	// The policies of subdirectories are named after their file only, so the
+	// order of the walk isn't the order of the names.
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].name != files[j].name {
+			return files[i].name < files[j].name
+		}
+		return files[i].file < files[j].file
+	})
+
+	conflicts := ConflictError{}
+	for i := 1; i < len(files); i++ {
+		if files[i].name != files[i-1].name {
+			continue
+		}
+		if len(conflicts[files[i].name]) == 0 {
+			conflicts[files[i].name] = []string{files[i-1].file}
+		}
+		conflicts[files[i].name] = append(conflicts[files[i].name], files[i].file)
+	}
+	if len(conflicts) > 0 {
+		return conflicts
+	}
+
+	for _, pf := range files {
+		err = f(pf.file, pf.name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConflictError lists the files of a directory holding the same policy, by
+// policy name. Nothing is read from a directory with conflicts, rather than
+// one of the files winning.
+type ConflictError map[string][]string
+
+func (c ConflictError) Error() string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"several files hold the same policy:"}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  %s: %s", name, strings.Join(c[name], ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// collect adds the policy files of dir and its subdirectories to files.
+// visited holds the real paths of the directories already walked, to not loop
+// through symbolic links.
+func (d *Directory) collect(dir string, visited map[string]bool, files *[]policyFile) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if visited[real] {
+		return nil
+	}
+	visited[real] = true
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.Type()&os.ModeSymlink != 0 && !d.FollowSymlinks {
+			d.warn(path, fmt.Sprintf("skipping the symbolic link %s, symbolic links are only followed when enabled", path))
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && d.Shallow {
+			continue
+		}
+		if info.IsDir() {
+			err = d.collect(path, visited, files)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if filepath.Ext(path) != ".hcl" {
+			continue
+		}
+
+		if info.Size() > d.maxSize() {
+			return fmt.Errorf("%s is %d bytes, more than the %d bytes a policy file may be", path, info.Size(), d.maxSize())
+		}
+
+		// Guess the policy name from the file name
+		base := filepath.Base(path)
+		base = base[:len(base)-len(filepath.Ext(base))]
+		name := PolicyName(base)
+		if name != base {
+			d.warn(path, fmt.Sprintf("%s holds policy %q, as Vault lowercases and trims policy names", path, name))
+		}
+
+		if d.Filter != nil {
+			ok, err := d.Filter(path, name)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		*files = append(*files, policyFile{file: path, name: name})
+	}
+	return nil
+}
+
+func (d *Directory) maxSize() int64 {
+	if d.MaxSize <= 0 {
+		return DefaultMaxSize
+	}
+	return d.MaxSize
+}
+
+// read returns the content of a policy file with Unix line endings and
+// without byte order mark, unless it isn't text.
+func (d *Directory) read(file string) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content) {
+		return nil, fmt.Errorf("%s is not a text file", file)
+	}
+	return NormalizeText(content), nil
+}
+
+// NormalizeText removes the UTF-8 byte order mark and the carriage returns of
+// the line endings of files edited on Windows.
+func NormalizeText(content []byte) []byte {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+}
+
+func (d *Directory) warn(file, message string) {
+	if d.Warn == nil || d.warned[file] {
+		return
+	}
+	if d.warned == nil {
+		d.warned = map[string]bool{}
+	}
+	d.warned[file] = true
+	d.Warn(message)
+}
+
+// PolicyName returns the name Vault gives to a policy created as name.
+func PolicyName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// List returns the names of the policies of the directory.
+func (d *Directory) List() ([]string, error) {
+	names := []string{}
+	err := d.walkFiles(func(file, name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns the content of the file of a policy.
+func (d *Directory) Get(name string) (string, error) {
+	file, err := d.file(name)
+	if err != nil {
+		return "", err
+	}
+	if file == "" {
+		return "", fmt.Errorf("no file for policy %s in %s", name, d.Path)
+	}
+
+	content, err := d.read(file)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// File returns the file Put writes a policy to: its current file if it has one
+// and otherwise where Layout places it.
+func (d *Directory) File(name string) (string, error) {
+	file, err := d.file(PolicyName(name))
+	if err != nil || file != "" {
+		return file, err
+	}
+
+	if d.Layout != nil {
+		return filepath.Join(d.Path, d.Layout(name)), nil
+	}
+	return filepath.Join(d.Path, name+".hcl"), nil
+}
+
+// Put writes the file of a policy, see File.
+func (d *Directory) Put(name, content string) error {
+	file, err := d.File(name)
+	if err != nil {
+		return err
+	}
+
+	dirMode := d.DirMode
+	if dirMode == 0 {
+		dirMode = 0755
+	}
+	err = os.MkdirAll(filepath.Dir(file), dirMode)
+	if err != nil {
+		return err
+	}
+
+	data := []byte(content)
+	if d.NormalizeWrites {
+		data = NormalizeText(data)
+	}
+
+	mode := d.FileMode
+	if mode == 0 {
+		mode = 0644
+	}
+	err = os.WriteFile(file, data, mode)
+	if err != nil {
+		return err
+	}
+	if d.files != nil {
+		d.files[PolicyName(name)] = file
+	}
+	// WriteFile only sets the permissions of new files.
+	return os.Chmod(file, mode)
+}
+
+// Delete removes the file of a policy.
+func (d *Directory) Delete(name string) error {
+	file, err := d.file(name)
+	if err != nil || file == "" {
+		return err
+	}
+	err = os.Remove(file)
+	if err == nil {
+		delete(d.files, name)
+	}
+	return err
+}
+
+// file returns the file of a policy, or an empty string if it has none.
+func (d *Directory) file(name string) (string, error) {
+	if d.files == nil {
+		files := map[string]string{}
+		err := d.walkFiles(func(file, policy string) error {
+			if _, ok := files[policy]; !ok {
+				files[policy] = file
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		d.files = files
+	}
+	return d.files[name], nil
+}
+
+// Vault is the set of ACL policies of a Vault server.
+type Vault struct {
+	client *vaultApi.Client
+}
+
+// NewVault returns the store of the policies of the Vault server of client.
+func NewVault(client *vaultApi.Client) *Vault {
+	return &Vault{client: client}
+}
+
+// List returns the names of the policies of Vault.
+func (v *Vault) List() ([]string, error) {
+	names, err := v.client.Sys().ListPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns the content of a policy of Vault.
+func (v *Vault) Get(name string) (string, error) {
+	return v.client.Sys().GetPolicy(name)
+}
+
+// Put creates or replaces a policy of Vault.
+func (v *Vault) Put(name, content string) error {
+	return v.client.Sys().PutPolicy(name, content)
+}
+
+// Delete removes a policy of Vault.
+func (v *Vault) Delete(name string) error {
+	return v.client.Sys().DeletePolicy(name)
+}
+
+// Overlay merges the policies of several directories, like a shared base and
+// the overrides of a team: a policy of a later directory replaces the policy of
+// the same name of earlier ones.
+type Overlay struct {
+	Directories []*Directory
+}
+
+// NewOverlay returns the store merging the policies of directories, from the
+// lowest to the highest precedence.
+func NewOverlay(directories ...*Directory) *Overlay {
+	return &Overlay{Directories: directories}
+}
+
+// Sources returns the files holding each policy, from the lowest to the
+// highest precedence: the content of the policy is the one of the last file.
+func (o *Overlay) Sources() (map[string][]string, error) {
+	sources := map[string][]string{}
+	for _, d := range o.Directories {
+		err := d.walkFiles(func(file, name string) error {
+			sources[name] = append(sources[name], file)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+// List returns the names of the policies of all the directories.
+func (o *Overlay) List() ([]string, error) {
+	sources, err := o.Sources()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns the content of a policy in the last directory holding it.
+func (o *Overlay) Get(name string) (string, error) {
+	d, err := o.holder(name)
+	if err != nil {
+		return "", err
+	}
+	if d == nil {
+		return "", fmt.Errorf("no file for policy %s in any directory", name)
+	}
+	return d.Get(name)
+}
+
+// Put writes a policy to the last directory holding it, or to the last
+// directory for a new policy.
+func (o *Overlay) Put(name, content string) error {
+	d, err := o.holder(name)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		d = o.Directories[len(o.Directories)-1]
+	}
+	return d.Put(name, content)
+}
+
+// Delete removes the files of a policy from all the directories.
+func (o *Overlay) Delete(name string) error {
+	for _, d := range o.Directories {
+		err := d.Delete(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holder returns the last directory holding a policy, or nil if none does.
+func (o *Overlay) holder(name string) (*Directory, error) {
+	for i := len(o.Directories) - 1; i >= 0; i-- {
+		file, err := o.Directories[i].file(name)
+		if err != nil {
+			return nil, err
+		}
+		if file != "" {
+			return o.Directories[i], nil
+		}
+	}
+	return nil, nil
+}
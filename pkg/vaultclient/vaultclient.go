@@ -0,0 +1,625 @@
+// Package vaultclient creates the clients of the Vault servers the policies are
+// synchronized with.
+package vaultclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// DevAddress and DevToken are the address and root token of the Vault dev
+// server, as started with vault server -dev -dev-root-token-id=dev-only-token.
+const (
+	DevAddress = "http://127.0.0.1:8200"
+	DevToken   = "dev-only-token"
+)
+
+// Option changes the configuration of a client before it is created.
+type Option func(*vaultApi.Config) error
+
+// WithTransport wraps the HTTP transport of the client, to observe or replace
+// the requests it sends.
+func WithTransport(wrap func(http.RoundTripper) http.RoundTripper) Option {
+	return func(config *vaultApi.Config) error {
+		config.HttpClient.Transport = wrap(config.HttpClient.Transport)
+		return nil
+	}
+}
+
+// TransportSettings tune the HTTP connections of a client, the zero value
+// keeping the defaults of the Vault API.
+type TransportSettings struct {
+	// DisableKeepAlives opens a new connection for each request.
+	DisableKeepAlives bool
+	// MaxIdleConnsPerHost is how many idle connections to Vault are kept
+	// open for the next requests.
+	MaxIdleConnsPerHost int
+	// TLSHandshakeTimeout is how long the TLS handshake may take.
+	TLSHandshakeTimeout time.Duration
+	// DisableHTTP2 only speaks HTTP/1.1 to Vault.
+	DisableHTTP2 bool
+}
+
+// WithTransportSettings tunes the HTTP transport of the client. It must come
+// before the options wrapping the transport.
+func WithTransportSettings(settings TransportSettings) Option {
+	return func(config *vaultApi.Config) error {
+		transport, ok := config.HttpClient.Transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("unable to tune the HTTP transport of the client, it was replaced")
+		}
+
+		transport.DisableKeepAlives = settings.DisableKeepAlives
+		if settings.MaxIdleConnsPerHost > 0 {
+			transport.MaxIdleConnsPerHost = settings.MaxIdleConnsPerHost
+			if transport.MaxIdleConns > 0 && transport.MaxIdleConns < settings.MaxIdleConnsPerHost {
+				transport.MaxIdleConns = settings.MaxIdleConnsPerHost
+			}
+		}
+		if settings.TLSHandshakeTimeout > 0 {
+			transport.TLSHandshakeTimeout = settings.TLSHandshakeTimeout
+		}
+		if settings.DisableHTTP2 {
+			// A non-nil empty map keeps HTTP/2 from being negotiated.
+			transport.ForceAttemptHTTP2 = false
+			transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		return nil
+	}
+}
+
+// WithProxy sends the requests through the HTTP, HTTPS or SOCKS5 proxy at
+// proxyURL, rather than the proxy of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables. It must come before the options wrapping the
+// transport.
+func WithProxy(proxyURL string) Option {
+	return func(config *vaultApi.Config) error {
+		u, err := url.Parse(proxyURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy %q, expected a URL like http://proxy:3128", proxyURL)
+		}
+
+		transport, ok := config.HttpClient.Transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("unable to set the proxy of the client, its transport was replaced")
+		}
+		transport.Proxy = http.ProxyURL(u)
+		return nil
+	}
+}
+
+// WithHeaders adds headers to every request, like the identity that an
+// ingress in front of Vault expects.
+func WithHeaders(headers http.Header) Option {
+	return WithTransport(func(next http.RoundTripper) http.RoundTripper {
+		return &headerTransport{next: next, headers: headers}
+	})
+}
+
+type headerTransport struct {
+	next    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// A round tripper must not change the request it is given.
+	r = r.Clone(r.Context())
+	for name, values := range t.headers {
+		r.Header[name] = values
+	}
+	return t.next.RoundTrip(r)
+}
+
+// WithRequestTimeout limits how long each request may take, retries included.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(config *vaultApi.Config) error {
+		config.Timeout = timeout
+		return nil
+	}
+}
+
+// ErrDeadline is the error of the requests sent after the deadline of
+// WithDeadline.
+var ErrDeadline = errors.New("deadline reached")
+
+// WithDeadline cancels the requests still running at deadline, and refuses
+// those sent after.
+func WithDeadline(deadline time.Time) Option {
+	return func(config *vaultApi.Config) error {
+		checkRetry := config.CheckRetry
+		if checkRetry == nil {
+			checkRetry = vaultApi.DefaultRetryPolicy
+		}
+		config.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			if errors.Is(err, ErrDeadline) {
+				return false, err
+			}
+			return checkRetry(ctx, resp, err)
+		}
+
+		return WithTransport(func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if !time.Now().Before(deadline) {
+					return nil, ErrDeadline
+				}
+
+				ctx, cancel := context.WithDeadline(r.Context(), deadline)
+				resp, err := next.RoundTrip(r.WithContext(ctx))
+				if err != nil {
+					cancel()
+					if ctx.Err() == context.DeadlineExceeded {
+						return nil, fmt.Errorf("%w: %v", ErrDeadline, err)
+					}
+					return nil, err
+				}
+				// The body is read after the round trip.
+				resp.Body = &cancelingBody{ReadCloser: resp.Body, cancel: cancel}
+				return resp, nil
+			})
+		})(config)
+	}
+}
+
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// RetryPolicy is how a client retries the requests that failed.
+type RetryPolicy struct {
+	// MaxRetries is how many times a request is retried, as many as the
+	// Vault API does when negative.
+	MaxRetries int
+	// MaxElapsed is how long the client may wait between retries in all, no
+	// request being retried once it waited that long. Zero doesn't limit it.
+	MaxElapsed time.Duration
+	// RetryOn are the status codes retried, those of the Vault API when
+	// empty. The requests failing without a response are always retried.
+	RetryOn []int
+	// Breaker stops the requests once Vault failed too many, when set.
+	Breaker *CircuitBreaker
+}
+
+// WithRetryPolicy replaces how the client retries the requests that failed.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(config *vaultApi.Config) error {
+		if policy.MaxRetries >= 0 {
+			config.MaxRetries = policy.MaxRetries
+		}
+
+		backoff := config.Backoff
+		if backoff == nil {
+			backoff = retryablehttp.LinearJitterBackoff
+		}
+		var mu sync.Mutex
+		waited := time.Duration(0)
+		config.Backoff = func(min, max time.Duration, attempt int, resp *http.Response) time.Duration {
+			wait := backoff(min, max, attempt, resp)
+			mu.Lock()
+			waited += wait
+			mu.Unlock()
+			return wait
+		}
+
+		config.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			if policy.Breaker != nil {
+				open := policy.Breaker.record(ctx, resp, err)
+				if open != nil {
+					return false, open
+				}
+			}
+
+			retry, err := vaultApi.DefaultRetryPolicy(ctx, resp, err)
+			if len(policy.RetryOn) > 0 && err == nil && resp != nil {
+				retry = false
+				for _, status := range policy.RetryOn {
+					retry = retry || resp.StatusCode == status
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if retry && policy.MaxElapsed > 0 && waited >= policy.MaxElapsed {
+				return false, err
+			}
+			return retry, err
+		}
+
+		if policy.Breaker != nil {
+			return WithTransport(policy.Breaker.wrap)(config)
+		}
+		return nil
+	}
+}
+
+// CircuitBreaker stops sending requests once Vault failed too many of them
+// in a row, so that a run stops early rather than failing every request when
+// Vault is down.
+type CircuitBreaker struct {
+	// Failures is how many requests in a row, retries included, may fail
+	// without a response or with a server error.
+	Failures int
+
+	mu       sync.Mutex
+	failed   int
+	sent     int
+	answered int
+	last     string
+	open     *CircuitOpenError
+}
+
+// CircuitOpenError is the error of the requests refused once the circuit
+// breaker opened.
+type CircuitOpenError struct {
+	Failures int
+	Sent     int
+	Answered int
+	Last     string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("stopped sending requests to Vault after %d failed in a row, the last with %s (%d requests sent, %d answered)",
+		e.Failures, e.Last, e.Sent, e.Answered)
+}
+
+// Open returns the error of the requests refused, nil while the circuit
+// breaker is closed.
+func (b *CircuitBreaker) Open() *CircuitOpenError {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// record counts the result of a request, and returns the error opening the
+// circuit breaker if it did.
+func (b *CircuitBreaker) record(ctx context.Context, resp *http.Response, err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open != nil {
+		return b.open
+	}
+
+	b.sent++
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// The request was canceled, it says nothing of Vault.
+		return nil
+	case err != nil:
+		b.failed++
+		b.last = err.Error()
+	case resp != nil && resp.StatusCode >= http.StatusInternalServerError:
+		b.failed++
+		b.last = resp.Status
+	default:
+		b.failed = 0
+		b.answered++
+		return nil
+	}
+
+	if b.failed < b.Failures {
+		return nil
+	}
+	b.open = &CircuitOpenError{Failures: b.failed, Sent: b.sent, Answered: b.answered, Last: b.last}
+	return b.open
+}
+
+// wrap refuses the requests once the circuit breaker opened.
+func (b *CircuitBreaker) wrap(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if open := b.Open(); open != nil {
+			return nil, open
+		}
+		return next.RoundTrip(r)
+	})
+}
+
+// Throttle spaces the calls changing Vault evenly, so that a large run doesn't
+// load its storage or its audit devices with bursts of writes. It is shared
+// by the clients of a run.
+type Throttle struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewThrottle returns a throttle letting at most requests calls through per
+// period.
+func NewThrottle(requests int, per time.Duration) (*Throttle, error) {
+	if requests < 1 || per <= 0 {
+		return nil, fmt.Errorf("a throttle lets at least 1 request through per positive period")
+	}
+	return &Throttle{interval: per / time.Duration(requests)}, nil
+}
+
+// ParseThrottle parses a throttle like 5/s, 100/m, 1000/h or 10/30s, a number
+// of requests per second when no period is given.
+func ParseThrottle(throttle string) (*Throttle, error) {
+	count, period, found := strings.Cut(throttle, "/")
+	requests, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return nil, fmt.Errorf("invalid throttle %q, expected requests per period like 5/s", throttle)
+	}
+
+	per := time.Second
+	switch period = strings.TrimSpace(period); {
+	case !found || period == "s":
+	case period == "m":
+		per = time.Minute
+	case period == "h":
+		per = time.Hour
+	default:
+		per, err = time.ParseDuration(period)
+		if err != nil {
+			return nil, fmt.Errorf("invalid throttle %q, expected requests per period like 5/s", throttle)
+		}
+	}
+	return NewThrottle(requests, per)
+}
+
+// wait waits for the turn of a call, or for ctx to be done.
+func (t *Throttle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	now := time.Now()
+	turn := t.next
+	if turn.Before(now) {
+		turn = now
+	}
+	t.next = turn.Add(t.interval)
+	t.mu.Unlock()
+
+	wait := turn.Sub(now)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// WithThrottle delays the requests that may change Vault, all but GET, HEAD
+// and LIST, to the rate of throttle. Their retries are throttled too.
+func WithThrottle(throttle *Throttle) Option {
+	return WithTransport(func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, "LIST":
+			default:
+				err := throttle.wait(r.Context())
+				if err != nil {
+					return nil, err
+				}
+			}
+			return next.RoundTrip(r)
+		})
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// TLSSettings configure the TLS connections of a client, like the flags and
+// environment variables of the vault command line.
+type TLSSettings struct {
+	// CACert is a PEM file of the CA certificates trusted to sign the
+	// certificate of Vault, and CAPath a directory of such files, the system
+	// ones being trusted when neither is set.
+	CACert string
+	CAPath string
+	// ClientCert and ClientKey are the PEM files of the certificate the client
+	// authenticates with, both set or neither.
+	ClientCert string
+	ClientKey  string
+	// ServerName is the name expected in the certificate of Vault, and sent
+	// with SNI, instead of the host of its address.
+	ServerName string
+	// SkipVerify doesn't verify the certificate of Vault, for tests only.
+	SkipVerify bool
+	// MinVersion is the lowest TLS version accepted, like tls.VersionTLS13,
+	// TLS 1.2 when zero.
+	MinVersion uint16
+}
+
+// WithTLS configures the TLS connections of the client. It must come before
+// the options wrapping the transport.
+func WithTLS(settings TLSSettings) Option {
+	return func(config *vaultApi.Config) error {
+		err := config.ConfigureTLS(&vaultApi.TLSConfig{
+			CACert:        settings.CACert,
+			CAPath:        settings.CAPath,
+			ClientCert:    settings.ClientCert,
+			ClientKey:     settings.ClientKey,
+			TLSServerName: settings.ServerName,
+			Insecure:      settings.SkipVerify,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to configure TLS: %w", err)
+		}
+
+		if settings.MinVersion != 0 {
+			// ConfigureTLS already failed if the transport was replaced.
+			transport := config.HttpClient.Transport.(*http.Transport)
+			transport.TLSClientConfig.MinVersion = settings.MinVersion
+		}
+		return nil
+	}
+}
+
+// EnvironmentTLS returns the TLS settings of the VAULT_CACERT, VAULT_CAPATH,
+// VAULT_CLIENT_CERT, VAULT_CLIENT_KEY, VAULT_TLS_SERVER_NAME and
+// VAULT_SKIP_VERIFY environment variables, like the vault command line.
+func EnvironmentTLS() (TLSSettings, error) {
+	settings := TLSSettings{
+		CACert:     os.Getenv("VAULT_CACERT"),
+		CAPath:     os.Getenv("VAULT_CAPATH"),
+		ClientCert: os.Getenv("VAULT_CLIENT_CERT"),
+		ClientKey:  os.Getenv("VAULT_CLIENT_KEY"),
+		ServerName: os.Getenv("VAULT_TLS_SERVER_NAME"),
+	}
+
+	if v := os.Getenv("VAULT_SKIP_VERIFY"); v != "" {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			return settings, fmt.Errorf("invalid VAULT_SKIP_VERIFY %q, expected true or false", v)
+		}
+		settings.SkipVerify = skip
+	}
+	return settings, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the TLS version of 1.2 or tls12 for example, the
+// second being how Vault writes it in its configuration.
+func ParseTLSVersion(version string) (uint16, error) {
+	v := strings.TrimPrefix(strings.ToLower(version), "tls")
+	if len(v) == 2 {
+		v = v[:1] + "." + v[1:]
+	}
+	tlsVersion, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return tlsVersion, nil
+}
+
+// New returns a client of the Vault server at address authenticated with
+// token. The address can be a unix:///path/to/socket, like the listener of a
+// Vault Agent. Vault is verified with the CA certificates of caCert, when
+// set, and the client authenticates with clientCert and clientKey, when both
+// are set.
+func New(address, token, caCert, clientCert, clientKey string, options ...Option) (*vaultApi.Client, error) {
+	config := vaultApi.DefaultConfig()
+
+	err := WithAddress(address)(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if caCert != "" || clientCert != "" || clientKey != "" {
+		err = WithTLS(TLSSettings{CACert: caCert, ClientCert: clientCert, ClientKey: clientKey})(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, option := range options {
+		err := option(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := vaultApi.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize Vault developer client: %w", err)
+	}
+
+	client.SetToken(token)
+
+	return client, nil
+}
+
+const unixScheme = "unix://"
+
+// IsUnixAddress tells whether address is the unix:// address of a socket.
+func IsUnixAddress(address string) bool {
+	return strings.HasPrefix(address, unixScheme)
+}
+
+// WithAddress replaces the address of the Vault server, which can be a
+// unix:///path/to/socket. It must come before the options replacing the
+// transport.
+func WithAddress(address string) Option {
+	return func(config *vaultApi.Config) error {
+		if !IsUnixAddress(address) {
+			config.Address = address
+			return nil
+		}
+
+		// The Vault API dials sockets too, but only with the transport it
+		// creates, not once an option wrapped it.
+		transport, ok := config.HttpClient.Transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("unable to reach %s, the transport of the client was replaced", address)
+		}
+		socket := strings.TrimPrefix(address, unixScheme)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		config.Address = "http://localhost"
+		return nil
+	}
+}
+
+// NewDev returns a client of the Vault dev server.
+func NewDev(options ...Option) (*vaultApi.Client, error) {
+	return New(DevAddress, DevToken, "", "", "", options...)
+}
+
+// NewFromEnvironment returns a client configured like the vault command line,
+// with the token of ~/.vault-token, the VAULT_ADDR, or VAULT_AGENT_ADDR,
+// environment variable and the TLS settings of EnvironmentTLS, which the Vault
+// API reads itself.
+// A Vault Agent adds the token of its auto-auth, so the token is optional
+// with VAULT_AGENT_ADDR or a socket.
+func NewFromEnvironment(options ...Option) (*vaultApi.Client, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	address := EnvironmentAddress()
+	token, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	agent := os.Getenv("VAULT_AGENT_ADDR") != "" || IsUnixAddress(address)
+	if err != nil && !(agent && errors.Is(err, fs.ErrNotExist)) {
+		return nil, err
+	}
+
+	return New(address, string(token), "", "", "", options...)
+}
+
+// EnvironmentAddress returns the address of Vault the vault command line
+// uses: VAULT_AGENT_ADDR, or else VAULT_ADDR.
+func EnvironmentAddress() string {
+	if address := os.Getenv("VAULT_AGENT_ADDR"); address != "" {
+		return address
+	}
+	return os.Getenv("VAULT_ADDR")
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// jsonChange is a change as shown to the HTTP API and the hooks.
+type jsonChange struct {
+	Action  string   `json:"action"`
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Details []string `json:"details,omitempty"`
+	Content string   `json:"content,omitempty"`
+	Diff    []string `json:"diff,omitempty"`
+}
+
+// The actions a change can do on an object.
+const (
+	actionCreate   = "+"
+	actionUpdate   = "~"
+	actionDelete   = "-"
+	actionRecreate = "-/+"
+)
+
+// change is a single modification of the Vault configuration. Changes are
+// planned first, so they can be shown to the operator, and applied later.
+type change struct {
+	action string
+	kind   string
+	name   string
+	// details are the field level differences of an update.
+	details []string
+	// content is the new content of a created or updated object.
+	content string
+	// previous is the content of an updated or deleted policy, to show its
+	// diff.
+	previous string
+
+	apply func() error
+}
+
+func (c change) verb() string {
+	switch c.action {
+	case actionCreate:
+		return "created"
+	case actionUpdate:
+		return "updated"
+	case actionDelete:
+		return "deleted"
+	default:
+		return "recreated"
+	}
+}
+
+// written returns the content a change writes to Vault, that of a policy
+// being stamped with the change ticket.
+func (c change) written() string {
+	if c.kind == "policy" && c.action != actionDelete {
+		return stampChangeRef(c.content)
+	}
+	return c.content
+}
+
+func printPlan(changes []change) {
+	for _, c := range changes {
+		fmt.Printf("%s %s %s\n", c.action, c.kind, c.name)
+		for _, detail := range c.details {
+			fmt.Println("    " + detail)
+		}
+	}
+}
+
+const chooseHelp = `y - make this change
+n - skip this change
+a - make this change and all the later ones
+d - skip this change and all the later ones
+q - abort without making any change
+? - print this help`
+
+// chooseChanges shows each change with its diff and returns those chosen,
+// reading the answers from input.
+func chooseChanges(changes []change, input io.Reader) ([]change, error) {
+	chosen := []change{}
+	scanner := bufio.NewScanner(input)
+	for i, c := range changes {
+		printPlan([]change{c})
+		if c.kind == "policy" && len(c.details) == 0 {
+			for _, line := range policyDiff(c.previous, c.content) {
+				fmt.Println("    " + line)
+			}
+		}
+
+		answer := ""
+		for answer == "" {
+			fmt.Printf("(%d/%d) Make this change [y,n,a,d,q,?]? ", i+1, len(changes))
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("aborted, no answer for %s %s", c.kind, c.name)
+			}
+			answer = strings.ToLower(strings.TrimSpace(scanner.Text()))
+			switch answer {
+			case "y", "n", "a", "d":
+			case "q":
+				return nil, fmt.Errorf("aborted")
+			default:
+				fmt.Println(chooseHelp)
+				answer = ""
+			}
+		}
+
+		switch answer {
+		case "y":
+			chosen = append(chosen, c)
+		case "a":
+			return append(chosen, changes[i:]...), nil
+		case "d":
+			return chosen, nil
+		}
+	}
+	return chosen, nil
+}
+
+// applyChanges applies the changes, calling the before_apply hooks first and
+// the after_change and after_run hooks as it goes.
+func applyChanges(changes []change, dryRun bool) error {
+	return applySyncChanges(changes, dryRun, nil)
+}
+
+// applySyncChanges is applyChanges for the changes synchronizing Vault with a
+// directory: their conflicts with the base of the directory are resolved
+// first, unless they already are, and the base is recorded once they are
+// applied.
+func applySyncChanges(changes []change, dryRun bool, base *baseSync) error {
+	var err error
+	if base != nil && !base.resolved {
+		changes, err = base.resolve(changes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dryRun {
+		printDryRun(changes)
+		return nil
+	}
+	if len(changes) == 0 {
+		if base != nil {
+			base.record(nil)
+		}
+		return nil
+	}
+
+	err = checkChanges()
+	if err != nil {
+		return err
+	}
+
+	release, err := acquireLock(trailVault)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = runHooks(false, hookBeforeApply, hookPayload{Changes: newJSONChanges(changes)})
+	if err != nil {
+		return err
+	}
+
+	applied, err := applyAll(changes)
+	if base != nil {
+		base.record(applied)
+	}
+
+	payload := hookPayload{Changes: newJSONChanges(applied)}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	warnHooks(hookAfterRun, payload)
+
+	return err
+}
+
+// checkChanges fails unless the safeguards of the active profile, the apply
+// windows and the replication allow changing Vault.
+func checkChanges() error {
+	err := checkTier()
+	if err != nil {
+		return err
+	}
+	err = checkPlanApplied()
+	if err != nil {
+		return err
+	}
+	err = checkChangeRef()
+	if err != nil {
+		return err
+	}
+	err = checkApplyWindow(time.Now())
+	if err != nil {
+		return err
+	}
+	return checkSecondary(trailVault)
+}
+
+// applyChange makes a change, records it in the audit trail and calls the
+// after_change hooks.
+func applyChange(c change) error {
+	log("Applying", c.action, c.kind, c.name)
+	err := c.apply()
+	if err != nil {
+		return fmt.Errorf("unable to apply the change to %s %s: %w", c.kind, c.name, err)
+	}
+
+	err = recordChange(c)
+	if err != nil {
+		return fmt.Errorf("unable to record the change to %s %s in the audit trail: %w", c.kind, c.name, err)
+	}
+	complete("%s %s %s", c.verb(), c.kind, c.name)
+
+	jc := newJSONChange(c)
+	warnHooks(hookAfterChange, hookPayload{Change: &jc})
+	return nil
+}
+
+func printDryRun(changes []change) {
+	for _, c := range changes {
+		fmt.Printf("Would have %s %s %s", c.verb(), c.kind, c.name)
+		if c.content != "" {
+			fmt.Println(" with content:")
+			fmt.Println(c.content)
+		} else {
+			fmt.Println()
+		}
+		for _, detail := range c.details {
+			fmt.Println("    " + detail)
+		}
+	}
+}
+
+func newJSONChange(c change) jsonChange {
+	jc := jsonChange{Action: c.action, Kind: c.kind, Name: c.name, Details: c.details, Content: c.content}
+	if c.kind == "policy" {
+		jc.Diff = lineDiff(c.previous, c.content)
+	}
+	return jc
+}
+
+func newJSONChanges(changes []change) []jsonChange {
+	result := make([]jsonChange, 0, len(changes))
+	for _, c := range changes {
+		result = append(result, newJSONChange(c))
+	}
+	return result
+}
+
+// summarize counts the changes per action.
+func summarize(changes []change) string {
+	count := map[string]int{}
+	for _, c := range changes {
+		count[c.action]++
+	}
+
+	return fmt.Sprintf("%d to create, %d to update, %d to recreate, %d to delete",
+		count[actionCreate], count[actionUpdate], count[actionRecreate], count[actionDelete])
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChooseChanges(t *testing.T) {
+	discardOutput(t)
+
+	changes := []change{
+		{action: actionCreate, kind: "policy", name: "a", content: "a"},
+		{action: actionUpdate, kind: "policy", name: "b", previous: "b1", content: "b2"},
+		{action: actionDelete, kind: "policy", name: "c", previous: "c"},
+		{action: actionCreate, kind: "attachment", name: "d"},
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		err      string
+	}{
+		{name: "each", input: "y\nn\ny\nn\n", expected: []string{"a", "c"}},
+		{name: "all the later ones", input: "n\na\n", expected: []string{"b", "c", "d"}},
+		{name: "none of the later ones", input: "y\nd\n", expected: []string{"a"}},
+		{name: "help and case", input: "?\nwhat\nY\n N \ny\ny\n", expected: []string{"a", "c", "d"}},
+		{name: "quit", input: "y\nq\n", err: "aborted"},
+		{name: "no more answers", input: "y\n", err: "no answer for policy b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chosen, err := chooseChanges(changes, strings.NewReader(test.input))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{}
+			for _, c := range chosen {
+				names = append(names, c.name)
+			}
+			if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("chose %v, expected %v", names, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/policysync"
+	"github.com/fynelabs/vault-policies/pkg/store"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// planFile is a restore planned by the plan command, to be reviewed, approved
+// and then applied as is by the apply command.
+type planFile struct {
+	Profile     string          `json:"profile,omitempty"`
+	Address     string          `json:"address"`
+	ClusterID   string          `json:"cluster_id,omitempty"`
+	Author      string          `json:"author"`
+	Created     time.Time       `json:"created"`
+	Directories []string        `json:"directories"`
+	ChangeRef   string          `json:"change_ref,omitempty"`
+	Changes     []plannedChange `json:"changes"`
+	// AuthorKey is the base64 ed25519 public key of the author of the plan,
+	// so that they can't approve it.
+	AuthorKey string `json:"author_key,omitempty"`
+	// AuthorSignature, Approvals and Signature sign the digest of the rest of
+	// the plan.
+	AuthorSignature string         `json:"author_signature,omitempty"`
+	Approvals       []approval     `json:"approvals,omitempty"`
+	Signature       *planSignature `json:"signature,omitempty"`
+}
+
+type plannedChange struct {
+	Action   string `json:"action"`
+	Name     string `json:"name"`
+	Content  string `json:"content,omitempty"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// approval is the ed25519 signature of a plan by a principal.
+type approval struct {
+	Principal string    `json:"principal"`
+	Time      time.Time `json:"time"`
+	Signature string    `json:"signature"`
+}
+
+func planCommand() *cli.Command {
+	out := "plan.json"
+	sign := false
+	signKey := ""
+	authorKey := ""
+
+	return &cli.Command{
+		Name:      "plan",
+		Usage:     "Write the changes restoring the policies of local directories would make to a plan file, to approve and apply later",
+		ArgsUsage: "directory [overlay directory...]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "out",
+				Usage:       "File to write the plan to",
+				Value:       out,
+				Destination: &out,
+			},
+			&cli.BoolFlag{
+				Name:        "sign",
+				Usage:       "Sign the plan with cosign, keyless unless --sign-key is set",
+				Destination: &sign,
+			},
+			&cli.StringFlag{
+				Name:        "sign-key",
+				Usage:       "Cosign private key, or KMS URI, to sign the plan with",
+				Destination: &signKey,
+			},
+			&cli.StringFlag{
+				Name:        "author-key",
+				Usage:       "File holding the base64 ed25519 private key of the author of the plan, whose approvals are then ignored, required for production profiles",
+				Destination: &authorKey,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) < 1 {
+				return fmt.Errorf("plan requires a directory")
+			}
+
+			return writePlan(dev, out, sign || signKey != "", signKey, authorKey, c.Args().Slice())
+		},
+	}
+}
+
+func approveCommand() *cli.Command {
+	key := ""
+	principal := ""
+	generate := ""
+
+	return &cli.Command{
+		Name:      "approve",
+		Usage:     "Sign a plan file, so that it can be applied to production profiles",
+		ArgsUsage: "plan",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "key",
+				Usage:       "File holding the base64 ed25519 private key to sign with",
+				Destination: &key,
+			},
+			&cli.StringFlag{
+				Name:        "principal",
+				Usage:       "Name the public key of the signer has in the approvers of the profiles",
+				Destination: &principal,
+			},
+			&cli.StringFlag{
+				Name:        "generate-key",
+				Usage:       "Write a new private key to this file and print its public key, instead of approving",
+				Destination: &generate,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if generate != "" {
+				return generateApprovalKey(generate)
+			}
+
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("approve requires a plan")
+			}
+			if key == "" || principal == "" {
+				return fmt.Errorf("approve requires --key and --principal")
+			}
+
+			return approvePlan(c.Args().Slice()[0], key, principal)
+		},
+	}
+}
+
+func applyCommand() *cli.Command {
+	requireSigned := false
+	verifier := planVerifier{}
+	canaryPatterns := cli.NewStringSlice()
+	canary := canaryOptions{}
+
+	return &cli.Command{
+		Name:      "apply",
+		Usage:     "Apply a plan file written by plan, if Vault didn't change since and, for production profiles, someone else than its author approved it",
+		ArgsUsage: "plan",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "require-signed-plan",
+				Usage:       "Only apply plans signed with cosign for the Vault cluster targeted",
+				Destination: &requireSigned,
+			},
+			&cli.StringFlag{
+				Name:        "plan-key",
+				Usage:       "Cosign public key, or KMS URI, the plan must be signed with",
+				Destination: &verifier.key,
+			},
+			&cli.StringFlag{
+				Name:        "plan-identity",
+				Usage:       "Identity of the certificate of the keyless signatures of the plan, like the workflow of the CI that signs them",
+				Destination: &verifier.identity,
+			},
+			&cli.StringFlag{
+				Name:        "plan-issuer",
+				Usage:       "OIDC issuer of the certificate of the keyless signatures of the plan",
+				Destination: &verifier.issuer,
+			},
+			&cli.StringSliceFlag{
+				Name:        "canary",
+				Usage:       "Pattern of the names of the policies to apply and verify with the after_canary hooks first, the rest being applied only if they pass (can be repeated)",
+				Destination: canaryPatterns,
+			},
+			&cli.DurationFlag{
+				Name:        "canary-wait",
+				Usage:       "How long to wait after applying the canary before verifying it, like 5m",
+				Destination: &canary.wait,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("apply requires a plan")
+			}
+
+			if activeProfile != nil && activeProfile.RequireSignedPlan {
+				requireSigned = true
+				verifier = activeProfile.planVerifier(verifier)
+			}
+			var v *planVerifier
+			if requireSigned {
+				v = &verifier
+			}
+
+			canary.patterns = canaryPatterns.Value()
+			err := checkCanaryPatterns(canary.patterns)
+			if err != nil {
+				return err
+			}
+
+			return applyPlan(dev, dryRun, c.Args().Slice()[0], v, canary)
+		},
+	}
+}
+
+func writePlan(dev bool, out string, sign bool, signKey, authorKey string, directories []string) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	source, err := policySource(directories)
+	if err != nil {
+		return err
+	}
+
+	changes, err := planPolicyChanges(client, source)
+	if err != nil {
+		return err
+	}
+
+	printPlan(changes)
+	fmt.Println(summarize(changes))
+
+	p := newPlan(client, directories, changes)
+	if sign {
+		p.ClusterID, err = clusterID(client)
+		if err != nil {
+			return err
+		}
+	}
+	err = signAuthor(p, authorKey)
+	if err != nil {
+		return err
+	}
+	if sign {
+		err = signPlan(p, signKey)
+		if err != nil {
+			return err
+		}
+	}
+	return savePlan(out, p)
+}
+
+// signAuthor signs the plan with the private key of its author in keyFile,
+// which production profiles require to be the key of one of their approvers.
+func signAuthor(p *planFile, keyFile string) error {
+	if keyFile == "" {
+		if activeProfile != nil && activeProfile.Production {
+			return fmt.Errorf("profile %s is production, sign the plan as its author with --author-key", activeProfile.name)
+		}
+		return nil
+	}
+
+	key, err := readPrivateKey(keyFile)
+	if err != nil {
+		return err
+	}
+	public := key.Public().(ed25519.PublicKey)
+	if activeProfile != nil && activeProfile.Production {
+		_, err = activeProfile.approverName(public)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.AuthorKey = base64.StdEncoding.EncodeToString(public)
+	digest, err := p.digest()
+	if err != nil {
+		return err
+	}
+	p.AuthorSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))
+	return nil
+}
+
+// targets tells if the plan was made against the server of client, at its
+// address or, when redirected to the primary with --on-secondary primary, at
+// the address of the secondary.
+func (p *planFile) targets(client *vaultApi.Client) bool {
+	return p.Address == client.Address() || (redirectedFrom != "" && p.Address == redirectedFrom)
+}
+
+// newPlan returns the plan of the policy changes restoring directories.
+func newPlan(client *vaultApi.Client, directories []string, changes []change) *planFile {
+	p := &planFile{
+		Address:     client.Address(),
+		Author:      currentPrincipal(client),
+		Created:     time.Now().UTC(),
+		Directories: directories,
+		ChangeRef:   changeRef,
+		Changes:     []plannedChange{},
+	}
+	if activeProfile != nil {
+		p.Profile = activeProfile.name
+	}
+	for _, c := range changes {
+		if c.kind == "policy" {
+			p.Changes = append(p.Changes, plannedChange{Action: c.action, Name: c.name, Content: c.content, Previous: c.previous})
+		}
+	}
+	return p
+}
+
+func approvePlan(file, keyFile, principal string) error {
+	p, err := loadPlan(file)
+	if err != nil {
+		return err
+	}
+
+	key, err := readPrivateKey(keyFile)
+	if err != nil {
+		return err
+	}
+	if p.AuthorKey == base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)) {
+		return fmt.Errorf("the plan was written with this key, it must be approved by someone else")
+	}
+
+	digest, err := p.digest()
+	if err != nil {
+		return err
+	}
+
+	p.Approvals = append(p.Approvals, approval{
+		Principal: principal,
+		Time:      time.Now().UTC(),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest)),
+	})
+	return savePlan(file, p)
+}
+
+// applyPlan applies the plan of file, which must be signed as verifier tells
+// unless nil, its canary policies first if there are some.
+func applyPlan(dev, dryRun bool, file string, verifier *planVerifier, canary canaryOptions) error {
+	p, err := loadPlan(file)
+	if err != nil {
+		return err
+	}
+
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	// The change ticket of the plan is used unless another one is given.
+	if changeRef == "" {
+		changeRef = p.ChangeRef
+	}
+
+	if !p.targets(client) {
+		return fmt.Errorf("the plan is for %s, not %s", p.Address, client.Address())
+	}
+
+	if verifier != nil {
+		err = verifyPlan(p, *verifier, client)
+		if err != nil {
+			return err
+		}
+		signedPlanApplied = true
+	}
+
+	if activeProfile != nil && activeProfile.Production {
+		err = activeProfile.checkApproved(p)
+		if err != nil {
+			return err
+		}
+		approvedPlanApplied = true
+	}
+
+	progress, err := loadProgress(file, p)
+	if err != nil {
+		return err
+	}
+	if len(canary.patterns) > 0 {
+		return applyPlanCanary(client, p, progress, canary, dryRun)
+	}
+
+	changes, err := p.changes(client, progress)
+	if err != nil {
+		return err
+	}
+
+	return applyChanges(changes, dryRun)
+}
+
+// changes returns the changes of the plan not completed yet, unless a policy
+// they change changed in Vault since the plan was written, or since a
+// previous run completed its change.
+func (p *planFile) changes(client *vaultApi.Client, progress *planProgress) ([]change, error) {
+	remote := store.NewVault(client)
+	names, err := remote.List()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]bool, len(names))
+	for _, name := range names {
+		current[name] = true
+	}
+
+	changes := make([]change, 0, len(p.Changes))
+	for _, pc := range p.Changes {
+		// Only the policies of the plan are read.
+		existing, ok := "", current[pc.Name]
+		if ok {
+			existing, err = remote.Get(pc.Name)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get policy %s: %w", pc.Name, err)
+			}
+		}
+		if run, done := progress.Completed[pc.Name]; done {
+			if ok != (pc.Action != actionDelete) || !policysync.Equal(existing, pc.Content) {
+				return nil, fmt.Errorf("policy %s changed in Vault since run %s applied the plan, plan again", pc.Name, run)
+			}
+			fmt.Printf("Skipping policy %s, already changed by run %s\n", pc.Name, run)
+			continue
+		}
+		if ok != (pc.Action != actionCreate) || !policysync.Equal(existing, pc.Previous) {
+			return nil, fmt.Errorf("policy %s changed in Vault since the plan was written, plan again", pc.Name)
+		}
+
+		sc := policysync.Change{Action: policysync.Action(pc.Action), Name: pc.Name, Content: pc.Content, Previous: pc.Previous}
+		c := change{
+			action:   pc.Action,
+			kind:     "policy",
+			name:     pc.Name,
+			content:  pc.Content,
+			previous: pc.Previous,
+			apply: func() error {
+				err := applyPolicyChange(remote, sc)
+				if err != nil {
+					return err
+				}
+				return progress.complete(sc.Name)
+			},
+		}
+		if pc.Action == actionUpdate {
+			c.details = policyDiff(pc.Previous, pc.Content)
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// checkApproved fails unless an approver of the profile other than the author
+// of the plan signed it. The author is known from the key they signed the plan
+// with, so the approvals made with that key or under the name it has in the
+// approvers don't count, whatever principal they claim.
+func (pr *profile) checkApproved(p *planFile) error {
+	if p.Profile != pr.name {
+		return fmt.Errorf("the plan was written for profile %q, not %s", p.Profile, pr.name)
+	}
+
+	digest, err := p.digest()
+	if err != nil {
+		return err
+	}
+	author, authorKey, err := pr.checkAuthor(p, digest)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range p.Approvals {
+		if a.Principal == author || a.Principal == p.Author {
+			log("Ignoring the approval of", a.Principal+", the author of the plan")
+			continue
+		}
+
+		key, err := pr.approverKey(a.Principal)
+		if err != nil {
+			log("Ignoring the approval of", a.Principal+":", err.Error())
+			continue
+		}
+		if key.Equal(authorKey) {
+			log("Ignoring the approval of", a.Principal+", made with the key of the author", author)
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(a.Signature)
+		if err == nil && ed25519.Verify(key, digest, signature) {
+			log("Plan approved by", a.Principal)
+			return nil
+		}
+		log("Ignoring the invalid signature of", a.Principal)
+	}
+	return fmt.Errorf("profile %s is production, the plan of %s must be approved by one of its other approvers", pr.name, author)
+}
+
+// checkAuthor verifies the signature of the author of the plan, and returns
+// the name and key they have in the approvers of the profile.
+func (pr *profile) checkAuthor(p *planFile, digest []byte) (string, ed25519.PublicKey, error) {
+	if p.AuthorKey == "" {
+		return "", nil, fmt.Errorf("profile %s is production, the plan must be signed by its author with plan --author-key", pr.name)
+	}
+	key, err := base64.StdEncoding.DecodeString(p.AuthorKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return "", nil, fmt.Errorf("the author key of the plan isn't a base64 ed25519 public key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(p.AuthorSignature)
+	if err != nil || !ed25519.Verify(key, digest, signature) {
+		return "", nil, fmt.Errorf("the signature of the author of the plan is invalid")
+	}
+
+	name, err := pr.approverName(key)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, key, nil
+}
+
+// approverName returns the name of the approver of the profile with that key.
+func (pr *profile) approverName(key ed25519.PublicKey) (string, error) {
+	names := make([]string, 0, len(pr.Approvers))
+	for name := range pr.Approvers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		k, err := pr.approverKey(name)
+		if err == nil && k.Equal(key) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("the key of the author isn't the key of an approver of profile %s, who alone write its plans", pr.name)
+}
+
+func (pr *profile) approverKey(principal string) (ed25519.PublicKey, error) {
+	encoded, ok := pr.Approvers[principal]
+	if !ok {
+		return nil, fmt.Errorf("%s is not an approver of profile %s", principal, pr.name)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("the key of approver %s of profile %s isn't a base64 ed25519 public key", principal, pr.name)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// digest returns the hash of the plan without its signatures, which they
+// sign.
+func (p *planFile) digest() ([]byte, error) {
+	unsigned := *p
+	unsigned.AuthorSignature = ""
+	unsigned.Approvals = nil
+	unsigned.Signature = nil
+
+	content, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	return sum[:], nil
+}
+
+func loadPlan(file string) (*planFile, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &planFile{}
+	err = json.Unmarshal(content, p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the plan %s: %w", file, err)
+	}
+	return p, nil
+}
+
+func savePlan(file string, p *planFile) error {
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(content, '\n'), 0600)
+}
+
+// currentPrincipal returns who the token of client belongs to, or the local
+// user when Vault doesn't tell.
+func currentPrincipal(client *vaultApi.Client) string {
+	secret, err := client.Auth().Token().LookupSelf()
+	if err == nil && secret != nil {
+		if name, ok := secret.Data["display_name"].(string); ok && name != "" {
+			return name
+		}
+	}
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return "unknown"
+}
+
+func readPrivateKey(file string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the private key: %w", err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	switch {
+	case err == nil && len(key) == ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case err == nil && len(key) == ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("%s doesn't hold a base64 ed25519 private key", file)
+}
+
+func generateApprovalKey(file string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(private.Seed()))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(base64.StdEncoding.EncodeToString(public))
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+func TestCheckApproved(t *testing.T) {
+	alice, bob, mallory := newTestKey(t), newTestKey(t), newTestKey(t)
+	pr := &profile{name: "prod", Production: true, Approvers: map[string]string{
+		"alice": publicKeyText(alice),
+		"bob":   publicKeyText(bob),
+		// The key of alice under another name
+		"alice2": publicKeyText(alice),
+	}}
+
+	tests := []struct {
+		name      string
+		author    ed25519.PrivateKey
+		approvals func(p *planFile) []approval
+		err       string
+	}{
+		{
+			name:      "approved by another approver",
+			author:    alice,
+			approvals: func(p *planFile) []approval { return []approval{approve(t, p, "bob", bob)} },
+		},
+		{
+			name:      "approved by the author",
+			author:    alice,
+			approvals: func(p *planFile) []approval { return []approval{approve(t, p, "alice", alice)} },
+			err:       "must be approved by one of its other approvers",
+		},
+		{
+			name:      "approved with the key of the author under another name",
+			author:    alice,
+			approvals: func(p *planFile) []approval { return []approval{approve(t, p, "alice2", alice)} },
+			err:       "must be approved by one of its other approvers",
+		},
+		{
+			name:      "approved by the author claiming another name",
+			author:    alice,
+			approvals: func(p *planFile) []approval { return []approval{approve(t, p, "bob", alice)} },
+			err:       "must be approved by one of its other approvers",
+		},
+		{
+			name:      "approved by someone not an approver",
+			author:    alice,
+			approvals: func(p *planFile) []approval { return []approval{approve(t, p, "mallory", mallory)} },
+			err:       "must be approved by one of its other approvers",
+		},
+		{
+			name:      "written by someone not an approver",
+			author:    mallory,
+			approvals: func(p *planFile) []approval { return []approval{approve(t, p, "bob", bob)} },
+			err:       "isn't the key of an approver",
+		},
+		{
+			name:      "not signed by its author",
+			approvals: func(p *planFile) []approval { return []approval{approve(t, p, "bob", bob)} },
+			err:       "must be signed by its author",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &planFile{Profile: "prod", Address: "https://vault:8200", Author: "ci", Created: time.Now().UTC()}
+			if test.author != nil {
+				err := signAuthor(p, writeTestKey(t, test.author))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			p.Approvals = test.approvals(p)
+
+			err := pr.checkApproved(p)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+
+	t.Run("changed after the approval", func(t *testing.T) {
+		p := &planFile{Profile: "prod", Address: "https://vault:8200"}
+		err := signAuthor(p, writeTestKey(t, alice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Approvals = []approval{approve(t, p, "bob", bob)}
+		p.Directories = []string{"other"}
+
+		err = pr.checkApproved(p)
+		if err == nil || !strings.Contains(err.Error(), "signature of the author of the plan is invalid") {
+			t.Fatalf("got error %v, expected the author signature to be invalid", err)
+		}
+	})
+}
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func publicKeyText(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+func writeTestKey(t *testing.T, key ed25519.PrivateKey) string {
+	file := filepath.Join(t.TempDir(), "key")
+	err := os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key.Seed())), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func approve(t *testing.T, p *planFile, principal string, key ed25519.PrivateKey) approval {
+	digest, err := p.digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return approval{Principal: principal, Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))}
+}
+
+func TestPlanTargets(t *testing.T) {
+	previous := redirectedFrom
+	t.Cleanup(func() {
+		redirectedFrom = previous
+	})
+
+	client, err := vaultApi.NewClient(&vaultApi.Config{Address: "https://vault:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		address    string
+		redirected string
+		expected   bool
+	}{
+		{name: "same address", address: "https://vault:8200", expected: true},
+		{name: "other address", address: "https://vault-eu:8200"},
+		{name: "primary of the secondary", address: "https://vault:8200", redirected: "https://vault-eu:8200", expected: true},
+		{name: "secondary redirected to its primary", address: "https://vault-eu:8200", redirected: "https://vault-eu:8200", expected: true},
+		{name: "other secondary", address: "https://vault-us:8200", redirected: "https://vault-eu:8200"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redirectedFrom = test.redirected
+			p := &planFile{Address: test.address}
+			if got := p.targets(client); got != test.expected {
+				t.Errorf("got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// parsedPolicy is an ACL policy parsed the same way Vault parses it.
+type parsedPolicy struct {
+	name string
+	// description is the comment at the top of the policy, if any.
+	description string
+	paths       []*policyPath
+	// content is the text of the policy, comments included.
+	content string
+}
+
+// policyPath is a path stanza of an ACL policy.
+type policyPath struct {
+	Capabilities       []string                 `hcl:"capabilities"`
+	MinWrappingTTL     interface{}              `hcl:"min_wrapping_ttl"`
+	MaxWrappingTTL     interface{}              `hcl:"max_wrapping_ttl"`
+	AllowedParameters  map[string][]interface{} `hcl:"allowed_parameters"`
+	DeniedParameters   map[string][]interface{} `hcl:"denied_parameters"`
+	RequiredParameters []string                 `hcl:"required_parameters"`
+	// ControlGroup, on Vault Enterprise, requires approvals to access the path.
+	ControlGroup *controlGroup `hcl:"control_group"`
+
+	path string
+	line int
+	// offset is the position of the quoted path name in the policy file.
+	offset int
+	item   *ast.ObjectItem
+}
+
+func parsePolicy(name, content string) (*parsedPolicy, error) {
+	root, err := hcl.Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse policy %s: %w", name, err)
+	}
+
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("unable to parse policy %s: does not contain a root object", name)
+	}
+
+	p := &parsedPolicy{name: name, description: leadingComment(root, list), content: content}
+	for _, item := range list.Filter("path").Items {
+		if len(item.Keys) == 0 {
+			return nil, fmt.Errorf("policy %s: line %d: path without a name", name, item.Pos().Line)
+		}
+
+		path := &policyPath{
+			line:   item.Pos().Line,
+			offset: item.Keys[0].Token.Pos.Offset,
+			item:   item,
+		}
+
+		key, ok := item.Keys[0].Token.Value().(string)
+		if !ok {
+			return nil, fmt.Errorf("policy %s: line %d: invalid path name", name, path.line)
+		}
+		path.path = key
+
+		err = hcl.DecodeObject(path, item.Val)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: path %q: %w", name, key, err)
+		}
+
+		p.paths = append(p.paths, path)
+	}
+
+	return p, nil
+}
+
+// loadPolicies parses the policies of a local directory, sorted by name, with
+// their variables substituted as they are written to Vault.
+func loadPolicies(directory string) ([]*parsedPolicy, error) {
+	policies := []*parsedPolicy{}
+
+	log("Walking directory", directory)
+	err := walkDirectoryPolicies(directory, func(policy string, content []byte) error {
+		rendered, err := substituteVariables(string(content))
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", policy, err)
+		}
+		p, err := parsePolicy(policy, rendered)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].name < policies[j].name
+	})
+	return policies, nil
+}
+
+// loadRemotePolicies parses the policies of the Vault server, sorted by name.
+func loadRemotePolicies(client *vaultApi.Client) ([]*parsedPolicy, error) {
+	policies := []*parsedPolicy{}
+
+	err := walkRemotePolicies(client, func(policy string, content string) error {
+		p, err := parsePolicy(policy, content)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].name < policies[j].name
+	})
+	return policies, nil
+}
+
+// loadPoliciesFrom parses the policies of the Vault server with live, or else
+// of a local directory, sorted by name.
+func loadPoliciesFrom(dev, live bool, directory string) ([]*parsedPolicy, error) {
+	if !live {
+		return loadPolicies(directory)
+	}
+
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return nil, err
+	}
+	return loadRemotePolicies(client)
+}
+
+// match returns the path stanza of the policy that applies to a request path,
+// the one with the highest priority among those matching it, or nil.
+func (p *parsedPolicy) match(requestPath string) *policyPath {
+	var best *policyPath
+	for _, path := range p.paths {
+		if !matchPath(path.path, requestPath) {
+			continue
+		}
+		if best == nil || lowerPriority(best.path, path.path) {
+			best = path
+		}
+	}
+	return best
+}
+
+// allows tells if the path stanza grants capability. A deny overrides
+// everything else.
+func (path *policyPath) allows(capability string) bool {
+	allowed := false
+	for _, c := range path.Capabilities {
+		if c == "deny" {
+			return false
+		}
+		allowed = allowed || c == capability
+	}
+	return allowed
+}
+
+// matchPath tells if the policy path pattern matches a request path: a +
+// matches a single segment and a trailing * anything.
+func matchPath(pattern, requestPath string) bool {
+	glob := strings.HasSuffix(pattern, "*")
+	patternSegments := strings.Split(strings.TrimSuffix(pattern, "*"), "/")
+	segments := strings.Split(requestPath, "/")
+
+	if len(segments) < len(patternSegments) || (!glob && len(segments) != len(patternSegments)) {
+		return false
+	}
+
+	for i, segment := range patternSegments {
+		switch {
+		case segment == "+":
+			continue
+		case glob && i == len(patternSegments)-1:
+			return strings.HasPrefix(segments[i], segment)
+		case segment != segments[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// lowerPriority tells if the policy path a has a lower priority than b when
+// both match a request, following the rules of Vault.
+func lowerPriority(a, b string) bool {
+	aWildcard, bWildcard := firstWildcard(a), firstWildcard(b)
+	if aWildcard != bWildcard {
+		return aWildcard < bWildcard
+	}
+
+	aGlob, bGlob := strings.HasSuffix(a, "*"), strings.HasSuffix(b, "*")
+	if aGlob != bGlob {
+		return aGlob
+	}
+
+	aPlus, bPlus := strings.Count(a, "+"), strings.Count(b, "+")
+	if aPlus != bPlus {
+		return aPlus > bPlus
+	}
+
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// firstWildcard returns the position of the first + or * of a policy path, or
+// its length if it has none.
+func firstWildcard(path string) int {
+	if i := strings.IndexAny(path, "+*"); i >= 0 {
+		return i
+	}
+	return len(path)
+}
+
+// leadingComment returns the text of the comments of a policy that come before
+// its first statement.
+func leadingComment(root *ast.File, list *ast.ObjectList) string {
+	firstLine := -1
+	if len(list.Items) > 0 {
+		firstLine = list.Items[0].Pos().Line
+	}
+
+	lines := []string{}
+	for _, group := range root.Comments {
+		for _, comment := range group.List {
+			if firstLine >= 0 && comment.Start.Line >= firstLine {
+				return strings.Join(lines, "\n")
+			}
+			lines = append(lines, commentText(comment.Text)...)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// commentText returns the lines of a comment without its markers.
+func commentText(comment string) []string {
+	switch {
+	case strings.HasPrefix(comment, "#"):
+		return []string{strings.TrimSpace(comment[1:])}
+	case strings.HasPrefix(comment, "//"):
+		return []string{strings.TrimSpace(comment[2:])}
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(comment, "/*"), "*/"), "\n") {
+		lines = append(lines, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "*")))
+	}
+	return lines
+}
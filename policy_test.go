@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"secret/data/app", "secret/data/app", true},
+		{"secret/data/app", "secret/data/app/db", false},
+		{"secret/data/app", "secret/data", false},
+		{"secret/data/app/*", "secret/data/app/db", true},
+		{"secret/data/app/*", "secret/data/app/", true},
+		{"secret/data/app/*", "secret/data/app", false},
+		{"secret/data/app*", "secret/data/application", true},
+		{"secret/data/app*", "secret/data/ap", false},
+		{"secret/+/app", "secret/data/app", true},
+		{"secret/+/app", "secret/data/other/app", false},
+		{"secret/+/app/*", "secret/metadata/app/db/password", true},
+		{"+/+", "a/b", true},
+		{"+/+", "a/b/c", false},
+		{"*", "anything/at/all", true},
+	}
+
+	for _, test := range tests {
+		if got := matchPath(test.pattern, test.path); got != test.expected {
+			t.Errorf("matchPath(%q, %q) = %v, expected %v", test.pattern, test.path, got, test.expected)
+		}
+	}
+}
+
+func TestLowerPriority(t *testing.T) {
+	tests := []struct {
+		name  string
+		lower string
+		upper string
+	}{
+		{"earlier wildcard", "secret/+/app", "secret/data/+"},
+		{"glob before exact", "secret/data/app*", "secret/data/appx"},
+		{"more plus segments", "secret/+/+/db", "secret/+/app/db"},
+		{"shorter", "secret/data/*", "secret/data/app/*"},
+		{"lexical order", "secret/data/a", "secret/data/b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !lowerPriority(test.lower, test.upper) {
+				t.Errorf("%q doesn't have a lower priority than %q", test.lower, test.upper)
+			}
+			if lowerPriority(test.upper, test.lower) {
+				t.Errorf("%q has a lower priority than %q", test.upper, test.lower)
+			}
+		})
+	}
+
+	if lowerPriority("secret/data/app", "secret/data/app") {
+		t.Error("a path has a lower priority than itself")
+	}
+}
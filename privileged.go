@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// extraProtectedPaths are root-protected paths that older versions of the API
+// client don't list as sudo paths.
+var extraProtectedPaths = []string{
+	"sys/generate-root/attempt",
+	"sys/seal",
+	"sys/step-down",
+}
+
+// writeCapabilities are the capabilities that change something on a path.
+var writeCapabilities = map[string]bool{
+	"create": true,
+	"update": true,
+	"patch":  true,
+	"delete": true,
+	"sudo":   true,
+}
+
+// privilegedGrant is a path of a policy that grants sudo or writes to a
+// root-protected path.
+type privilegedGrant struct {
+	policy    string
+	path      *policyPath
+	protected []string
+}
+
+func privilegedCommand() *cli.Command {
+	allow := cli.NewStringSlice()
+
+	return &cli.Command{
+		Name:  "privileged",
+		Usage: "Report the policies of a local directory that grant sudo or write to root-protected paths",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "allow",
+				Usage:       "Policy allowed to have privileged grants, like a break-glass policy (can be repeated)",
+				Destination: allow,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("privileged requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			return reportPrivileged(directory, allow.Value())
+		},
+	}
+}
+
+func reportPrivileged(directory string, allow []string) error {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]bool, len(allow))
+	for _, policy := range allow {
+		allowed[policy] = true
+	}
+
+	grants := []privilegedGrant{}
+	for _, g := range findPrivileged(policies) {
+		if allowed[g.policy] {
+			log("Ignoring the allowed policy", g.policy, g.path.path)
+			continue
+		}
+		grants = append(grants, g)
+	}
+
+	if len(grants) == 0 {
+		fmt.Println("No privileged grant outside of the allowed policies")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tPATH\tCAPABILITIES\tROOT-PROTECTED")
+	for _, g := range grants {
+		fmt.Fprintf(w, "%s:%d\t%s\t%s\t%s\n", g.policy, g.path.line, g.path.path,
+			strings.Join(g.path.Capabilities, ","), summarizePaths(g.protected))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%d privileged grants found", len(grants))
+}
+
+// findPrivileged returns the paths of policies that grant sudo, or any write
+// capability on a root-protected path.
+func findPrivileged(policies []*parsedPolicy) []privilegedGrant {
+	protected := protectedPaths()
+
+	grants := []privilegedGrant{}
+	for _, p := range policies {
+		for _, path := range p.paths {
+			sudo, write := false, false
+			for _, capability := range path.Capabilities {
+				sudo = sudo || capability == "sudo"
+				write = write || writeCapabilities[capability]
+			}
+			if !write {
+				continue
+			}
+
+			matches := []string{}
+			for _, protectedPath := range protected {
+				if pathOverlaps(path.path, protectedPath) {
+					matches = append(matches, protectedPath)
+				}
+			}
+			if sudo || len(matches) > 0 {
+				grants = append(grants, privilegedGrant{policy: p.name, path: path, protected: matches})
+			}
+		}
+	}
+	return grants
+}
+
+// protectedPaths returns the root-protected paths, sorted, with their
+// templated segments like {path}.
+func protectedPaths() []string {
+	unique := map[string]bool{}
+	for _, path := range extraProtectedPaths {
+		unique[path] = true
+	}
+	for path := range vaultApi.SudoPaths() {
+		unique[strings.TrimPrefix(path, "/")] = true
+	}
+
+	paths := make([]string, 0, len(unique))
+	for path := range unique {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// summarizePaths lists paths, or the first of them when there are too many.
+func summarizePaths(paths []string) string {
+	if len(paths) <= 3 {
+		return strings.Join(paths, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(paths[:3], ", "), len(paths)-3)
+}
+
+// pathOverlaps tells if the policy path pattern, which can hold + segments and
+// end with *, matches at least one of the paths of the templated path.
+func pathOverlaps(pattern, templated string) bool {
+	glob := strings.HasSuffix(pattern, "*")
+	patternSegments := strings.Split(strings.TrimSuffix(pattern, "*"), "/")
+	templatedSegments := strings.Split(templated, "/")
+
+	for i, segment := range patternSegments {
+		if i >= len(templatedSegments) {
+			return false
+		}
+		target := templatedSegments[i]
+		template := strings.HasPrefix(target, "{")
+
+		if glob && i == len(patternSegments)-1 {
+			return template || strings.HasPrefix(target, segment)
+		}
+		// The last templated segment can hold several segments.
+		if template && i == len(templatedSegments)-1 {
+			return segment != ""
+		}
+		if segment != "+" && !template && segment != target {
+			return false
+		}
+	}
+	return len(patternSegments) == len(templatedSegments)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+	"gopkg.in/yaml.v3"
+)
+
+// profile is a Vault server the commands can target, as declared in the file
+// of --profiles.
+type profile struct {
+	// Address replaces VAULT_ADDR.
+	Address string `yaml:"address"`
+	// Tier is the environment of the profile, dev, staging or prod, adding
+	// safeguards to the settings below.
+	Tier string `yaml:"tier"`
+	// Production profiles only apply plans approved by someone else than
+	// their author.
+	Production bool `yaml:"production"`
+	// Approvers are the base64 ed25519 public keys of the principals allowed
+	// to approve plans, by name.
+	Approvers map[string]string `yaml:"approvers"`
+	// RequireChangeRef refuses to change Vault without --change-ref.
+	RequireChangeRef bool `yaml:"require_change_ref"`
+	// ApplyWindows are when Vault may be changed, at any time if empty.
+	ApplyWindows []string `yaml:"apply_windows"`
+	// RequireSignedPlan only applies plans signed with cosign with PlanKey,
+	// or keyless by PlanIdentity from PlanIssuer.
+	RequireSignedPlan bool   `yaml:"require_signed_plan"`
+	PlanKey           string `yaml:"plan_key"`
+	PlanIdentity      string `yaml:"plan_identity"`
+	PlanIssuer        string `yaml:"plan_issuer"`
+	// Proxy is the URL of the proxy Vault is reached through.
+	Proxy string `yaml:"proxy"`
+	// Transport tunes the HTTP connections to Vault.
+	Transport transportConfig `yaml:"transport"`
+	// Retry is how the requests to Vault are retried, and when to give up.
+	Retry retryConfig `yaml:"retry"`
+	// TLS configures the TLS connections to Vault.
+	TLS tlsConfig `yaml:"tls"`
+	// Headers are added to every request to Vault, before those of --header.
+	Headers map[string]string `yaml:"headers"`
+	// Vars are the values of the ${name} variables of the policies, before
+	// the environment variables.
+	Vars map[string]string `yaml:"vars"`
+	// Throttle is the most calls changing Vault per period, like 5/s, unless
+	// --throttle is set.
+	Throttle string `yaml:"throttle"`
+	// QueueDirectory is where restores outside of the apply windows write
+	// their plan, instead of being refused.
+	QueueDirectory string `yaml:"queue_directory"`
+
+	name    string
+	windows []*timeWindow
+}
+
+// profiles is the content of the file of --profiles.
+type profiles struct {
+	Profiles map[string]*profile `yaml:"profiles"`
+	// Rollouts are the stages the rollout command restores the profiles in,
+	// by name.
+	Rollouts map[string]*rollout `yaml:"rollouts"`
+}
+
+var (
+	profilesFile = ""
+	profileName  = ""
+
+	// proxy is the URL of the proxy of --proxy.
+	proxy = ""
+
+	// activeProfile is the profile selected with --profile, if any.
+	activeProfile *profile
+)
+
+func loadProfile(file, name string) (*profile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if file == "" {
+		return nil, fmt.Errorf("--profile requires a profiles file set with --profiles")
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p := profiles{}
+	err = yaml.Unmarshal(content, &p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+
+	selected, ok := p.Profiles[name]
+	if !ok || selected == nil {
+		return nil, fmt.Errorf("no profile %s in %s, expected one of %v", name, file, sortedProfileNames(p.Profiles))
+	}
+	selected.name = name
+
+	err = selected.applyTier()
+	if err != nil {
+		return nil, err
+	}
+
+	selected.windows, err = parseTimeWindows(selected.ApplyWindows)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+
+	if selected.Throttle != "" {
+		_, err = vaultclient.ParseThrottle(selected.Throttle)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+
+	for approver := range selected.Approvers {
+		_, err = selected.approverKey(approver)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return selected, nil
+}
+
+// profileOptions returns the client options of the active profile, and of
+// --proxy.
+func profileOptions() []vaultclient.Option {
+	options := []vaultclient.Option{}
+	proxyURL := proxy
+	if proxyURL == "" && activeProfile != nil {
+		proxyURL = activeProfile.Proxy
+	}
+	if proxyURL != "" {
+		options = append(options, vaultclient.WithProxy(proxyURL))
+	}
+	if activeProfile == nil {
+		return options
+	}
+
+	if activeProfile.Address != "" {
+		options = append(options, vaultclient.WithAddress(activeProfile.Address))
+	}
+	if settings, ok := activeProfile.Transport.settings(); ok {
+		options = append(options, vaultclient.WithTransportSettings(settings))
+	}
+	if policy, ok := activeProfile.Retry.policy(); ok {
+		options = append(options, vaultclient.WithRetryPolicy(policy))
+	}
+	return options
+}
+
+// profileAddress returns the address of the Vault of the active profile, or
+// VAULT_AGENT_ADDR or VAULT_ADDR.
+func profileAddress() string {
+	if activeProfile != nil && activeProfile.Address != "" {
+		return activeProfile.Address
+	}
+	return vaultclient.EnvironmentAddress()
+}
+
+// planVerifier returns how the plans applied to the profile must be signed,
+// the flags set replacing the settings of the profile.
+func (pr *profile) planVerifier(flags planVerifier) planVerifier {
+	if flags.key != "" || flags.identity != "" {
+		return flags
+	}
+	return planVerifier{key: pr.PlanKey, identity: pr.PlanIdentity, issuer: pr.PlanIssuer}
+}
+
+func sortedProfileNames(p map[string]*profile) []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
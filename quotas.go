@@ -0,0 +1,28 @@
+package main
+
+var rateLimitQuotasResource = &resource{
+	name: "rate-limit-quotas",
+	kind: "rate limit quota",
+	path: "sys/quotas/rate-limit",
+	fields: []string{
+		"block_interval",
+		"inheritable",
+		"interval",
+		"path",
+		"rate",
+		"role",
+	},
+}
+
+// Lease count quotas are only available on Vault Enterprise.
+var leaseCountQuotasResource = &resource{
+	name: "lease-count-quotas",
+	kind: "lease count quota",
+	path: "sys/quotas/lease-count",
+	fields: []string{
+		"inheritable",
+		"max_leases",
+		"path",
+		"role",
+	},
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// What to do when the Vault server targeted is a replication secondary, which
+// doesn't hold the policies replicated from its primary.
+const (
+	onSecondaryRefuse  = "refuse"
+	onSecondaryPrimary = "primary"
+)
+
+// onSecondary is the strategy of --on-secondary.
+var onSecondary = onSecondaryRefuse
+
+// redirectedFrom is the address of the secondary the client was redirected
+// from with --on-secondary primary, empty otherwise.
+var redirectedFrom = ""
+
+// replicationSecondary is the replication a Vault server is a secondary of.
+type replicationSecondary struct {
+	// kind is performance or DR.
+	kind string
+	// primary is the API address of the primary, if the server knows it.
+	primary string
+}
+
+func checkOnSecondary() error {
+	if onSecondary != onSecondaryRefuse && onSecondary != onSecondaryPrimary {
+		return fmt.Errorf("unknown --on-secondary %s, expected %s or %s", onSecondary, onSecondaryRefuse, onSecondaryPrimary)
+	}
+	return nil
+}
+
+// findSecondary tells if the server of client is a performance or DR
+// secondary, from sys/replication/status. The servers without replication,
+// like Vault community edition, aren't.
+func findSecondary(client *vaultApi.Client) *replicationSecondary {
+	secret, err := client.Logical().Read("sys/replication/status")
+	if err != nil {
+		// Only Vault Enterprise has the endpoint
+		log("Unable to read the replication status, assuming a primary:", err.Error())
+		return nil
+	}
+	if secret == nil || secret.Data == nil {
+		return nil
+	}
+
+	for _, kind := range []string{"performance", "dr"} {
+		status, _ := secret.Data[kind].(map[string]interface{})
+		if mode, _ := status["mode"].(string); mode != "secondary" {
+			continue
+		}
+
+		s := &replicationSecondary{kind: kind}
+		if kind == "dr" {
+			s.kind = "DR"
+		}
+		primaries, _ := status["primaries"].([]interface{})
+		for _, p := range primaries {
+			primary, _ := p.(map[string]interface{})
+			if address, _ := primary["api_address"].(string); address != "" {
+				s.primary = address
+				break
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// explain tells why the policies can't be changed on the secondary, and where
+// to change them.
+func (s *replicationSecondary) explain() string {
+	reason := "its policies are replicated from its primary, which must be changed instead"
+	if s.kind == "DR" {
+		reason = "it serves no requests until it is promoted"
+	}
+	if s.primary == "" {
+		return fmt.Sprintf("a %s replication secondary: %s", s.kind, reason)
+	}
+	return fmt.Sprintf("a %s replication secondary: %s; target %s, or pass --on-secondary %s to be redirected to it", s.kind, reason, s.primary, onSecondaryPrimary)
+}
+
+// checkSecondary fails if the server of client is a replication secondary,
+// before changing its policies.
+func checkSecondary(client *vaultApi.Client) error {
+	if client == nil {
+		return nil
+	}
+	s := findSecondary(client)
+	if s == nil {
+		return nil
+	}
+	return fmt.Errorf("refusing to change the policies of %s, %s", client.Address(), s.explain())
+}
+
+// redirectToPrimary points client to the primary of the server with
+// --on-secondary primary, so that the policies are read from and written to
+// the cluster that replicates them.
+func redirectToPrimary(client *vaultApi.Client) error {
+	if onSecondary != onSecondaryPrimary {
+		return nil
+	}
+	s := findSecondary(client)
+	if s == nil {
+		return nil
+	}
+	if s.primary == "" {
+		return fmt.Errorf("%s is a %s replication secondary that doesn't tell the API address of its primary, target the primary instead", client.Address(), s.kind)
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: %s is a %s replication secondary, redirecting to its primary %s\n", client.Address(), s.kind, s.primary)
+	redirectedFrom = client.Address()
+	return client.SetAddress(strings.TrimSuffix(s.primary, "/"))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// noOwner is how the policies without owner are reported.
+const noOwner = "(no owner)"
+
+func reportCommand() *cli.Command {
+	byOwner := false
+
+	return &cli.Command{
+		Name:  "report",
+		Usage: "List the policies of a local directory with their owner, tags and number of paths, from their .meta.yaml files",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "by-owner",
+				Usage:       "Group the policies by owner, with the number of policies and paths of each owner",
+				Destination: &byOwner,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("report requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			return reportPolicies(directory, byOwner)
+		},
+	}
+}
+
+func reportPolicies(directory string, byOwner bool) error {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+	metadata, err := loadDirectoryMetadata([]string{directory})
+	if err != nil {
+		return err
+	}
+
+	if len(policies) == 0 {
+		fmt.Println("No policy to report")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !byOwner {
+		fmt.Fprintln(w, "POLICY\tOWNER\tTAGS\tPATHS\tDESCRIPTION")
+		for _, p := range policies {
+			m := policyMetadataOf(metadata, p.name)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", p.name, reportOwner(m), strings.Join(m.Tags, ","), len(p.paths),
+				strings.SplitN(policyDescription(p, m), "\n", 2)[0])
+		}
+		return w.Flush()
+	}
+
+	owners := map[string][]*parsedPolicy{}
+	for _, p := range policies {
+		owner := reportOwner(policyMetadataOf(metadata, p.name))
+		owners[owner] = append(owners[owner], p)
+	}
+
+	fmt.Fprintln(w, "OWNER\tPOLICIES\tPATHS\tNAMES")
+	for _, owner := range sortedOwners(owners) {
+		paths := 0
+		names := make([]string, 0, len(owners[owner]))
+		for _, p := range owners[owner] {
+			paths += len(p.paths)
+			names = append(names, p.name)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", owner, len(names), paths, strings.Join(names, ","))
+	}
+	return w.Flush()
+}
+
+// policyMetadataOf returns the metadata of a policy, empty if it has none.
+func policyMetadataOf(metadata map[string]*policyMetadata, name string) *policyMetadata {
+	if m := metadata[name]; m != nil {
+		return m
+	}
+	return &policyMetadata{}
+}
+
+func reportOwner(m *policyMetadata) string {
+	if m.Owner == "" {
+		return noOwner
+	}
+	return m.Owner
+}
+
+// sortedOwners returns the owners sorted, the policies without owner last.
+func sortedOwners(owners map[string][]*parsedPolicy) []string {
+	names := make([]string, 0, len(owners))
+	for name := range owners {
+		if name != noOwner {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if owners[noOwner] != nil {
+		names = append(names, noOwner)
+	}
+	return names
+}
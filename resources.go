@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// resource describes a kind of named Vault object, like a group or a role,
+// that is kept in a local directory as one JSON file per object.
+type resource struct {
+	// name is the plural name of the objects, used for the command name.
+	name string
+	// kind is the singular name of the objects, used in messages.
+	kind string
+
+	// path is the API path under which the objects are listed, read, written
+	// and deleted. A %s in it is replaced with the mount path.
+	path string
+	// mount is the default mount path of the auth method or secret engine
+	// holding the objects, selected with --mount.
+	mount string
+	// fields are the settings kept in the files, all the others returned by
+	// Vault being ignored.
+	fields []string
+	// partial is set when only some settings of objects managed elsewhere are
+	// kept in the files. Objects missing from the directory are then left
+	// alone instead of being deleted.
+	partial bool
+
+	// read and write replace the plain read and write of the objects, when
+	// they need some processing between Vault and the files.
+	read  func(client *vaultApi.Client, path string) (map[string]interface{}, error)
+	write func(client *vaultApi.Client, path string, data map[string]interface{}) error
+}
+
+func resourceCommand(r *resource, usage string) *cli.Command {
+	fileMode := "0600"
+	dirMode := "0700"
+
+	flags := []cli.Flag{}
+	if r.mount != "" {
+		flags = append(flags, &cli.StringFlag{
+			Name:  "mount",
+			Usage: "Mount path of the " + r.name,
+			Value: r.mount,
+		})
+	}
+	backupFlags := append([]cli.Flag{
+		&cli.StringFlag{
+			Name:        "file-mode",
+			Usage:       fmt.Sprintf("Permissions, in octal, of the %s files written", r.name),
+			Value:       fileMode,
+			Destination: &fileMode,
+		},
+		&cli.StringFlag{
+			Name:        "dir-mode",
+			Usage:       "Permissions, in octal, of the directories created when missing",
+			Value:       dirMode,
+			Destination: &dirMode,
+		},
+	}, flags...)
+
+	// withMount returns the resource for the mount selected on the command line.
+	withMount := func(c *cli.Context) *resource {
+		selected := *r
+		if r.mount != "" {
+			selected.mount = strings.Trim(c.String("mount"), "/")
+		}
+		return &selected
+	}
+
+	return &cli.Command{
+		Name:  r.name,
+		Usage: usage,
+		Subcommands: []*cli.Command{
+			{
+				Name:  "backup",
+				Usage: fmt.Sprintf("Backup the %s from a Vault into the specified local directory", r.name),
+				Flags: backupFlags,
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) != 1 {
+						return fmt.Errorf("%s backup requires a directory", r.name)
+					}
+
+					directory := c.Args().Slice()[0]
+					f, err := parseFileMode(fileMode)
+					if err != nil {
+						return err
+					}
+					d, err := parseDirMode(dirMode)
+					if err != nil {
+						return err
+					}
+
+					return backupResources(withMount(c), dev, dryRun, directory, f, d)
+				},
+			},
+			{
+				Name:  "diff",
+				Usage: fmt.Sprintf("Show the differences between the %s in a local directory and in Vault", r.name),
+				Flags: flags,
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) != 1 {
+						return fmt.Errorf("%s diff requires a directory", r.name)
+					}
+
+					directory := c.Args().Slice()[0]
+
+					return diffResources(withMount(c), dev, directory)
+				},
+			},
+			{
+				Name:  "restore",
+				Usage: fmt.Sprintf("Restore the %s from a local directory into Vault (will overwrite existing %s, and remove any existing %s not present in the local directory)", r.name, r.name, r.name),
+				Flags: flags,
+				Action: func(c *cli.Context) error {
+					if len(c.Args().Slice()) != 1 {
+						return fmt.Errorf("%s restore requires a directory", r.name)
+					}
+
+					directory := c.Args().Slice()[0]
+
+					return restoreResources(withMount(c), dev, dryRun, directory)
+				},
+			},
+		},
+	}
+}
+
+func (r *resource) basePath() string {
+	if strings.Contains(r.path, "%s") {
+		return fmt.Sprintf(r.path, r.mount)
+	}
+	return r.path
+}
+
+func (r *resource) listObjects(client *vaultApi.Client) ([]string, error) {
+	return listKeys(client, r.basePath())
+}
+
+func (r *resource) readObject(client *vaultApi.Client, name string) (map[string]interface{}, error) {
+	path := r.basePath() + "/" + name
+	if r.read != nil {
+		return r.read(client, path)
+	}
+	return readFields(client, path, r.fields)
+}
+
+func (r *resource) writeObject(client *vaultApi.Client, name string, data map[string]interface{}) error {
+	path := r.basePath() + "/" + name
+	if r.write != nil {
+		return r.write(client, path, data)
+	}
+	return writeData(client, path, data)
+}
+
+func (r *resource) deleteObject(client *vaultApi.Client, name string) error {
+	return deletePath(client, r.basePath()+"/"+name)
+}
+
+func backupResources(r *resource, dev, dryRun bool, directory string, fileMode, dirMode os.FileMode) error {
+	log("Backing", r.name, "to", directory)
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	err = walkRemoteResources(client, r, func(name string, data map[string]interface{}) error {
+		content, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		file := resourceFile(directory, name)
+		if dryRun {
+			fmt.Printf("Would have written %s with content:\n", file)
+			fmt.Println(string(content))
+			return nil
+		}
+
+		log("Writing", file)
+		err = os.MkdirAll(filepath.Dir(file), dirMode)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(file, append(content, '\n'), fileMode)
+	})
+	if err != nil {
+		return err
+	}
+
+	log("Done backing up", r.name)
+	return nil
+}
+
+func diffResources(r *resource, dev bool, directory string) error {
+	log("Comparing", r.name, "with", directory)
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	changes, err := planResources(client, r, directory)
+	if err != nil {
+		return err
+	}
+
+	printPlan(changes)
+	return nil
+}
+
+func restoreResources(r *resource, dev, dryRun bool, directory string) error {
+	log("Restoring", r.name, "from", directory)
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	err = runHooks(dryRun, hookBeforePlan, hookPayload{Directory: directory})
+	if err != nil {
+		return err
+	}
+
+	changes, err := planResources(client, r, directory)
+	if err != nil {
+		return err
+	}
+
+	err = applyChanges(changes, dryRun)
+	if err != nil {
+		return err
+	}
+
+	log("Done restoring", r.name)
+	return nil
+}
+
+// planResources returns the changes needed for the objects in Vault to match
+// the directory, deletions first.
+func planResources(client *vaultApi.Client, r *resource, directory string) ([]change, error) {
+	local, remote, err := loadResources(client, r, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []change{}
+	for _, name := range sortedResourceNames(nil, remote) {
+		if _, ok := local[name]; ok || r.partial {
+			continue
+		}
+
+		name := name
+		changes = append(changes, change{
+			action: actionDelete,
+			kind:   r.kind,
+			name:   name,
+			apply: func() error {
+				return r.deleteObject(client, name)
+			},
+		})
+	}
+
+	for _, name := range sortedResourceNames(local, nil) {
+		name := name
+		c := change{
+			action:  actionCreate,
+			kind:    r.kind,
+			name:    name,
+			content: canonicalJSON(local[name]),
+			apply: func() error {
+				return r.writeObject(client, name, local[name])
+			},
+		}
+
+		if remoteData, ok := remote[name]; ok {
+			if canonicalJSON(remoteData) == c.content {
+				continue
+			}
+			c.action = actionUpdate
+			c.details = diffFields(remoteData, local[name])
+		}
+
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+func loadResources(client *vaultApi.Client, r *resource, directory string) (map[string]map[string]interface{}, map[string]map[string]interface{}, error) {
+	local := make(map[string]map[string]interface{})
+
+	log("Walking directory", directory)
+	err := walkDirectoryResources(directory, func(name string, data map[string]interface{}) error {
+		log("Found", r.kind, name)
+		local[name] = data
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remote := make(map[string]map[string]interface{})
+	err = walkRemoteResources(client, r, func(name string, data map[string]interface{}) error {
+		remote[name] = data
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return local, remote, nil
+}
+
+func walkDirectoryResources(directory string, f func(name string, data map[string]interface{}) error) error {
+	return filepath.Walk(directory, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		if filepath.Ext(file) != ".json" {
+			return nil
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		var data map[string]interface{}
+		err = json.Unmarshal(content, &data)
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: %w", file, err)
+		}
+
+		// The object name is the file path relative to the directory
+		rel, err := filepath.Rel(directory, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(strings.TrimSuffix(rel, ".json"))
+
+		return f(name, pruneEmpty(data))
+	})
+}
+
+func walkRemoteResources(client *vaultApi.Client, r *resource, f func(name string, data map[string]interface{}) error) error {
+	log("Listing", r.name, "from the Vault server")
+	names, err := r.listObjects(client)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		log("Getting", r.kind, name)
+		data, err := r.readObject(client, name)
+		if err != nil {
+			return err
+		}
+
+		err = f(name, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listKeys returns the keys of a LIST request on path, or nothing if the path
+// doesn't exist.
+func listKeys(client *vaultApi.Client, path string) ([]string, error) {
+	secret, err := client.Logical().List(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	keys, _ := secret.Data["keys"].([]interface{})
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if name, ok := key.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// readFields reads path and returns only the listed fields of its data, so
+// that server generated values don't end up in the local files.
+func readFields(client *vaultApi.Client, path string, fields []string) (map[string]interface{}, error) {
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("%s not found", path)
+	}
+
+	data := make(map[string]interface{})
+	for _, field := range fields {
+		if value, ok := secret.Data[field]; ok {
+			data[field] = value
+		}
+	}
+	return pruneEmpty(data), nil
+}
+
+// pruneEmpty removes the null, empty list and empty object values from data,
+// as Vault treats them the same as a missing field.
+func pruneEmpty(data map[string]interface{}) map[string]interface{} {
+	for field, value := range data {
+		switch v := value.(type) {
+		case nil:
+			delete(data, field)
+		case []interface{}:
+			if len(v) == 0 {
+				delete(data, field)
+			}
+		case []string:
+			if len(v) == 0 {
+				delete(data, field)
+			}
+		case map[string]interface{}:
+			if len(v) == 0 {
+				delete(data, field)
+			}
+		}
+	}
+	return data
+}
+
+func writeData(client *vaultApi.Client, path string, data map[string]interface{}) error {
+	_, err := client.Logical().Write(path, data)
+	return err
+}
+
+func deletePath(client *vaultApi.Client, path string) error {
+	_, err := client.Logical().Delete(path)
+	return err
+}
+
+func resourceFile(directory, name string) string {
+	return filepath.Join(directory, filepath.FromSlash(name)+".json")
+}
+
+func sortedResourceNames(local, remote map[string]map[string]interface{}) []string {
+	names := make([]string, 0, len(local)+len(remote))
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// canonicalJSON encodes v with sorted keys, so that two values holding the
+// same data, whether they come from a file or from Vault, encode the same.
+func canonicalJSON(v interface{}) string {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(content, &generic); err != nil {
+		return ""
+	}
+
+	content, _ = json.Marshal(generic)
+	return string(content)
+}
+
+// diffFields returns a line per JSON field whose value differs between before
+// and after, using the dotted JSON path of the field as its name.
+func diffFields(before, after interface{}) []string {
+	beforeFields := flattenJSON(before)
+	afterFields := flattenJSON(after)
+
+	names := make([]string, 0, len(beforeFields)+len(afterFields))
+	for name := range beforeFields {
+		names = append(names, name)
+	}
+	for name := range afterFields {
+		if _, ok := beforeFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []string{}
+	for _, name := range names {
+		b, inBefore := beforeFields[name]
+		a, inAfter := afterFields[name]
+		switch {
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("%s: %s", name, a))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("%s: %s -> (unset)", name, b))
+		case a != b:
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, b, a))
+		}
+	}
+	return changes
+}
+
+func flattenJSON(v interface{}) map[string]string {
+	fields := make(map[string]string)
+
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fields
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(content, &generic); err != nil {
+		return fields
+	}
+
+	var walk func(prefix string, value interface{})
+	walk = func(prefix string, value interface{}) {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			encoded, _ := json.Marshal(value)
+			fields[prefix] = string(encoded)
+			return
+		}
+		for key, child := range object {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			walk(key, child)
+		}
+	}
+	walk("", generic)
+
+	return fields
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+)
+
+// retryConfig is how the requests to the Vault of a profile are retried when
+// they fail, and when to give up on it.
+type retryConfig struct {
+	// MaxRetries is how many times a request is retried, 2 by default.
+	MaxRetries *int `yaml:"max_retries"`
+	// MaxElapsed is how long the run may wait between retries in all, like
+	// 2m, no request being retried after.
+	MaxElapsed time.Duration `yaml:"max_elapsed"`
+	// RetryOn are the status codes retried, those of the Vault API, like the
+	// 5xx but 501, by default.
+	RetryOn []int `yaml:"retry_on"`
+	// CircuitBreaker is how many requests in a row may fail, without a
+	// response or with a 5xx, before the run stops sending any.
+	CircuitBreaker int `yaml:"circuit_breaker"`
+}
+
+// breaker is the circuit breaker of the run, nil without circuit_breaker.
+var breaker *vaultclient.CircuitBreaker
+
+// policy returns the retry policy of the configuration, and whether any is
+// set.
+func (r retryConfig) policy() (vaultclient.RetryPolicy, bool) {
+	p := vaultclient.RetryPolicy{MaxRetries: -1, MaxElapsed: r.MaxElapsed, RetryOn: r.RetryOn}
+	if r.MaxRetries != nil {
+		p.MaxRetries = *r.MaxRetries
+	}
+	if r.CircuitBreaker > 0 {
+		// All the clients of the run share it.
+		if breaker == nil {
+			breaker = &vaultclient.CircuitBreaker{Failures: r.CircuitBreaker}
+		}
+		p.Breaker = breaker
+	}
+	return p, r.MaxRetries != nil || r.MaxElapsed > 0 || len(r.RetryOn) > 0 || p.Breaker != nil
+}
+
+// circuitOpen returns the error of the requests refused since the circuit
+// breaker opened, nil while it is closed.
+func circuitOpen() error {
+	if breaker == nil {
+		return nil
+	}
+	if open := breaker.Open(); open != nil {
+		return open
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+// The token settings shared by the roles of most auth methods.
+var tokenFields = []string{
+	"token_bound_cidrs",
+	"token_explicit_max_ttl",
+	"token_max_ttl",
+	"token_no_default_policy",
+	"token_num_uses",
+	"token_period",
+	"token_policies",
+	"token_ttl",
+	"token_type",
+}
+
+// AppRole roles are stored without their role id and secret ids, which are
+// credentials and don't belong in a repository.
+var approleRolesResource = &resource{
+	name:  "approle-roles",
+	kind:  "AppRole role",
+	path:  "auth/%s/role",
+	mount: "approle",
+	fields: append([]string{
+		"bind_secret_id",
+		"local_secret_ids",
+		"secret_id_bound_cidrs",
+		"secret_id_num_uses",
+		"secret_id_ttl",
+	}, tokenFields...),
+}
+
+var kubernetesRolesResource = &resource{
+	name:  "kubernetes-roles",
+	kind:  "Kubernetes role",
+	path:  "auth/%s/role",
+	mount: "kubernetes",
+	fields: append([]string{
+		"alias_name_source",
+		"audience",
+		"bound_service_account_names",
+		"bound_service_account_namespaces",
+	}, tokenFields...),
+}
+
+// The token auth method can't be moved, so there is no mount to select.
+var tokenRolesResource = &resource{
+	name: "token-roles",
+	kind: "token role",
+	path: "auth/token/roles",
+	fields: []string{
+		"allowed_entity_aliases",
+		"allowed_policies",
+		"allowed_policies_glob",
+		"disallowed_policies",
+		"disallowed_policies_glob",
+		"orphan",
+		"path_suffix",
+		"renewable",
+		"token_bound_cidrs",
+		"token_explicit_max_ttl",
+		"token_no_default_policy",
+		"token_num_uses",
+		"token_period",
+		"token_type",
+	},
+}
+
+var databaseRolesResource = &resource{
+	name:  "database-roles",
+	kind:  "database role",
+	path:  "%s/roles",
+	mount: "database",
+	fields: []string{
+		"creation_statements",
+		"credential_config",
+		"credential_type",
+		"db_name",
+		"default_ttl",
+		"max_ttl",
+		"renew_statements",
+		"revocation_statements",
+		"rollback_statements",
+	},
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// rollout is the order a directory is restored to the profiles of a fleet of
+// Vault servers in, as declared under rollouts in the file of --profiles.
+type rollout struct {
+	Stages []*rolloutStage `yaml:"stages"`
+}
+
+// rolloutStage is a set of profiles restored one after the other, once the
+// previous stages succeeded.
+type rolloutStage struct {
+	// Name is the name of the stage, its profiles by default.
+	Name     string   `yaml:"name"`
+	Profiles []string `yaml:"profiles"`
+	// Pause is how long to wait before the stage once the previous one is
+	// done, to let its changes soak, like 30m.
+	Pause time.Duration `yaml:"pause"`
+	// Approval asks for a confirmation on the terminal before the stage.
+	Approval bool `yaml:"approval"`
+}
+
+func rolloutCommand() *cli.Command {
+	name := ""
+	fromStage := ""
+	maxDeletions := "50%"
+	force := false
+
+	return &cli.Command{
+		Name:      "rollout",
+		Usage:     "Restore a directory to the profiles of a rollout of the file of --profiles, stage after stage, halting at the first failure",
+		ArgsUsage: "directory [overlay directory...]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "rollout",
+				Usage:       "Rollout of the file of --profiles to follow, required if it has several",
+				Destination: &name,
+			},
+			&cli.StringFlag{
+				Name:        "from-stage",
+				Usage:       "Stage to start at, to resume a rollout that halted",
+				Destination: &fromStage,
+			},
+			&cli.StringFlag{
+				Name:        "max-deletions",
+				Usage:       "Most policies a restore may delete, as a number or a percentage of the policies in Vault, above which the rollout halts unless forced",
+				Value:       maxDeletions,
+				Destination: &maxDeletions,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Usage:       "Restore even if it deletes more policies than --max-deletions",
+				Destination: &force,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) < 1 {
+				return fmt.Errorf("rollout requires a directory")
+			}
+			if profileName != "" {
+				return fmt.Errorf("rollout targets the profiles of its stages, not --profile")
+			}
+
+			r, err := loadRollout(profilesFile, name)
+			if err != nil {
+				return err
+			}
+			limit, err := newDeletionLimit(maxDeletions, force)
+			if err != nil {
+				return err
+			}
+			options := restoreOptions{onConflict: conflictFail, maxDeletions: limit}
+
+			return runRollout(dev, dryRun, r, fromStage, options, c.Args().Slice(), os.Stdin)
+		},
+	}
+}
+
+// loadRollout reads the rollout of that name from the profiles file, the only
+// one if name is empty, and checks its stages.
+func loadRollout(file, name string) (*rollout, error) {
+	if file == "" {
+		return nil, fmt.Errorf("rollout requires a profiles file set with --profiles")
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := profiles{}
+	err = yaml.Unmarshal(content, &p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+
+	names := make([]string, 0, len(p.Rollouts))
+	for n := range p.Rollouts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if name == "" {
+		if len(names) != 1 {
+			return nil, fmt.Errorf("%s has %d rollouts, choose one of %v with --rollout", file, len(names), names)
+		}
+		name = names[0]
+	}
+	r, ok := p.Rollouts[name]
+	if !ok || r == nil || len(r.Stages) == 0 {
+		return nil, fmt.Errorf("no rollout %s with stages in %s, expected one of %v", name, file, names)
+	}
+
+	for i, stage := range r.Stages {
+		if stage == nil || len(stage.Profiles) == 0 {
+			return nil, fmt.Errorf("rollout %s: stage %d has no profiles", name, i+1)
+		}
+		if stage.Name == "" {
+			stage.Name = strings.Join(stage.Profiles, ",")
+		}
+		for _, profile := range stage.Profiles {
+			if p.Profiles[profile] == nil {
+				return nil, fmt.Errorf("rollout %s: stage %s: no profile %s, expected one of %v", name, stage.Name, profile, sortedProfileNames(p.Profiles))
+			}
+		}
+	}
+	return r, nil
+}
+
+// runRollout restores directories to the profiles of the stages of r from the
+// stage fromStage, pausing and asking input for an approval before the stages
+// requiring them. The rollout halts at the first profile failing.
+func runRollout(dev, dryRun bool, r *rollout, fromStage string, options restoreOptions, directories []string, input io.Reader) error {
+	stages := r.Stages
+	if fromStage != "" {
+		for i, stage := range r.Stages {
+			if stage.Name == fromStage {
+				stages = r.Stages[i:]
+				break
+			}
+			if i == len(r.Stages)-1 {
+				return fmt.Errorf("no stage %s in the rollout", fromStage)
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(input)
+	for i, stage := range stages {
+		if !dryRun && i > 0 && stage.Pause > 0 {
+			fmt.Printf("Pausing %s before stage %s\n", stage.Pause, stage.Name)
+			time.Sleep(stage.Pause)
+		}
+		if !dryRun && stage.Approval {
+			err := approveStage(stage, scanner)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := runRolloutStage(dev, dryRun, stage, options, directories)
+		if err != nil {
+			return fmt.Errorf("rollout halted at %w%s, resume it with --from-stage %s once fixed", err, remainingStages(stages[i+1:]), stage.Name)
+		}
+	}
+
+	fmt.Printf("Rolled out %d stages\n", len(stages))
+	return nil
+}
+
+func runRolloutStage(dev, dryRun bool, stage *rolloutStage, options restoreOptions, directories []string) error {
+	var err error
+	for _, name := range stage.Profiles {
+		fmt.Printf("Stage %s: restoring profile %s\n", stage.Name, name)
+		activeProfile, err = loadProfile(profilesFile, name)
+		if err != nil {
+			return fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+
+		err = restorePolicies(dev, dryRun, options, directories)
+		if err != nil {
+			return fmt.Errorf("stage %s: profile %s: %w", stage.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// approveStage asks whether to roll out to the stage, anything but yes
+// stopping the rollout.
+func approveStage(stage *rolloutStage, scanner *bufio.Scanner) error {
+	fmt.Printf("Roll out to stage %s (%s) [y/N]? ", stage.Name, strings.Join(stage.Profiles, ", "))
+	answer := ""
+	if scanner.Scan() {
+		answer = strings.ToLower(strings.TrimSpace(scanner.Text()))
+	}
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("rollout stopped before stage %s, resume it with --from-stage %s", stage.Name, stage.Name)
+	}
+	return nil
+}
+
+func remainingStages(stages []*rolloutStage) string {
+	if len(stages) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(stages))
+	for _, stage := range stages {
+		names = append(names, stage.Name)
+	}
+	return ", not rolled out to " + strings.Join(names, ", ")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runID identifies the run in the audit trail, the hooks and the lock, set
+// with --run-id or generated.
+var runID = ""
+
+// newRunID returns a run id made of the time and random bytes.
+func newRunID() string {
+	random := make([]byte, 4)
+	_, err := rand.Read(random)
+	if err != nil {
+		return time.Now().UTC().Format("20060102T150405.000000000Z")
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(random)
+}
+
+// planProgress is what the runs applying a plan completed, so that applying
+// it again after a failure only makes the remaining changes.
+type planProgress struct {
+	// Digest is the digest of the plan, whose changes are the ones recorded.
+	Digest string `json:"digest"`
+	// Completed are the policies changed, with the run that changed them.
+	Completed map[string]string `json:"completed"`
+
+	file string
+	mu   sync.Mutex
+}
+
+// progressFile returns the file of the progress of the plan of file.
+func progressFile(planFile string) string {
+	return strings.TrimSuffix(planFile, ".json") + ".progress.json"
+}
+
+// loadProgress returns the progress of applying the plan p of file, empty if
+// it was never applied or the plan changed since.
+func loadProgress(file string, p *planFile) (*planProgress, error) {
+	digest, err := p.digest()
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &planProgress{Digest: hex.EncodeToString(digest), Completed: map[string]string{}, file: progressFile(file)}
+	content, err := os.ReadFile(progress.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := &planProgress{}
+	err = json.Unmarshal(content, saved)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the progress %s: %w", progress.file, err)
+	}
+	if saved.Digest != progress.Digest {
+		log("Ignoring the progress of another plan in", progress.file)
+		return progress, nil
+	}
+	if saved.Completed != nil {
+		progress.Completed = saved.Completed
+	}
+	return progress, nil
+}
+
+// complete records that the current run changed a policy.
+func (pp *planProgress) complete(name string) error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.Completed[name] = runID
+	return pp.save()
+}
+
+// forget records that the change of a policy was reverted, so that it is
+// applied again with the rest of the plan.
+func (pp *planProgress) forget(name string) error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	delete(pp.Completed, name)
+	return pp.save()
+}
+
+func (pp *planProgress) save() error {
+	content, err := json.MarshalIndent(pp, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(pp.file, append(content, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("unable to record the progress of the plan in %s: %w", pp.file, err)
+	}
+	return nil
+}
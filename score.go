@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// sensitivePaths are the paths that a policy granting a wildcard over them is
+// expected to deny explicitly.
+var sensitivePaths = []string{
+	"sys/audit/{path}",
+	"sys/auth/{path}",
+	"sys/generate-root/attempt",
+	"sys/raw/{path}",
+	"sys/rotate",
+	"sys/seal",
+}
+
+// validCapabilities are the capabilities an ACL policy can grant.
+var validCapabilities = map[string]bool{
+	"create": true,
+	"read":   true,
+	"update": true,
+	"patch":  true,
+	"delete": true,
+	"list":   true,
+	"sudo":   true,
+	"deny":   true,
+}
+
+// benchmarkInput is what the benchmark checks look at.
+type benchmarkInput struct {
+	policies    []*parsedPolicy
+	attachments *attachments
+	// rootHolders are the objects of the server holding the root policy, or
+	// nil if the server wasn't checked.
+	rootHolders []string
+}
+
+// benchmarkCheck is a rule of the benchmark. It returns the violations it
+// found, the check passes if there is none.
+type benchmarkCheck struct {
+	id     string
+	title  string
+	weight int
+	run    func(in *benchmarkInput) []string
+}
+
+var benchmarkChecks = []benchmarkCheck{
+	{id: "no-wildcard-admin", title: "No policy grants write or sudo on a wildcard at the root", weight: 3, run: checkWildcardAdmin},
+	{id: "deny-sensitive", title: "Wildcards over sensitive paths come with an explicit deny", weight: 2, run: checkDenySensitive},
+	{id: "valid-capabilities", title: "No policy uses a plain * or an unknown capability", weight: 2, run: checkCapabilities},
+	{id: "root-unused", title: "The root policy isn't attached to anything", weight: 3, run: checkRootUnused},
+}
+
+// checkResult is the outcome of a benchmark check in the report.
+type checkResult struct {
+	ID         string   `json:"id"`
+	Title      string   `json:"title"`
+	Weight     int      `json:"weight"`
+	Passed     bool     `json:"passed"`
+	Violations []string `json:"violations,omitempty"`
+}
+
+// scoreReport is the report of the audit-score command.
+type scoreReport struct {
+	GeneratedAt time.Time     `json:"generated_at"`
+	Directory   string        `json:"directory"`
+	Live        bool          `json:"live"`
+	Score       int           `json:"score"`
+	Checks      []checkResult `json:"checks"`
+}
+
+func auditScoreCommand() *cli.Command {
+	live := false
+	jsonOutput := false
+	minScore := 0
+
+	return &cli.Command{
+		Name:  "audit-score",
+		Usage: "Score the policies of a local directory against a built-in security benchmark",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Connect to Vault to check that the root policy isn't attached to any group, entity or role",
+				Destination: &live,
+			},
+			&cli.BoolFlag{
+				Name:        "json",
+				Usage:       "Print the report as JSON, to keep it as compliance evidence",
+				Destination: &jsonOutput,
+			},
+			&cli.IntFlag{
+				Name:        "min-score",
+				Usage:       "Fail if the score, out of 100, is below this value",
+				Destination: &minScore,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("audit-score requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			return auditScore(dev, live, jsonOutput, minScore, directory)
+		},
+	}
+}
+
+func auditScore(dev, live, jsonOutput bool, minScore int, directory string) error {
+	in, err := newBenchmarkInput(dev, live, directory)
+	if err != nil {
+		return err
+	}
+
+	report := runBenchmark(in)
+	report.Directory = directory
+	report.Live = live
+
+	if jsonOutput {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(content))
+	} else {
+		printScoreReport(report)
+	}
+
+	if report.Score < minScore {
+		return fmt.Errorf("score %d is below the minimum of %d", report.Score, minScore)
+	}
+	return nil
+}
+
+func newBenchmarkInput(dev, live bool, directory string) (*benchmarkInput, error) {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return nil, err
+	}
+	in := &benchmarkInput{policies: policies, attachments: &attachments{}}
+
+	file := filepath.Join(directory, attachmentsFile)
+	if _, err := os.Stat(file); err == nil {
+		in.attachments, err = loadAttachments(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if live {
+		client, err := selectNewVault(dev)
+		if err != nil {
+			return nil, err
+		}
+
+		in.rootHolders, err = rootHolders(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return in, nil
+}
+
+// rootHolders returns the objects of the server that hold the root policy.
+func rootHolders(client *vaultApi.Client) ([]string, error) {
+	all, err := policyHolders(client)
+	if err != nil {
+		return nil, err
+	}
+
+	holders := []string{}
+	for _, holder := range all {
+		for _, policy := range holder.policies {
+			if policy == "root" {
+				holders = append(holders, holder.name)
+			}
+		}
+	}
+	return holders, nil
+}
+
+func runBenchmark(in *benchmarkInput) *scoreReport {
+	report := &scoreReport{GeneratedAt: time.Now().UTC()}
+
+	total, passed := 0, 0
+	for _, check := range benchmarkChecks {
+		violations := check.run(in)
+		result := checkResult{
+			ID:         check.id,
+			Title:      check.title,
+			Weight:     check.weight,
+			Passed:     len(violations) == 0,
+			Violations: violations,
+		}
+		report.Checks = append(report.Checks, result)
+
+		total += check.weight
+		if result.Passed {
+			passed += check.weight
+		}
+	}
+
+	report.Score = 100 * passed / total
+	return report
+}
+
+func printScoreReport(report *scoreReport) {
+	for _, result := range report.Checks {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Printf("%s [%s] %s\n", status, result.ID, result.Title)
+		for _, violation := range result.Violations {
+			fmt.Println("    " + violation)
+		}
+	}
+	fmt.Printf("Score: %d/100\n", report.Score)
+}
+
+// checkWildcardAdmin reports the paths whose wildcard starts in the first
+// segment, like * or +/*, and that grant more than reading.
+func checkWildcardAdmin(in *benchmarkInput) []string {
+	violations := []string{}
+	for _, p := range in.policies {
+		for _, path := range p.paths {
+			literal := path.path
+			if i := strings.IndexAny(literal, "*+"); i >= 0 {
+				literal = literal[:i]
+			} else {
+				continue
+			}
+			if strings.Contains(literal, "/") {
+				continue
+			}
+
+			for _, capability := range path.Capabilities {
+				if writeCapabilities[capability] {
+					violations = append(violations, fmt.Sprintf("%s:%d: path %q grants %s", p.name, path.line, path.path, strings.Join(path.Capabilities, ", ")))
+					break
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// checkDenySensitive reports the policies granting a wildcard that covers a
+// sensitive path without denying that path.
+func checkDenySensitive(in *benchmarkInput) []string {
+	violations := []string{}
+	for _, p := range in.policies {
+		for _, sensitive := range sensitivePaths {
+			granted, denied := 0, false
+			for _, path := range p.paths {
+				if !strings.HasSuffix(path.path, "*") || !pathOverlaps(path.path, sensitive) {
+					continue
+				}
+				if isDeny(path) {
+					denied = true
+				} else if granted == 0 {
+					granted = path.line
+				}
+			}
+			if granted > 0 && !denied {
+				violations = append(violations, fmt.Sprintf("%s:%d: grants a wildcard over %s without denying it", p.name, granted, sensitive))
+			}
+		}
+	}
+	return violations
+}
+
+// checkCapabilities reports the capabilities Vault doesn't know, starting
+// with the tempting *.
+func checkCapabilities(in *benchmarkInput) []string {
+	violations := []string{}
+	for _, p := range in.policies {
+		for _, path := range p.paths {
+			for _, capability := range path.Capabilities {
+				if !validCapabilities[capability] {
+					violations = append(violations, fmt.Sprintf("%s:%d: path %q uses the unknown capability %q", p.name, path.line, path.path, capability))
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// checkRootUnused reports the root policy being attached in the attachments
+// file and, when the server was checked, on the server.
+func checkRootUnused(in *benchmarkInput) []string {
+	violations := []string{}
+
+	groups := make([]string, 0, len(in.attachments.Groups))
+	for group := range in.attachments.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		for _, policy := range in.attachments.Groups[group] {
+			if policy == "root" {
+				violations = append(violations, fmt.Sprintf("%s: root is attached to group %s", attachmentsFile, group))
+			}
+		}
+	}
+
+	for _, holder := range in.rootHolders {
+		violations = append(violations, fmt.Sprintf("Vault: root is attached to %s", holder))
+	}
+	return violations
+}
+
+func isDeny(path *policyPath) bool {
+	for _, capability := range path.Capabilities {
+		if capability == "deny" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// secretPattern is what a kind of credential looks like.
+type secretPattern struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+var secretPatterns = []secretPattern{
+	{"a Vault token", regexp.MustCompile(`\bhv[sbr]\.[A-Za-z0-9_-]{20,}`)},
+	{"a legacy Vault token", regexp.MustCompile(`\b[sbr]\.[A-Za-z0-9]{24}\b`)},
+	{"a private key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY( BLOCK)?-----`)},
+	{"an AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"a GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"a Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"a password", regexp.MustCompile(`(?i)\b(password|passwd|pwd|secret|token|api[_-]?key)\s*[:=]\s*["']?[^\s"'\[\]{}]{6,}`)},
+}
+
+// randomPattern matches the words long enough to be a generated credential,
+// and not paths.
+var randomPattern = regexp.MustCompile(`[A-Za-z0-9+=_-]{32,}`)
+
+// minSecretEntropy is the Shannon entropy, in bits per character, above which
+// a long word looks generated. Hexadecimal ids like those of entities stay
+// below it.
+const minSecretEntropy = 4.2
+
+// lintSecrets reports what looks like a token, a private key or a password in
+// the policy, comments included: policy files are replicated in every clone
+// of the repository and every Vault, so they shouldn't hold any credential,
+// not even an example one.
+func lintSecrets(p *parsedPolicy, ctx *lintContext) []finding {
+	findings := []finding{}
+	for i, line := range strings.Split(p.content, "\n") {
+		kind := secretKind(line)
+		if kind == "" {
+			continue
+		}
+		findings = append(findings, finding{
+			policy:  p.name,
+			line:    i + 1,
+			rule:    "secret",
+			message: fmt.Sprintf("this looks like %s, remove it and revoke it if it is real", kind),
+		})
+	}
+	return findings
+}
+
+// secretKind returns the kind of credential line seems to hold, if any.
+func secretKind(line string) string {
+	for _, s := range secretPatterns {
+		if s.pattern.MatchString(line) {
+			return s.kind
+		}
+	}
+	for _, word := range randomPattern.FindAllString(line, -1) {
+		if entropy(word) >= minSecretEntropy {
+			return "a generated secret"
+		}
+	}
+	return ""
+}
+
+// entropy returns the Shannon entropy of s, in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	total := float64(len(s))
+	bits := 0.0
+	for _, count := range counts {
+		frequency := float64(count) / total
+		bits -= frequency * math.Log2(frequency)
+	}
+	return bits
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const latestReleaseURL = "https://api.github.com/repos/fynelabs/vault-policies/releases/latest"
+
+// The release holds a binary per platform, and the SHA-256 sums of all of them
+// in a checksums file signed with ed25519.
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// releasePublicKey is the base64 ed25519 public key the checksums of the
+// releases are signed with. Set at build time with -ldflags
+// "-X main.releasePublicKey=...", like the version.
+var releasePublicKey = ""
+
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func selfUpdateCommand() *cli.Command {
+	force := false
+	publicKeyFile := ""
+	releaseURL := latestReleaseURL
+
+	return &cli.Command{
+		Name:  "self-update",
+		Usage: "Replace the running binary with the latest release, after verifying its signature and checksum",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "force",
+				Usage:       "Update even if the running version isn't older than the latest release",
+				Destination: &force,
+			},
+			&cli.StringFlag{
+				Name:        "public-key",
+				Usage:       "File holding the base64 ed25519 public key the checksums of the release must be signed with, instead of the key of the releases built into the binary",
+				Destination: &publicKeyFile,
+			},
+			&cli.StringFlag{
+				Name:        "release-url",
+				Usage:       "URL of the GitHub API describing the release to install",
+				Value:       releaseURL,
+				Destination: &releaseURL,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.Args().Len() != 0 {
+				return fmt.Errorf("self-update doesn't take any argument")
+			}
+
+			return selfUpdate(dryRun, force, publicKeyFile, releaseURL)
+		},
+	}
+}
+
+func selfUpdate(dryRun, force bool, publicKeyFile, releaseURL string) error {
+	publicKey, err := updatePublicKey(publicKeyFile)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	latest, err := fetchRelease(client, releaseURL)
+	if err != nil {
+		return err
+	}
+
+	current, _, _ := buildVersion()
+	if !force && !versionBefore(current, latest.TagName) {
+		fmt.Printf("vault-policies %s is up to date, the latest release is %s\n", current, latest.TagName)
+		return nil
+	}
+
+	binary, err := downloadRelease(client, latest, publicKey)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find the running binary: %w", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return fmt.Errorf("unable to find the running binary: %w", err)
+	}
+
+	if dryRun {
+		fmt.Printf("Would have replaced %s (%s) with %s\n", executable, current, latest.TagName)
+		return nil
+	}
+
+	err = replaceExecutable(executable, binary)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s from %s to %s\n", executable, current, latest.TagName)
+	return nil
+}
+
+// updatePublicKey returns the key the release must be signed with, from file
+// or else built into the binary. Builds without one can't update unverified.
+func updatePublicKey(file string) (ed25519.PublicKey, error) {
+	if file == "" {
+		if releasePublicKey == "" {
+			return nil, fmt.Errorf("this build of vault-policies has no release public key, pass the key of the releases with --public-key")
+		}
+		return parsePublicKey(releasePublicKey, "the release public key built in")
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the public key: %w", err)
+	}
+	return parsePublicKey(string(content), file)
+}
+
+func parsePublicKey(encoded, source string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s isn't a base64 ed25519 public key", source)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func fetchRelease(client *http.Client, url string) (*release, error) {
+	content, err := download(client, url)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &release{}
+	err = json.Unmarshal(content, r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the release: %w", err)
+	}
+	return r, nil
+}
+
+// downloadRelease downloads the binary of the release for the running
+// platform and returns it once the signature of the checksums and its
+// checksum are verified.
+func downloadRelease(client *http.Client, r *release, publicKey ed25519.PublicKey) ([]byte, error) {
+	name := fmt.Sprintf("vault-policies_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+
+	urls := map[string]string{}
+	for _, asset := range r.Assets {
+		urls[asset.Name] = asset.URL
+	}
+	for _, required := range []string{name, checksumsAsset, signatureAsset} {
+		if urls[required] == "" {
+			return nil, fmt.Errorf("release %s has no %s", r.TagName, required)
+		}
+	}
+
+	checksums, err := download(client, urls[checksumsAsset])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := download(client, urls[signatureAsset])
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(publicKey, checksums, signature) {
+		return nil, fmt.Errorf("the signature of the checksums of release %s is invalid", r.TagName)
+	}
+
+	expected, err := findChecksum(checksums, name)
+	if err != nil {
+		return nil, err
+	}
+
+	binary, err := download(client, urls[name])
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(binary)
+	if hex.EncodeToString(sum[:]) != expected {
+		return nil, fmt.Errorf("the checksum of %s doesn't match the release", name)
+	}
+	return binary, nil
+}
+
+// findChecksum returns the SHA-256 sum of a file from a checksums file as
+// written by sha256sum.
+func findChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s in the release", name)
+}
+
+func download(client *http.Client, url string) ([]byte, error) {
+	log("Downloading", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download %s: %s", url, resp.Status)
+	}
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s: %w", url, err)
+	}
+	return content, nil
+}
+
+// replaceExecutable writes the new binary next to the running one and swaps
+// them, keeping the old one until the new one is in place so that a failure
+// leaves a working binary.
+func replaceExecutable(executable string, binary []byte) error {
+	info, err := os.Stat(executable)
+	if err != nil {
+		return err
+	}
+
+	next := executable + ".new"
+	err = os.WriteFile(next, binary, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("unable to write the new binary: %w", err)
+	}
+
+	old := executable + ".old"
+	err = os.Rename(executable, old)
+	if err != nil {
+		os.Remove(next)
+		return fmt.Errorf("unable to move the running binary: %w", err)
+	}
+
+	err = os.Rename(next, executable)
+	if err != nil {
+		os.Rename(old, executable)
+		return fmt.Errorf("unable to install the new binary: %w", err)
+	}
+
+	// Windows doesn't let a running binary be removed, it stays until the
+	// next update.
+	err = os.Remove(old)
+	if err != nil {
+		log("Unable to remove", old, err.Error())
+	}
+	return nil
+}
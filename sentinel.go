@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// EGP bindings are the paths an Endpoint Governing Policy applies to and its
+// enforcement level. The Sentinel code of the policies is not part of them, so
+// restoring bindings never creates nor deletes an EGP.
+var egpBindingsResource = &resource{
+	name:    "egp-bindings",
+	kind:    "EGP binding",
+	path:    "sys/policies/egp",
+	fields:  []string{"enforcement_level", "paths"},
+	partial: true,
+	write:   writeEGPBinding,
+}
+
+func writeEGPBinding(client *vaultApi.Client, path string, data map[string]interface{}) error {
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Data == nil {
+		return fmt.Errorf("%s doesn't exist, the EGP policy must be created before binding it", path)
+	}
+
+	payload := map[string]interface{}{
+		"policy": secret.Data["policy"],
+	}
+	for field, value := range data {
+		payload[field] = value
+	}
+
+	return writeData(client, path, payload)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>vault-policies</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.3em 1em; border-bottom: 1px solid #ddd; text-align: left; }
+pre { background: #f6f6f6; padding: 1em; }
+.drift { font-family: monospace; font-weight: bold; }
+.add { color: #080; } .del { color: #a00; }
+</style>
+</head>
+<body>
+{{if .Policy}}
+<p><a href="/">All policies</a></p>
+<h1>{{.Policy.Name}}</h1>
+{{if .Policy.Diff}}<h2>Drift</h2>
+<pre>{{range .Policy.Diff}}{{if eq (slice . 0 1) "+"}}<span class="add">{{.}}</span>{{else if eq (slice . 0 1) "-"}}<span class="del">{{.}}</span>{{else}}{{.}}{{end}}
+{{end}}</pre>{{end}}
+<h2>In the directory</h2>
+{{if .Policy.HasLocal}}<pre>{{.Policy.Local}}</pre>{{else}}<p>Missing</p>{{end}}
+<h2>In Vault</h2>
+{{if .Policy.HasRemote}}<pre>{{.Policy.Remote}}</pre>{{else}}<p>Missing</p>{{end}}
+{{else if .History}}
+<p><a href="/">All policies</a></p>
+<h1>Changes made to Vault</h1>
+{{template "history" .History}}
+{{else}}
+<h1>Policies of {{.Directory}}</h1>
+<table>
+<tr><th></th><th>Policy</th><th>State</th></tr>
+{{range .Policies}}<tr><td class="drift">{{.Marker}}</td><td><a href="/policy/{{.Name}}">{{.Name}}</a></td><td>{{.State}}</td></tr>
+{{end}}</table>
+<h2>Lint findings</h2>
+{{if .Findings}}<ul>{{range .Findings}}<li>{{.}}</li>{{end}}</ul>{{else}}<p>No problem found</p>{{end}}
+<h2>Recent changes</h2>
+{{if .Recent}}{{template "history" .Recent}}<p><a href="/history">All the changes</a></p>{{else}}<p>{{.NoHistory}}</p>{{end}}
+{{end}}
+</body>
+</html>
+{{define "history"}}<table>
+<tr><th>Time</th><th>Change</th><th>By</th><th>Vault</th><th>Change ticket</th><th>Run</th></tr>
+{{range .}}<tr><td>{{.Time.Format "2006-01-02 15:04:05Z07:00"}}</td><td><span class="drift">{{.Action}}</span> {{.Kind}} {{.Name}}</td><td>{{.Actor}}</td><td>{{.Address}}</td><td>{{.ChangeRef}}</td><td>{{.RunID}}</td></tr>
+{{end}}</table>{{end}}
+`))
+
+// dashboardRecentChanges is the number of changes of the audit trail shown on
+// the index of the dashboard.
+const dashboardRecentChanges = 10
+
+// dashboardPolicy is a policy as shown on the dashboard.
+type dashboardPolicy struct {
+	Name      string
+	Marker    string
+	State     string
+	Local     string
+	Remote    string
+	HasLocal  bool
+	HasRemote bool
+	Diff      []string
+}
+
+type dashboardPage struct {
+	Directory string
+	Policies  []dashboardPolicy
+	Findings  []string
+	Policy    *dashboardPolicy
+	// Recent are the last changes of the audit trail, the latest first, and
+	// History all of them.
+	Recent    []trailEntry
+	History   []trailEntry
+	NoHistory string
+}
+
+// dashboard serves the read-only dashboard of a policies directory. Everything
+// is read again from Vault and the directory on each request.
+type dashboard struct {
+	client    *vaultApi.Client
+	directory string
+	// token is required to see the dashboard, unless empty.
+	token string
+}
+
+func serveCommand() *cli.Command {
+	listen := "127.0.0.1:8080"
+	apiTokenFile := ""
+	maxDeletions := "50%"
+	force := false
+
+	return &cli.Command{
+		Name:  "serve",
+		Usage: "Serve a read-only dashboard of the drift, contents and lint findings of the policies of a local directory and of the changes of the audit trail, and optionally an HTTP API to diff, plan, apply and back them up",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "listen",
+				Usage:       "Address to listen on, only reachable from other hosts with an API token",
+				Value:       listen,
+				Destination: &listen,
+			},
+			&cli.StringFlag{
+				Name:        "api-token-file",
+				Usage:       "File holding the bearer token enabling the HTTP API under /api/v1, which can also be set with " + apiTokenEnv,
+				Destination: &apiTokenFile,
+			},
+			&cli.StringFlag{
+				Name:        "max-deletions",
+				Usage:       "Most policies an apply of the HTTP API may delete, as a number or a percentage of the policies in Vault, above which it is refused unless forced",
+				Value:       maxDeletions,
+				Destination: &maxDeletions,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Usage:       "Apply even if it deletes more policies than --max-deletions",
+				Destination: &force,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("serve requires a directory")
+			}
+
+			limit, err := newDeletionLimit(maxDeletions, force)
+			if err != nil {
+				return err
+			}
+			directory := c.Args().Slice()[0]
+
+			return serve(dev, listen, apiTokenFile, directory, limit)
+		},
+	}
+}
+
+func serve(dev bool, listen, apiTokenFile, directory string, limit *deletionLimit) error {
+	token, err := readAPIToken(apiTokenFile)
+	if err != nil {
+		return err
+	}
+
+	if token == "" && !loopbackAddress(listen) {
+		return fmt.Errorf("serving the policies on %s requires a token, set with --api-token-file or %s, or listen on 127.0.0.1", listen, apiTokenEnv)
+	}
+
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	d := &dashboard{client: client, directory: directory, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.authenticated(d.index))
+	mux.HandleFunc("/policy/", d.authenticated(d.policy))
+	mux.HandleFunc("/history", d.authenticated(d.history))
+
+	if token != "" {
+		api := &apiServer{client: client, directory: directory, token: token, limit: limit}
+		api.register(mux)
+		fmt.Println("Serving the HTTP API on /api/v1")
+	}
+
+	fmt.Printf("Serving the dashboard of %s on %s\n", directory, listen)
+	return http.ListenAndServe(listen, mux)
+}
+
+// loopbackAddress tells if the listen address is only reachable from this
+// host.
+func loopbackAddress(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authenticated wraps a page so that it requires the token, if any, which
+// browsers ask for as the password of a basic authentication.
+func (d *dashboard) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.token != "" && !tokenMatches(r, d.token) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="vault-policies"`)
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (d *dashboard) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	states, err := loadPolicyStates(d.client, d.directory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	page := dashboardPage{Directory: d.directory}
+	for _, s := range states {
+		page.Policies = append(page.Policies, newDashboardPolicy(s))
+	}
+
+	page.Findings, err = d.findings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	page.Recent, page.NoHistory, err = d.changes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(page.Recent) > dashboardRecentChanges {
+		page.Recent = page.Recent[:dashboardRecentChanges]
+	}
+
+	d.render(w, page)
+}
+
+func (d *dashboard) history(w http.ResponseWriter, r *http.Request) {
+	changes, none, err := d.changes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(changes) == 0 {
+		http.Error(w, none, http.StatusNotFound)
+		return
+	}
+
+	d.render(w, dashboardPage{Directory: d.directory, History: changes})
+}
+
+// changes returns the changes of the audit trail, the latest first, or why
+// there are none.
+func (d *dashboard) changes() ([]trailEntry, string, error) {
+	if auditTrailFile == "" {
+		return nil, "No audit trail, record the changes with --audit-trail to show them here", nil
+	}
+
+	entries, err := readAuditTrail(auditTrailFile)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, "No change recorded in " + auditTrailFile + " yet", nil
+}
+
+func (d *dashboard) policy(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/policy/")
+
+	states, err := loadPolicyStates(d.client, d.directory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	for _, s := range states {
+		if s.name == name {
+			p := newDashboardPolicy(s)
+			d.render(w, dashboardPage{Directory: d.directory, Policy: &p})
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// findings lints the directory against the mounts of the server, or without
+// them if the token can't list them.
+func (d *dashboard) findings() ([]string, error) {
+	ctx := &lintContext{}
+	mounts, err := liveMounts(d.client)
+	if err != nil {
+		log("Linting without the mounts:", err.Error())
+	} else {
+		ctx.mounts, ctx.authMounts = mounts, true
+	}
+
+	findings, err := lintPolicies(d.directory, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, len(findings))
+	for _, f := range findings {
+		lines = append(lines, f.String())
+	}
+	return lines, nil
+}
+
+func (d *dashboard) render(w http.ResponseWriter, page dashboardPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, page)
+	if err != nil {
+		log("Unable to render the dashboard:", err.Error())
+	}
+}
+
+func newDashboardPolicy(s *policyState) dashboardPolicy {
+	states := map[string]string{
+		actionCreate: "only in the directory",
+		actionDelete: "only in Vault",
+		actionUpdate: "different",
+		" ":          "in sync",
+	}
+
+	p := dashboardPolicy{
+		Name:      s.name,
+		Marker:    s.marker(),
+		State:     states[s.marker()],
+		Local:     s.local,
+		Remote:    s.remote,
+		HasLocal:  s.hasLocal,
+		HasRemote: s.hasRemote,
+	}
+	if p.Marker != " " {
+		p.Diff = policyDiff(s.remote, s.local)
+	}
+	return p
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lintShadowed reports the rules of a policy that don't do what they look
+// like they do. Vault merges the stanzas of the same path, a deny winning over
+// everything, and applies the most specific path matching a request whatever
+// it grants, so a deny glob doesn't cover the narrower paths of the policy.
+func lintShadowed(p *parsedPolicy, ctx *lintContext) []finding {
+	findings := []finding{}
+	first := map[string]*policyPath{}
+	denied := map[string]*policyPath{}
+	for _, path := range p.paths {
+		if _, ok := first[path.path]; !ok {
+			first[path.path] = path
+		}
+		if containsDeny(path) && denied[path.path] == nil {
+			denied[path.path] = path
+		}
+	}
+
+	for _, path := range p.paths {
+		message := shadowedMessage(path, first[path.path], denied[path.path])
+		if message != "" {
+			findings = append(findings, finding{policy: p.name, line: path.line, rule: "shadowed", message: message})
+		}
+	}
+
+	for _, deny := range p.paths {
+		if !containsDeny(deny) {
+			continue
+		}
+		for _, path := range p.paths {
+			if path.path == deny.path || containsDeny(path) || !coversPath(deny.path, path.path) {
+				continue
+			}
+			findings = append(findings, finding{
+				policy: p.name,
+				line:   path.line,
+				rule:   "shadowed",
+				message: fmt.Sprintf("path %q overrides the deny of %q at line %d for the paths it matches, as the most specific path wins",
+					path.path, deny.path, deny.line),
+			})
+		}
+	}
+	return findings
+}
+
+// shadowedMessage tells why a stanza grants less than it says, given the first
+// stanza of its path and the first denying it, or returns "".
+func shadowedMessage(path, first, denied *policyPath) string {
+	switch {
+	case len(path.Capabilities) == 0:
+		return fmt.Sprintf("path %q has no capabilities, it grants nothing", path.path)
+	case containsDeny(path) && len(path.Capabilities) > 1:
+		return fmt.Sprintf("path %q denies, its other capabilities %s have no effect", path.path,
+			strings.Join(withoutDeny(path.Capabilities), ","))
+	case denied != nil && !containsDeny(path):
+		return fmt.Sprintf("path %q is denied at line %d, this stanza grants nothing as Vault merges them and deny wins",
+			path.path, denied.line)
+	case first != path:
+		return fmt.Sprintf("path %q is already at line %d, Vault merges the capabilities of both stanzas", path.path, first.line)
+	}
+	return ""
+}
+
+func containsDeny(path *policyPath) bool {
+	for _, c := range path.Capabilities {
+		if c == "deny" {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutDeny(capabilities []string) []string {
+	others := []string{}
+	for _, c := range capabilities {
+		if c != "deny" {
+			others = append(others, c)
+		}
+	}
+	return others
+}
+
+// coversPath tells if every request path the policy path inner matches is
+// also matched by outer.
+func coversPath(outer, inner string) bool {
+	if strings.HasSuffix(inner, "*") && !strings.HasSuffix(outer, "*") {
+		return false
+	}
+	// The + and * of inner are taken as literals, which only the wildcards
+	// of outer match.
+	return matchPath(outer, inner)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// planSignature is the cosign signature of the digest of a plan, and the
+// certificate of the signer for keyless signatures.
+type planSignature struct {
+	Signature   string `json:"signature"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// planVerifier is what a signed plan must be signed with: the cosign public
+// key, or the identity and OIDC issuer of the certificate of keyless
+// signatures.
+type planVerifier struct {
+	key      string
+	identity string
+	issuer   string
+}
+
+// clusterID returns the id of the Vault cluster of client, which plans are
+// bound to.
+func clusterID(client *vaultApi.Client) (string, error) {
+	health, err := client.Sys().Health()
+	if err != nil {
+		return "", fmt.Errorf("unable to get the id of the Vault cluster: %w", err)
+	}
+	if health.ClusterID == "" {
+		return "", fmt.Errorf("the Vault server doesn't tell the id of its cluster")
+	}
+	return health.ClusterID, nil
+}
+
+// signPlan signs the digest of the plan with cosign, with the private key if
+// set and keyless otherwise.
+func signPlan(p *planFile, key string) error {
+	dir, err := os.MkdirTemp("", "vault-policies-plan")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	payload, err := writePlanPayload(p, dir)
+	if err != nil {
+		return err
+	}
+
+	signature := filepath.Join(dir, "signature")
+	certificate := filepath.Join(dir, "certificate")
+	args := []string{"sign-blob", "--yes", "--output-signature", signature}
+	if key != "" {
+		args = append(args, "--key", key)
+	} else {
+		args = append(args, "--output-certificate", certificate)
+	}
+
+	err = runCosign(append(args, payload)...)
+	if err != nil {
+		return fmt.Errorf("unable to sign the plan: %w", err)
+	}
+
+	s := &planSignature{}
+	content, err := os.ReadFile(signature)
+	if err != nil {
+		return err
+	}
+	s.Signature = string(content)
+	if key == "" {
+		content, err = os.ReadFile(certificate)
+		if err != nil {
+			return err
+		}
+		s.Certificate = string(content)
+	}
+	p.Signature = s
+	return nil
+}
+
+// verifyPlan fails unless the plan is signed as v requires, and is for the
+// Vault cluster of client.
+func verifyPlan(p *planFile, v planVerifier, client *vaultApi.Client) error {
+	if p.Signature == nil {
+		return fmt.Errorf("the plan isn't signed")
+	}
+	if v.key == "" && (v.identity == "" || v.issuer == "") {
+		return fmt.Errorf("verifying the plan requires either the public key or the certificate identity and issuer of its signer")
+	}
+
+	dir, err := os.MkdirTemp("", "vault-policies-plan")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	payload, err := writePlanPayload(p, dir)
+	if err != nil {
+		return err
+	}
+
+	signature := filepath.Join(dir, "signature")
+	err = os.WriteFile(signature, []byte(p.Signature.Signature), 0600)
+	if err != nil {
+		return err
+	}
+	args := []string{"verify-blob", "--signature", signature}
+	if v.key != "" {
+		args = append(args, "--key", v.key)
+	} else {
+		certificate := filepath.Join(dir, "certificate")
+		err = os.WriteFile(certificate, []byte(p.Signature.Certificate), 0600)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--certificate", certificate, "--certificate-identity", v.identity, "--certificate-oidc-issuer", v.issuer)
+	}
+
+	err = runCosign(append(args, payload)...)
+	if err != nil {
+		return fmt.Errorf("invalid signature of the plan: %w", err)
+	}
+
+	// The signature covers the cluster id, which the address doesn't tell.
+	id, err := clusterID(client)
+	if err != nil {
+		return err
+	}
+	if p.ClusterID != id {
+		return fmt.Errorf("the plan is for the Vault cluster %q, not %q", p.ClusterID, id)
+	}
+	log("Plan signature verified")
+	return nil
+}
+
+// writePlanPayload writes the hex digest of the plan, which is what is signed,
+// to a file of dir.
+func writePlanPayload(p *planFile, dir string) (string, error) {
+	digest, err := p.digest()
+	if err != nil {
+		return "", err
+	}
+
+	payload := filepath.Join(dir, "payload")
+	return payload, os.WriteFile(payload, []byte(hex.EncodeToString(digest)), 0600)
+}
+
+func runCosign(args ...string) error {
+	cmd := exec.Command("cosign", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// similarCluster is a set of policies that differ from each other, directly
+// or through other policies of the set, by a few rules.
+type similarCluster struct {
+	// common are the rules all the policies have.
+	common []canonicalRule
+	// policies are the names of the policies, with the rules they have on top
+	// of the common ones.
+	policies []string
+	extra    map[string][]canonicalRule
+}
+
+func similarCommand() *cli.Command {
+	live := false
+	maxDifferences := 2
+
+	return &cli.Command{
+		Name:      "similar",
+		Usage:     "Cluster the policies that differ from each other by a few rules, to merge them or turn them into a template",
+		ArgsUsage: "[directory]",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "max-differences",
+				Usage:       "Number of rules two policies may have that the other doesn't to be clustered together",
+				Value:       maxDifferences,
+				Destination: &maxDifferences,
+			},
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Look at the policies of the Vault server instead of a local directory",
+				Destination: &live,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 && !live {
+				return fmt.Errorf("similar requires a directory or --live")
+			}
+			if maxDifferences < 1 {
+				return fmt.Errorf("--max-differences must be at least 1, not %d", maxDifferences)
+			}
+
+			return reportSimilar(dev, live, c.Args().First(), maxDifferences)
+		},
+	}
+}
+
+func reportSimilar(dev, live bool, directory string, maxDifferences int) error {
+	policies, err := loadPoliciesFrom(dev, live, directory)
+	if err != nil {
+		return err
+	}
+
+	clusters := clusterSimilar(policies, maxDifferences)
+	if len(clusters) == 0 {
+		fmt.Printf("No policies among %d differ by %d rules or less\n", len(policies), maxDifferences)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, c := range clusters {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Cluster %d: %d policies with %d rules in common\n", i+1, len(c.policies), len(c.common))
+		for _, name := range c.policies {
+			extra := []string{}
+			for _, r := range c.extra[name] {
+				extra = append(extra, "+ "+r.String())
+			}
+			if len(extra) == 0 {
+				extra = append(extra, "(only the common rules)")
+			}
+			fmt.Fprintf(w, "  %s\t%s\n", name, strings.Join(extra, "; "))
+		}
+	}
+	return w.Flush()
+}
+
+// clusterSimilar links the policies that have at most maxDifferences rules the
+// other doesn't, and at least one in common, and returns the groups of linked
+// policies, largest first.
+func clusterSimilar(policies []*parsedPolicy, maxDifferences int) []similarCluster {
+	rules := make([]map[string]canonicalRule, len(policies))
+	for i, p := range policies {
+		rules[i] = ruleSet(p)
+	}
+
+	// parent is a union-find forest of the indexes of the policies.
+	parent := make([]int, len(policies))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range policies {
+		for j := i + 1; j < len(policies); j++ {
+			if similarRules(rules[i], rules[j], maxDifferences) {
+				parent[root(j)] = root(i)
+			}
+		}
+	}
+
+	members := map[int][]int{}
+	for i := range policies {
+		members[root(i)] = append(members[root(i)], i)
+	}
+
+	clusters := []similarCluster{}
+	for _, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+		clusters = append(clusters, newSimilarCluster(policies, rules, indexes))
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].policies) != len(clusters[j].policies) {
+			return len(clusters[i].policies) > len(clusters[j].policies)
+		}
+		return clusters[i].policies[0] < clusters[j].policies[0]
+	})
+	return clusters
+}
+
+// similarRules tells if two sets of rules share one, and differ by at most
+// maxDifferences rules. Sets too different in size are skipped right away.
+func similarRules(a, b map[string]canonicalRule, maxDifferences int) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	if len(a)-len(b) > maxDifferences || len(b)-len(a) > maxDifferences {
+		return false
+	}
+
+	common := 0
+	for key := range a {
+		if _, ok := b[key]; ok {
+			common++
+		}
+	}
+	return common > 0 && len(a)+len(b)-2*common <= maxDifferences
+}
+
+func newSimilarCluster(policies []*parsedPolicy, rules []map[string]canonicalRule, indexes []int) similarCluster {
+	c := similarCluster{extra: map[string][]canonicalRule{}}
+
+	common := map[string]bool{}
+	for key := range rules[indexes[0]] {
+		shared := true
+		for _, i := range indexes[1:] {
+			if _, ok := rules[i][key]; !ok {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			common[key] = true
+			c.common = append(c.common, rules[indexes[0]][key])
+		}
+	}
+	sortRules(c.common)
+
+	for _, i := range indexes {
+		name := policies[i].name
+		c.policies = append(c.policies, name)
+		for key, r := range rules[i] {
+			if !common[key] {
+				c.extra[name] = append(c.extra[name], r)
+			}
+		}
+		sortRules(c.extra[name])
+	}
+	sort.Strings(c.policies)
+	return c
+}
+
+// ruleSet returns the canonical rules of a policy by their JSON encoding.
+func ruleSet(p *parsedPolicy) map[string]canonicalRule {
+	set := map[string]canonicalRule{}
+	for _, r := range canonicalRules(p) {
+		// Only strings and decoded HCL are marshaled, which can't fail.
+		key, _ := json.Marshal(r)
+		set[string(key)] = r
+	}
+	return set
+}
+
+func sortRules(rules []canonicalRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Path != rules[j].Path {
+			return rules[i].Path < rules[j].Path
+		}
+		return strings.Join(rules[i].Capabilities, ",") < strings.Join(rules[j].Capabilities, ",")
+	})
+}
+
+// String describes a rule by its path and capabilities, and tells whether it
+// has other constraints.
+func (r canonicalRule) String() string {
+	s := fmt.Sprintf("%s [%s]", r.Path, strings.Join(r.Capabilities, ","))
+	if len(r.AllowedParameters) > 0 || len(r.DeniedParameters) > 0 || len(r.RequiredParameters) > 0 ||
+		r.MinWrappingTTL != "" || r.MaxWrappingTTL != "" || r.ControlGroup != nil {
+		s += " with constraints"
+	}
+	return s
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+// defaultMaxPolicySize is the size a policy shouldn't reach, the most Consul
+// stores under a key. Raft stores up to 1 MiB by default, but a policy that
+// big is slow to restore and to review anyway.
+const defaultMaxPolicySize = 512 * 1024
+
+// sizeWarningRatio is how close to the maximum size lint starts to warn.
+const sizeWarningRatio = 0.8
+
+// policySize is the size of a policy as written to Vault.
+type policySize struct {
+	name  string
+	bytes int
+	paths int
+}
+
+func sizesCommand() *cli.Command {
+	live := false
+	top := 20
+	maxSize := defaultMaxPolicySize
+
+	return &cli.Command{
+		Name:      "sizes",
+		Usage:     "List the largest policies, with their size once their variables are substituted and their number of paths",
+		ArgsUsage: "[directory]",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "top",
+				Usage:       "Number of policies to report, 0 for all of them",
+				Value:       top,
+				Destination: &top,
+			},
+			maxSizeFlag(&maxSize),
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Look at the policies of the Vault server instead of a local directory",
+				Destination: &live,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 && !live {
+				return fmt.Errorf("sizes requires a directory or --live")
+			}
+			if maxSize < 1 {
+				return fmt.Errorf("--max-size must be at least 1, not %d", maxSize)
+			}
+
+			return reportSizes(dev, live, c.Args().First(), top, maxSize)
+		},
+	}
+}
+
+func maxSizeFlag(maxSize *int) cli.Flag {
+	return &cli.IntFlag{
+		Name:        "max-size",
+		Usage:       "Size in bytes the policies shouldn't reach, depending on the storage of Vault",
+		Value:       *maxSize,
+		Destination: maxSize,
+	}
+}
+
+func reportSizes(dev, live bool, directory string, top, maxSize int) error {
+	policies, err := loadPoliciesFrom(dev, live, directory)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		fmt.Println("No policy to report")
+		return nil
+	}
+
+	sizes := make([]policySize, 0, len(policies))
+	total := 0
+	for _, p := range policies {
+		s := policySize{name: p.name, bytes: len(p.content), paths: len(p.paths)}
+		if !live {
+			s.bytes = renderedSize(p.content)
+		}
+		sizes = append(sizes, s)
+		total += s.bytes
+	}
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].bytes > sizes[j].bytes
+	})
+	if top > 0 && len(sizes) > top {
+		sizes = sizes[:top]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tBYTES\tPATHS\tOF MAX")
+	for _, s := range sizes {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.0f%%\n", s.name, s.bytes, s.paths, 100*float64(s.bytes)/float64(maxSize))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d policies, %d bytes in total\n", len(policies), total)
+	return nil
+}
+
+// renderedSize returns the size of a policy once its variables are
+// substituted, or as it is if some aren't defined.
+func renderedSize(content string) int {
+	rendered, err := substituteVariables(content)
+	if err != nil {
+		return len(content)
+	}
+	return len(rendered)
+}
+
+// lintSize reports the policies close to the maximum size, or with more paths
+// than allowed with --max-paths. Oversized policies fail to be written, or
+// make restores slow.
+func lintSize(p *parsedPolicy, ctx *lintContext) []finding {
+	findings := []finding{}
+	maxSize := ctx.maxSize
+	if maxSize == 0 {
+		maxSize = defaultMaxPolicySize
+	}
+
+	size := renderedSize(p.content)
+	if float64(size) >= sizeWarningRatio*float64(maxSize) {
+		findings = append(findings, finding{
+			policy:  p.name,
+			rule:    "size",
+			message: fmt.Sprintf("%d bytes is %.0f%% of the maximum size of %d bytes, split the policy", size, 100*float64(size)/float64(maxSize), maxSize),
+		})
+	}
+	if ctx.maxPaths > 0 && len(p.paths) > ctx.maxPaths {
+		findings = append(findings, finding{
+			policy:  p.name,
+			rule:    "size",
+			message: fmt.Sprintf("%d paths is more than the maximum of %d, split the policy", len(p.paths), ctx.maxPaths),
+		})
+	}
+	return findings
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// snapshotStateFile is the file of a Raft snapshot archive holding the
+	// storage entries.
+	snapshotStateFile = "state.bin"
+	// snapshotSumsFile holds the SHA-256 hashes of the other files.
+	snapshotSumsFile = "SHA256SUMS"
+
+	// snapshotKeyringPath is where the barrier keyring is stored, encrypted
+	// with the root key.
+	snapshotKeyringPath = "core/keyring"
+	// snapshotRootKeyPath is where a Shamir seal stores the root key,
+	// encrypted with the key the unseal keys combine to.
+	snapshotRootKeyPath = "core/hsm/barrier-unseal-keys"
+	// snapshotPolicyPrefix is where the ACL policies of the root namespace
+	// are stored.
+	snapshotPolicyPrefix = "sys/policy/"
+
+	// barrierVersionPathAAD is the version of the values of the barrier
+	// authenticating their path along with their content.
+	barrierVersionPathAAD = 2
+)
+
+// snapshotEntries are the storage entries of a snapshot needed to extract its
+// policies.
+type snapshotEntries struct {
+	keyring  []byte
+	rootKey  []byte
+	policies map[string][]byte
+}
+
+// barrierKeyring is the keyring of the barrier, whose keys encrypt the values
+// of their term.
+type barrierKeyring struct {
+	Keys []struct {
+		Term  uint32
+		Value []byte
+	}
+}
+
+func extractSnapshotCommand() *cli.Command {
+	unsealKeys := cli.NewStringSlice()
+
+	return &cli.Command{
+		Name:      "extract-snapshot",
+		Usage:     "Extract the ACL policies of a Raft snapshot of the integrated storage into a local directory, when the cluster is gone",
+		ArgsUsage: "snapshot directory",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "unseal-key",
+				Usage:       "Unseal key of the cluster of the snapshot, in base64 or hex, as many as its threshold (can be repeated)",
+				EnvVars:     []string{"VAULT_UNSEAL_KEYS"},
+				Destination: unsealKeys,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 2 {
+				return fmt.Errorf("extract-snapshot requires a snapshot and a directory")
+			}
+
+			return extractSnapshot(dryRun, c.Args().Get(0), c.Args().Get(1), unsealKeys.Value())
+		},
+	}
+}
+
+func extractSnapshot(dryRun bool, snapshot, directory string, unsealKeys []string) error {
+	entries, err := readSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	if len(entries.policies) == 0 {
+		return fmt.Errorf("no policy found in %s", snapshot)
+	}
+
+	var keyring map[uint32]cipher.AEAD
+	if len(unsealKeys) > 0 {
+		keyring, err = unsealSnapshot(entries, unsealKeys)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !dryRun {
+		err = os.MkdirAll(directory, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(entries.policies))
+	for name := range entries.policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	local := policyDirectory(directory)
+	local.Filter = nil
+	for _, name := range names {
+		content, err := snapshotPolicy(name, entries.policies[name], keyring)
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			fmt.Printf("Would have written policy %s with content:\n", name)
+			fmt.Println(content)
+			continue
+		}
+
+		log("Writing policy", name)
+		err = local.Put(name, content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSnapshot reads the storage entries of a snapshot archive, as written by
+// vault operator raft snapshot save, checking the hash of its state.
+func readSnapshot(snapshot string) (*snapshotEntries, error) {
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a Raft snapshot: %w", snapshot, err)
+	}
+	defer gz.Close()
+
+	var entries *snapshotEntries
+	var stateHash, sums []byte
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s isn't a Raft snapshot: %w", snapshot, err)
+		}
+
+		switch header.Name {
+		case snapshotStateFile:
+			hash := sha256.New()
+			entries, err = readSnapshotState(io.TeeReader(archive, hash))
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the state of %s: %w", snapshot, err)
+			}
+			stateHash = hash.Sum(nil)
+		case snapshotSumsFile:
+			sums, err = io.ReadAll(archive)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if entries == nil {
+		return nil, fmt.Errorf("%s isn't a Raft snapshot: no %s in it", snapshot, snapshotStateFile)
+	}
+
+	if sums == nil {
+		fmt.Fprintln(os.Stderr, "Warning: no", snapshotSumsFile, "in", snapshot+", its state can't be checked")
+	} else if !bytes.Contains(sums, []byte(hex.EncodeToString(stateHash)+"  "+snapshotStateFile)) {
+		return nil, fmt.Errorf("the state of %s doesn't match its hash, the snapshot is corrupted", snapshot)
+	}
+	return entries, nil
+}
+
+// readSnapshotState reads the storage entries of the state of a snapshot, each
+// a StorageEntry protobuf message prefixed with its length, keeping those
+// needed to extract the policies.
+func readSnapshotState(r io.Reader) (*snapshotEntries, error) {
+	entries := &snapshotEntries{policies: map[string][]byte{}}
+	reader := bufio.NewReader(r)
+	for {
+		size, err := binary.ReadUvarint(reader)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		message := make([]byte, size)
+		_, err = io.ReadFull(reader, message)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := protobufFields(message)
+		if err != nil {
+			return nil, err
+		}
+
+		key, value := string(fields[1]), fields[2]
+		switch {
+		case key == snapshotKeyringPath:
+			entries.keyring = value
+		case key == snapshotRootKeyPath:
+			entries.rootKey = value
+		case strings.HasPrefix(key, snapshotPolicyPrefix):
+			entries.policies[strings.TrimPrefix(key, snapshotPolicyPrefix)] = value
+		}
+	}
+}
+
+// protobufFields returns the length-delimited fields of a protobuf message by
+// number, skipping the others, which is all that storage entries and sealed
+// values are made of.
+func protobufFields(message []byte) (map[uint64][]byte, error) {
+	fields := map[uint64][]byte{}
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid protobuf message")
+		}
+		message = message[n:]
+
+		var size uint64
+		switch tag & 7 {
+		case 0:
+			_, n = binary.Uvarint(message)
+		case 1:
+			n = 8
+		case 2:
+			size, n = binary.Uvarint(message)
+		case 5:
+			n = 4
+		default:
+			n = -1
+		}
+		if n <= 0 || len(message) < n || uint64(len(message)-n) < size {
+			return nil, fmt.Errorf("invalid protobuf message")
+		}
+		if tag&7 == 2 {
+			fields[tag>>3] = message[n : n+int(size)]
+		}
+		message = message[n+int(size):]
+	}
+	return fields, nil
+}
+
+// unsealSnapshot returns the keys of the barrier of a snapshot by term, from
+// the unseal keys of its Shamir seal.
+func unsealSnapshot(entries *snapshotEntries, unsealKeys []string) (map[uint32]cipher.AEAD, error) {
+	if entries.rootKey == nil || entries.keyring == nil {
+		return nil, fmt.Errorf("no root key or keyring in the snapshot, it can only be unsealed with the unseal keys of a Shamir seal")
+	}
+
+	shares := make([][]byte, 0, len(unsealKeys))
+	for _, k := range unsealKeys {
+		share, err := decodeUnsealKey(k)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	unsealKey, err := combineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+
+	// The root key is stored as a JSON list of keys, sealed like the seals
+	// of go-kms-wrapping: the ciphertext field of a protobuf message, whose
+	// first 12 bytes are the nonce.
+	fields, err := protobufFields(entries.rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the root key of the snapshot: %w", err)
+	}
+	rootKeys, err := openGCM(unsealKey, fields[1], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the root key, the unseal keys are wrong or fewer than the threshold")
+	}
+	keys := [][]byte{}
+	err = json.Unmarshal(rootKeys, &keys)
+	if err != nil || len(keys) == 0 {
+		return nil, fmt.Errorf("unable to read the root key of the snapshot")
+	}
+
+	root, err := newGCM(keys[0])
+	if err != nil {
+		return nil, err
+	}
+	// The keyring is always encrypted as the first term.
+	content, err := openBarrierValue(map[uint32]cipher.AEAD{1: root}, snapshotKeyringPath, entries.keyring)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the keyring of the snapshot: %w", err)
+	}
+	keyring := barrierKeyring{}
+	err = json.Unmarshal(content, &keyring)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the keyring of the snapshot: %w", err)
+	}
+
+	terms := map[uint32]cipher.AEAD{}
+	for _, k := range keyring.Keys {
+		terms[k.Term], err = newGCM(k.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return terms, nil
+}
+
+// snapshotPolicy returns the content of a policy from its storage entry,
+// decrypted with the keyring unless it is nil, for snapshots whose values
+// aren't encrypted.
+func snapshotPolicy(name string, value []byte, keyring map[uint32]cipher.AEAD) (string, error) {
+	if keyring != nil {
+		var err error
+		value, err = openBarrierValue(keyring, snapshotPolicyPrefix+name, value)
+		if err != nil {
+			return "", fmt.Errorf("unable to decrypt policy %s: %w", name, err)
+		}
+	} else if !json.Valid(value) {
+		return "", fmt.Errorf("policy %s is encrypted, extract-snapshot requires the unseal keys with --unseal-key", name)
+	}
+
+	entry := struct {
+		Raw string
+	}{}
+	err := json.Unmarshal(value, &entry)
+	if err != nil {
+		return "", fmt.Errorf("unable to read policy %s: %w", name, err)
+	}
+	return entry.Raw, nil
+}
+
+// openBarrierValue decrypts a value of the barrier: the term of its key on 4
+// bytes, the version of the encryption, the nonce and the ciphertext.
+func openBarrierValue(keyring map[uint32]cipher.AEAD, path string, value []byte) ([]byte, error) {
+	if len(value) < 5 {
+		return nil, fmt.Errorf("value too short")
+	}
+	gcm := keyring[binary.BigEndian.Uint32(value[:4])]
+	if gcm == nil {
+		return nil, fmt.Errorf("no key of term %d in the keyring", binary.BigEndian.Uint32(value[:4]))
+	}
+
+	var aad []byte
+	if value[4] == barrierVersionPathAAD {
+		aad = []byte(path)
+	}
+	return openGCMWith(gcm, value[5:], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// openGCM decrypts a ciphertext prefixed with its nonce.
+func openGCM(key, ciphertext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return openGCMWith(gcm, ciphertext, aad)
+}
+
+func openGCMWith(gcm cipher.AEAD, ciphertext, aad []byte) ([]byte, error) {
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], aad)
+}
+
+// decodeUnsealKey decodes an unseal key as printed by vault operator init, in
+// base64 or hex.
+func decodeUnsealKey(key string) ([]byte, error) {
+	if decoded, err := base64.StdEncoding.DecodeString(key); err == nil {
+		return decoded, nil
+	}
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("an unseal key is neither base64 nor hex")
+	}
+	return decoded, nil
+}
+
+// combineShares returns the key the Shamir shares of Vault are split from,
+// each share ending with its x coordinate. A single key is the key itself, the
+// threshold being 1.
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 1 {
+		return shares[0], nil
+	}
+
+	size := len(shares[0])
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size || size < 2 {
+			return nil, fmt.Errorf("the unseal keys aren't of the same cluster")
+		}
+		xs[i] = share[size-1]
+		for j := 0; j < i; j++ {
+			if xs[j] == xs[i] {
+				return nil, fmt.Errorf("an unseal key is given twice")
+			}
+		}
+	}
+
+	key := make([]byte, size-1)
+	for b := range key {
+		for i, share := range shares {
+			// The Lagrange basis polynomial of the share, at 0.
+			basis := byte(1)
+			for j := range shares {
+				if j != i {
+					basis = gfMultiply(basis, gfDivide(xs[j], xs[i]^xs[j]))
+				}
+			}
+			key[b] ^= gfMultiply(share[b], basis)
+		}
+	}
+	return key, nil
+}
+
+// gfMultiply multiplies in GF(2^8) with the polynomial of AES, the field of the
+// Shamir shares of Vault.
+func gfMultiply(a, b byte) byte {
+	product := byte(0)
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+// gfDivide divides in GF(2^8), multiplying by the inverse a^254 of b, which
+// isn't 0.
+func gfDivide(a, b byte) byte {
+	inverse := byte(1)
+	for i := 0; i < 254; i++ {
+		inverse = gfMultiply(inverse, b)
+	}
+	return gfMultiply(a, inverse)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCombineShares(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	shares := splitKey(t, key, 5, 3)
+
+	tests := []struct {
+		name   string
+		shares [][]byte
+		err    bool
+		wrong  bool
+	}{
+		{name: "threshold", shares: [][]byte{shares[0], shares[1], shares[2]}},
+		{name: "other shares", shares: [][]byte{shares[4], shares[1], shares[3]}},
+		{name: "all shares", shares: shares},
+		{name: "fewer than the threshold", shares: [][]byte{shares[0], shares[1]}, wrong: true},
+		{name: "single key", shares: [][]byte{key}},
+		{name: "twice the same", shares: [][]byte{shares[0], shares[0], shares[1]}, err: true},
+		{name: "other sizes", shares: [][]byte{shares[0], shares[1][1:], shares[2]}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := combineShares(test.shares)
+			if test.err {
+				if err == nil {
+					t.Fatal("combining the shares didn't fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(got, key) == test.wrong {
+				t.Errorf("got key %x from the shares, expected %x", got, key)
+			}
+		})
+	}
+}
+
+func TestOpenBarrierValue(t *testing.T) {
+	gcm, err := newGCM([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := map[uint32]cipher.AEAD{3: gcm}
+	plaintext := []byte(`{"Raw":"path \"secret/*\" {}"}`)
+
+	tests := []struct {
+		name  string
+		value []byte
+		path  string
+		err   bool
+	}{
+		{name: "path authenticated", value: sealBarrierValue(t, gcm, 3, barrierVersionPathAAD, "sys/policy/app", plaintext), path: "sys/policy/app"},
+		{name: "without path", value: sealBarrierValue(t, gcm, 3, 1, "", plaintext), path: "sys/policy/app"},
+		{name: "other path", value: sealBarrierValue(t, gcm, 3, barrierVersionPathAAD, "sys/policy/app", plaintext), path: "sys/policy/other", err: true},
+		{name: "unknown term", value: sealBarrierValue(t, gcm, 4, barrierVersionPathAAD, "sys/policy/app", plaintext), path: "sys/policy/app", err: true},
+		{name: "too short", value: []byte{0, 0, 0, 3}, path: "sys/policy/app", err: true},
+		{name: "no nonce", value: []byte{0, 0, 0, 3, 1, 42}, path: "sys/policy/app", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := openBarrierValue(keyring, test.path, test.value)
+			if test.err {
+				if err == nil {
+					t.Fatal("opening the value didn't fail")
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Errorf("got %q, %v, expected %q", got, err, plaintext)
+			}
+		})
+	}
+}
+
+// splitKey splits key into count Shamir shares, threshold of which combine
+// into it, as Vault does.
+func splitKey(t *testing.T, key []byte, count, threshold int) [][]byte {
+	shares := make([][]byte, count)
+	for i := range shares {
+		shares[i] = make([]byte, len(key)+1)
+		shares[i][len(key)] = byte(i*37 + 11)
+	}
+
+	coefficients := make([]byte, threshold-1)
+	for b, secret := range key {
+		_, err := rand.Read(coefficients)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, share := range shares {
+			x, y, power := share[len(key)], secret, byte(1)
+			for _, c := range coefficients {
+				power = gfMultiply(power, x)
+				y ^= gfMultiply(c, power)
+			}
+			share[b] = y
+		}
+	}
+	return shares
+}
+
+func sealBarrierValue(t *testing.T, gcm cipher.AEAD, term uint32, version byte, path string, plaintext []byte) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aad []byte
+	if version == barrierVersionPathAAD {
+		aad = []byte(path)
+	}
+
+	value := make([]byte, 4, 5+len(nonce))
+	binary.BigEndian.PutUint32(value, term)
+	value = append(value, version)
+	value = append(value, nonce...)
+	return gcm.Seal(value, nonce, plaintext, aad)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/printer"
+	"github.com/hashicorp/hcl/hcl/token"
+	"github.com/urfave/cli/v2"
+)
+
+func suggestCommand() *cli.Command {
+	auditLogs := cli.NewStringSlice()
+	output := ""
+
+	return &cli.Command{
+		Name:  "suggest",
+		Usage: "Suggest tightened policies, without the grants never used in Vault audit logs",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "audit-log",
+				Usage:       "Vault audit log file, or glob pattern of files (can be repeated)",
+				Required:    true,
+				Destination: auditLogs,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Usage:       "Directory where the suggested policies are written",
+				Required:    true,
+				Destination: &output,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("suggest requires a directory")
+			}
+
+			directory := c.Args().Slice()[0]
+
+			return suggestPolicies(dryRun, auditLogs.Value(), directory, output)
+		},
+	}
+}
+
+func suggestPolicies(dryRun bool, auditLogs []string, directory, output string) error {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+
+	usages, err := attributeUsage(policies, auditLogs)
+	if err != nil {
+		return err
+	}
+
+	suggested := 0
+	for _, p := range policies {
+		usage := usages.policies[p.name]
+		if usage.requests == 0 {
+			fmt.Printf("Policy %s authorized no request in the audit logs, consider removing it\n", p.name)
+			continue
+		}
+
+		content, ok, err := suggestPolicy(usage)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		suggested++
+
+		file := filepath.Join(output, p.name+".hcl")
+		if dryRun {
+			fmt.Printf("Would have written the suggested policy %s to %s:\n%s", p.name, file, content)
+			continue
+		}
+
+		err = os.MkdirAll(output, 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(file, []byte(content), 0644)
+		if err != nil {
+			return fmt.Errorf("unable to write the suggested policy %s: %w", file, err)
+		}
+	}
+
+	fmt.Printf("Suggested %d tightened policies\n", suggested)
+	return nil
+}
+
+// suggestPolicy returns the policy without the path stanzas and capabilities
+// that the audit logs never exercised, and false if all of them were. Deny
+// rules and the sudo capability, which isn't visible in the audit logs, are
+// kept.
+func suggestPolicy(usage *policyUsage) (string, bool, error) {
+	p := usage.policy
+	changed := false
+	items := []*ast.ObjectItem{}
+
+	for i, path := range p.paths {
+		stanza := usage.stanzas[i]
+		if isDeny(path) {
+			items = append(items, path.item)
+			continue
+		}
+		if stanza.requests == 0 {
+			fmt.Printf("%s: path %q was never used\n", p.name, path.path)
+			changed = true
+			continue
+		}
+
+		capabilities := []string{}
+		unused := []string{}
+		for _, capability := range path.Capabilities {
+			if stanza.capabilities[capability] || capability == "sudo" {
+				capabilities = append(capabilities, capability)
+			} else {
+				unused = append(unused, capability)
+			}
+		}
+		if len(unused) > 0 {
+			fmt.Printf("%s: path %q never used %v\n", p.name, path.path, unused)
+			setCapabilities(path.item, capabilities)
+			changed = true
+		}
+		items = append(items, path.item)
+	}
+
+	if !changed {
+		return "", false, nil
+	}
+
+	var buffer bytes.Buffer
+	for _, item := range items {
+		// The stanzas were filtered on their path key, put it back
+		keys := append([]*ast.ObjectKey{{Token: token.Token{Type: token.IDENT, Text: "path"}}}, item.Keys...)
+		err := printer.Fprint(&buffer, &ast.ObjectItem{Keys: keys, Val: item.Val, LeadComment: item.LeadComment})
+		if err != nil {
+			return "", false, err
+		}
+		buffer.WriteString("\n\n")
+	}
+	return string(bytes.TrimSpace(buffer.Bytes())) + "\n", true, nil
+}
+
+// setCapabilities replaces the capabilities of a path stanza in its syntax
+// tree.
+func setCapabilities(item *ast.ObjectItem, capabilities []string) {
+	object, ok := item.Val.(*ast.ObjectType)
+	if !ok {
+		return
+	}
+
+	list := &ast.ListType{}
+	for _, capability := range capabilities {
+		list.Add(&ast.LiteralType{Token: token.Token{Type: token.STRING, Text: strconv.Quote(capability)}})
+	}
+
+	for _, attribute := range object.List.Items {
+		if len(attribute.Keys) > 0 && attribute.Keys[0].Token.Value() == "capabilities" {
+			attribute.Val = list
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fynelabs/vault-policies/pkg/store"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// tagFilters are the --tag filters: the commands only work on the policies
+// whose metadata match all of them.
+var tagFilters []string
+
+// tagsMatch tells whether a policy with metadata m, possibly nil, matches the
+// --tag filters.
+func tagsMatch(m *policyMetadata) bool {
+	for _, filter := range tagFilters {
+		if !m.hasTag(filter) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTag tells whether the metadata have tag, owner=<owner> matching their
+// owner.
+func (m *policyMetadata) hasTag(tag string) bool {
+	if m == nil {
+		return false
+	}
+	if m.Owner != "" && tag == "owner="+m.Owner {
+		return true
+	}
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// tagFilter is the Filter of the policy directories with --tag, keeping the
+// files whose metadata file matches.
+func tagFilter(file, name string) (bool, error) {
+	m, err := readMetadata(metadataFile(file))
+	if err != nil {
+		return false, err
+	}
+	return tagsMatch(m), nil
+}
+
+// remoteSelection returns whether --tag selects a policy of Vault, from the
+// metadata kept in Vault, or nil without --tag.
+func remoteSelection(client *vaultApi.Client) (func(name string) bool, error) {
+	if len(tagFilters) == 0 {
+		return nil, nil
+	}
+
+	s, err := newMetadataStore(client)
+	if err != nil {
+		return nil, fmt.Errorf("--tag requires the metadata of the policies: %w", err)
+	}
+	metadata, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		return tagsMatch(metadata[name])
+	}, nil
+}
+
+// taggedStore is a store of policies without those it doesn't select.
+type taggedStore struct {
+	store.Store
+	selected func(name string) bool
+}
+
+// List returns the names of the policies selected.
+func (t *taggedStore) List() ([]string, error) {
+	names, err := t.Store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]string, 0, len(names))
+	for _, name := range names {
+		if t.selected(name) {
+			selected = append(selected, name)
+		}
+	}
+	return selected, nil
+}
+
+// remotePolicies returns the store of the policies of Vault, with --tag only
+// those whose metadata in Vault match or that source, if not nil, holds, so
+// that the policies of other teams are neither changed nor deleted.
+func remotePolicies(client *vaultApi.Client, source store.Store) (store.Store, error) {
+	remote := store.NewVault(client)
+	tagged, err := remoteSelection(client)
+	if err != nil || tagged == nil {
+		return remote, err
+	}
+
+	local := map[string]bool{}
+	if source != nil {
+		names, err := source.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			local[name] = true
+		}
+	}
+	return &taggedStore{Store: remote, selected: func(name string) bool {
+		return local[name] || tagged(name)
+	}}, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lintTemplates reports the identity templating expressions of the paths that
+// Vault doesn't understand. Vault doesn't reject them, it uses the path as a
+// literal, so the policy silently grants nothing.
+func lintTemplates(p *parsedPolicy, ctx *lintContext) []finding {
+	findings := []finding{}
+	for _, path := range p.paths {
+		for _, problem := range templateProblems(path.path) {
+			findings = append(findings, finding{
+				policy:  p.name,
+				line:    path.line,
+				rule:    "template",
+				message: fmt.Sprintf("path %q: %s", path.path, problem),
+			})
+		}
+	}
+	return findings
+}
+
+// templateProblems returns what is wrong with each templating expression of
+// path.
+func templateProblems(path string) []string {
+	problems := []string{}
+	for rest := path; rest != ""; {
+		open := strings.Index(rest, "{{")
+		closing := strings.Index(rest, "}}")
+		if open < 0 {
+			if closing >= 0 {
+				problems = append(problems, "}} without a matching {{")
+			}
+			break
+		}
+		if closing >= 0 && closing < open {
+			problems = append(problems, "}} without a matching {{")
+		}
+
+		rest = rest[open+2:]
+		closing = strings.Index(rest, "}}")
+		if closing < 0 {
+			problems = append(problems, "{{ without a matching }}")
+			break
+		}
+
+		expression := strings.TrimSpace(rest[:closing])
+		if err := validateTemplate(expression); err != nil {
+			problems = append(problems, fmt.Sprintf("template {{%s}}: %s", expression, err))
+		}
+		rest = rest[closing+2:]
+	}
+	return problems
+}
+
+// validateTemplate checks expression against the parameters documented for
+// the ACL policy templating.
+func validateTemplate(expression string) error {
+	if strings.Contains(expression, "{{") {
+		return fmt.Errorf("nested {{")
+	}
+
+	parts := strings.Split(expression, ".")
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("empty segment")
+		}
+	}
+	if parts[0] != "identity" || len(parts) < 3 {
+		return fmt.Errorf("unknown parameter %s, expected identity.entity or identity.groups", expression)
+	}
+
+	switch parts[1] {
+	case "entity":
+		return validateEntityTemplate(parts[2:])
+	case "groups":
+		return validateGroupsTemplate(parts[2:])
+	}
+	return fmt.Errorf("unknown parameter identity.%s", parts[1])
+}
+
+// validateEntityTemplate checks the part of an expression following
+// identity.entity.
+func validateEntityTemplate(parts []string) error {
+	switch parts[0] {
+	case "id", "name":
+		if len(parts) == 1 {
+			return nil
+		}
+	case "metadata":
+		if len(parts) == 2 {
+			return nil
+		}
+		return fmt.Errorf("identity.entity.metadata requires a single key")
+	case "aliases":
+		return validateAliasTemplate(parts[1:])
+	default:
+		return fmt.Errorf("unknown parameter identity.entity.%s", parts[0])
+	}
+	return fmt.Errorf("identity.entity.%s has no field", parts[0])
+}
+
+// validateAliasTemplate checks the part of an expression following
+// identity.entity.aliases.
+func validateAliasTemplate(parts []string) error {
+	if len(parts) < 2 {
+		return fmt.Errorf("identity.entity.aliases requires a mount accessor and a field")
+	}
+
+	switch parts[1] {
+	case "id", "name":
+		if len(parts) == 2 {
+			return nil
+		}
+		return fmt.Errorf("identity.entity.aliases.<accessor>.%s has no field", parts[1])
+	case "metadata", "custom_metadata":
+		if len(parts) == 3 {
+			return nil
+		}
+		return fmt.Errorf("identity.entity.aliases.<accessor>.%s requires a single key", parts[1])
+	}
+	return fmt.Errorf("unknown alias parameter %s, expected id, name, metadata or custom_metadata", parts[1])
+}
+
+// validateGroupsTemplate checks the part of an expression following
+// identity.groups.
+func validateGroupsTemplate(parts []string) error {
+	field := ""
+	switch parts[0] {
+	case "ids":
+		field = "name"
+	case "names":
+		field = "id"
+	default:
+		return fmt.Errorf("unknown parameter identity.groups.%s, expected ids or names", parts[0])
+	}
+	if len(parts) < 3 {
+		return fmt.Errorf("identity.groups.%s requires a group and a field", parts[0])
+	}
+
+	switch parts[2] {
+	case field:
+		if len(parts) == 3 {
+			return nil
+		}
+		return fmt.Errorf("identity.groups.%s.<group>.%s has no field", parts[0], field)
+	case "metadata":
+		if len(parts) == 4 {
+			return nil
+		}
+		return fmt.Errorf("identity.groups.%s.<group>.metadata requires a single key", parts[0])
+	}
+	return fmt.Errorf("unknown group parameter %s, expected %s or metadata", parts[2], field)
+}
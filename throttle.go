@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+)
+
+var (
+	// throttleFlag is the rate of --throttle, like 5/s.
+	throttleFlag = ""
+
+	// runThrottle is the throttle of the run, shared by its clients.
+	runThrottle *vaultclient.Throttle
+)
+
+// throttleOptions returns the client option throttling the calls changing
+// Vault to the rate of --throttle, or else of the active profile.
+func throttleOptions() ([]vaultclient.Option, error) {
+	if runThrottle == nil {
+		rate := throttleFlag
+		if rate == "" && activeProfile != nil {
+			rate = activeProfile.Throttle
+		}
+		if rate == "" {
+			return nil, nil
+		}
+
+		var err error
+		runThrottle, err = vaultclient.ParseThrottle(rate)
+		if err != nil {
+			return nil, err
+		}
+		log("Throttling the calls changing Vault to", rate)
+	}
+	return []vaultclient.Option{vaultclient.WithThrottle(runThrottle)}, nil
+}
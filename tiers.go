@@ -0,0 +1,69 @@
+package main
+
+import "fmt"
+
+// The environment tiers of the profiles, from the least to the most guarded.
+const (
+	tierDev     = "dev"
+	tierStaging = "staging"
+	tierProd    = "prod"
+)
+
+var (
+	// confirmed is set with --yes, which prod profiles require to change
+	// Vault.
+	confirmed = false
+
+	// signedPlanApplied is set while applying a plan whose signature was
+	// verified, and approvedPlanApplied a plan approved as the production
+	// profiles require.
+	signedPlanApplied   = false
+	approvedPlanApplied = false
+)
+
+// applyTier sets the safeguards of the tier of a profile: staging requires a
+// change ticket, and prod a change ticket, --yes and signed plans. dev adds
+// none.
+func (pr *profile) applyTier() error {
+	switch pr.Tier {
+	case "", tierDev:
+	case tierStaging:
+		pr.RequireChangeRef = true
+	case tierProd:
+		pr.RequireChangeRef = true
+		pr.RequireSignedPlan = true
+	default:
+		return fmt.Errorf("profile %s: unknown tier %s, expected %s, %s or %s", pr.name, pr.Tier, tierDev, tierStaging, tierProd)
+	}
+	return nil
+}
+
+// checkTier fails when the tier of the active profile doesn't allow the
+// changes: prod only applies changes confirmed with --yes, the signed plans
+// it requires being checked by checkPlanApplied.
+func checkTier() error {
+	if activeProfile == nil || activeProfile.Tier != tierProd {
+		return nil
+	}
+	if !confirmed {
+		return fmt.Errorf("profile %s is %s, confirm the changes with --yes", activeProfile.name, tierProd)
+	}
+	return nil
+}
+
+// checkPlanApplied fails unless the changes are those of a plan, when the
+// active profile only applies plans: signed ones with require_signed_plan,
+// and approved ones when it is a production profile. Any other command
+// changing Vault is refused.
+func checkPlanApplied() error {
+	if activeProfile == nil {
+		return nil
+	}
+	if activeProfile.RequireSignedPlan && !signedPlanApplied {
+		return fmt.Errorf("profile %s only applies signed plans, write one with plan --sign and run apply", activeProfile.name)
+	}
+	if activeProfile.Production && !approvedPlanApplied {
+		return fmt.Errorf("profile %s is a production profile and only applies approved plans, write one with plan, have it approved and run apply", activeProfile.name)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPlanApplied(t *testing.T) {
+	discardOutput(t)
+
+	tests := []struct {
+		name     string
+		profile  *profile
+		signed   bool
+		approved bool
+		err      string
+	}{
+		{name: "no profile"},
+		{name: "profile without safeguards", profile: &profile{name: "dev"}},
+		{name: "signed plan required", profile: &profile{name: "ci", RequireSignedPlan: true}, err: "only applies signed plans"},
+		{name: "signed plan applied", profile: &profile{name: "ci", RequireSignedPlan: true}, signed: true},
+		{name: "approved plan required", profile: &profile{name: "prod", Production: true}, err: "only applies approved plans"},
+		{name: "signed plan not approved", profile: &profile{name: "prod", Production: true}, signed: true, err: "only applies approved plans"},
+		{name: "approved plan applied", profile: &profile{name: "prod", Production: true}, approved: true},
+		{name: "approved plan not signed", profile: &profile{name: "prod", Production: true, RequireSignedPlan: true}, approved: true, err: "only applies signed plans"},
+		{name: "approved and signed plan applied", profile: &profile{name: "prod", Production: true, RequireSignedPlan: true}, signed: true, approved: true},
+	}
+
+	previous, previousSigned, previousApproved := activeProfile, signedPlanApplied, approvedPlanApplied
+	t.Cleanup(func() {
+		activeProfile, signedPlanApplied, approvedPlanApplied = previous, previousSigned, previousApproved
+	})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			activeProfile, signedPlanApplied, approvedPlanApplied = test.profile, test.signed, test.approved
+
+			err := checkPlanApplied()
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+
+			// Every command changes Vault through applyChanges
+			written := false
+			err = applyChanges([]change{{action: actionCreate, kind: "policy", name: "app", apply: func() error {
+				written = true
+				return nil
+			}}}, false)
+			if written != (test.err == "") {
+				t.Errorf("got the change made %v with error %v, expected %v", written, err, test.err == "")
+			}
+		})
+	}
+}
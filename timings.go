@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// timingsFormat is how --timings reports the durations of the requests to
+// Vault at the end of the run, text or json, nothing when empty.
+var timingsFormat = ""
+
+func checkTimingsFormat() error {
+	if timingsFormat != "" && timingsFormat != "text" && timingsFormat != "json" {
+		return fmt.Errorf("unknown timings format %s, expected text or json", timingsFormat)
+	}
+	return nil
+}
+
+// runTimings are the durations of the requests to Vault of the run, to tell
+// whether the tool, the network or Vault is slow.
+type runTimings struct {
+	mu    sync.Mutex
+	start time.Time
+	// operations are the durations of the requests by operation: list, get,
+	// put or delete.
+	operations map[string][]time.Duration
+	// connecting is how long the requests waited for a connection, and
+	// waiting how long they waited for Vault to answer once sent.
+	connecting time.Duration
+	waiting    time.Duration
+	// idle is how long no request was running, the time of the tool itself,
+	// until idleSince if none is running.
+	idle      time.Duration
+	idleSince time.Time
+	running   int
+}
+
+var timings = &runTimings{start: time.Now(), idleSince: time.Now(), operations: map[string][]time.Duration{}}
+
+// requestTrace are the times of the steps of a request.
+type requestTrace struct {
+	getConn, gotConn, wrote, firstByte time.Time
+}
+
+// begin records that a request starts, and returns it traced, with
+// --timings only.
+func (t *runTimings) begin(r *http.Request) (*http.Request, *requestTrace) {
+	if timingsFormat == "" {
+		return r, nil
+	}
+
+	t.mu.Lock()
+	if t.running == 0 {
+		t.idle += time.Since(t.idleSince)
+	}
+	t.running++
+	t.mu.Unlock()
+
+	rt := &requestTrace{}
+	trace := &httptrace.ClientTrace{
+		GetConn:              func(string) { rt.getConn = time.Now() },
+		GotConn:              func(httptrace.GotConnInfo) { rt.gotConn = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { rt.wrote = time.Now() },
+		GotFirstResponseByte: func() { rt.firstByte = time.Now() },
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace)), rt
+}
+
+// end records the duration of a request begun.
+func (t *runTimings) end(r *http.Request, rt *requestTrace, elapsed time.Duration) {
+	if rt == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running--
+	if t.running == 0 {
+		t.idleSince = time.Now()
+	}
+
+	operation := requestOperation(r)
+	t.operations[operation] = append(t.operations[operation], elapsed)
+	if !rt.getConn.IsZero() && !rt.gotConn.IsZero() {
+		t.connecting += rt.gotConn.Sub(rt.getConn)
+	}
+	if !rt.wrote.IsZero() && !rt.firstByte.IsZero() {
+		t.waiting += rt.firstByte.Sub(rt.wrote)
+	}
+}
+
+// requestOperation returns the operation of a request to Vault.
+func requestOperation(r *http.Request) string {
+	switch {
+	case r.Method == "LIST" || r.URL.Query().Get("list") == "true":
+		return "list"
+	case r.Method == http.MethodPut || r.Method == http.MethodPost:
+		return "put"
+	}
+	return strings.ToLower(r.Method)
+}
+
+// jsonTimings are the timings of --timings json, in milliseconds.
+type jsonTimings struct {
+	Duration   float64                        `json:"duration_ms"`
+	Tool       float64                        `json:"tool_ms"`
+	Connecting float64                        `json:"connecting_ms"`
+	Waiting    float64                        `json:"waiting_ms"`
+	Operations map[string]jsonOperationTiming `json:"operations"`
+}
+
+type jsonOperationTiming struct {
+	Count int     `json:"count"`
+	Total float64 `json:"total_ms"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// summary returns the timings of the run so far.
+func (t *runTimings) summary() jsonTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idle := t.idle
+	if t.running == 0 {
+		idle += time.Since(t.idleSince)
+	}
+	s := jsonTimings{
+		Duration:   milliseconds(time.Since(t.start)),
+		Tool:       milliseconds(idle),
+		Connecting: milliseconds(t.connecting),
+		Waiting:    milliseconds(t.waiting),
+		Operations: map[string]jsonOperationTiming{},
+	}
+	for operation, durations := range t.operations {
+		sorted := append([]time.Duration{}, durations...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		total := time.Duration(0)
+		for _, d := range sorted {
+			total += d
+		}
+		s.Operations[operation] = jsonOperationTiming{
+			Count: len(sorted),
+			Total: milliseconds(total),
+			P50:   milliseconds(percentile(sorted, 0.50)),
+			P95:   milliseconds(percentile(sorted, 0.95)),
+			Max:   milliseconds(sorted[len(sorted)-1]),
+		}
+	}
+	return s
+}
+
+// percentile returns the nearest rank percentile p of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// reportTimings prints the timings of the run to stderr, with --timings.
+func reportTimings() {
+	if timingsFormat == "" || checkTimingsFormat() != nil {
+		return
+	}
+	s := timings.summary()
+
+	if timingsFormat == "json" {
+		content, err := json.Marshal(s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: unable to report the timings:", err)
+			return
+		}
+		fmt.Fprintln(os.Stderr, string(content))
+		return
+	}
+
+	ms := func(v float64) string {
+		return time.Duration(v * float64(time.Millisecond)).Round(10 * time.Microsecond).String()
+	}
+	fmt.Fprintf(os.Stderr, "Run took %s, %s of it in the tool without any request to Vault running\n", ms(s.Duration), ms(s.Tool))
+	fmt.Fprintf(os.Stderr, "Requests spent %s connecting and %s waiting for Vault to answer\n", ms(s.Connecting), ms(s.Waiting))
+
+	operations := []string{}
+	for operation := range s.Operations {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OPERATION\tCOUNT\tTOTAL\tP50\tP95\tMAX")
+	for _, operation := range operations {
+		o := s.Operations[operation]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", operation, o.Count, ms(o.Total), ms(o.P50), ms(o.P95), ms(o.Max))
+	}
+	w.Flush()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+)
+
+// tlsConfig configures the TLS connections to the Vault of a profile, or of
+// the flags, like the VAULT_CACERT... environment variables it replaces.
+type tlsConfig struct {
+	// CACert is a PEM file of the CA certificates trusted to sign the
+	// certificate of Vault, and CAPath a directory of such files.
+	CACert string `yaml:"ca_cert"`
+	CAPath string `yaml:"ca_path"`
+	// ClientCert and ClientKey are the certificate to authenticate with.
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	// ServerName is the name expected in the certificate of Vault.
+	ServerName string `yaml:"server_name"`
+	// SkipVerify doesn't verify the certificate of Vault, for tests only.
+	SkipVerify bool `yaml:"skip_verify"`
+	// MinVersion is the lowest TLS version accepted, like 1.3.
+	MinVersion string `yaml:"min_version"`
+}
+
+// tlsFlags are the TLS settings of the flags.
+var tlsFlags tlsConfig
+
+// merge returns the settings with those set in t instead. The CA and the
+// client certificate are replaced as a whole.
+func (t tlsConfig) merge(settings vaultclient.TLSSettings) (vaultclient.TLSSettings, error) {
+	if t.CACert != "" || t.CAPath != "" {
+		settings.CACert, settings.CAPath = t.CACert, t.CAPath
+	}
+	if t.ClientCert != "" || t.ClientKey != "" {
+		settings.ClientCert, settings.ClientKey = t.ClientCert, t.ClientKey
+	}
+	if t.ServerName != "" {
+		settings.ServerName = t.ServerName
+	}
+	if t.SkipVerify {
+		settings.SkipVerify = true
+	}
+	if t.MinVersion != "" {
+		version, err := vaultclient.ParseTLSVersion(t.MinVersion)
+		if err != nil {
+			return settings, err
+		}
+		settings.MinVersion = version
+	}
+	return settings, nil
+}
+
+// tlsOptions returns the client option configuring TLS with the environment
+// variables, the tls of the active profile and the flags, each replacing the
+// previous ones.
+func tlsOptions() ([]vaultclient.Option, error) {
+	settings, err := vaultclient.EnvironmentTLS()
+	if err != nil {
+		return nil, err
+	}
+	if activeProfile != nil {
+		settings, err = activeProfile.TLS.merge(settings)
+		if err != nil {
+			return nil, err
+		}
+	}
+	settings, err = tlsFlags.merge(settings)
+	if err != nil {
+		return nil, err
+	}
+	return []vaultclient.Option{vaultclient.WithTLS(settings)}, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultTokenScanFile is where token-scan keeps its progress and results.
+const defaultTokenScanFile = "token-scan.json"
+
+// tokenScanCheckpoint is the number of tokens looked up between two saves of
+// a scan, the most a scan interrupted has to look up again.
+const tokenScanCheckpoint = 100
+
+// defaultTokenScanRate is the number of tokens looked up per second.
+const defaultTokenScanRate = 10
+
+// tokenScan is a scan of the live tokens of a Vault server, looked up one by
+// one from the accessors listed when it started.
+type tokenScan struct {
+	Address   string    `json:"address"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Accessors []string  `json:"accessors"`
+	// Next is the position of the next accessor to look up.
+	Next int `json:"next"`
+	// Scanned is the number of tokens still alive when looked up.
+	Scanned int `json:"scanned"`
+	// Tokens are the tokens by policy they carry, directly or through their
+	// entity.
+	Tokens map[string][]scannedToken `json:"tokens"`
+}
+
+type scannedToken struct {
+	Accessor    string `json:"accessor"`
+	DisplayName string `json:"display_name"`
+	Field       string `json:"field"`
+}
+
+func tokenScanCommand() *cli.Command {
+	state := defaultTokenScanFile
+	rate := defaultTokenScanRate
+	restart := false
+
+	return &cli.Command{
+		Name:  "token-scan",
+		Usage: "Look up every live token through auth/token/accessors to count the tokens carrying each policy, resuming an interrupted scan",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "state",
+				Usage:       "File to keep the progress and the results of the scan in, for who-uses and unused",
+				Value:       state,
+				Destination: &state,
+			},
+			&cli.IntFlag{
+				Name:        "rate",
+				Usage:       "Number of tokens to look up per second",
+				Value:       rate,
+				Destination: &rate,
+			},
+			&cli.BoolFlag{
+				Name:        "restart",
+				Usage:       "Start a new scan even if the last one isn't finished",
+				Destination: &restart,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if rate < 1 {
+				return fmt.Errorf("--rate must be at least 1, not %d", rate)
+			}
+
+			return runTokenScan(dev, state, rate, restart)
+		},
+	}
+}
+
+func tokenScanFlag(state *string) cli.Flag {
+	return &cli.StringFlag{
+		Name:        "token-scan",
+		Usage:       "File of the results of token-scan, to look at the live tokens too",
+		Destination: state,
+	}
+}
+
+func runTokenScan(dev bool, state string, rate int, restart bool) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	s, err := loadTokenScan(state)
+	if err != nil {
+		return err
+	}
+	if s != nil && s.Address != client.Address() {
+		return fmt.Errorf("%s is the token scan of %s, not %s", state, s.Address, client.Address())
+	}
+	if s == nil || restart || !s.Finished.IsZero() {
+		s, err = newTokenScan(client)
+		if err != nil {
+			return err
+		}
+	} else {
+		log(fmt.Sprintf("Resuming the token scan of %s at %d of %d tokens", s.Started.Format(time.RFC3339), s.Next, len(s.Accessors)))
+	}
+
+	err = s.run(client, rate, func() error {
+		return s.save(state)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.save(state)
+	if err != nil {
+		return err
+	}
+
+	return printTokenScan(s)
+}
+
+func newTokenScan(client *vaultApi.Client) (*tokenScan, error) {
+	log("Listing the token accessors from the Vault server")
+	accessors, err := listKeys(client, "auth/token/accessors")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the token accessors: %w", err)
+	}
+	sort.Strings(accessors)
+
+	return &tokenScan{
+		Address:   client.Address(),
+		Started:   time.Now().UTC(),
+		Accessors: accessors,
+		Tokens:    map[string][]scannedToken{},
+	}, nil
+}
+
+// loadTokenScan reads a token scan, nil if the file doesn't exist.
+func loadTokenScan(file string) (*tokenScan, error) {
+	content, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &tokenScan{}
+	err = json.Unmarshal(content, s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the token scan %s: %w", file, err)
+	}
+	if s.Tokens == nil {
+		s.Tokens = map[string][]scannedToken{}
+	}
+	return s, nil
+}
+
+// save writes the scan to file, replacing it once written.
+func (s *tokenScan) save(file string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(file+".tmp", content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// run looks up the remaining tokens at rate per second, calling checkpoint
+// regularly so that the scan can be resumed.
+func (s *tokenScan) run(client *vaultApi.Client, rate int, checkpoint func() error) error {
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	for ; s.Next < len(s.Accessors); s.Next++ {
+		<-ticker.C
+		accessor := s.Accessors[s.Next]
+		secret, err := client.Auth().Token().LookupAccessor(accessor)
+		if err != nil {
+			// The token expired since it was listed
+			log("Skipping token", accessor+":", err.Error())
+		} else if secret != nil && secret.Data != nil {
+			s.record(accessor, secret.Data)
+		}
+
+		if (s.Next+1)%tokenScanCheckpoint == 0 {
+			log(fmt.Sprintf("Looked up %d of %d tokens", s.Next+1, len(s.Accessors)))
+			err = checkpoint()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	s.Finished = time.Now().UTC()
+	return nil
+}
+
+func (s *tokenScan) record(accessor string, data map[string]interface{}) {
+	s.Scanned++
+	for _, field := range []string{"policies", "identity_policies"} {
+		list, _ := data[field].([]interface{})
+		for _, p := range list {
+			policy := fmt.Sprint(p)
+			s.Tokens[policy] = append(s.Tokens[policy], scannedToken{
+				Accessor:    accessor,
+				DisplayName: fmt.Sprint(data["display_name"]),
+				Field:       field,
+			})
+		}
+	}
+}
+
+// users returns the tokens carrying policy.
+func (s *tokenScan) users(policy string) []policyUser {
+	users := []policyUser{}
+	for _, t := range s.Tokens[policy] {
+		users = append(users, policyUser{holder: fmt.Sprintf("token %s (%s)", t.Accessor, t.DisplayName), field: t.Field})
+	}
+	return users
+}
+
+// finishedTokenScan reads a token scan for a report, warning if it isn't
+// finished or its tokens may have changed a lot since.
+func finishedTokenScan(file string) (*tokenScan, error) {
+	s, err := loadTokenScan(file)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("no token scan in %s, run token-scan first", file)
+	}
+
+	if s.Finished.IsZero() {
+		fmt.Fprintf(os.Stderr, "Warning: the token scan of %s only looked up %d of %d tokens, run token-scan to finish it\n", file, s.Next, len(s.Accessors))
+	} else if time.Since(s.Finished) > 24*time.Hour {
+		fmt.Fprintf(os.Stderr, "Warning: the token scan of %s is from %s, tokens may have been created or expired since\n", file, s.Finished.Format(time.RFC3339))
+	}
+	return s, nil
+}
+
+func printTokenScan(s *tokenScan) error {
+	policies := make([]string, 0, len(s.Tokens))
+	for policy := range s.Tokens {
+		policies = append(policies, policy)
+	}
+	sort.SliceStable(policies, func(i, j int) bool {
+		if len(s.Tokens[policies[i]]) != len(s.Tokens[policies[j]]) {
+			return len(s.Tokens[policies[i]]) > len(s.Tokens[policies[j]])
+		}
+		return policies[i] < policies[j]
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tTOKENS")
+	for _, policy := range policies {
+		fmt.Fprintf(w, "%s\t%d\n", policy, len(s.Tokens[policy]))
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d live tokens of %s\n", s.Scanned, s.Address)
+	return nil
+}
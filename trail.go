@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	auditTrailFile = ""
+
+	// trailVault is the last Vault client created, whose address and token
+	// owner are recorded in the audit trail.
+	trailVault *vaultApi.Client
+	trailActor = ""
+	trailMu    sync.Mutex
+)
+
+// trailEntry is a change made to Vault, as recorded in the audit trail. Each
+// entry holds the hash of the previous one, so that no entry can be changed,
+// removed or inserted without breaking the chain.
+type trailEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Address   string    `json:"address"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	Before    string    `json:"before,omitempty"`
+	After     string    `json:"after,omitempty"`
+	ChangeRef string    `json:"change_ref,omitempty"`
+	RunID     string    `json:"run_id,omitempty"`
+	Previous  string    `json:"previous"`
+	Hash      string    `json:"hash"`
+}
+
+func verifyAuditCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "verify-audit",
+		Usage:     "Check that no entry of an audit trail written with --audit-trail was changed, removed or inserted",
+		ArgsUsage: "file",
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("verify-audit requires a file")
+			}
+
+			count, err := verifyAuditTrail(c.Args().Slice()[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d entries verified\n", count)
+			return nil
+		},
+	}
+}
+
+// recordChange appends a change just made to the audit trail, if any.
+func recordChange(c change) error {
+	if auditTrailFile == "" {
+		return nil
+	}
+
+	trailMu.Lock()
+	defer trailMu.Unlock()
+
+	previous, err := lastTrailHash(auditTrailFile)
+	if err != nil {
+		return err
+	}
+
+	e := trailEntry{
+		Time:      time.Now().UTC(),
+		Actor:     auditActor(),
+		Kind:      c.kind,
+		Name:      c.name,
+		Action:    c.action,
+		Before:    contentHash(c.previous),
+		After:     contentHash(c.written()),
+		ChangeRef: changeRef,
+		RunID:     runID,
+		Previous:  previous,
+	}
+	if trailVault != nil {
+		e.Address = trailVault.Address()
+	}
+	e.Hash, err = e.hash()
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(auditTrailFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open the audit trail: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write the audit trail: %w", err)
+	}
+	return f.Close()
+}
+
+// auditActor returns who the changes are made by, asking Vault once.
+func auditActor() string {
+	if trailActor == "" && trailVault != nil {
+		trailActor = currentPrincipal(trailVault)
+	}
+	if trailActor == "" {
+		return "unknown"
+	}
+	return trailActor
+}
+
+// hash returns the hash of the entry without its own hash.
+func (e trailEntry) hash() (string, error) {
+	e.Hash = ""
+	content, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastTrailHash returns the hash of the last entry of the audit trail, which
+// the next one chains to. Only the end of the file is read, so that recording
+// a change doesn't get slower as the trail grows.
+func lastTrailHash(file string) (string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// Read blocks backwards until the line before the last one ends
+	tail := []byte{}
+	for offset := info.Size(); offset > 0; {
+		size := int64(4096)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		block := make([]byte, size)
+		_, err = f.ReadAt(block, offset)
+		if err != nil {
+			return "", err
+		}
+		tail = append(block, tail...)
+
+		last := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(last, '\n'); i >= 0 || offset == 0 {
+			return entryHash(file, last[i+1:])
+		}
+	}
+	return "", nil
+}
+
+func entryHash(file string, line []byte) (string, error) {
+	if len(line) == 0 {
+		return "", nil
+	}
+	e := trailEntry{}
+	err := json.Unmarshal(line, &e)
+	if err != nil {
+		return "", fmt.Errorf("%s: unable to parse the last entry: %w", file, err)
+	}
+	return e.Hash, nil
+}
+
+func readAuditTrail(file string) ([]trailEntry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []trailEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		e := trailEntry{}
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: unable to parse the entry: %w", file, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// verifyAuditTrail checks the hashes of all the entries of an audit trail and
+// returns how many there are.
+func verifyAuditTrail(file string) (int, error) {
+	if _, err := os.Stat(file); err != nil {
+		return 0, err
+	}
+
+	entries, err := readAuditTrail(file)
+	if err != nil {
+		return 0, err
+	}
+
+	previous := ""
+	for i, e := range entries {
+		if e.Previous != previous {
+			return 0, fmt.Errorf("%s:%d: the entry doesn't follow the previous one, entries were removed or inserted", file, i+1)
+		}
+
+		hash, err := e.hash()
+		if err != nil {
+			return 0, err
+		}
+		if hash != e.Hash {
+			return 0, fmt.Errorf("%s:%d: the entry was modified", file, i+1)
+		}
+		previous = e.Hash
+	}
+	return len(entries), nil
+}
+
+func contentHash(content string) string {
+	if content == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
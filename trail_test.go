@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAuditTrail(t *testing.T) {
+	file := writeAuditTrail(t, 4)
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	lines = lines[:len(lines)-1]
+
+	tests := []struct {
+		name  string
+		lines []string
+		count int
+		err   string
+	}{
+		{name: "intact", lines: lines, count: 4},
+		{name: "empty", lines: nil, count: 0},
+		{name: "modified", lines: replace(lines, 2, strings.Replace(lines[2], `"name":"p2"`, `"name":"px"`, 1)), err: ":3: the entry was modified"},
+		{name: "removed", lines: append(append([]string{}, lines[:1]...), lines[2:]...), err: ":2: the entry doesn't follow the previous one"},
+		{name: "inserted", lines: append(append(append([]string{}, lines[:2]...), lines[0]), lines[2:]...), err: ":3: the entry doesn't follow the previous one"},
+		{name: "first removed", lines: lines[1:], err: ":1: the entry doesn't follow the previous one"},
+		{name: "truncated line", lines: replace(lines, 3, lines[3][:20]+"\n"), err: ":4: unable to parse the entry"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trail := filepath.Join(t.TempDir(), "trail.jsonl")
+			err := os.WriteFile(trail, []byte(strings.Join(test.lines, "")), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count, err := verifyAuditTrail(trail)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || count != test.count {
+				t.Fatalf("got %d, %v, expected %d entries", count, err, test.count)
+			}
+		})
+	}
+}
+
+func TestLastTrailHash(t *testing.T) {
+	// Longer than the blocks read from the end
+	file := writeAuditTrail(t, 20)
+	entries, err := readAuditTrail(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := lastTrailHash(file)
+	if last := entries[len(entries)-1].Hash; err != nil || hash != last {
+		t.Errorf("got %q, %v, expected %q", hash, err, last)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Previous != entries[i-1].Hash {
+			t.Errorf("entry %d doesn't chain to the previous one", i+1)
+		}
+	}
+
+	hash, err = lastTrailHash(filepath.Join(t.TempDir(), "missing.jsonl"))
+	if err != nil || hash != "" {
+		t.Errorf("got %q, %v for a missing trail, expected no hash", hash, err)
+	}
+}
+
+func TestRecordChangeStamped(t *testing.T) {
+	previous := changeRef
+	t.Cleanup(func() {
+		changeRef = previous
+	})
+	changeRef = "CHG-42"
+	file := writeAuditTrail(t, 0)
+
+	content := `path "secret/*" { capabilities = ["read"] }`
+	for _, c := range []change{
+		{action: actionCreate, kind: "policy", name: "app", content: content},
+		{action: actionDelete, kind: "policy", name: "old", previous: content},
+	} {
+		err := recordChange(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := readAuditTrail(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := contentHash("# change-ref: CHG-42\n" + content); entries[0].After != expected {
+		t.Errorf("got hash %s of the policy created, expected %s of the content stamped", entries[0].After, expected)
+	}
+	if entries[1].After != "" || entries[1].Before != contentHash(content) {
+		t.Errorf("got hashes %s and %s of the policy deleted, expected only %s before", entries[1].Before, entries[1].After, contentHash(content))
+	}
+}
+
+// writeAuditTrail records count changes in a new audit trail and returns its
+// file.
+func writeAuditTrail(t *testing.T, count int) string {
+	previous := auditTrailFile
+	t.Cleanup(func() {
+		auditTrailFile = previous
+	})
+	auditTrailFile = filepath.Join(t.TempDir(), "trail.jsonl")
+
+	for i := 0; i < count; i++ {
+		err := recordChange(change{
+			action:  actionCreate,
+			kind:    "policy",
+			name:    fmt.Sprintf("p%d", i),
+			content: fmt.Sprintf("path \"secret/%d/*\" { capabilities = [\"read\"] }", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return auditTrailFile
+}
+
+func replace(lines []string, i int, line string) []string {
+	replaced := append([]string{}, lines...)
+	replaced[i] = line
+	return replaced
+}
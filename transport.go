@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+
+	"github.com/fynelabs/vault-policies/pkg/vaultclient"
+)
+
+// transportConfig tunes the HTTP connections to the Vault of a profile, for
+// distant servers where the defaults are slow.
+type transportConfig struct {
+	// KeepAlives reuses the connections between requests, the default.
+	KeepAlives *bool `yaml:"keep_alives"`
+	// MaxIdleConnsPerHost is how many idle connections are kept open.
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+	// TLSHandshakeTimeout is how long the TLS handshake may take, like 30s.
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	// HTTP2 is negotiated with the servers that speak it, the default.
+	HTTP2 *bool `yaml:"http2"`
+}
+
+// settings returns the transport settings of the configuration, and whether
+// any is set.
+func (t transportConfig) settings() (vaultclient.TransportSettings, bool) {
+	s := vaultclient.TransportSettings{
+		DisableKeepAlives:   t.KeepAlives != nil && !*t.KeepAlives,
+		MaxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+		TLSHandshakeTimeout: t.TLSHandshakeTimeout,
+		DisableHTTP2:        t.HTTP2 != nil && !*t.HTTP2,
+	}
+	return s, s != vaultclient.TransportSettings{}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/fynelabs/vault-policies/pkg/policysync"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+const tuiListHelp = "up/down move, enter diff, a apply to Vault, r revert the file, l reload, q quit"
+
+const tuiDiffHelp = "up/down scroll, a apply to Vault, r revert the file, esc back, q quit"
+
+// policyState is a policy as found in the local directory and in Vault.
+type policyState struct {
+	name      string
+	file      string
+	local     string
+	remote    string
+	hasLocal  bool
+	hasRemote bool
+}
+
+// marker tells how the policy drifted: + only in the directory, - only in
+// Vault, ~ different, and a space when in sync.
+func (s *policyState) marker() string {
+	switch {
+	case !s.hasRemote:
+		return actionCreate
+	case !s.hasLocal:
+		return actionDelete
+	case !policysync.Equal(s.local, s.remote):
+		return actionUpdate
+	}
+	return " "
+}
+
+func tuiCommand() *cli.Command {
+	fileMode := "0600"
+
+	return &cli.Command{
+		Name:  "tui",
+		Usage: "Interactively browse the policies of Vault and a local directory, see their drift, and apply or revert them one by one",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "file-mode",
+				Usage:       "Permissions, in octal, of the policy files written by a revert",
+				Value:       fileMode,
+				Destination: &fileMode,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("tui requires a directory")
+			}
+
+			mode, err := parseFileMode(fileMode)
+			if err != nil {
+				return err
+			}
+			directory := c.Args().Slice()[0]
+
+			return runTUI(dev, dryRun, directory, mode, os.Stdin)
+		},
+	}
+}
+
+func runTUI(dev, dryRun bool, directory string, fileMode os.FileMode, input io.Reader) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	states, err := loadPolicyStates(client, directory)
+	if err != nil {
+		return err
+	}
+
+	m := &tuiModel{client: client, dryRun: dryRun, directory: directory, fileMode: fileMode, states: states, height: 24}
+	_, err = tea.NewProgram(m, tea.WithAltScreen(), tea.WithInput(input)).Run()
+	return err
+}
+
+// tuiModel is the state of the tui: the list of the policies, or the diff of
+// the one under the cursor.
+type tuiModel struct {
+	client    *vaultApi.Client
+	dryRun    bool
+	directory string
+	// fileMode is the permissions of the files written by a revert.
+	fileMode os.FileMode
+	states   []*policyState
+	cursor   int
+	// diff is the diff shown of the policy under the cursor, nil in the list.
+	diff []string
+	// offset is the first line of the list or of the diff shown.
+	offset int
+	height int
+	status string
+}
+
+// tuiStatesMsg carries the policies reloaded after an action, or the error
+// of the action.
+type tuiStatesMsg struct {
+	states []*policyState
+	status string
+	err    error
+}
+
+// tuiAction runs an action changing a policy with the terminal released by
+// the tui, so that it prints what it does and the hooks can prompt, then
+// waits for enter before going back to the tui.
+type tuiAction struct {
+	run    func() error
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func (a *tuiAction) Run() error {
+	err := a.run()
+	if err != nil {
+		fmt.Fprintln(a.stdout, "Error:", err)
+	}
+	fmt.Fprint(a.stdout, "Press enter to go back")
+	_, _ = bufio.NewReader(a.stdin).ReadString('\n')
+	return err
+}
+
+func (a *tuiAction) SetStdin(r io.Reader)  { a.stdin = r }
+func (a *tuiAction) SetStdout(w io.Writer) { a.stdout = w }
+func (a *tuiAction) SetStderr(io.Writer)   {}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return nil
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.height = msg.Height
+	case tuiStatesMsg:
+		m.status = msg.status
+		if msg.err != nil {
+			m.status = "Error: " + msg.err.Error()
+		}
+		if msg.states != nil {
+			m.setStates(msg.states)
+		}
+	case tea.KeyMsg:
+		return m, m.key(msg.String())
+	}
+	return m, nil
+}
+
+// key handles a key press, returning the command to run if any.
+func (m *tuiModel) key(key string) tea.Cmd {
+	switch key {
+	case "ctrl+c", "q":
+		return tea.Quit
+	case "up", "k":
+		m.move(-1)
+	case "down", "j":
+		m.move(1)
+	case "pgup":
+		m.move(-m.rows())
+	case "pgdown", " ":
+		m.move(m.rows())
+	case "enter", "d":
+		if len(m.states) > 0 && m.diff == nil {
+			m.diff, m.offset = policyStateDiff(m.states[m.cursor]), 0
+		}
+	case "esc", "left":
+		m.diff, m.offset = nil, 0
+	case "l":
+		return m.reload("Reloaded")
+	case "a":
+		return m.selected(func(s *policyState) tea.Cmd {
+			return m.act("Applied policy "+s.name, func() error { return applyPolicyState(m.client, m.dryRun, m.directory, s) })
+		})
+	case "r":
+		return m.selected(func(s *policyState) tea.Cmd {
+			return m.act("Reverted policy "+s.name, func() error { return revertPolicyState(m.dryRun, m.directory, m.fileMode, s) })
+		})
+	}
+	return nil
+}
+
+// move moves the cursor in the list, or scrolls the diff.
+func (m *tuiModel) move(delta int) {
+	if m.diff != nil {
+		m.offset = clamp(m.offset+delta, 0, len(m.diff)-m.rows())
+		return
+	}
+	m.cursor = clamp(m.cursor+delta, 0, len(m.states)-1)
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+	} else if m.cursor >= m.offset+m.rows() {
+		m.offset = m.cursor - m.rows() + 1
+	}
+}
+
+func (m *tuiModel) selected(action func(s *policyState) tea.Cmd) tea.Cmd {
+	if len(m.states) == 0 {
+		return nil
+	}
+	s := m.states[m.cursor]
+	if s.marker() == " " {
+		m.status = fmt.Sprintf("Policy %s is already in sync", s.name)
+		return nil
+	}
+	return action(s)
+}
+
+// act runs an action with the terminal released, then reloads the policies.
+func (m *tuiModel) act(done string, run func() error) tea.Cmd {
+	if m.dryRun {
+		done = "Dry run, nothing changed"
+	}
+
+	return tea.Exec(&tuiAction{run: run}, func(err error) tea.Msg {
+		if err != nil {
+			return tuiStatesMsg{err: err}
+		}
+		return m.reload(done)()
+	})
+}
+
+// reload reloads the policies from the directory and Vault.
+func (m *tuiModel) reload(done string) tea.Cmd {
+	return func() tea.Msg {
+		states, err := loadPolicyStates(m.client, m.directory)
+		return tuiStatesMsg{states: states, status: done, err: err}
+	}
+}
+
+// setStates replaces the policies, keeping the cursor on the same policy and
+// the diff shown up to date.
+func (m *tuiModel) setStates(states []*policyState) {
+	name := ""
+	if m.cursor < len(m.states) {
+		name = m.states[m.cursor].name
+	}
+	found := false
+	m.states, m.cursor = states, clamp(m.cursor, 0, len(states)-1)
+	for i, s := range states {
+		if s.name == name {
+			m.cursor, found = i, true
+		}
+	}
+
+	if m.diff != nil && found {
+		m.diff = policyStateDiff(states[m.cursor])
+		m.offset = clamp(m.offset, 0, len(m.diff)-m.rows())
+		return
+	}
+	if m.diff != nil {
+		// The policy shown is gone, back to the list
+		m.diff, m.offset = nil, 0
+	}
+	m.move(0)
+}
+
+// rows is the number of lines of the list or the diff that fit, under the
+// title and above the status and the help.
+func (m *tuiModel) rows() int {
+	if m.height < 5 {
+		return 1
+	}
+	return m.height - 4
+}
+
+func (m *tuiModel) View() string {
+	b := strings.Builder{}
+	title := fmt.Sprintf("%s against %s: + only in the directory, - only in Vault, ~ different", m.directory, m.client.Address())
+	help := tuiListHelp
+	lines := []string{}
+	if m.diff != nil && len(m.states) > 0 {
+		title = fmt.Sprintf("Policy %s, - in Vault, + in the directory", m.states[m.cursor].name)
+		help = tuiDiffHelp
+		lines = m.diff
+	} else {
+		for i, s := range m.states {
+			cursor := " "
+			if i == m.cursor {
+				cursor = ">"
+			}
+			lines = append(lines, fmt.Sprintf("%s %-3s %s", cursor, s.marker(), s.name))
+		}
+		if len(lines) == 0 {
+			lines = append(lines, "No policies in the directory nor in Vault")
+		}
+	}
+
+	fmt.Fprintln(&b, title)
+	end := m.offset + m.rows()
+	if end > len(lines) {
+		end = len(lines)
+	}
+	for _, line := range lines[clamp(m.offset, 0, len(lines)):end] {
+		fmt.Fprintln(&b, line)
+	}
+	for i := end - m.offset; i < m.rows(); i++ {
+		fmt.Fprintln(&b)
+	}
+	fmt.Fprintln(&b, m.status)
+	fmt.Fprint(&b, help)
+	return b.String()
+}
+
+func clamp(value, min, max int) int {
+	if value > max {
+		value = max
+	}
+	if value < min {
+		value = min
+	}
+	return value
+}
+
+// loadPolicyStates returns the policies of the directory and of Vault, sorted
+// by name.
+func loadPolicyStates(client *vaultApi.Client, directory string) ([]*policyState, error) {
+	byName := map[string]*policyState{}
+	get := func(name string) *policyState {
+		if byName[name] == nil {
+			byName[name] = &policyState{name: name}
+		}
+		return byName[name]
+	}
+
+	err := walkRemotePolicies(client, func(policy, content string) error {
+		s := get(policy)
+		s.remote, s.hasRemote = content, true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = walkDirectoryPolicyFiles(directory, func(file, policy string, content []byte) error {
+		s := get(policy)
+		s.file, s.local, s.hasLocal = file, string(content), true
+		// Compared with Vault as it would be written to it, unless
+		// applying it fails on a missing variable.
+		if rendered, err := substituteVariables(s.local); err == nil {
+			s.local = rendered
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]*policyState, 0, len(byName))
+	for _, s := range byName {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].name < states[j].name
+	})
+	return states, nil
+}
+
+// policyStateDiff returns the diff from the policy in Vault to the policy in
+// the directory.
+func policyStateDiff(s *policyState) []string {
+	if s.marker() == " " {
+		return []string{fmt.Sprintf("Policy %s is in sync", s.name)}
+	}
+	return policyDiff(s.remote, s.local)
+}
+
+// applyPolicyState makes the policy in Vault match the directory, as a restore
+// of only this policy would, through the safeguards, audit trail and hooks of
+// the changes to Vault.
+func applyPolicyState(client *vaultApi.Client, dryRun bool, directory string, s *policyState) error {
+	if !s.hasLocal && builtinPolicies[s.name] {
+		return fmt.Errorf("policy %s is built into Vault and can't be deleted", s.name)
+	}
+
+	err := runHooks(dryRun, hookBeforePlan, hookPayload{Directory: directory})
+	if err != nil {
+		return err
+	}
+	changes, err := planPolicies(client, directory)
+	if err != nil {
+		return err
+	}
+
+	selected := []change{}
+	for _, c := range changes {
+		if c.kind == "policy" && c.name == s.name {
+			selected = append(selected, c)
+		}
+	}
+	if len(selected) == 0 {
+		fmt.Printf("Policy %s is already in sync\n", s.name)
+		return nil
+	}
+
+	// The terminal is released, so a conflict with the base can be asked
+	base := &baseSync{client: client, directory: directory, onConflict: conflictInteractive, scope: func(name string) bool {
+		return name == s.name
+	}}
+	return applySyncChanges(selected, dryRun, base)
+}
+
+// revertPolicyState makes the policy in the directory match Vault.
+func revertPolicyState(dryRun bool, directory string, fileMode os.FileMode, s *policyState) error {
+	switch {
+	case s.marker() == " ":
+		fmt.Printf("Policy %s is already in sync\n", s.name)
+		return nil
+	case !s.hasRemote && dryRun:
+		fmt.Printf("Would have removed %s\n", s.file)
+		return nil
+	case !s.hasRemote:
+		return os.Remove(s.file)
+	}
+
+	file := s.file
+	if file == "" {
+		file = filepath.Join(directory, s.name+".hcl")
+	}
+	if dryRun {
+		fmt.Printf("Would have written %s with content:\n%s\n", file, s.remote)
+		return nil
+	}
+	return os.WriteFile(file, []byte(s.remote), fileMode)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+func TestSetStates(t *testing.T) {
+	client, err := vaultApi.NewClient(&vaultApi.Config{Address: "https://vault:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := func(names ...string) []*policyState {
+		states := []*policyState{}
+		for _, name := range names {
+			states = append(states, &policyState{name: name, local: "path \"" + name + "/*\" {}", hasLocal: true})
+		}
+		return states
+	}
+
+	tests := []struct {
+		name     string
+		reloaded []*policyState
+		cursor   int
+		diff     bool
+		title    string
+	}{
+		{name: "same policy moved", reloaded: states("a", "aa", "b", "c"), cursor: 2, diff: true, title: "Policy b"},
+		{name: "policy shown gone", reloaded: states("a", "c"), cursor: 1, title: "against"},
+		{name: "no policies left", reloaded: states(), cursor: 0, title: "against"},
+		{name: "no policies at all", reloaded: nil, cursor: 0, title: "against"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &tuiModel{client: client, directory: "policies", height: 10}
+			m.setStates(states("a", "b", "c"))
+			m.key("down")
+			m.key("enter")
+
+			m.setStates(test.reloaded)
+			if m.cursor != test.cursor || (m.diff != nil) != test.diff {
+				t.Errorf("got cursor %d and diff %v, expected %d and %v", m.cursor, m.diff != nil, test.cursor, test.diff)
+			}
+			if view := m.View(); !strings.Contains(view, test.title) {
+				t.Errorf("got view %q, expected %q in it", view, test.title)
+			}
+
+			for _, key := range []string{"up", "down", "enter", "pgdown", "a", "r"} {
+				m.key(key)
+			}
+			m.View()
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func usageCommand() *cli.Command {
+	auditLogs := cli.NewStringSlice()
+	top := 10
+
+	return &cli.Command{
+		Name:      "usage",
+		Usage:     "Report how many requests of Vault audit logs each policy of a local directory authorized, and on which paths",
+		ArgsUsage: "[more audit logs...] <directory>",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "audit-log",
+				Usage:       "Vault audit log file, or glob pattern of files (can be repeated)",
+				Required:    true,
+				Destination: auditLogs,
+			},
+			&cli.IntFlag{
+				Name:        "top",
+				Usage:       "Number of paths to report per policy, 0 for all of them",
+				Value:       top,
+				Destination: &top,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			logs, directory, err := auditLogArgs(c, auditLogs.Value())
+			if err != nil {
+				return err
+			}
+
+			return reportUsage(logs, directory, top)
+		},
+	}
+}
+
+func reportUsage(auditLogs []string, directory string, top int) error {
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		return err
+	}
+
+	usages, err := attributeUsage(policies, auditLogs)
+	if err != nil {
+		return err
+	}
+
+	if usages.requests == 0 {
+		fmt.Println("No authorized request in the audit logs")
+		return nil
+	}
+	fmt.Printf("%d authorized requests from %s to %s\n", usages.requests,
+		usages.first.Format(time.RFC3339), usages.last.Format(time.RFC3339))
+
+	for _, p := range policies {
+		usage := usages.policies[p.name]
+		fmt.Printf("%s: %d requests\n", p.name, usage.requests)
+
+		paths := sortedCounts(usage.paths)
+		if top > 0 && len(paths) > top {
+			fmt.Printf("    (%d more paths)\n", len(paths)-top)
+			paths = paths[:top]
+		}
+		for _, path := range paths {
+			fmt.Printf("    %6d %s\n", usage.paths[path], path)
+		}
+	}
+	return nil
+}
+
+// auditLogArgs returns the audit logs and the directory of a command taking
+// audit logs. A pattern of --audit-log expanded by the shell leaves its other
+// files as arguments before the directory.
+func auditLogArgs(c *cli.Context, auditLogs []string) ([]string, string, error) {
+	if c.Args().Len() < 1 {
+		return nil, "", fmt.Errorf("%s requires a directory", c.Command.Name)
+	}
+
+	args := c.Args().Slice()
+	return append(auditLogs, args[:len(args)-1]...), args[len(args)-1], nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/fynelabs/vault-policies/pkg/store"
+)
+
+// variablePattern matches the ${name} variables of the policies, and the
+// $${name} escaping them.
+var variablePattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// substituteVariables replaces the ${name} variables of a policy with the vars
+// of the active profile, or else the environment variable of that name.
+// $${name} is written as ${name}.
+func substituteVariables(content string) (string, error) {
+	missing := []string{}
+	result := variablePattern.ReplaceAllStringFunc(content, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+
+		name := match[2 : len(match)-1]
+		value, ok := variableValue(name)
+		if !ok {
+			missing = append(missing, name)
+			return match
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined variables %s, set them in the vars of the profile or in the environment", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+func variableValue(name string) (string, bool) {
+	if activeProfile != nil {
+		if value, ok := activeProfile.Vars[name]; ok {
+			return value, true
+		}
+	}
+	return os.LookupEnv(name)
+}
+
+// substitutedStore is a store of local policies whose variables Get
+// substitutes, as they are written to Vault.
+type substitutedStore struct {
+	store.Store
+}
+
+// Get returns the content of a policy with its variables substituted.
+func (s substitutedStore) Get(name string) (string, error) {
+	content, err := s.Store.Get(name)
+	if err != nil {
+		return "", err
+	}
+
+	return substituteVariables(content)
+}
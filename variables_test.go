@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fynelabs/vault-policies/pkg/store"
+)
+
+func TestSubstituteVariables(t *testing.T) {
+	previous := activeProfile
+	t.Cleanup(func() {
+		activeProfile = previous
+	})
+	activeProfile = &profile{name: "staging", Vars: map[string]string{"kv": "kv-staging", "HOME": "/profile"}}
+	t.Setenv("VP_TEST_TEAM", "payments")
+	t.Setenv("VP_TEST_UNSET", "")
+	os.Unsetenv("VP_TEST_UNSET")
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		err      string
+	}{
+		{name: "profile", content: `path "${kv}/data/*" {}`, expected: `path "kv-staging/data/*" {}`},
+		{name: "environment", content: `path "kv/${VP_TEST_TEAM}/*" {}`, expected: `path "kv/payments/*" {}`},
+		{name: "profile before the environment", content: `path "${HOME}" {}`, expected: `path "/profile" {}`},
+		{name: "escaped", content: `path "$${kv}/${kv}" {}`, expected: `path "${kv}/kv-staging" {}`},
+		{name: "not a variable", content: `path "$kv/{kv}/${1}" {}`, expected: `path "$kv/{kv}/${1}" {}`},
+		{name: "undefined", content: `path "${VP_TEST_UNSET}/${kv}/${other}" {}`, err: "undefined variables VP_TEST_UNSET, other"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := substituteVariables(test.content)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil || got != test.expected {
+				t.Errorf("got %q, %v, expected %q", got, err, test.expected)
+			}
+		})
+	}
+}
+
+func TestLoadPoliciesVariables(t *testing.T) {
+	t.Setenv("VP_TEST_KV", "kv-staging")
+	directory := t.TempDir()
+	writePolicyFile(t, directory, "app", `path "${VP_TEST_KV}/data/*" { capabilities = ["read"] }`)
+
+	policies, err := loadPolicies(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || len(policies[0].paths) != 1 || policies[0].paths[0].path != "kv-staging/data/*" {
+		t.Fatalf("got policies %v, expected the path kv-staging/data/*", policies)
+	}
+
+	writePolicyFile(t, directory, "other", `path "${VP_TEST_UNDEFINED}/*" {}`)
+	_, err = loadPolicies(directory)
+	if err == nil || !strings.Contains(err.Error(), "policy other: undefined variables VP_TEST_UNDEFINED") {
+		t.Errorf("got error %v, expected the variable of other to be undefined", err)
+	}
+}
+
+func TestBackupKeepsTemplates(t *testing.T) {
+	t.Setenv("VP_TEST_KV", "kv-staging")
+	const (
+		template = `path "${VP_TEST_KV}/data/*" { capabilities = ["read"] }`
+		rendered = `path "kv-staging/data/*" { capabilities = ["read"] }`
+		changed  = `path "kv-staging/data/*" { capabilities = ["read", "list"] }`
+	)
+
+	client := newTestMemoryVault(t)
+	vault := store.NewVault(client)
+	directory := t.TempDir()
+	writePolicyFile(t, directory, "kept", template)
+	writePolicyFile(t, directory, "changed", template)
+	for name, content := range map[string]string{"kept": rendered, "changed": changed, "created": rendered} {
+		err := vault.Put(name, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options, err := newBackupOptions("0600", "0700", layoutFlat, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backupNamespace(client, false, options, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"kept": template, "changed": changed, "created": rendered} {
+		content, err := os.ReadFile(filepath.Join(directory, name+".hcl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(content)) != expected {
+			t.Errorf("got %s with %q, expected %q", name, content, expected)
+		}
+	}
+}
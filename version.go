@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	runtimeDebug "runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=...". Otherwise they come from the module information Go
+// embeds in the binary, when there is any.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// serverFeature is a feature of the tool that needs a given Vault version.
+type serverFeature struct {
+	name       string
+	minimum    string
+	enterprise bool
+}
+
+var serverFeatures = []serverFeature{
+	{name: "policies backup, upload and restore", minimum: "0.9.0"},
+	{name: "identity groups, entities and attachments", minimum: "0.9.0"},
+	{name: "KV v2 path linting", minimum: "0.10.0"},
+	{name: "rate limit quotas", minimum: "1.5.0"},
+	{name: "lease count quotas", minimum: "1.6.0", enterprise: true},
+	{name: "OIDC provider", minimum: "1.9.0"},
+	{name: "Sentinel EGP bindings", minimum: "0.9.0", enterprise: true},
+}
+
+func versionCommand() *cli.Command {
+	checkServer := false
+
+	return &cli.Command{
+		Name:  "version",
+		Usage: "Print the version of the tool, and optionally of the Vault server with the features it supports",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "check-server",
+				Usage:       "Also print the version of the Vault server and which features of the tool it supports",
+				Destination: &checkServer,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			printVersion()
+			if !checkServer {
+				return nil
+			}
+
+			return checkServerVersion(dev)
+		},
+	}
+}
+
+func printVersion() {
+	v, rev, built := buildVersion()
+
+	fmt.Println("vault-policies", v)
+	if rev != "" {
+		fmt.Println("commit:", rev)
+	}
+	if built != "" {
+		fmt.Println("built:", built)
+	}
+}
+
+// buildVersion returns the version, commit and build date of the tool.
+func buildVersion() (string, string, string) {
+	v, rev, built := version, commit, date
+	if info, ok := runtimeDebug.ReadBuildInfo(); ok {
+		if v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && rev == "":
+				rev = setting.Value
+			case setting.Key == "vcs.time" && built == "":
+				built = setting.Value
+			}
+		}
+	}
+	return v, rev, built
+}
+
+func checkServerVersion(dev bool) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	health, err := client.Sys().Health()
+	if err != nil {
+		return fmt.Errorf("unable to get the version of Vault: %w", err)
+	}
+
+	fmt.Printf("Vault %s at %s\n", health.Version, client.Address())
+	enterprise := strings.Contains(health.Version, "+ent")
+	for _, f := range serverFeatures {
+		supported := !versionBefore(health.Version, f.minimum) && (enterprise || !f.enterprise)
+
+		requirement := "Vault " + f.minimum
+		if f.enterprise {
+			requirement = "Vault Enterprise " + f.minimum
+		}
+
+		state := "supported"
+		if !supported {
+			state = "unsupported"
+		}
+		fmt.Printf("  %-12s %s (requires %s)\n", state, f.name, requirement)
+	}
+	return nil
+}
+
+// versionBefore tells if the version a, like 1.12.3+ent, is older than b. Only
+// the numbers of the major, minor and patch versions are compared.
+func versionBefore(a, b string) bool {
+	x, y := versionNumbers(a), versionNumbers(b)
+	for i := range x {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return false
+}
+
+func versionNumbers(v string) [3]int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "+-"); i >= 0 {
+		v = v[:i]
+	}
+
+	numbers := [3]int{}
+	for i, part := range strings.SplitN(v, ".", 3) {
+		numbers[i], _ = strconv.Atoi(part)
+	}
+	return numbers
+}
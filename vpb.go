@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fynelabs/vault-policies/pkg/bundle"
+	"github.com/fynelabs/vault-policies/pkg/store"
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+func exportBundleCommand() *cli.Command {
+	output := ""
+	live := false
+
+	return &cli.Command{
+		Name:      "bundle",
+		Usage:     "Export the policies, their metadata and hashes, and where they come from as a single " + bundle.Extension + " file",
+		ArgsUsage: "[directory]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "File to write the bundle to, instead of the standard output",
+				Destination: &output,
+			},
+			&cli.BoolFlag{
+				Name:        "live",
+				Usage:       "Export the policies of the Vault server instead of a local directory",
+				Destination: &live,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 && !live {
+				return fmt.Errorf("export bundle requires a directory or --live")
+			}
+
+			return exportBundle(dev, live, c.Args().First(), output)
+		},
+	}
+}
+
+func importCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "import",
+		Usage: "Import policies from other formats into a local directory",
+		Subcommands: []*cli.Command{
+			importBundleCommand(),
+			importCRDCommand(),
+		},
+	}
+}
+
+func importBundleCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "bundle",
+		Usage:     "Write the policies of a " + bundle.Extension + " file and their metadata to a local directory",
+		ArgsUsage: "bundle directory",
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 2 {
+				return fmt.Errorf("import bundle requires a bundle and a directory")
+			}
+
+			return importBundle(dryRun, c.Args().Get(0), c.Args().Get(1))
+		},
+	}
+}
+
+func exportBundle(dev, live bool, directory, output string) error {
+	var b *bundle.Bundle
+	if live {
+		client, err := selectNewVault(dev)
+		if err != nil {
+			return err
+		}
+		b, err = liveBundle(client)
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		b, err = directoryBundle(directory)
+		if err != nil {
+			return err
+		}
+	}
+
+	if output == "" {
+		return b.Write(os.Stdout)
+	}
+	log("Writing", output)
+	return b.WriteFile(output)
+}
+
+// liveBundle returns the bundle of the policies of the Vault server, with the
+// metadata kept in Vault if there is any.
+func liveBundle(client *vaultApi.Client) (*bundle.Bundle, error) {
+	source := bundle.Source{Address: client.Address()}
+	if health, err := client.Sys().Health(); err != nil {
+		log("Exporting without the cluster of", client.Address()+":", err.Error())
+	} else {
+		source.ClusterName, source.ClusterID, source.Version = health.ClusterName, health.ClusterID, health.Version
+	}
+
+	b := bundle.New(source)
+	err := walkRemotePolicies(client, b.Put)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newMetadataStore(client)
+	var metadata map[string]*policyMetadata
+	if err == nil {
+		metadata, err = s.load()
+	}
+	if err != nil {
+		log("Skipping the metadata of the policies:", err.Error())
+	}
+	addBundleMetadata(b, metadata)
+	return b, nil
+}
+
+// directoryBundle returns the bundle of the policies of a local directory as
+// they are written to Vault, their variables substituted, with the metadata of
+// their files.
+func directoryBundle(directory string) (*bundle.Bundle, error) {
+	b := bundle.New(bundle.Source{Directory: directory})
+	source := substitutedStore{Store: policyDirectory(directory)}
+	names, err := source.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		content, err := source.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get policy %s: %w", name, err)
+		}
+		err = b.Put(name, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metadata, err := loadDirectoryMetadata([]string{directory})
+	if err != nil {
+		return nil, err
+	}
+	addBundleMetadata(b, metadata)
+	return b, nil
+}
+
+func addBundleMetadata(b *bundle.Bundle, metadata map[string]*policyMetadata) {
+	for name, m := range metadata {
+		if p := b.Policy(name); p != nil {
+			p.Metadata = &bundle.Metadata{Owner: m.Owner, Description: m.Description, Links: m.Links, Tags: m.Tags}
+		}
+	}
+}
+
+// importBundle writes the policies of a bundle to directory, with a metadata
+// file for those having some. The policies already in the directory are
+// replaced in their file, and the others are left alone.
+func importBundle(dryRun bool, file, directory string) error {
+	b, err := bundle.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	log(fmt.Sprintf("Importing %d policies of %s exported on %s", len(b.Policies), file, b.Created.Format("2006-01-02 15:04:05Z")))
+
+	if !dryRun {
+		err = os.MkdirAll(directory, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	local := policyDirectory(directory)
+	local.Filter = nil
+	for _, p := range b.Policies {
+		err = importBundlePolicy(dryRun, local, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func importBundlePolicy(dryRun bool, local *store.Directory, p *bundle.Policy) error {
+	if dryRun {
+		fmt.Printf("Would have written policy %s with content:\n", p.Name)
+		fmt.Println(p.Content)
+		return nil
+	}
+
+	err := local.Put(p.Name, p.Content)
+	if err != nil {
+		return err
+	}
+	if p.Metadata == nil {
+		return nil
+	}
+
+	policyFile, err := local.File(p.Name)
+	if err != nil {
+		return err
+	}
+	m := &policyMetadata{Owner: p.Metadata.Owner, Description: p.Metadata.Description, Links: p.Metadata.Links, Tags: p.Metadata.Tags}
+	log("Writing", metadataFile(policyFile))
+	return os.WriteFile(metadataFile(policyFile), []byte(m.yaml()), 0644)
+}
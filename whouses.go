@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/urfave/cli/v2"
+)
+
+// policyUser is something of the server that carries a policy, or lets its
+// tokens carry it.
+type policyUser struct {
+	holder string
+	field  string
+}
+
+func whoUsesCommand() *cli.Command {
+	tokens := false
+	tokenScanFile := ""
+
+	return &cli.Command{
+		Name:      "who-uses",
+		Usage:     "Report the identity groups, entities, auth roles and with --tokens the tokens that carry a policy, before editing or deleting it",
+		ArgsUsage: "policy",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "tokens",
+				Usage:       "Look up every token through auth/token/accessors too, which requires sudo and takes a request per token",
+				Destination: &tokens,
+			},
+			tokenScanFlag(&tokenScanFile),
+		},
+		Action: func(c *cli.Context) error {
+			if len(c.Args().Slice()) != 1 {
+				return fmt.Errorf("who-uses requires a policy")
+			}
+			if tokens && tokenScanFile != "" {
+				return fmt.Errorf("who-uses takes either --tokens or --token-scan")
+			}
+
+			return reportWhoUses(dev, c.Args().First(), tokens, tokenScanFile)
+		},
+	}
+}
+
+func reportWhoUses(dev bool, policy string, tokens bool, tokenScanFile string) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+
+	remote, err := remotePolicies(client, nil)
+	if err != nil {
+		return err
+	}
+	if content, err := remote.Get(policy); err == nil && content == "" {
+		fmt.Fprintln(os.Stderr, "Warning: there is no policy", policy, "on the server")
+	}
+
+	scan, err := reportTokenScan(client, tokens, tokenScanFile)
+	if err != nil {
+		return err
+	}
+	users, err := findPolicyUsers(client, policy, scan)
+	if err != nil {
+		return err
+	}
+	if policy == "default" {
+		fmt.Println("Every token carries the default policy, unless created with no_default_policy or token_no_default_policy")
+	}
+	if len(users) == 0 {
+		fmt.Println("Nothing carries policy", policy)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOLDER\tFIELD")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\n", u.holder, u.field)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d holders of policy %s\n", len(users), policy)
+	return nil
+}
+
+// reportTokenScan returns the tokens to report: a scan done now with tokens,
+// the results of token-scan, or else nil.
+func reportTokenScan(client *vaultApi.Client, tokens bool, tokenScanFile string) (*tokenScan, error) {
+	if tokenScanFile != "" {
+		return finishedTokenScan(tokenScanFile)
+	}
+	if !tokens {
+		return nil, nil
+	}
+
+	s, err := newTokenScan(client)
+	if err != nil {
+		return nil, err
+	}
+	err = s.run(client, defaultTokenScanRate, func() error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// findPolicyUsers returns what carries policy: the groups, entities and roles,
+// sorted, and the tokens of scan if there is one.
+func findPolicyUsers(client *vaultApi.Client, policy string, scan *tokenScan) ([]policyUser, error) {
+	holders, err := policyHolders(client)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []policyUser{}
+	for _, holder := range holders {
+		for _, p := range holder.policies {
+			if p == policy {
+				users = append(users, policyUser{holder: holder.name, field: holder.field})
+				break
+			}
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].holder < users[j].holder
+	})
+
+	if scan == nil {
+		return users, nil
+	}
+	return append(users, scan.users(policy)...), nil
+}
+
+func unusedCommand() *cli.Command {
+	tokenScanFile := ""
+
+	return &cli.Command{
+		Name:  "unused",
+		Usage: "List the policies of the Vault server that no identity group, entity or auth role carries, nor with --token-scan any live token",
+		Flags: []cli.Flag{
+			tokenScanFlag(&tokenScanFile),
+		},
+		Action: func(c *cli.Context) error {
+			return reportUnused(dev, tokenScanFile)
+		},
+	}
+}
+
+func reportUnused(dev bool, tokenScanFile string) error {
+	client, err := selectNewVault(dev)
+	if err != nil {
+		return err
+	}
+	scan, err := reportTokenScan(client, false, tokenScanFile)
+	if err != nil {
+		return err
+	}
+	holders, err := policyHolders(client)
+	if err != nil {
+		return err
+	}
+
+	used := map[string]bool{"default": true, "root": true}
+	for _, holder := range holders {
+		for _, p := range holder.policies {
+			used[p] = true
+		}
+	}
+	if scan != nil {
+		for p := range scan.Tokens {
+			used[p] = true
+		}
+	}
+
+	remote, err := remotePolicies(client, nil)
+	if err != nil {
+		return err
+	}
+	policies, err := remote.List()
+	if err != nil {
+		return err
+	}
+
+	unused := 0
+	for _, policy := range policies {
+		if !used[policy] {
+			fmt.Println(policy)
+			unused++
+		}
+	}
+
+	fmt.Printf("%d of %d policies unused\n", unused, len(policies))
+	if scan == nil {
+		fmt.Println("Tokens created with the policies directly aren't looked at, run token-scan and pass its results with --token-scan")
+	}
+	return nil
+}
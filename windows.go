@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow is a range of the time of day, on some days of the week, in a
+// time zone, like "Mon-Fri 09:00-17:00 Europe/Paris". A range ending before
+// it starts runs overnight, and belongs to the day it starts. A window can
+// also open on a cron schedule for a duration, like
+// "0 22 * * Sat,Sun for 8h Europe/Paris".
+type timeWindow struct {
+	text     string
+	days     [7]bool
+	start    int
+	end      int
+	cron     *cronSchedule
+	duration time.Duration
+	location *time.Location
+}
+
+// parseTimeWindow parses a window made of optional days, like Mon-Fri or
+// Sat,Sun, every day if missing, a time range and an optional time zone, the
+// local one if missing, or else of a cron expression for a duration.
+func parseTimeWindow(text string) (*timeWindow, error) {
+	if expression, rest, ok := strings.Cut(text, " for "); ok {
+		return parseCronWindow(text, expression, rest)
+	}
+
+	w := &timeWindow{text: text, location: time.Local}
+	fields := strings.Fields(text)
+	if len(fields) >= len(cronFields) && !strings.Contains(text, ":") {
+		return nil, fmt.Errorf("invalid window %q, a cron expression must be followed by for and how long the window stays open, like 2h", text)
+	}
+
+	if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+		err := w.parseDays(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %w", text, err)
+		}
+		fields = fields[1:]
+	} else {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid window %q, expected [days] HH:MM-HH:MM [time zone], or a cron expression for a duration [time zone]", text)
+	}
+
+	bounds := strings.SplitN(fields[0], "-", 2)
+	var err error
+	if len(bounds) == 2 {
+		w.start, err = parseTimeOfDay(bounds[0])
+		if err == nil {
+			w.end, err = parseTimeOfDay(bounds[1])
+		}
+	}
+	if len(bounds) != 2 || err != nil {
+		return nil, fmt.Errorf("invalid window %q, expected a time range like 09:00-17:00", text)
+	}
+
+	if len(fields) == 2 {
+		w.location, err = time.LoadLocation(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %w", text, err)
+		}
+	}
+	return w, nil
+}
+
+func (w *timeWindow) parseDays(text string) error {
+	for _, part := range strings.Split(strings.ToLower(text), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		last := first
+		if ok && len(bounds) == 2 {
+			last, ok = weekdays[bounds[1]]
+		}
+		if !ok {
+			return fmt.Errorf("unknown days %s, expected names like Mon, ranges like Mon-Fri, or lists like Sat,Sun", part)
+		}
+
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of HH:MM, 24:00 being
+// the end of the day.
+func parseTimeOfDay(text string) (int, error) {
+	if text == "24:00" {
+		return 24 * 60, nil
+	}
+
+	t, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains tells if t is in the window.
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	if w.cron != nil {
+		return w.cron.startedWithin(t, w.duration)
+	}
+	minute := t.Hour()*60 + t.Minute()
+
+	if w.start <= w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+	// Overnight, the end of the window is the morning after the day it
+	// started.
+	if minute >= w.start {
+		return w.days[t.Weekday()]
+	}
+	return minute < w.end && w.days[(t.Weekday()+6)%7]
+}
+
+func (w *timeWindow) String() string {
+	return w.text
+}
+
+func parseTimeWindows(texts []string) ([]*timeWindow, error) {
+	windows := make([]*timeWindow, 0, len(texts))
+	for _, text := range texts {
+		w, err := parseTimeWindow(text)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// inAnyWindow tells if t is in one of windows.
+func inAnyWindow(windows []*timeWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindows(t *testing.T) {
+	tests := []struct {
+		name   string
+		window string
+		err    string
+		in     []string
+		out    []string
+	}{
+		{
+			name:   "week days",
+			window: "Mon-Fri 09:00-17:00 UTC",
+			in:     []string{"2026-10-16T09:00:00Z", "2026-10-12T16:59:00Z"},
+			out:    []string{"2026-10-16T08:59:00Z", "2026-10-16T17:00:00Z", "2026-10-17T12:00:00Z"},
+		},
+		{
+			name:   "every day",
+			window: "12:00-13:00 UTC",
+			in:     []string{"2026-10-17T12:30:00Z", "2026-10-18T12:00:00Z"},
+			out:    []string{"2026-10-17T13:00:00Z"},
+		},
+		{
+			name:   "overnight belongs to the day it starts",
+			window: "Sat 22:00-06:00 UTC",
+			in:     []string{"2026-10-17T22:00:00Z", "2026-10-18T05:59:00Z"},
+			out:    []string{"2026-10-17T06:00:00Z", "2026-10-18T22:30:00Z", "2026-10-18T06:00:00Z"},
+		},
+		{
+			name:   "list of days up to midnight",
+			window: "Sat,Sun 20:00-24:00 UTC",
+			in:     []string{"2026-10-17T23:59:00Z", "2026-10-18T20:00:00Z"},
+			out:    []string{"2026-10-19T20:00:00Z", "2026-10-18T00:00:00Z"},
+		},
+		{
+			name:   "time zone",
+			window: "Mon 09:00-10:00 Europe/Paris",
+			in:     []string{"2026-10-12T07:30:00Z"},
+			out:    []string{"2026-10-12T09:30:00Z"},
+		},
+		{
+			name:   "cron for a duration",
+			window: "0 22 * * Sat,Sun for 8h UTC",
+			in:     []string{"2026-10-17T22:00:00Z", "2026-10-18T05:59:00Z", "2026-10-19T03:00:00Z"},
+			out:    []string{"2026-10-17T21:59:00Z", "2026-10-18T06:00:00Z", "2026-10-20T00:00:00Z"},
+		},
+		{
+			name:   "cron with steps and both days",
+			window: "*/30 9-17 1 * Mon for 10m UTC",
+			in:     []string{"2026-10-01T09:05:00Z", "2026-10-12T17:39:00Z"},
+			out:    []string{"2026-10-01T09:15:00Z", "2026-10-13T09:00:00Z", "2026-10-12T18:00:00Z"},
+		},
+		{name: "unknown day", window: "Mon-Fry 09:00-17:00", err: "unknown days"},
+		{name: "missing range", window: "Mon-Fri", err: "expected [days] HH:MM-HH:MM"},
+		{name: "bad time", window: "09:00-25:00", err: "expected a time range"},
+		{name: "unknown time zone", window: "09:00-17:00 Mars/Olympus", err: "unknown time zone"},
+		{name: "cron without duration", window: "0 22 * * Sat", err: "must be followed by for"},
+		{name: "cron fields", window: "0 22 * * for 8h", err: "has 4 fields"},
+		{name: "cron value", window: "0 24 * * * for 1h", err: "invalid hour 24"},
+		{name: "cron range", window: "0 5-1 * * * for 1h", err: "ends before it starts"},
+		{name: "cron duration", window: "0 5 * * * for 30s", err: "expected a duration"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			windows, err := parseTimeWindows([]string{test.window})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, times := range []struct {
+				times    []string
+				expected bool
+			}{{test.in, true}, {test.out, false}} {
+				for _, text := range times.times {
+					at, err := time.Parse(time.RFC3339, text)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if inAnyWindow(windows, at) != times.expected {
+						t.Errorf("%s in %q is %v, expected %v", text, test.window, !times.expected, times.expected)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
+)
+
+// lintWrapping reports the wrapping TTLs of the paths that aren't durations or
+// contradict each other, which Vault rejects, and the paths requiring response
+// wrapping that the clients of --no-wrapping paths can't unwrap.
+func lintWrapping(p *parsedPolicy, ctx *lintContext) []finding {
+	findings := []finding{}
+	for _, path := range p.paths {
+		for _, problem := range wrappingProblems(path, ctx.noWrapping) {
+			findings = append(findings, finding{
+				policy:  p.name,
+				line:    path.line,
+				rule:    "wrapping",
+				message: fmt.Sprintf("path %q: %s", path.path, problem),
+			})
+		}
+	}
+	return findings
+}
+
+func wrappingProblems(path *policyPath, noWrapping []string) []string {
+	if path.MinWrappingTTL == nil && path.MaxWrappingTTL == nil {
+		return nil
+	}
+
+	problems := []string{}
+	min, err := wrappingTTL("min_wrapping_ttl", path.MinWrappingTTL)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	max, err := wrappingTTL("max_wrapping_ttl", path.MaxWrappingTTL)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if min > 0 && max > 0 && min > max {
+		problems = append(problems, fmt.Sprintf("min_wrapping_ttl %s is more than max_wrapping_ttl %s", min, max))
+	}
+
+	if min > 0 && !containsDeny(path) {
+		for _, pattern := range noWrapping {
+			if coversPath(pattern, path.path) || coversPath(path.path, pattern) {
+				problems = append(problems, fmt.Sprintf("min_wrapping_ttl requires response wrapping on %s, whose clients can't unwrap", pattern))
+			}
+		}
+	}
+	return problems
+}
+
+// wrappingTTL parses a wrapping TTL like Vault does, a number of seconds or a
+// duration, 0 if it isn't set.
+func wrappingTTL(name string, value interface{}) (time.Duration, error) {
+	if value == nil {
+		return 0, nil
+	}
+
+	ttl, err := parseutil.ParseDurationSecond(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s %v isn't a duration", name, value)
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("%s %v is negative", name, value)
+	}
+	return ttl, nil
+}